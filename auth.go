@@ -0,0 +1,327 @@
+package lsmdb
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrTokenExpired       = errors.New("the token has expired")
+)
+
+// What a principal is allowed to do on the keys of a prefix. The admin permission grants the other ones, and the
+// endpoints administrating the whole database require it on all the keys (the empty prefix).
+type Permission string
+
+const (
+	PermissionRead  Permission = "read"
+	PermissionWrite Permission = "write"
+	PermissionAdmin Permission = "admin"
+)
+
+// The permissions granted on the keys starting with the prefix (in all the column families)
+type Grant struct {
+	Prefix      string       `json:"prefix"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// The grants of each principal. The grants of AnyPrincipal are given to all of them, and to the requests without
+// credentials.
+type ACL map[string][]Grant
+
+const AnyPrincipal = "*"
+
+// Tells if the principal has the permission on all the keys k such that start <= k < end (nil bounds are unbounded).
+// One of the grants must cover the whole range.
+func (acl ACL) Allows(principal string, permission Permission, start, end []byte) bool {
+	for _, name := range []string{principal, AnyPrincipal} {
+		for _, grant := range acl[name] {
+			if !slices.Contains(grant.Permissions, permission) && !slices.Contains(grant.Permissions, PermissionAdmin) {
+				continue
+			}
+
+			prefix := []byte(grant.Prefix)
+			if !bytes.HasPrefix(start, prefix) {
+				continue
+			}
+			if prefixEnd := prefixEnd(prefix); prefixEnd == nil || (end != nil && bytes.Compare(end, prefixEnd) <= 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns the smallest key greater than all the keys starting with the prefix, nil if there is none.
+func prefixEnd(prefix []byte) []byte {
+	end := bytes.Clone(prefix)
+	for len(end) > 0 {
+		if end[len(end)-1] < 0xff {
+			end[len(end)-1]++
+			return end
+		}
+		end = end[:len(end)-1]
+	}
+	return nil
+}
+
+// Authenticates the HTTP requests. Returns the principal a request is authenticated as, an empty one if it doesn't
+// have credentials the authenticator recognizes, or an error if they are invalid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (string, error)
+}
+
+// Tries the authenticators in order, until one of them recognizes the credentials of the request.
+type Authenticators []Authenticator
+
+func (authenticators Authenticators) Authenticate(r *http.Request) (string, error) {
+	for _, authenticator := range authenticators {
+		principal, err := authenticator.Authenticate(r)
+		if principal != "" || err != nil {
+			return principal, err
+		}
+	}
+	return "", nil
+}
+
+// Returns the bearer token of the request, or an empty string if it has none.
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+// Sets the bearer token of a request sent to another node, if there is one.
+func setBearerToken(r *http.Request, token string) {
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// Authenticates the requests whose bearer token is one of the static tokens, which are mapped to their principal.
+type StaticTokens map[string]string
+
+func (tokens StaticTokens) Authenticate(r *http.Request) (string, error) {
+	given := bearerToken(r)
+	if given == "" {
+		return "", nil
+	}
+
+	// All the tokens are compared, so the time taken doesn't tell which one is the closest
+	var principal string
+	for token, name := range tokens {
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1 {
+			principal = name
+		}
+	}
+	return principal, nil
+}
+
+// Authenticates the requests whose bearer token was signed with the secret by SignToken, until it expires.
+type HMACTokens struct {
+	Secret []byte
+}
+
+// Returns a token of the principal signed with the secret, valid until expiresAt. It is made of the base64 encoded
+// principal, the expiry time in Unix seconds and the base64 encoded HMAC-SHA256 of both, separated by dots.
+func SignToken(secret []byte, principal string, expiresAt time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(principal)) + "." + strconv.FormatInt(expiresAt.Unix(), 10)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(secret, payload))
+}
+
+func tokenSignature(secret []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func (tokens HMACTokens) Authenticate(r *http.Request) (string, error) {
+	parts := strings.Split(bearerToken(r), ".")
+	if len(parts) != 3 {
+		return "", nil
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	if !hmac.Equal(signature, tokenSignature(tokens.Secret, parts[0]+"."+parts[1])) {
+		return "", ErrInvalidCredentials
+	}
+
+	principal, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(principal) == 0 {
+		return "", ErrInvalidCredentials
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidCredentials
+	}
+	if time.Now().Unix() >= expiresAt {
+		return "", ErrTokenExpired
+	}
+
+	return string(principal), nil
+}
+
+// The access control of the HTTP API: the requests are authenticated by the authenticator, and the operations are
+// allowed by the ACL.
+type AccessControl struct {
+	Authenticator Authenticator
+	ACL           ACL
+
+	// The denied requests are logged to it, one JSON AuditEntry per line. They are not logged if it is nil.
+	AuditLog *log.Logger
+}
+
+// An entry of the audit log, describing a denied request
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+
+	// The permission missing on the keys start <= k < end, omitted if the request was not authenticated
+	Permission Permission `json:"permission,omitempty"`
+	Start      string     `json:"start,omitempty"`
+	End        string     `json:"end,omitempty"`
+
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// The principal a request is authenticated as, and the access control allowing its operations
+type requestAccess struct {
+	access    *AccessControl
+	principal string
+}
+
+type requestAccessKey struct{}
+
+// Returns the handler authenticating the requests before passing them to handler, which authorizes their operations.
+// The requests with invalid credentials are refused with 401. Without access control, handler is returned as it is.
+func (access *AccessControl) authenticate(handler http.HandlerFunc) http.HandlerFunc {
+	if access == nil {
+		return handler
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var principal string
+		var err error
+		if access.Authenticator != nil {
+			principal, err = access.Authenticator.Authenticate(r)
+		}
+		if err == nil && principal == "" && r.Header.Get("Authorization") != "" {
+			err = ErrInvalidCredentials
+		}
+		if err != nil {
+			access.audit(r, AuditEntry{Status: http.StatusUnauthorized, Reason: err.Error()})
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), requestAccessKey{}, &requestAccess{access: access, principal: principal})
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// Logs a denied request to the audit log.
+func (access *AccessControl) audit(r *http.Request, entry AuditEntry) {
+	if access.AuditLog == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.RemoteAddr = r.RemoteAddr
+	entry.Method = r.Method
+	entry.Path = r.URL.Path
+	encoded, _ := json.Marshal(entry)
+	access.AuditLog.Println(string(encoded))
+}
+
+// Returns the HTTP status and the message refusing the operation of the request needing the permission on the keys
+// start <= k < end, or 0 if it is allowed. The refusals are logged to the audit log.
+// The requests without credentials are refused with 401, the authenticated ones with 403.
+func checkAccess(r *http.Request, permission Permission, start, end []byte) (int, string) {
+	ra, ok := r.Context().Value(requestAccessKey{}).(*requestAccess)
+	if !ok || ra.access.ACL.Allows(ra.principal, permission, start, end) {
+		return 0, ""
+	}
+
+	status, message := http.StatusForbidden, "Permission denied"
+	if ra.principal == "" {
+		status, message = http.StatusUnauthorized, "Authentication required"
+	}
+
+	ra.access.audit(r, AuditEntry{
+		Principal:  ra.principal,
+		Permission: permission,
+		Start:      string(start),
+		End:        string(end),
+		Status:     status,
+		Reason:     "missing the " + string(permission) + " permission",
+	})
+	return status, message
+}
+
+// Tells if the request is allowed to do an operation needing the permission on the key, without refusing it or
+// logging it to the audit log otherwise.
+func isAllowed(r *http.Request, permission Permission, key []byte) bool {
+	ra, ok := r.Context().Value(requestAccessKey{}).(*requestAccess)
+	return !ok || ra.access.ACL.Allows(ra.principal, permission, key, keySuccessor(key))
+}
+
+// Tells if the request is allowed to do an operation needing the permission on the keys start <= k < end, and
+// refuses it otherwise.
+func authorizeRange(w http.ResponseWriter, r *http.Request, permission Permission, start, end []byte) bool {
+	status, message := checkAccess(r, permission, start, end)
+	if status == 0 {
+		return true
+	}
+
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, message, status)
+	return false
+}
+
+// Tells if the request is allowed to do an operation needing the permission on the key, and refuses it otherwise.
+func authorize(w http.ResponseWriter, r *http.Request, permission Permission, key []byte) bool {
+	return authorizeRange(w, r, permission, key, keySuccessor(key))
+}
+
+// Returns the smallest key greater than the key.
+func keySuccessor(key []byte) []byte {
+	return append(bytes.Clone(key), 0)
+}
+
+// Returns the handler passing the requests allowed to administrate the whole database to handler.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeRange(w, r, PermissionAdmin, nil, nil) {
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Returns the handler passing the authenticated requests allowed to administrate the whole database to handler, so the
+// endpoints added to the ones of NewHTTPHandler are protected like its admin endpoints.
+func (access *AccessControl) RequireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return access.authenticate(requireAdmin(handler))
+}
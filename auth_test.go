@@ -0,0 +1,212 @@
+package lsmdb
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestACL(t *testing.T) {
+	acl := ACL{
+		"alice": {
+			{Prefix: "user:alice:", Permissions: []Permission{PermissionRead, PermissionWrite}},
+			{Prefix: "user:", Permissions: []Permission{PermissionRead}},
+		},
+		"ops":        {{Prefix: "", Permissions: []Permission{PermissionAdmin}}},
+		AnyPrincipal: {{Prefix: "public:", Permissions: []Permission{PermissionRead}}},
+	}
+
+	for _, test := range []struct {
+		principal  string
+		permission Permission
+		start, end string
+		expected   bool
+	}{
+		{"alice", PermissionWrite, "user:alice:1", "user:alice:1\x00", true},
+		{"alice", PermissionWrite, "user:bob:1", "user:bob:1\x00", false},
+		{"alice", PermissionRead, "user:bob:1", "user:bob:1\x00", true},
+		{"alice", PermissionRead, "user:", "user;", true},
+		{"alice", PermissionRead, "user:", "v", false},
+		{"alice", PermissionRead, "user:", "", false},
+		{"alice", PermissionRead, "public:a", "public:a\x00", true},
+		{"alice", PermissionAdmin, "", "", false},
+		{"", PermissionRead, "public:a", "public:b", true},
+		{"", PermissionWrite, "public:a", "public:a\x00", false},
+		{"ops", PermissionWrite, "anything", "anything\x00", true},
+		{"ops", PermissionAdmin, "", "", true},
+	} {
+		var start, end []byte
+		if test.start != "" {
+			start = []byte(test.start)
+		}
+		if test.end != "" {
+			end = []byte(test.end)
+		}
+		if allowed := acl.Allows(test.principal, test.permission, start, end); allowed != test.expected {
+			t.Errorf("Expected %v for %s %s on [%q, %q), got %v", test.expected, test.principal, test.permission, test.start, test.end, allowed)
+		}
+	}
+
+	if end := prefixEnd([]byte("a\xff\xff")); string(end) != "b" {
+		t.Errorf("Expected b, got %q", end)
+	}
+	if end := prefixEnd([]byte("\xff")); end != nil {
+		t.Errorf("Expected no end, got %q", end)
+	}
+}
+
+func TestHMACTokens(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	authenticator := Authenticators{StaticTokens{"static": "bob"}, HMACTokens{Secret: secret}}
+
+	authenticate := func(token string) (string, error) {
+		r := httptest.NewRequest("GET", "/get?key=a", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return authenticator.Authenticate(r)
+	}
+
+	token := SignToken(secret, "alice.smith", time.Now().Add(time.Hour))
+	if principal, err := authenticate(token); principal != "alice.smith" || err != nil {
+		t.Errorf("Expected alice.smith, got %q (%v)", principal, err)
+	}
+	if principal, err := authenticate("static"); principal != "bob" || err != nil {
+		t.Errorf("Expected bob, got %q (%v)", principal, err)
+	}
+	if principal, err := authenticate("unknown"); principal != "" || err != nil {
+		t.Errorf("Expected no principal, got %q (%v)", principal, err)
+	}
+
+	// The principal can't be changed without the secret
+	parts := strings.Split(token, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte("ops")) + "." + parts[1] + "." + parts[2]
+	if _, err := authenticate(forged); err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := authenticate(SignToken([]byte("another secret"), "alice", time.Now().Add(time.Hour))); err != ErrInvalidCredentials {
+		t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+	}
+	if _, err := authenticate(SignToken(secret, "alice", time.Now().Add(-time.Second))); err != ErrTokenExpired {
+		t.Errorf("Expected ErrTokenExpired, got %v", err)
+	}
+}
+
+func TestAccessControl(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.Put([]byte("user:bob:1"), []byte("bob"))
+
+	var auditLog bytes.Buffer
+	access := &AccessControl{
+		Authenticator: StaticTokens{"alice-token": "alice", "ops-token": "ops"},
+		ACL: ACL{
+			"alice": {{Prefix: "user:alice:", Permissions: []Permission{PermissionRead, PermissionWrite}}},
+			"ops":   {{Prefix: "", Permissions: []Permission{PermissionAdmin}}},
+		},
+		AuditLog: log.New(&auditLog, "", 0),
+	}
+	server := httptest.NewServer(NewHTTPHandler(lsmdb, nil, nil, nil, access))
+	defer server.Close()
+
+	do := func(method, path, token, body string) int {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	for _, test := range []struct {
+		method, path, token, body string
+		expected                  int
+	}{
+		{"GET", "/get?key=user:bob:1", "", "", http.StatusUnauthorized},
+		{"GET", "/get?key=user:bob:1", "wrong-token", "", http.StatusUnauthorized},
+		{"GET", "/get?key=user:bob:1", "alice-token", "", http.StatusForbidden},
+		{"POST", "/set", "alice-token", `{"Key": "user:alice:1", "Value": "alice"}`, http.StatusOK},
+		{"POST", "/set", "alice-token", `{"Key": "user:bob:1", "Value": "alice"}`, http.StatusForbidden},
+		{"GET", "/get?key=user:alice:1", "alice-token", "", http.StatusOK},
+		{"DELETE", "/del?key=user:bob:1", "alice-token", "", http.StatusForbidden},
+		{"DELETE", "/cf/default/del?key=user:bob:1", "alice-token", "", http.StatusForbidden},
+		{"GET", "/v2/keys/user:alice:1", "alice-token", "", http.StatusOK},
+		{"PUT", "/v2/keys/user:bob:1", "alice-token", "alice", http.StatusForbidden},
+		{"GET", "/v2/keys?start=" + base64.StdEncoding.EncodeToString([]byte("user:alice:")) + "&end=" + base64.StdEncoding.EncodeToString([]byte("user:alice;")), "alice-token", "", http.StatusOK},
+		{"GET", "/v2/keys", "alice-token", "", http.StatusForbidden},
+		{"GET", "/admin/stats", "alice-token", "", http.StatusForbidden},
+		{"POST", "/cf/logs/create", "alice-token", "", http.StatusForbidden},
+		{"GET", "/metrics", "", "", http.StatusUnauthorized},
+		{"GET", "/admin/stats", "ops-token", "", http.StatusOK},
+		{"DELETE", "/del?key=user:bob:1", "ops-token", "", http.StatusOK},
+	} {
+		if status := do(test.method, test.path, test.token, test.body); status != test.expected {
+			t.Errorf("Expected status %d for %s %s as %q, got %d", test.expected, test.method, test.path, test.token, status)
+		}
+	}
+
+	// The denied requests are in the audit log
+	var entries []AuditEntry
+	for _, line := range strings.Split(strings.TrimSpace(auditLog.String()), "\n") {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) != 11 {
+		t.Fatalf("Expected 11 entries, got %d:\n%s", len(entries), auditLog.String())
+	}
+	if entry := entries[1]; entry.Status != http.StatusUnauthorized || entry.Reason != ErrInvalidCredentials.Error() {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+	if entry := entries[2]; entry.Principal != "alice" || entry.Permission != PermissionRead || entry.Start != "user:bob:1" || entry.Path != "/get" || entry.Status != http.StatusForbidden {
+		t.Errorf("Unexpected entry %+v", entry)
+	}
+}
+
+func TestAccessControl_DeletedValueNeedsRead(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.Put([]byte("log:1"), []byte("secret"))
+	lsmdb.Put([]byte("log:2"), []byte("entry"))
+
+	access := &AccessControl{
+		Authenticator: StaticTokens{"writer-token": "writer", "reader-token": "reader"},
+		ACL: ACL{
+			"writer": {{Prefix: "log:", Permissions: []Permission{PermissionWrite}}},
+			"reader": {{Prefix: "log:", Permissions: []Permission{PermissionRead, PermissionWrite}}},
+		},
+	}
+	server := httptest.NewServer(NewHTTPHandler(lsmdb, nil, nil, nil, access))
+	defer server.Close()
+
+	del := func(key, token string) string {
+		req, _ := http.NewRequest("DELETE", server.URL+"/del?key="+key, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	if body := del("log:1", "writer-token"); body != "OK" {
+		t.Errorf("Expected OK, got %q", body)
+	}
+	if _, err := lsmdb.Get([]byte("log:1")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if body := del("log:2", "reader-token"); body != "entry" {
+		t.Errorf("Expected entry, got %q", body)
+	}
+}
@@ -0,0 +1,435 @@
+package lsmdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBackupNotFound  = errors.New("backup not found")
+	ErrBackupCorrupted = errors.New("the backup is corrupted")
+	ErrTargetExists    = errors.New("the restore directory already exists")
+)
+
+// The description of a backup, stored in meta/<id>.json.
+type BackupInfo struct {
+	ID       int          `json:"id"`
+	Created  time.Time    `json:"created"`
+	Sequence uint64       `json:"sequence"`
+	Size     int64        `json:"size"`
+	Files    []BackupFile `json:"files"`
+}
+
+// A file of a backup, whose content is stored in shared/<sha256>.
+type BackupFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+
+	// The modification time of the file in the database, used to find the unchanged files without reading them
+	ModTime time.Time `json:"modTime"`
+}
+
+// Backs up databases to a directory. The files are stored by the SHA-256 of their content in shared/, so the files
+// that didn't change since the previous backups (the sst files and the sealed value log segments) are stored once.
+type BackupEngine struct {
+	dir string
+
+	// The directory the checkpoints are created in before they are copied to the backup directory.
+	// It must be on the file system of the database, so the checkpoints only hold links to the sst files.
+	checkpointPath string
+
+	// The number of backups kept, the oldest ones are purged when a backup is created (0 keeps all of them)
+	keepLast int
+
+	mu sync.Mutex
+}
+
+func OpenBackupEngine(dir, checkpointPath string, keepLast int) (*BackupEngine, error) {
+	for _, path := range []string{filepath.Join(dir, "meta"), filepath.Join(dir, "shared")} {
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	engine := &BackupEngine{
+		dir:            dir,
+		checkpointPath: checkpointPath,
+		keepLast:       keepLast,
+	}
+	return engine, nil
+}
+
+func (engine *BackupEngine) metaPath(id int) string {
+	return filepath.Join(engine.dir, "meta", strconv.Itoa(id)+".json")
+}
+
+func (engine *BackupEngine) blobPath(sha string) string {
+	return filepath.Join(engine.dir, "shared", sha)
+}
+
+// Returns the IDs of the backups, in increasing order.
+func (engine *BackupEngine) BackupIDs() ([]int, error) {
+	files, err := os.ReadDir(filepath.Join(engine.dir, "meta"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []int
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if id, err := strconv.Atoi(name); err == nil {
+			ids = append(ids, id)
+		}
+	}
+
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (engine *BackupEngine) readInfo(id int) (*BackupInfo, error) {
+	encoded, err := os.ReadFile(engine.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrBackupNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info := &BackupInfo{}
+	if err := json.Unmarshal(encoded, info); err != nil {
+		return nil, ErrCorruptedFile
+	}
+	return info, nil
+}
+
+// Returns the backups, from the oldest to the newest.
+func (engine *BackupEngine) ListBackups() ([]*BackupInfo, error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	ids, err := engine.BackupIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*BackupInfo, 0, len(ids))
+	for _, id := range ids {
+		info, err := engine.readInfo(id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// Backs up the database, from a checkpoint taken while it keeps serving.
+// Only the files whose content isn't stored yet are copied.
+func (engine *BackupEngine) CreateBackup(lsmdb *DB) (info *BackupInfo, err error) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	_, finish := lsmdb.startJob("backup")
+	defer func() { finish(nil, err) }()
+
+	ids, err := engine.BackupIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	id := 1
+	known := make(map[string]BackupFile)
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+
+		previous, err := engine.readInfo(ids[len(ids)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range previous.Files {
+			known[file.Path] = file
+		}
+	}
+
+	checkpointDir := filepath.Join(engine.checkpointPath, fmt.Sprint("backup-", id))
+	if err := os.RemoveAll(checkpointDir); err != nil {
+		return nil, err
+	}
+	manifest, err := lsmdb.Checkpoint(checkpointDir)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(checkpointDir)
+
+	info = &BackupInfo{
+		ID:       id,
+		Created:  manifest.Created,
+		Sequence: manifest.Sequence,
+	}
+
+	for _, file := range manifest.Files {
+		backupFile, err := engine.storeFile(filepath.Join(checkpointDir, file.Path), file.Path, known)
+		if err != nil {
+			return nil, err
+		}
+		info.Files = append(info.Files, backupFile)
+		info.Size += backupFile.Size
+	}
+
+	encoded, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomically(engine.metaPath(id), encoded); err != nil {
+		return nil, err
+	}
+
+	if engine.keepLast > 0 {
+		if err := engine.purge(engine.keepLast); err != nil {
+			return nil, err
+		}
+	}
+
+	return info, nil
+}
+
+// Stores the content of a file of a checkpoint in shared/, unless it is already there.
+// A file with the path, the size and the modification time of a file of the previous backup isn't read again.
+func (engine *BackupEngine) storeFile(src, path string, known map[string]BackupFile) (BackupFile, error) {
+	stat, err := os.Stat(src)
+	if err != nil {
+		return BackupFile{}, err
+	}
+
+	file := BackupFile{
+		Path:    path,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime().UTC(),
+	}
+
+	if previous, ok := known[path]; ok && previous.Size == file.Size && previous.ModTime.Equal(file.ModTime) {
+		if _, err := os.Stat(engine.blobPath(previous.SHA256)); err == nil {
+			file.SHA256 = previous.SHA256
+			return file, nil
+		}
+	}
+
+	if file.SHA256, err = fileSHA256(src); err != nil {
+		return BackupFile{}, err
+	}
+
+	if _, err := os.Stat(engine.blobPath(file.SHA256)); err == nil {
+		return file, nil
+	}
+
+	tmp := engine.blobPath(file.SHA256) + ".tmp"
+	if err := copyFilePrefix(src, tmp, file.Size); err != nil {
+		os.Remove(tmp)
+		return BackupFile{}, err
+	}
+
+	return file, os.Rename(tmp, engine.blobPath(file.SHA256))
+}
+
+// Checks that every file of the backup is stored with its size and its checksum.
+func (engine *BackupEngine) VerifyBackup(id int) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	info, err := engine.readInfo(id)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range info.Files {
+		stat, err := os.Stat(engine.blobPath(file.SHA256))
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%w: %s is missing", ErrBackupCorrupted, file.Path)
+		}
+		if err != nil {
+			return err
+		}
+		if stat.Size() != file.Size {
+			return fmt.Errorf("%w: %s has size %d instead of %d", ErrBackupCorrupted, file.Path, stat.Size(), file.Size)
+		}
+
+		sha, err := fileSHA256(engine.blobPath(file.SHA256))
+		if err != nil {
+			return err
+		}
+		if sha != file.SHA256 {
+			return fmt.Errorf("%w: the checksum of %s doesn't match", ErrBackupCorrupted, file.Path)
+		}
+	}
+
+	return nil
+}
+
+// Deletes the backups older than the keepLast newest ones, and the files only they used.
+func (engine *BackupEngine) PurgeOldBackups(keepLast int) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	return engine.purge(keepLast)
+}
+
+func (engine *BackupEngine) purge(keepLast int) error {
+	ids, err := engine.BackupIDs()
+	if err != nil {
+		return err
+	}
+
+	for len(ids) > keepLast {
+		if err := os.Remove(engine.metaPath(ids[0])); err != nil {
+			return err
+		}
+		ids = ids[1:]
+	}
+
+	// Deleting the stored files that no backup uses anymore
+	used := make(map[string]bool)
+	for _, id := range ids {
+		info, err := engine.readInfo(id)
+		if err != nil {
+			return err
+		}
+		for _, file := range info.Files {
+			used[file.SHA256] = true
+		}
+	}
+
+	blobs, err := os.ReadDir(filepath.Join(engine.dir, "shared"))
+	if err != nil {
+		return err
+	}
+	for _, blob := range blobs {
+		if !used[blob.Name()] {
+			if err := os.Remove(engine.blobPath(blob.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Reconstructs the data directory of a backup in dir, which must not exist. The checksums of the files are checked
+// while they are copied. The database can then be started from dir.
+func (engine *BackupEngine) RestoreBackup(id int, dir string) error {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+
+	info, err := engine.readInfo(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dir); err == nil {
+		return ErrTargetExists
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	// The files are restored in a temporary directory, renamed once all of them are there
+	tmp := filepath.Clean(dir) + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+
+	for _, file := range info.Files {
+		if err := engine.restoreFile(file, filepath.Join(tmp, file.Path)); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+
+	return os.Rename(tmp, dir)
+}
+
+func (engine *BackupEngine) restoreFile(file BackupFile, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+
+	in, err := os.Open(engine.blobPath(file.SHA256))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%w: %s is missing", ErrBackupCorrupted, file.Path)
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err != nil {
+		return err
+	}
+
+	if n != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.SHA256 {
+		return fmt.Errorf("%w: the checksum of %s doesn't match", ErrBackupCorrupted, file.Path)
+	}
+
+	return out.Sync()
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Writes the file to a temporary file, and renames it so a crash can't leave half of it.
+func writeFileAtomically(path string, content []byte) error {
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,93 @@
+package lsmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackupEngine(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	backupDir := t.TempDir()
+
+	engine, err := OpenBackupEngine(backupDir, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+
+	first, err := engine.CreateBackup(lsmdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("new value", i)))
+	}
+
+	second, err := engine.CreateBackup(lsmdb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != 1 || second.ID != 2 {
+		t.Errorf("Expected backups 1 and 2, got %d and %d", first.ID, second.ID)
+	}
+
+	// The sst files of the first backup are not stored again
+	shas := make(map[string]bool)
+	for _, file := range append(first.Files, second.Files...) {
+		shas[file.SHA256] = true
+	}
+	blobs, _ := os.ReadDir(filepath.Join(backupDir, "shared"))
+	if len(blobs) != len(shas) || len(blobs) >= len(first.Files)+len(second.Files) {
+		t.Errorf("Expected %d deduplicated files, got %d", len(shas), len(blobs))
+	}
+
+	for _, id := range []int{1, 2} {
+		if err := engine.VerifyBackup(id); err != nil {
+			t.Errorf("Expected backup %d to be valid, got %v", id, err)
+		}
+	}
+	if err := engine.VerifyBackup(3); err != ErrBackupNotFound {
+		t.Errorf("Expected ErrBackupNotFound, got %v", err)
+	}
+
+	// Restoring the first backup gives the database as it was then
+	target := filepath.Join(t.TempDir(), "restored")
+	if err := engine.RestoreBackup(1, target); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.RestoreBackup(1, target); err != ErrTargetExists {
+		t.Errorf("Expected ErrTargetExists, got %v", err)
+	}
+
+	restored := openTestLSMDB(t, target)
+	for i := 0; i < 20; i++ {
+		if v, err := restored.Get([]byte(fmt.Sprint("key", i))); err != nil || string(v) != fmt.Sprint("value", i) {
+			t.Errorf("Expected value%d, got %s (%v)", i, v, err)
+		}
+	}
+
+	// Purging the first backup keeps the files the second one uses
+	if err := engine.PurgeOldBackups(1); err != nil {
+		t.Fatal(err)
+	}
+	if backups, err := engine.ListBackups(); err != nil || len(backups) != 1 || backups[0].ID != 2 {
+		t.Errorf("Expected only backup 2, got %v (%v)", backups, err)
+	}
+	if err := engine.VerifyBackup(2); err != nil {
+		t.Errorf("Expected backup 2 to be valid, got %v", err)
+	}
+
+	// A damaged file is detected
+	damaged := second.Files[len(second.Files)-1]
+	os.WriteFile(filepath.Join(backupDir, "shared", damaged.SHA256), []byte("damaged"), 0600)
+	if err := engine.VerifyBackup(2); !errors.Is(err, ErrBackupCorrupted) {
+		t.Errorf("Expected ErrBackupCorrupted, got %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+package lsmdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	ErrCDCBatchFull = errors.New("the CDC batch is full")
+)
+
+const (
+	cdcCursorFileName = "cursor.json"
+	cdcActiveFileName = "active.jsonl"
+)
+
+type CDCOptions struct {
+	// The directory the export files are written to
+	Dir string
+
+	// The active file is rolled once it reaches this size
+	MaxFileSize int64
+
+	// The interval at which the WAL is read for new records
+	PollInterval time.Duration
+
+	// The maximum number of WAL records read at once, while the database is locked
+	BatchSize int
+
+	// The number of keys whose value is kept in memory once exported, to export it as the old value of their next
+	// mutation. The old values are not exported if it is 0.
+	OldValueKeys int
+}
+
+// A mutation exported to the CDC files, as one JSON line. The keys and the values are encoded in base64.
+// Ts is the commit time of the mutation, or the time it was exported if the WAL doesn't hold its commit time.
+// OldValue is the value of the key before the mutation. It is only known if the previous mutation of the key was
+// exported since the exporter started, and its value is still among the OldValueKeys ones kept, otherwise it is
+// omitted, like when the key had no value.
+type CDCRecord struct {
+	Seq      uint64    `json:"seq"`
+	Op       string    `json:"op"`
+	Family   string    `json:"family,omitempty"`
+	Key      []byte    `json:"key"`
+	Value    []byte    `json:"value,omitempty"`
+	OldValue []byte    `json:"oldValue,omitempty"`
+	Ts       time.Time `json:"ts"`
+}
+
+// The position of the export, persisted after every write to the active file.
+type CDCCursor struct {
+	// The sequence number of the last exported record
+	Seq uint64 `json:"seq"`
+
+	// The sequence number of the first record of the active file
+	FileFirstSeq uint64 `json:"fileFirstSeq"`
+
+	// The size of the active file. Whatever is beyond it was written after the last cursor update, and is dropped
+	// when the export resumes, so the records are exported exactly once.
+	FileSize int64 `json:"fileSize"`
+}
+
+// Tails the WAL and exports its mutations to JSON lines files, in commit order.
+// The records are appended to the active file, which is rolled into cdc-<first seq>-<last seq>.jsonl once it is
+// big enough, along with a .sha256 file holding its checksum (in the format of sha256sum).
+type CDCExporter struct {
+	lsmdb  *DB
+	opts   CDCOptions
+	cursor CDCCursor
+	active *os.File
+
+	// The values of the keys after their last exported mutation, by column family and key (nil for the deleted keys)
+	values map[cdcKey][]byte
+}
+
+type cdcKey struct {
+	family string
+	key    string
+}
+
+// Opens the export directory, and resumes the export after the last record of the cursor.
+// Without a cursor, the export starts from the oldest record of the WAL.
+func newCDCExporter(lsmdb *DB, opts CDCOptions) (*CDCExporter, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	exp := &CDCExporter{
+		lsmdb:  lsmdb,
+		opts:   opts,
+		values: make(map[cdcKey][]byte),
+	}
+
+	encoded, err := os.ReadFile(exp.path(cdcCursorFileName))
+	switch {
+	case os.IsNotExist(err):
+		unlock := lsmdb.lock()
+		wal := lsmdb.rootDB().wal
+		segments, err := wal.retainedSegments()
+		exp.cursor.Seq = wal.oldestRetainedSeq(segments)
+		unlock()
+
+		if err != nil {
+			return nil, err
+		}
+
+	case err != nil:
+		return nil, err
+
+	default:
+		if err := json.Unmarshal(encoded, &exp.cursor); err != nil {
+			return nil, ErrCorruptedFile
+		}
+	}
+
+	// If the active file is missing, it was rolled right before the exporter stopped
+	if _, err := os.Stat(exp.path(cdcActiveFileName)); os.IsNotExist(err) {
+		exp.cursor.FileFirstSeq = 0
+		exp.cursor.FileSize = 0
+	}
+
+	// Dropping what was written after the last cursor update
+	active, err := os.OpenFile(exp.path(cdcActiveFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	exp.active = active
+
+	info, err := active.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < exp.cursor.FileSize {
+		active.Close()
+		return nil, ErrCorruptedFile
+	}
+	if err := active.Truncate(exp.cursor.FileSize); err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	// The rolled files whose checksum wasn't written before the exporter stopped
+	if err := exp.writeMissingChecksums(); err != nil {
+		active.Close()
+		return nil, err
+	}
+
+	return exp, nil
+}
+
+func (exp *CDCExporter) path(name string) string {
+	return filepath.Join(exp.opts.Dir, name)
+}
+
+// Returns the sequence number of the last exported record.
+func (exp *CDCExporter) Cursor() uint64 {
+	return exp.cursor.Seq
+}
+
+// Exports the records committed since the last export, and returns their number.
+func (exp *CDCExporter) Export() (int, error) {
+	exported := 0
+
+	for {
+		records, err := exp.readBatch()
+		if err != nil {
+			return exported, err
+		}
+		if len(records) == 0 {
+			return exported, nil
+		}
+
+		if err := exp.write(records); err != nil {
+			// The values were updated with records that will be read again
+			clear(exp.values)
+			return exported, err
+		}
+
+		for _, record := range records {
+			if record.Op != "" {
+				exported++
+			}
+		}
+	}
+}
+
+// Reads the changes of the next WAL records, at most BatchSize of them.
+func (exp *CDCExporter) readBatch() ([]CDCRecord, error) {
+	defer exp.lsmdb.lock()()
+
+	root := exp.lsmdb.rootDB()
+	now := time.Now().UTC()
+
+	var records []CDCRecord
+	read := 0
+
+	err := root.wal.readRecordsAfter(exp.cursor.Seq, func(record walRecord) error {
+		if read == exp.opts.BatchSize {
+			return ErrCDCBatchFull
+		}
+		read++
+
+		events, err := root.changesOf(record.seq, record.entry, func(string, []byte) bool { return true })
+		if err != nil {
+			return err
+		}
+
+		ts := record.time.UTC()
+		if record.time.IsZero() {
+			ts = now
+		}
+
+		for _, event := range events {
+			records = append(records, CDCRecord{
+				Seq:      event.Seq,
+				Op:       event.Type.String(),
+				Family:   event.Family,
+				Key:      event.Key,
+				Value:    event.Value,
+				OldValue: exp.applyChange(event),
+				Ts:       ts,
+			})
+		}
+
+		// A record without changes (an empty batch) still moves the cursor
+		if len(events) == 0 {
+			records = append(records, CDCRecord{Seq: record.seq})
+		}
+
+		return nil
+	})
+	if err != nil && err != ErrCDCBatchFull {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// Returns the value of the key before the change if it is known, and remembers its value after the change.
+// It must be called with the database locked.
+func (exp *CDCExporter) applyChange(event ChangeEvent) []byte {
+	if exp.opts.OldValueKeys == 0 {
+		return nil
+	}
+
+	id := cdcKey{event.Family, string(event.Key)}
+	old, known := exp.values[id]
+
+	var value []byte
+	switch event.Type {
+	case ChangePut:
+		value = event.Value
+	case ChangeMerge:
+		// The new value is only known if the old one is, and the merge operator can fold the operand into it
+		family, err := exp.lsmdb.columnFamily(event.Family)
+		if !known || err != nil || family.mergeOperator == nil {
+			delete(exp.values, id)
+			return old
+		}
+		if value, err = family.mergeOperator.FullMerge(event.Key, old, [][]byte{event.Value}); err != nil {
+			delete(exp.values, id)
+			return old
+		}
+	}
+
+	// Forgetting any key to make room for this one
+	if !known && len(exp.values) >= exp.opts.OldValueKeys {
+		for evicted := range exp.values {
+			delete(exp.values, evicted)
+			break
+		}
+	}
+	exp.values[id] = value
+
+	return old
+}
+
+// Appends the records to the active file, then saves the cursor, and rolls the file if it is big enough.
+func (exp *CDCExporter) write(records []CDCRecord) error {
+	if _, err := exp.active.Seek(exp.cursor.FileSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	var lines []byte
+	for _, record := range records {
+		if record.Op == "" {
+			continue
+		}
+
+		if exp.cursor.FileSize == 0 && len(lines) == 0 {
+			exp.cursor.FileFirstSeq = record.Seq
+		}
+
+		encoded, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, encoded...)
+		lines = append(lines, '\n')
+	}
+
+	if _, err := exp.active.Write(lines); err != nil {
+		return err
+	}
+	if err := exp.active.Sync(); err != nil {
+		return err
+	}
+
+	exp.cursor.Seq = records[len(records)-1].Seq
+	exp.cursor.FileSize += int64(len(lines))
+	if err := exp.saveCursor(); err != nil {
+		return err
+	}
+
+	if exp.cursor.FileSize >= exp.opts.MaxFileSize {
+		return exp.roll()
+	}
+
+	return nil
+}
+
+// Writes the cursor to the cursor file, atomically.
+func (exp *CDCExporter) saveCursor() error {
+	encoded, err := json.Marshal(exp.cursor)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomically(exp.path(cdcCursorFileName), encoded)
+}
+
+// Moves the active file to its final name, writes its checksum, and starts a new active file.
+func (exp *CDCExporter) roll() error {
+	name := fmt.Sprintf("cdc-%020d-%020d.jsonl", exp.cursor.FileFirstSeq, exp.cursor.Seq)
+
+	if err := exp.active.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(exp.path(cdcActiveFileName), exp.path(name)); err != nil {
+		return err
+	}
+	if err := exp.writeChecksum(name); err != nil {
+		return err
+	}
+
+	active, err := os.OpenFile(exp.path(cdcActiveFileName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	exp.active = active
+
+	exp.cursor.FileFirstSeq = 0
+	exp.cursor.FileSize = 0
+	return exp.saveCursor()
+}
+
+func (exp *CDCExporter) writeChecksum(name string) error {
+	file, err := os.Open(exp.path(name))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+
+	line := hex.EncodeToString(hash.Sum(nil)) + "  " + name + "\n"
+	return os.WriteFile(exp.path(name+".sha256"), []byte(line), 0600)
+}
+
+func (exp *CDCExporter) writeMissingChecksums() error {
+	files, err := os.ReadDir(exp.opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "cdc-") || !strings.HasSuffix(name, ".jsonl") {
+			continue
+		}
+
+		if _, err := os.Stat(exp.path(name + ".sha256")); os.IsNotExist(err) {
+			if err := exp.writeChecksum(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Exports the new records at every poll interval, until stop is closed.
+func (exp *CDCExporter) Run(stop <-chan struct{}) error {
+	ticker := time.NewTicker(exp.opts.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := exp.Export(); err != nil {
+			return err
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (exp *CDCExporter) Close() error {
+	return exp.active.Close()
+}
+
+// Starts the CDC export in the background, and returns the function stopping it once the last changes are exported.
+// The failures of the background export are logged.
+func HandleCDCExport(lsmdb *DB, dir string) (func() error, error) {
+	exp, err := newCDCExporter(lsmdb, CDCOptions{
+		Dir:          dir,
+		MaxFileSize:  64 << 20,
+		PollInterval: time.Second,
+		BatchSize:    1024,
+		OldValueKeys: 100000,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		if err := exp.Run(stop); err != nil {
+			log.Println("The CDC export stopped:", err)
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		<-stopped
+
+		_, err := exp.Export()
+		return errors.Join(err, exp.Close())
+	}, nil
+}
@@ -0,0 +1,204 @@
+package lsmdb
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Returns the records of the export files (the rolled ones, then the active one).
+func readCDCRecords(t *testing.T, dir string) []CDCRecord {
+	files, err := filepath.Glob(filepath.Join(dir, "cdc-*.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, filepath.Join(dir, cdcActiveFileName))
+
+	var records []CDCRecord
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var record CDCRecord
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Fatal(err)
+			}
+			records = append(records, record)
+		}
+		file.Close()
+	}
+
+	return records
+}
+
+func TestCDCExport(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.wal.historyPath = t.TempDir()
+	lsmdb.wal.historyMaxSize = 1 << 20
+	lsmdb.mergeOperator = lookupMergeOperator("int64add")
+
+	opts := CDCOptions{
+		Dir:         t.TempDir(),
+		MaxFileSize: 300,
+		BatchSize:   4,
+	}
+
+	exp, err := newCDCExporter(lsmdb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmdb.Put([]byte("a"), []byte("1"))
+	lsmdb.Merge([]byte("a"), []byte("2"))
+	lsmdb.Delete([]byte("a"))
+
+	batch := WriteBatch{}
+	batch.Put("", []byte("b"), []byte("3"))
+	batch.Put("", []byte("c"), []byte("4"))
+	lsmdb.Write(&batch)
+
+	if n, err := exp.Export(); err != nil || n != 5 {
+		t.Fatalf("Expected 5 exported records, got %d (%v)", n, err)
+	}
+
+	records := readCDCRecords(t, opts.Dir)
+	expected := []string{"1 put a 1", "2 merge a 2", "3 delete a ", "4 put b 3", "4 put c 4"}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		got := strings.Join([]string{strconv.FormatUint(record.Seq, 10), record.Op, string(record.Key), string(record.Value)}, " ")
+		if got != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], got)
+		}
+	}
+
+	// Enough records to roll the active file several times, spread over several WAL segments
+	for i := 0; i < 30; i++ {
+		lsmdb.Put([]byte("key"+strconv.Itoa(i)), []byte("value"))
+	}
+	if _, err := exp.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Records written to the active file after the last cursor update are dropped when the export resumes
+	exp.active.Write([]byte(`{"seq":999,"op":"put","key":"","ts":"2020-01-01T00:00:00Z"}` + "\n"))
+	exp.Close()
+
+	lsmdb.Put([]byte("last"), []byte("value"))
+
+	exp, err = newCDCExporter(lsmdb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exp.Close()
+
+	if _, err := exp.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every record is exported exactly once, in order
+	records = readCDCRecords(t, opts.Dir)
+	if len(records) != 36 {
+		t.Fatalf("Expected 36 records, got %d", len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Seq != records[i-1].Seq+1 && records[i].Seq != records[i-1].Seq {
+			t.Errorf("Expected record %d to follow %d", records[i].Seq, records[i-1].Seq)
+		}
+	}
+	if exp.Cursor() != 35 {
+		t.Errorf("Expected cursor 35, got %d", exp.Cursor())
+	}
+
+	// The checksums match the rolled files
+	rolled, _ := filepath.Glob(filepath.Join(opts.Dir, "cdc-*.jsonl"))
+	if len(rolled) < 2 {
+		t.Fatalf("Expected several rolled files, got %d", len(rolled))
+	}
+	for _, name := range rolled {
+		content, _ := os.ReadFile(name)
+		checksum, err := os.ReadFile(name + ".sha256")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sum := sha256.Sum256(content)
+		if expected := hex.EncodeToString(sum[:]) + "  " + filepath.Base(name) + "\n"; string(checksum) != expected {
+			t.Errorf("Expected checksum %q, got %q", expected, checksum)
+		}
+	}
+}
+
+func TestCDCExportOldValues(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.wal.historyPath = t.TempDir()
+	lsmdb.wal.historyMaxSize = 1 << 20
+	lsmdb.mergeOperator = lookupMergeOperator("int64add")
+
+	opts := CDCOptions{
+		Dir:          t.TempDir(),
+		MaxFileSize:  1 << 20,
+		BatchSize:    4,
+		OldValueKeys: 2,
+	}
+
+	exp, err := newCDCExporter(lsmdb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmdb.Put([]byte("a"), []byte("1"))
+	lsmdb.Merge([]byte("a"), []byte("2"))
+	lsmdb.Put([]byte("a"), []byte("5"))
+	lsmdb.Delete([]byte("a"))
+	lsmdb.Put([]byte("a"), []byte("7"))
+
+	batch := WriteBatch{}
+	batch.Put("", []byte("b"), []byte("1"))
+	batch.Put("", []byte("c"), []byte("1"))
+	lsmdb.Write(&batch)
+
+	if _, err := exp.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if len(exp.values) > opts.OldValueKeys {
+		t.Errorf("Expected at most %d values kept, got %d", opts.OldValueKeys, len(exp.values))
+	}
+	exp.Close()
+
+	// The exporter doesn't know the values exported before it started
+	lsmdb.Put([]byte("a"), []byte("8"))
+
+	exp, err = newCDCExporter(lsmdb, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer exp.Close()
+
+	if _, err := exp.Export(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readCDCRecords(t, opts.Dir)
+	expected := []string{"put a 1 ", "merge a 2 1", "put a 5 3", "delete a  5", "put a 7 ", "put b 1 ", "put c 1 ", "put a 8 "}
+	if len(records) != len(expected) {
+		t.Fatalf("Expected %d records, got %d", len(expected), len(records))
+	}
+	for i, record := range records {
+		got := strings.Join([]string{record.Op, string(record.Key), string(record.Value), string(record.OldValue)}, " ")
+		if got != expected[i] {
+			t.Errorf("Expected %s, got %s", expected[i], got)
+		}
+	}
+}
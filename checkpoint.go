@@ -0,0 +1,484 @@
+package lsmdb
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrCheckpointExists = errors.New("the checkpoint directory already exists")
+)
+
+// The file describing a checkpoint, written last so that only complete checkpoints have one
+const checkpointManifestFileName = "CHECKPOINT"
+
+// The description of a checkpoint. The paths of the files are relative to the checkpoint directory.
+type CheckpointManifest struct {
+	// The sequence number of the last change in the checkpoint
+	Sequence uint64 `json:"sequence"`
+
+	Created time.Time        `json:"created"`
+	Files   []CheckpointFile `json:"files"`
+}
+
+type CheckpointFile struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// A prefix of an append-only file, copied once the database is unlocked.
+type checkpointTail struct {
+	src  string
+	dst  string
+	size int64
+}
+
+// Creates a consistent copy of the database in dir, which must not exist, while the database keeps serving.
+// The sst files and the sealed value log segments are immutable, so they are hard-linked (copied if they can't be).
+// The WAL is copied with the database locked, and the active value log segments up to their size at that time.
+//
+// The checkpoint has the layout of a data directory (wal.log, metadata.meta, sst/, vlog/, families.manifest and cf/),
+// and the database can be opened from it.
+func (lsmdb *DB) Checkpoint(dir string) (manifest *CheckpointManifest, err error) {
+	_, finish := lsmdb.startJob("checkpoint")
+	defer func() { finish(nil, err) }()
+
+	if _, err := os.Stat(dir); err == nil {
+		return nil, ErrCheckpointExists
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// The checkpoint is built in a temporary directory renamed at the end, so an interrupted one is never used
+	tmp := filepath.Clean(dir) + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0700); err != nil {
+		return nil, err
+	}
+
+	manifest, err = lsmdb.writeCheckpoint(tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func (lsmdb *DB) writeCheckpoint(dir string) (*CheckpointManifest, error) {
+	unlock := lsmdb.lock()
+	manifest, tails, err := lsmdb.rootDB().captureFiles(dir)
+	unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tail := range tails {
+		if err := copyFilePrefix(tail.src, filepath.Join(dir, tail.dst), tail.size); err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, CheckpointFile{Path: tail.dst, Size: tail.size})
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, checkpointManifestFileName), encoded, 0600); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// Links or writes the files of the checkpoint, except the active value log segments, which are returned as tails
+// to copy. It must be called with the database locked.
+func (lsmdb *DB) captureFiles(dir string) (*CheckpointManifest, []checkpointTail, error) {
+	manifest := &CheckpointManifest{
+		Sequence: lsmdb.wal.lastSeq,
+		Created:  time.Now().UTC(),
+	}
+	var tails []checkpointTail
+
+	addFile := func(path string, content []byte) error {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, path)), 0700); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, path), content, 0600); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, CheckpointFile{Path: path, Size: int64(len(content))})
+		return nil
+	}
+
+	linkFile := func(src, path string) error {
+		size, err := linkOrCopyFile(src, filepath.Join(dir, path))
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, CheckpointFile{Path: path, Size: size})
+		return nil
+	}
+
+	// The WAL starts with the sequence number of its segment, so the sequence numbers continue in the checkpoint
+	wal, err := os.ReadFile(lsmdb.wal.walPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if lsmdb.wal.baseSeq > 0 {
+		marker := Entry{op: SequenceOp, value: binary.BigEndian.AppendUint64(nil, lsmdb.wal.baseSeq)}
+		wal = append(marker.encode(), wal...)
+	}
+	if err := addFile("wal.log", wal); err != nil {
+		return nil, nil, err
+	}
+
+	if lsmdb.manifestFileName != "" {
+		if _, err := os.Stat(lsmdb.manifestFileName); err == nil {
+			if err := linkFile(lsmdb.manifestFileName, "families.manifest"); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	for _, family := range lsmdb.allFamilies() {
+		prefix := ""
+		if family.root != nil {
+			prefix = "cf/" + family.familyName + "/"
+		}
+
+		if err := os.MkdirAll(filepath.Join(dir, prefix+"sst"), 0700); err != nil {
+			return nil, nil, err
+		}
+
+		// The metadata file is written again, as it is updated in place
+		if err := addFile(prefix+"metadata.meta", family.encodeMetadata()); err != nil {
+			return nil, nil, err
+		}
+
+		for i := 1; i <= family.sstFilesNum; i++ {
+			name := fmt.Sprint("f", i, ".sst")
+			if err := linkFile(family.sstFilePath(i), prefix+"sst/"+name); err != nil {
+				return nil, nil, err
+			}
+
+			// The sst files written before the checksums were have none
+			if _, err := os.Stat(family.sstChecksumPath(i)); err == nil {
+				if err := linkFile(family.sstChecksumPath(i), prefix+"sst/"+name+".sha256"); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		if family.valueLog == nil {
+			continue
+		}
+
+		nums, err := family.valueLog.segments()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		activeNum, activeSize, err := family.valueLog.activeSegmentSize()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for _, num := range nums {
+			path := fmt.Sprint(prefix, "vlog/v", num, ".vlog")
+			if err := os.MkdirAll(filepath.Join(dir, prefix+"vlog"), 0700); err != nil {
+				return nil, nil, err
+			}
+
+			if num == activeNum {
+				tails = append(tails, checkpointTail{src: family.valueLog.segmentPath(num), dst: path, size: activeSize})
+				continue
+			}
+
+			if err := linkFile(family.valueLog.segmentPath(num), path); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	return manifest, tails, nil
+}
+
+// Hard-links src to dst, or copies it if it can't be linked (on another file system for instance).
+// Returns the size of the file.
+func linkOrCopyFile(src, dst string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return 0, err
+	}
+
+	if err := os.Link(src, dst); err == nil {
+		return info.Size(), nil
+	}
+
+	return info.Size(), copyFilePrefix(src, dst, info.Size())
+}
+
+// Copies the first size bytes of src to dst, and syncs dst.
+func copyFilePrefix(src, dst string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err := io.CopyN(out, in, size); err != nil {
+		return err
+	}
+
+	return out.Sync()
+}
+
+// Writes the files of the checkpoint in dir to a tar archive.
+func WriteCheckpointTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	if err := tw.AddFS(os.DirFS(dir)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Replaces the files of the database with the ones of the checkpoint in a tar archive written by WriteCheckpointTar,
+// and opens them. The checkpoint is staged in the directory of the database, so the files are swapped by renames: a
+// crash during the swap leaves either the old files, or the new ones once the database is opened again.
+func (lsmdb *DB) RestoreCheckpointTar(r io.Reader) error {
+	staging := filepath.Join(filepath.Dir(lsmdb.rootDB().wal.walPath), restoreStagingDirName)
+	if err := os.RemoveAll(staging); err != nil {
+		return err
+	}
+
+	if err := extractTar(r, staging); err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+
+	return lsmdb.replaceFiles(staging)
+}
+
+// Extracts a tar archive of a checkpoint to dir. The manifest of the checkpoint is not extracted.
+func extractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !filepath.IsLocal(header.Name) {
+			return ErrCorruptedFile
+		}
+		if header.Name == checkpointManifestFileName {
+			continue
+		}
+
+		path := filepath.Join(dir, header.Name)
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, 0700); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(file, tr)
+		if err == nil {
+			err = file.Sync()
+		}
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The files of a database swapped by a restore, by their name in its directory. The WAL history is never in a
+// checkpoint, it belongs to the replaced records.
+var restoredFileNames = []string{"wal.log", "metadata.meta", "sst", "vlog", "families.manifest", "cf", "wal-history"}
+
+const (
+	// The directory a checkpoint is extracted to before being restored
+	restoreStagingDirName = "restore.tmp"
+
+	// The complete checkpoint being swapped with the files of the database. The files missing from the checkpoint have
+	// a marker file named after them with the absentSuffix instead.
+	restoreDirName = "restore"
+	absentSuffix   = ".absent"
+
+	// The files of the database moved out of the way by the swap, removed once it is over
+	replacedDirName = "replaced"
+)
+
+// Replaces the files of the database with the ones of the checkpoint staged in dir, and opens them. The staging
+// directory must be in the directory of the database.
+func (lsmdb *DB) replaceFiles(staging string) error {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+
+	for _, family := range root.allFamilies() {
+		if family.valueLog != nil {
+			if err := family.valueLog.Close(); err != nil {
+				return err
+			}
+			family.valueLog = nil
+		}
+	}
+	if err := root.wal.logFile.Close(); err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(root.wal.walPath)
+	for _, name := range restoredFileNames {
+		if _, err := os.Stat(filepath.Join(staging, name)); os.IsNotExist(err) {
+			if err := os.WriteFile(filepath.Join(staging, name+absentSuffix), nil, 0600); err != nil {
+				return err
+			}
+		}
+	}
+	if err := syncDir(staging); err != nil {
+		return err
+	}
+
+	// From this rename on, the checkpoint replaces the files even if the swap is cut short
+	if err := os.Rename(staging, filepath.Join(dir, restoreDirName)); err != nil {
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	if _, err := finishRestore(dir); err != nil {
+		return err
+	}
+
+	// The WAL history is elsewhere if it is not in the directory of the database
+	if root.wal.historyPath != "" {
+		if err := os.RemoveAll(root.wal.historyPath); err != nil {
+			return err
+		}
+	}
+
+	logFile, err := os.OpenFile(root.wal.walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	root.wal.logFile = logFile
+
+	memTable := newMemTable()
+	root.memTable = &memTable
+	root.sstFilesNum = 0
+
+	return root.open()
+}
+
+// Swaps the files of the database in dir with the ones of the checkpoint being restored, if there is one, and tells
+// if there was one. It can be called again after a crash, each file being moved only once. The checkpoints whose
+// extraction was cut short are removed.
+func finishRestore(dir string) (bool, error) {
+	if err := os.RemoveAll(filepath.Join(dir, restoreStagingDirName)); err != nil {
+		return false, err
+	}
+
+	restore := filepath.Join(dir, restoreDirName)
+	if _, err := os.Stat(restore); os.IsNotExist(err) {
+		return false, os.RemoveAll(filepath.Join(dir, replacedDirName))
+	}
+
+	replaced := filepath.Join(dir, replacedDirName)
+	if err := os.MkdirAll(replaced, 0700); err != nil {
+		return false, err
+	}
+
+	// Moves the current file out of the way, it is removed once the new files are in place
+	moveAway := func(name string) error {
+		if err := os.RemoveAll(filepath.Join(replaced, name)); err != nil {
+			return err
+		}
+		err := os.Rename(filepath.Join(dir, name), filepath.Join(replaced, name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, name := range restoredFileNames {
+		restored := filepath.Join(restore, name)
+		if _, err := os.Stat(restored); err == nil {
+			if err := moveAway(name); err != nil {
+				return false, err
+			}
+			if err := os.Rename(restored, filepath.Join(dir, name)); err != nil {
+				return false, err
+			}
+			continue
+		}
+
+		absent := restored + absentSuffix
+		if _, err := os.Stat(absent); err == nil {
+			if err := moveAway(name); err != nil {
+				return false, err
+			}
+			if err := os.Remove(absent); err != nil {
+				return false, err
+			}
+		}
+	}
+	if err := syncDir(dir); err != nil {
+		return false, err
+	}
+
+	if err := os.RemoveAll(replaced); err != nil {
+		return false, err
+	}
+	return true, os.RemoveAll(restore)
+}
+
+// Syncs a directory, so the files created, renamed or removed in it are on the disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
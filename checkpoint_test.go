@@ -0,0 +1,167 @@
+package lsmdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 200
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lsmdb.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := lsmdb.ColumnFamily("users")
+
+	// Some keys are flushed to sst files, the others stay in the WAL
+	bigValue := bytes.Repeat([]byte("x"), 150)
+	for i := 0; i < 10; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	lsmdb.Put([]byte("big"), bigValue)
+	users.Put([]byte("alice"), []byte("1"))
+
+	dir := filepath.Join(t.TempDir(), "checkpoint")
+	manifest, err := lsmdb.Checkpoint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Sequence != lsmdb.LastSequence() {
+		t.Errorf("Expected sequence %d, got %d", lsmdb.LastSequence(), manifest.Sequence)
+	}
+	if _, err := lsmdb.Checkpoint(dir); err != ErrCheckpointExists {
+		t.Errorf("Expected ErrCheckpointExists, got %v", err)
+	}
+
+	// The sst files are shared with the database
+	if lsmdb.sstFilesNum == 0 {
+		t.Fatal("Expected some sst files")
+	}
+	original, _ := os.Stat(lsmdb.sstPath + "f1.sst")
+	linked, err := os.Stat(filepath.Join(dir, "sst", "f1.sst"))
+	if err != nil || !os.SameFile(original, linked) {
+		t.Errorf("Expected the sst file to be hard-linked (%v)", err)
+	}
+
+	// The changes made after the checkpoint are not in it
+	lsmdb.Put([]byte("key0"), []byte("changed"))
+	lsmdb.Put([]byte("big"), bytes.Repeat([]byte("y"), 150))
+	users.Delete([]byte("alice"))
+
+	checkpoint := openTestLSMDB(t, dir)
+	checkpoint.valueLogPath = dir + "/vlog/"
+	checkpoint.valueThreshold = 50
+	checkpoint.valueLogSegmentSize = 200
+	if err := checkpoint.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+	defer checkpoint.valueLog.Close()
+
+	for i := 0; i < 10; i++ {
+		if v, err := checkpoint.Get([]byte(fmt.Sprint("key", i))); err != nil || string(v) != fmt.Sprint("value", i) {
+			t.Errorf("Expected value%d, got %s (%v)", i, v, err)
+		}
+	}
+	if v, err := checkpoint.Get([]byte("big")); err != nil || !bytes.Equal(v, bigValue) {
+		t.Errorf("Expected the big value, got %s (%v)", v, err)
+	}
+
+	checkpointUsers, err := checkpoint.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := checkpointUsers.Get([]byte("alice")); err != nil || string(v) != "1" {
+		t.Errorf("Expected 1, got %s (%v)", v, err)
+	}
+
+	if seq := checkpoint.LastSequence(); seq != manifest.Sequence {
+		t.Errorf("Expected the sequence numbers to continue from %d, got %d", manifest.Sequence, seq)
+	}
+}
+
+func TestRestoreCheckpointTar(t *testing.T) {
+	source, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.Close()
+	for i := 0; i < 10; i++ {
+		source.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	if _, err := source.Checkpoint(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	var archive bytes.Buffer
+	if err := WriteCheckpointTar(&archive, checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	lsmdb, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lsmdb.Put([]byte("stale"), []byte("value"))
+
+	if err := lsmdb.RestoreCheckpointTar(bytes.NewReader(archive.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lsmdb.Get([]byte("key3")); err != nil || string(v) != "value3" {
+		t.Errorf("Expected value3, got %s (%v)", v, err)
+	}
+	if _, err := lsmdb.Get([]byte("stale")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	for _, name := range []string{restoreStagingDirName, restoreDirName, replacedDirName} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", name, err)
+		}
+	}
+
+	// A restore cut short after the WAL was swapped is completed when the database is opened
+	lsmdb.Put([]byte("stale"), []byte("value"))
+	lsmdb.Flush()
+	if err := lsmdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	restore := filepath.Join(dir, restoreDirName)
+	if err := extractTar(bytes.NewReader(archive.Bytes()), restore); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range restoredFileNames {
+		if _, err := os.Stat(filepath.Join(restore, name)); os.IsNotExist(err) {
+			os.WriteFile(filepath.Join(restore, name+absentSuffix), nil, 0600)
+		}
+	}
+	os.MkdirAll(filepath.Join(dir, replacedDirName), 0700)
+	os.Rename(filepath.Join(dir, "wal.log"), filepath.Join(dir, replacedDirName, "wal.log"))
+	os.Rename(filepath.Join(restore, "wal.log"), filepath.Join(dir, "wal.log"))
+
+	reopened, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if v, err := reopened.Get([]byte("key3")); err != nil || string(v) != "value3" {
+		t.Errorf("Expected value3, got %s (%v)", v, err)
+	}
+	if _, err := reopened.Get([]byte("stale")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := os.Stat(restore); !os.IsNotExist(err) {
+		t.Errorf("Expected the restore directory to be removed, got %v", err)
+	}
+}
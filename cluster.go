@@ -0,0 +1,225 @@
+package lsmdb
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// A cluster replicating the database with a consensus log, like the one of the raftcluster package. The writes of the
+// HTTP API are proposed to it instead of being applied to the database, which only takes the entries of the log.
+type Cluster interface {
+	// Tells if the node can take the write of the request. If it can't, the response is written, redirecting the
+	// client to the leader or telling it there is none.
+	TakesWrite(w http.ResponseWriter, r *http.Request) bool
+
+	// Proposes the batch to the cluster, and returns the result of its application once it is committed.
+	Propose(batch *WriteBatch) ([]byte, error)
+
+	// Adds a node to the cluster, or removes one from it.
+	Join(id, raftAddr, httpAddr string) error
+	Remove(id string) error
+
+	// Returns the state of the node and the members of the cluster.
+	Status() (ClusterStatus, error)
+}
+
+type ClusterMember struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr,omitempty"`
+	Voter    bool   `json:"voter"`
+}
+
+type ClusterStatus struct {
+	ID           string          `json:"id"`
+	State        string          `json:"state"`
+	Leader       string          `json:"leader,omitempty"`
+	AppliedIndex uint64          `json:"appliedIndex"`
+	Members      []ClusterMember `json:"members"`
+}
+
+// Puts the database in cluster mode: it is made read-only, and the writes of the HTTP API are proposed to the cluster.
+func (lsmdb *DB) SetCluster(cluster Cluster) {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	root.readOnly = true
+	root.cluster = cluster
+}
+
+// Returns the cluster of the database, nil if it is not in cluster mode.
+func (lsmdb *DB) clusterNode() Cluster {
+	defer lsmdb.lock()()
+	return lsmdb.rootDB().cluster
+}
+
+// Applies a write batch committed at the index of the log of the cluster. The index is written with the batch in the
+// key of indexFamily (created if it doesn't exist), so the entries replayed when the node restarts are not applied
+// twice.
+// A batch made of one deletion returns the previous value of the key, and is refused with ErrKeyNotFound if the key
+// doesn't exist (like DB.Delete). A refused batch still moves the applied index.
+func (lsmdb *DB) ApplyLogEntry(index uint64, encodedBatch []byte, indexFamily string, indexKey []byte) ([]byte, error) {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	if _, err := root.columnFamily(indexFamily); err == ErrColumnFamilyNotFound {
+		if err := root.createColumnFamily(indexFamily, ColumnFamilyOptions{MemSizeThreshold: root.memSizeThreshold}); err != nil {
+			return nil, err
+		}
+	}
+
+	applied, err := root.appliedLogIndex(indexFamily, indexKey)
+	if err != nil {
+		return nil, err
+	}
+	if index <= applied {
+		return nil, nil
+	}
+
+	var value []byte
+	batch, refused := decodeWriteBatch(encodedBatch)
+	if refused != nil {
+		batch = &WriteBatch{}
+	}
+
+	families, err := root.resolveBatch(batch)
+	if refused == nil {
+		refused = err
+	}
+
+	if refused == nil && batch.Len() == 1 && batch.entries[0].op == DelOp {
+		value, refused = families[0].get(batch.entries[0].key)
+	}
+
+	if refused != nil {
+		batch, families = &WriteBatch{}, nil
+	}
+
+	family, err := root.columnFamily(indexFamily)
+	if err != nil {
+		return nil, err
+	}
+	batch.Put(indexFamily, indexKey, binary.BigEndian.AppendUint64(nil, index))
+	families = append(families, family)
+
+	if err := root.commitBatch(batch, families); err != nil {
+		return nil, err
+	}
+
+	return value, refused
+}
+
+// Returns the index of the last log entry applied by ApplyLogEntry with the same key, 0 if there is none.
+func (lsmdb *DB) AppliedLogIndex(indexFamily string, indexKey []byte) (uint64, error) {
+	defer lsmdb.lock()()
+	return lsmdb.rootDB().appliedLogIndex(indexFamily, indexKey)
+}
+
+// It must be called with the database locked.
+func (lsmdb *DB) appliedLogIndex(indexFamily string, indexKey []byte) (uint64, error) {
+	family, err := lsmdb.columnFamily(indexFamily)
+	if err == ErrColumnFamilyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := family.get(indexKey)
+	if err == ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(value) != 8 {
+		return 0, ErrCorruptedFile
+	}
+
+	return binary.BigEndian.Uint64(value), nil
+}
+
+type ClusterJoinRequest struct {
+	ID       string `json:"id"`
+	RaftAddr string `json:"raftAddr"`
+	HTTPAddr string `json:"httpAddr"`
+}
+
+// This is the request handler for the nodes joining the cluster (/cluster/join)
+// The request is redirected to the leader.
+func clusterJoinHandler(cluster Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		var request ClusterJoinRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if request.ID == "" || request.RaftAddr == "" {
+			http.Error(w, "id and raftAddr must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if !cluster.TakesWrite(w, r) {
+			return
+		}
+
+		if err := cluster.Join(request.ID, request.RaftAddr, request.HTTPAddr); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// This is the request handler for the removal of a node from the cluster (/cluster/remove?id=node3)
+// The request is redirected to the leader.
+func clusterRemoveHandler(cluster Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			http.Error(w, "id must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if !cluster.TakesWrite(w, r) {
+			return
+		}
+
+		if err := cluster.Remove(id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// This is the request handler for the status of the cluster (/cluster/status)
+func clusterStatusHandler(cluster Cluster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		status, err := cluster.Status()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
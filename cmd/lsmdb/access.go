@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+// The principal authenticated by the admin token
+const adminPrincipal = "admin"
+
+// The minimum size of the secret signing the HMAC tokens
+const minHMACSecretSize = 32
+
+// The content of the ACL file: the static tokens mapped to their principal, and the permissions granted to each
+// principal ("*" for all of them and the requests without credentials).
+type ACLFile struct {
+	Tokens lsmdb.StaticTokens `json:"tokens"`
+	Grants lsmdb.ACL          `json:"grants"`
+}
+
+// Reads an ACL file, and checks its principals and permissions.
+func loadACLFile(path string) (ACLFile, error) {
+	var file ACLFile
+
+	f, err := os.Open(path)
+	if err != nil {
+		return file, err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&file); err != nil {
+		return file, fmt.Errorf("invalid ACL file %s: %v", path, err)
+	}
+
+	for token, principal := range file.Tokens {
+		if token == "" || principal == "" || principal == lsmdb.AnyPrincipal {
+			return file, fmt.Errorf("invalid ACL file %s: the tokens and their principal must not be empty or %q", path, lsmdb.AnyPrincipal)
+		}
+	}
+	validPermissions := []lsmdb.Permission{lsmdb.PermissionRead, lsmdb.PermissionWrite, lsmdb.PermissionAdmin}
+	for principal, grants := range file.Grants {
+		for _, grant := range grants {
+			for _, permission := range grant.Permissions {
+				if !slices.Contains(validPermissions, permission) {
+					return file, fmt.Errorf("invalid ACL file %s: unknown permission %q granted to %s", path, permission, principal)
+				}
+			}
+		}
+	}
+
+	return file, nil
+}
+
+// Returns the access control of the HTTP API, nil if it is open, and the function closing the audit log.
+// Without ACL file, the admin principal is granted all the permissions and everyone else can read and write all the
+// keys, so the admin token only protects the admin endpoints.
+func loadAccessControl(cfg Config) (*lsmdb.AccessControl, func(), error) {
+	if cfg.AdminToken == "" && cfg.HMACSecret == "" && cfg.ACLFile == "" && cfg.TLSClientCA == "" {
+		return nil, func() {}, nil
+	}
+
+	file := ACLFile{
+		Tokens: lsmdb.StaticTokens{},
+		Grants: lsmdb.ACL{
+			lsmdb.AnyPrincipal: {{Prefix: "", Permissions: []lsmdb.Permission{lsmdb.PermissionRead, lsmdb.PermissionWrite}}},
+		},
+	}
+	if cfg.ACLFile != "" {
+		var err error
+		if file, err = loadACLFile(cfg.ACLFile); err != nil {
+			return nil, nil, err
+		}
+		if file.Tokens == nil {
+			file.Tokens = lsmdb.StaticTokens{}
+		}
+		if file.Grants == nil {
+			file.Grants = lsmdb.ACL{}
+		}
+	}
+
+	if cfg.AdminToken != "" {
+		file.Tokens[cfg.AdminToken] = adminPrincipal
+		file.Grants[adminPrincipal] = append(file.Grants[adminPrincipal], lsmdb.Grant{Prefix: "", Permissions: []lsmdb.Permission{lsmdb.PermissionAdmin}})
+	}
+
+	authenticators := lsmdb.Authenticators{file.Tokens}
+	if cfg.HMACSecret != "" {
+		authenticators = append(authenticators, lsmdb.HMACTokens{Secret: []byte(cfg.HMACSecret)})
+	}
+	// The bearer tokens take precedence over the client certificates
+	if cfg.TLSClientCA != "" {
+		authenticators = append(authenticators, lsmdb.ClientCertificates{})
+	}
+
+	auditLog, closeAuditLog := log.New(os.Stderr, "audit: ", 0), func() {}
+	if cfg.AuditLog != "" {
+		f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+		auditLog, closeAuditLog = log.New(f, "", 0), func() { f.Close() }
+	}
+
+	return &lsmdb.AccessControl{Authenticator: authenticators, ACL: file.Grants, AuditLog: auditLog}, closeAuditLog, nil
+}
+
+// The token command: token -principal <name> [-ttl <duration>]
+// It prints a token of the principal signed with the secret given by -hmac-secret or LSMDB_HMAC_SECRET.
+func runTokenCommand(args []string, lookupEnv func(string) (string, bool)) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	secret := flags.String("hmac-secret", "", "secret signing the token, the one of the server")
+	principal := flags.String("principal", "", "principal authenticated by the token")
+	ttl := flags.Duration("ttl", 24*time.Hour, "time after which the token expires")
+	flags.Parse(args)
+
+	if v, ok := lookupEnv(envName("hmac-secret")); ok && *secret == "" {
+		*secret = v
+	}
+	if len(*secret) < minHMACSecretSize || *principal == "" {
+		log.Fatalf("A -principal and a -hmac-secret of at least %d bytes are required", minHMACSecretSize)
+	}
+
+	fmt.Println(lsmdb.SignToken([]byte(*secret), *principal, time.Now().Add(*ttl)))
+}
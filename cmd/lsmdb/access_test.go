@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+func TestLoadAccessControl(t *testing.T) {
+	if access, _, err := loadAccessControl(DefaultConfig()); access != nil || err != nil {
+		t.Errorf("Expected no access control, got %+v (%v)", access, err)
+	}
+
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.AdminToken = "admin-token"
+	cfg.HMACSecret = strings.Repeat("s", minHMACSecretSize)
+	cfg.ACLFile = filepath.Join(dir, "acl.json")
+	cfg.AuditLog = filepath.Join(dir, "audit.log")
+
+	acl := `{"tokens": {"alice-token": "alice"}, "grants": {"alice": [{"prefix": "user:", "permissions": ["read", "write"]}], "*": [{"prefix": "public:", "permissions": ["read"]}]}}`
+	if err := os.WriteFile(cfg.ACLFile, []byte(acl), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	access, closeAuditLog, err := loadAccessControl(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAuditLog()
+
+	for token, expected := range map[string]string{
+		"alice-token": "alice",
+		"admin-token": adminPrincipal,
+		lsmdb.SignToken([]byte(cfg.HMACSecret), "bob", time.Now().Add(time.Hour)): "bob",
+	} {
+		r := httptest.NewRequest("GET", "/get", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		if principal, err := access.Authenticator.Authenticate(r); principal != expected || err != nil {
+			t.Errorf("Expected %s, got %q (%v)", expected, principal, err)
+		}
+	}
+
+	if !access.ACL.Allows(adminPrincipal, lsmdb.PermissionAdmin, nil, nil) || access.ACL.Allows("bob", lsmdb.PermissionWrite, []byte("public:a"), []byte("public:b")) {
+		t.Errorf("Unexpected ACL %+v", access.ACL)
+	}
+
+	// The admin endpoints added by the server are protected too
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/admin/config", nil)
+	r.Header.Set("Authorization", "Bearer alice-token")
+	access.RequireAdmin(configHandler(cfg))(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", w.Code)
+	}
+	closeAuditLog()
+	if content, _ := os.ReadFile(cfg.AuditLog); !strings.Contains(string(content), `"principal":"alice"`) {
+		t.Errorf("Expected the denied request in the audit log, got %q", content)
+	}
+
+	// The secrets are redacted
+	w = httptest.NewRecorder()
+	configHandler(cfg)(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if body := w.Body.String(); strings.Contains(body, "admin-token") || strings.Contains(body, cfg.HMACSecret) {
+		t.Errorf("Expected the secrets to be redacted, got %s", body)
+	}
+
+	if err := os.WriteFile(cfg.ACLFile, []byte(`{"grants": {"alice": [{"prefix": "", "permissions": ["delete"]}]}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := loadAccessControl(cfg); err == nil || !strings.Contains(err.Error(), "delete") {
+		t.Errorf("Expected an error about the unknown permission, got %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+// The restore command: restore -backup-dir <dir> [-id <id>] -target <dir>
+// It verifies the backup (the newest one if no ID is given), and restores it in the target directory.
+func runRestoreCommand(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	backupDir := flags.String("backup-dir", "backups/", "directory of the backups")
+	id := flags.Int("id", 0, "ID of the backup to restore, the newest one if 0")
+	target := flags.String("target", "", "directory the data directory is restored to, it must not exist")
+	flags.Parse(args)
+
+	if *target == "" {
+		log.Fatal("The -target directory is required")
+	}
+
+	engine, err := lsmdb.OpenBackupEngine(*backupDir, "", 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *id == 0 {
+		ids, err := engine.BackupIDs()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(ids) == 0 {
+			log.Fatal(lsmdb.ErrBackupNotFound)
+		}
+		*id = ids[len(ids)-1]
+	}
+
+	if err := engine.VerifyBackup(*id); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := engine.RestoreBackup(*id, *target); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Backup %d restored to %s\n", *id, *target)
+}
+
+// The pitr command: pitr -checkpoint <dir> [-archive <dir>] [-wal <file>] -target <dir> [-until <time> | -until-seq <seq>]
+// It restores the checkpoint in the target directory, and replays the archived WAL on it up to the time or the
+// sequence number.
+func runPITRCommand(args []string) {
+	flags := flag.NewFlagSet("pitr", flag.ExitOnError)
+	checkpointDir := flags.String("checkpoint", "", "directory of the base checkpoint")
+	archiveDir := flags.String("archive", "wal-archive/", "directory of the archived WAL segments")
+	walPath := flags.String("wal", "", "WAL of the database, replayed after the archived segments if given")
+	target := flags.String("target", "", "directory the data directory is restored to, it must not exist")
+	until := flags.String("until", "", "time (RFC 3339) of the last replayed change, the replay isn't limited in time if empty")
+	untilSeq := flags.Uint64("until-seq", 0, "sequence number of the last replayed change, the replay isn't limited if 0")
+	flags.Parse(args)
+
+	if *checkpointDir == "" || *target == "" {
+		log.Fatal("The -checkpoint and -target directories are required")
+	}
+
+	recoveryTarget := lsmdb.RecoveryTarget{Sequence: *untilSeq}
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339Nano, *until)
+		if err != nil {
+			log.Fatal(err)
+		}
+		recoveryTarget.Time = t
+	}
+
+	lastSeq, err := lsmdb.RestoreToPoint(*checkpointDir, *archiveDir, *walPath, *target, recoveryTarget)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Restored to %s up to the sequence number %d\n", *target, lastSeq)
+}
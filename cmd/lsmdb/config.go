@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+// The prefix of the environment variables setting the options: -http-addr is set by LSMDB_HTTP_ADDR.
+const envPrefix = "LSMDB_"
+
+// The configuration of the server. It is read from a JSON config file, the environment variables and the
+// command-line flags, each of them overriding the previous ones.
+type Config struct {
+	// The directory holding all the files of the database
+	DataDir string `json:"dataDir"`
+
+	HTTPAddr      string `json:"httpAddr"`
+	RESPAddr      string `json:"respAddr"`
+	MemcachedAddr string `json:"memcachedAddr"`
+	GRPCAddr      string `json:"grpcAddr"`
+
+	CDCDir     string `json:"cdcDir"`
+	BackupDir  string `json:"backupDir"`
+	BackupKeep int    `json:"backupKeep"`
+
+	Follow string `json:"follow"`
+
+	RaftID        string `json:"raftID"`
+	RaftAddr      string `json:"raftAddr"`
+	RaftDir       string `json:"raftDir"`
+	RaftBootstrap bool   `json:"raftBootstrap"`
+	RaftJoin      string `json:"raftJoin"`
+	AdvertiseURL  string `json:"advertiseURL"`
+
+	// The time given to the HTTP requests in progress to finish when the server is stopped
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	// The access control of the HTTP API, which is open without them: the bearer token of the admin principal, the
+	// secret signing the HMAC tokens, the file of the static tokens and of the ACL, and the file the denied requests
+	// are logged to (stderr if empty)
+	AdminToken string `json:"adminToken"`
+	HMACSecret string `json:"hmacSecret"`
+	ACLFile    string `json:"aclFile"`
+	AuditLog   string `json:"auditLog"`
+
+	// The bearer token sent to the leader by a follower, and to the cluster by a node joining it
+	PeerToken string `json:"peerToken"`
+
+	// The certificate and the key of the HTTP listener, which serves TLS with them, and the certificate authorities
+	// the client certificates are verified with (their common name is then a principal of the access control)
+	TLSCert              string `json:"tlsCert"`
+	TLSKey               string `json:"tlsKey"`
+	TLSClientCA          string `json:"tlsClientCA"`
+	TLSRequireClientCert bool   `json:"tlsRequireClientCert"`
+
+	// The options of the database
+	lsmdb.Options
+}
+
+// Returns the configuration used when none is given.
+func DefaultConfig() Config {
+	return Config{
+		DataDir:    "data/",
+		HTTPAddr:   ":8080",
+		BackupKeep: 7,
+		RaftAddr:   "localhost:7000",
+
+		ShutdownTimeout: Duration(30 * time.Second),
+		Options:         lsmdb.DefaultOptions(),
+	}
+}
+
+// Defines a flag for each option, with its current value as default.
+func (cfg *Config) registerFlags(flags *flag.FlagSet) {
+	flags.StringVar(&cfg.DataDir, "data-dir", cfg.DataDir, "directory holding all the files of the database")
+	flags.StringVar(&cfg.HTTPAddr, "http-addr", cfg.HTTPAddr, "address of the HTTP API listener")
+	flags.StringVar(&cfg.RESPAddr, "resp-addr", cfg.RESPAddr, "address of the Redis protocol listener (e.g. :6379), disabled if empty")
+	flags.StringVar(&cfg.MemcachedAddr, "memcached-addr", cfg.MemcachedAddr, "address of the memcached protocol listener (e.g. :11211), disabled if empty")
+	flags.StringVar(&cfg.GRPCAddr, "grpc-addr", cfg.GRPCAddr, "address of the gRPC listener (e.g. :9090), disabled if empty")
+	flags.StringVar(&cfg.CDCDir, "cdc-dir", cfg.CDCDir, "directory the WAL mutations are exported to (CDC), disabled if empty")
+	flags.StringVar(&cfg.BackupDir, "backup-dir", cfg.BackupDir, "directory of the backups created with POST /admin/backup, disabled if empty")
+	flags.IntVar(&cfg.BackupKeep, "backup-keep", cfg.BackupKeep, "number of backups kept, the oldest ones are purged (0 keeps all of them)")
+	flags.StringVar(&cfg.WALArchiveDir, "wal-archive-dir", cfg.WALArchiveDir, "directory the full WAL segments are archived to for point-in-time recovery, disabled if empty")
+	flags.Int64Var(&cfg.WALHistoryMaxSize, "wal-history-max-size", cfg.WALHistoryMaxSize, "size in bytes of the old WAL segments kept for the change feed and the followers")
+	flags.StringVar(&cfg.Follow, "follow", cfg.Follow, "URL of the leader to replicate (e.g. http://leader:8080), the database is read-only if set")
+	flags.StringVar(&cfg.RaftID, "raft-id", cfg.RaftID, "ID of the node in the Raft cluster, the cluster mode is disabled if empty")
+	flags.StringVar(&cfg.RaftAddr, "raft-addr", cfg.RaftAddr, "address of the Raft listener of the node")
+	flags.StringVar(&cfg.RaftDir, "raft-dir", cfg.RaftDir, "directory of the Raft log and snapshots (<data-dir>/raft/ by default)")
+	flags.BoolVar(&cfg.RaftBootstrap, "raft-bootstrap", cfg.RaftBootstrap, "bootstraps a new cluster with the node as its only member")
+	flags.StringVar(&cfg.RaftJoin, "raft-join", cfg.RaftJoin, "URL of the HTTP API of a member of the cluster to join")
+	flags.StringVar(&cfg.AdvertiseURL, "advertise-url", cfg.AdvertiseURL, "URL of the HTTP API of the node given to the other members (http://localhost<http-addr> by default)")
+	flags.IntVar(&cfg.MemSizeThreshold, "mem-size-threshold", cfg.MemSizeThreshold, "size in bytes of the memTable after which it is flushed to an sst file")
+	flags.IntVar(&cfg.FileNumThreshold, "file-num-threshold", cfg.FileNumThreshold, "number of sst files after which they are compacted into one")
+	flags.IntVar(&cfg.ValueThreshold, "value-threshold", cfg.ValueThreshold, "size in bytes from which the values are written to the value log")
+	flags.Int64Var(&cfg.ValueLogSegmentSize, "value-log-segment-size", cfg.ValueLogSegmentSize, "size in bytes after which a new value log segment is started")
+	flags.DurationVar((*time.Duration)(&cfg.ShutdownTimeout), "shutdown-timeout", time.Duration(cfg.ShutdownTimeout), "time given to the HTTP requests in progress to finish when the server is stopped")
+	flags.StringVar(&cfg.AdminToken, "admin-token", cfg.AdminToken, "bearer token of the admin principal, granted all the permissions")
+	flags.StringVar(&cfg.HMACSecret, "hmac-secret", cfg.HMACSecret, "secret signing the tokens created with the token command")
+	flags.StringVar(&cfg.ACLFile, "acl-file", cfg.ACLFile, "JSON file of the static tokens and of the permissions granted to each principal")
+	flags.StringVar(&cfg.AuditLog, "audit-log", cfg.AuditLog, "file the requests denied by the access control are logged to, stderr if empty")
+	flags.StringVar(&cfg.PeerToken, "peer-token", cfg.PeerToken, "bearer token sent to the leader when following it, or to the cluster when joining it")
+	flags.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "PEM certificate of the HTTP listener, which serves TLS if set (reloaded on SIGHUP or when it changes)")
+	flags.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "PEM private key of the certificate of the HTTP listener")
+	flags.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA, "PEM certificate authorities verifying the client certificates, whose common name authenticates a principal")
+	flags.BoolVar(&cfg.TLSRequireClientCert, "tls-require-client-cert", cfg.TLSRequireClientCert, "refuses the TLS connections without a valid client certificate")
+	flags.BoolVar(&cfg.FlushOnClose, "flush-on-close", cfg.FlushOnClose, "flushes the memTables to sst files when the server is stopped, so it restarts without replaying the WAL")
+	flags.StringVar(&cfg.MergeOperator, "merge-operator", cfg.MergeOperator, "name of the merge operator (int64add, stringappend or jsonmergepatch), merges are disabled if empty")
+}
+
+// A duration written like "1m30s" in the config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// Returns the name of the environment variable setting the option of a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Returns the configuration given by the command-line arguments, the environment variables (looked up with
+// lookupEnv) and the config file given by -config or LSMDB_CONFIG, in this order of precedence over the defaults.
+func loadConfig(args []string, lookupEnv func(string) (string, bool)) (Config, error) {
+	cfg := DefaultConfig()
+
+	flags := flag.NewFlagSet("lsmdb", flag.ContinueOnError)
+	configPath := flags.String("config", "", "JSON config file of the options, overridden by the environment variables and the flags")
+	cfg.registerFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	// The flags are applied again once the other sources are, so they override them
+	given := map[string]string{}
+	flags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	if v, ok := lookupEnv(envName("config")); ok && given["config"] == "" {
+		*configPath = v
+	}
+
+	cfg = DefaultConfig()
+	if *configPath != "" {
+		if err := cfg.loadFile(*configPath); err != nil {
+			return cfg, err
+		}
+	}
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		v, ok := lookupEnv(envName(f.Name))
+		if !ok || f.Name == "config" || err != nil {
+			return
+		}
+		if setErr := f.Value.Set(v); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, envName(f.Name), setErr)
+		}
+	})
+	if err != nil {
+		return cfg, err
+	}
+
+	for name, v := range given {
+		flags.Set(name, v)
+	}
+
+	cfg.Follow = strings.TrimSuffix(cfg.Follow, "/")
+	if cfg.RaftDir == "" && cfg.DataDir != "" {
+		cfg.RaftDir = filepath.Join(cfg.DataDir, "raft")
+	}
+	if cfg.AdvertiseURL == "" {
+		scheme := "http://"
+		if cfg.TLSCert != "" {
+			scheme = "https://"
+		}
+		cfg.AdvertiseURL = scheme + "localhost" + cfg.HTTPAddr
+		if !strings.HasPrefix(cfg.HTTPAddr, ":") {
+			cfg.AdvertiseURL = scheme + cfg.HTTPAddr
+		}
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// Sets the options given in a JSON config file. The options it doesn't give are left unchanged.
+func (cfg *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cfg); err != nil {
+		return fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// Returns an error listing the options whose values make no sense, nil if there is none.
+func (cfg Config) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if cfg.DataDir == "" {
+		invalid("data-dir must not be empty")
+	}
+	if _, _, err := net.SplitHostPort(cfg.HTTPAddr); err != nil {
+		invalid("invalid http-addr %q: %v", cfg.HTTPAddr, err)
+	}
+	for name, addr := range map[string]string{"resp-addr": cfg.RESPAddr, "memcached-addr": cfg.MemcachedAddr, "grpc-addr": cfg.GRPCAddr} {
+		if _, _, err := net.SplitHostPort(addr); addr != "" && err != nil {
+			invalid("invalid %s %q: %v", name, addr, err)
+		}
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		invalid("shutdown-timeout must not be negative, got %s", time.Duration(cfg.ShutdownTimeout))
+	}
+	if cfg.BackupKeep < 0 {
+		invalid("backup-keep must not be negative, got %d", cfg.BackupKeep)
+	}
+	if cfg.WALHistoryMaxSize < 0 {
+		invalid("wal-history-max-size must not be negative, got %d", cfg.WALHistoryMaxSize)
+	}
+
+	if cfg.HMACSecret != "" && len(cfg.HMACSecret) < minHMACSecretSize {
+		invalid("hmac-secret must be at least %d bytes long", minHMACSecretSize)
+	}
+
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		invalid("tls-cert and tls-key must be given together")
+	}
+	if cfg.TLSClientCA != "" && cfg.TLSCert == "" {
+		invalid("tls-client-ca needs a tls-cert")
+	}
+	if cfg.TLSRequireClientCert && cfg.TLSClientCA == "" {
+		invalid("tls-require-client-cert needs a tls-client-ca")
+	}
+
+	if cfg.Follow != "" && cfg.RaftID != "" {
+		invalid("follow and raft-id can't be used together")
+	}
+	if cfg.RaftID == "" && (cfg.RaftBootstrap || cfg.RaftJoin != "") {
+		invalid("raft-bootstrap and raft-join need a raft-id")
+	}
+	if cfg.RaftID != "" {
+		if _, _, err := net.SplitHostPort(cfg.RaftAddr); err != nil {
+			invalid("invalid raft-addr %q: %v", cfg.RaftAddr, err)
+		}
+		if cfg.RaftDir == "" {
+			invalid("raft-dir must not be empty")
+		}
+	}
+
+	if err := cfg.Options.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// The value shown instead of the secrets
+const redacted = "<redacted>"
+
+// This is the request handler for /admin/config, returning the effective configuration of the server.
+func configHandler(cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		// The secrets are not given away
+		for _, secret := range []*string{&cfg.AdminToken, &cfg.HMACSecret, &cfg.PeerToken} {
+			if *secret != "" {
+				*secret = redacted
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg)
+	}
+}
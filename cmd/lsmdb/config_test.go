@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	config := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(config, []byte(`{"httpAddr": ":9000", "grpcAddr": ":9090", "memSizeThreshold": 4096, "backupKeep": 3}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"LSMDB_CONFIG":             config,
+		"LSMDB_GRPC_ADDR":          ":9091",
+		"LSMDB_MEM_SIZE_THRESHOLD": "8192",
+	}
+	lookupEnv := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	// The flags override the environment variables, which override the config file
+	opts, err := loadConfig([]string{"-mem-size-threshold", "16384"}, lookupEnv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.HTTPAddr != ":9000" || opts.GRPCAddr != ":9091" || opts.MemSizeThreshold != 16384 || opts.BackupKeep != 3 {
+		t.Errorf("Unexpected options %+v", opts)
+	}
+
+	// The options given nowhere keep their default
+	if opts.FileNumThreshold != 20 || opts.MergeOperator != "int64add" || opts.RaftDir != filepath.Join("data", "raft") {
+		t.Errorf("Expected the defaults, got %+v", opts)
+	}
+	if opts.AdvertiseURL != "http://localhost:9000" {
+		t.Errorf("Expected http://localhost:9000, got %s", opts.AdvertiseURL)
+	}
+
+	// The nodes serving TLS are advertised with https
+	if opts, _ := loadConfig([]string{"-tls-cert", "server.crt", "-tls-key", "server.key"}, lookupEnv); opts.AdvertiseURL != "https://localhost:9000" {
+		t.Errorf("Expected https://localhost:9000, got %s", opts.AdvertiseURL)
+	}
+
+	// A flag set to its default still overrides the other sources
+	if opts, _ := loadConfig([]string{"-grpc-addr", ""}, lookupEnv); opts.GRPCAddr != "" {
+		t.Errorf("Expected no gRPC address, got %s", opts.GRPCAddr)
+	}
+
+	env["LSMDB_BACKUP_KEEP"] = "many"
+	if _, err := loadConfig(nil, lookupEnv); err == nil || !strings.Contains(err.Error(), "LSMDB_BACKUP_KEEP") {
+		t.Errorf("Expected an error about LSMDB_BACKUP_KEEP, got %v", err)
+	}
+	delete(env, "LSMDB_BACKUP_KEEP")
+
+	if err := os.WriteFile(config, []byte(`{"memSizeTreshold": 4096}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfig(nil, lookupEnv); err == nil || !strings.Contains(err.Error(), "memSizeTreshold") {
+		t.Errorf("Expected an error about the unknown option, got %v", err)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Errorf("Expected valid defaults, got %v", err)
+	}
+
+	opts := DefaultConfig()
+	opts.HTTPAddr = "8080"
+	opts.MemSizeThreshold = 0
+	opts.MergeOperator = "sum"
+	opts.Follow = "http://leader:8080"
+	opts.RaftID = "node1"
+	opts.TLSKey = "server.key"
+	opts.TLSRequireClientCert = true
+
+	err := opts.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, expected := range []string{"http-addr", "mem-size-threshold", "merge-operator", "raft-id", "tls-cert and tls-key", "tls-require-client-cert"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error about %s, got %v", expected, err)
+		}
+	}
+}
+
+func TestConfigHandler(t *testing.T) {
+	opts := DefaultConfig()
+	opts.GRPCAddr = ":9090"
+
+	w := httptest.NewRecorder()
+	configHandler(opts)(w, httptest.NewRequest("GET", "/admin/config", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+
+	var effective Config
+	if err := json.NewDecoder(w.Body).Decode(&effective); err != nil {
+		t.Fatal(err)
+	}
+	if effective != opts {
+		t.Errorf("Expected %+v, got %+v", opts, effective)
+	}
+}
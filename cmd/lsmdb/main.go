@@ -0,0 +1,271 @@
+// The server of the database: it serves the HTTP API and, when they are enabled, the Redis, memcached and gRPC
+// protocols, the replication and the Raft cluster mode.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+	"github.com/IlyasIsHere/Persistent-key-value-store/grpcserver"
+	"github.com/IlyasIsHere/Persistent-key-value-store/memcachedserver"
+	"github.com/IlyasIsHere/Persistent-key-value-store/raftcluster"
+	"github.com/IlyasIsHere/Persistent-key-value-store/respserver"
+	"google.golang.org/grpc"
+)
+
+// The interval at which the files of the TLS certificates are checked for changes
+const tlsWatchInterval = 10 * time.Second
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "restore" {
+		runRestoreCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "pitr" {
+		runPITRCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		runTokenCommand(os.Args[2:], os.LookupEnv)
+		return
+	}
+
+	cfg, err := loadConfig(os.Args[1:], os.LookupEnv)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := serve(cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Runs the server until it receives SIGINT or SIGTERM, and stops it cleanly.
+func serve(cfg Config) error {
+	// A new follower starts from a checkpoint of its leader
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, "metadata.meta")); cfg.Follow != "" && os.IsNotExist(err) {
+		seq, err := lsmdb.BootstrapFollower(cfg.Follow, cfg.PeerToken, cfg.DataDir)
+		if err != nil {
+			return err
+		}
+		log.Println("Bootstrapped from the checkpoint of the leader at the sequence number", seq)
+	}
+
+	db, err := lsmdb.Open(cfg.DataDir, &cfg.Options)
+	if err != nil {
+		return err
+	}
+
+	// The servers and the background tasks are stopped in the reverse order they are started, before the database
+	// is closed
+	var stops []func()
+	defer func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+		if err := db.Close(); err != nil {
+			log.Println("The database was not closed cleanly:", err)
+		}
+	}()
+
+	// The first server failing stops the program (there is one slot for each server)
+	stopped := make(chan error, 4)
+
+	// Launching the Redis protocol server if it is enabled
+	if cfg.RESPAddr != "" {
+		listener, err := net.Listen("tcp", cfg.RESPAddr)
+		if err != nil {
+			return err
+		}
+		srv := respserver.NewServer(db)
+		go func() { stopped <- srv.Serve(listener) }()
+		stops = append(stops, func() { srv.Close() })
+	}
+
+	// Launching the memcached protocol server if it is enabled
+	if cfg.MemcachedAddr != "" {
+		srv, err := memcachedserver.NewServer(db)
+		if err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", cfg.MemcachedAddr)
+		if err != nil {
+			return err
+		}
+		go func() { stopped <- srv.Serve(listener) }()
+		stops = append(stops, func() { srv.Close() })
+	}
+
+	// Launching the gRPC server if it is enabled
+	if cfg.GRPCAddr != "" {
+		listener, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			return err
+		}
+		srv := grpcserver.NewServer(db)
+		go func() { stopped <- srv.Serve(listener) }()
+		stops = append(stops, func() { stopGRPCServer(srv, time.Duration(cfg.ShutdownTimeout)) })
+	}
+
+	// Launching the CDC export if it is enabled
+	if cfg.CDCDir != "" {
+		stopExport, err := lsmdb.HandleCDCExport(db, cfg.CDCDir)
+		if err != nil {
+			return err
+		}
+		stops = append(stops, func() {
+			if err := stopExport(); err != nil {
+				log.Println("The CDC export was not stopped cleanly:", err)
+			}
+		})
+	}
+
+	var backupEngine *lsmdb.BackupEngine
+	if cfg.BackupDir != "" {
+		engine, err := lsmdb.OpenBackupEngine(cfg.BackupDir, filepath.Join(cfg.DataDir, "backup.tmp"), cfg.BackupKeep)
+		if err != nil {
+			return err
+		}
+		backupEngine = engine
+	}
+
+	// Following the leader if it is a follower
+	var follower *lsmdb.Follower
+	if cfg.Follow != "" {
+		follower = lsmdb.NewFollower(db, cfg.Follow, cfg.PeerToken)
+		go follower.Run()
+		stops = append(stops, follower.Stop)
+	}
+
+	// Joining the Raft cluster if it is in cluster mode
+	// The interface stays nil out of cluster mode
+	var cluster lsmdb.Cluster
+	if cfg.RaftID != "" {
+		node, err := raftcluster.NewNode(db, raftcluster.Options{
+			ID:        cfg.RaftID,
+			RaftAddr:  cfg.RaftAddr,
+			HTTPAddr:  cfg.AdvertiseURL,
+			Dir:       cfg.RaftDir,
+			Bootstrap: cfg.RaftBootstrap,
+			Token:     cfg.PeerToken,
+		})
+		if err != nil {
+			return err
+		}
+		cluster = node
+		stops = append(stops, func() {
+			if err := node.Shutdown(); err != nil {
+				log.Println("The Raft node was not shut down cleanly:", err)
+			}
+		})
+
+		if cfg.RaftJoin != "" {
+			if err := node.JoinCluster(cfg.RaftJoin); err != nil {
+				log.Println("The node could not join the cluster:", err)
+			}
+		}
+	}
+
+	access, closeAuditLog, err := loadAccessControl(cfg)
+	if err != nil {
+		return err
+	}
+	stops = append(stops, closeAuditLog)
+
+	// Launching the HTTP API
+	mux := lsmdb.NewHTTPHandler(db, backupEngine, follower, cluster, access)
+	mux.HandleFunc("/admin/config", access.RequireAdmin(configHandler(cfg)))
+	srv := &http.Server{Addr: cfg.HTTPAddr, Handler: mux}
+
+	// The streams (watch, replication) never end by themselves, so their requests are cancelled by the shutdown
+	streams, cancelStreams := context.WithCancel(context.Background())
+	srv.BaseContext = func(net.Listener) context.Context { return streams }
+	srv.RegisterOnShutdown(cancelStreams)
+
+	// Serving TLS if it is enabled, with the certificates reloaded on SIGHUP or when their files change
+	var reloader *lsmdb.TLSReloader
+	if cfg.TLSCert != "" {
+		reloader, err = lsmdb.NewTLSReloader(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = reloader.Config(cfg.TLSRequireClientCert)
+		stops = append(stops, reloadTLSCertificates(reloader))
+	}
+
+	go func() {
+		if reloader != nil {
+			stopped <- srv.ListenAndServeTLS("", "")
+			return
+		}
+		stopped <- srv.ListenAndServe()
+	}()
+
+	// Stopping on SIGINT or SIGTERM, a second one kills the process
+	signals, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	select {
+	case err := <-stopped:
+		return err
+	case <-signals.Done():
+		stopSignals()
+	}
+
+	log.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("The HTTP requests in progress were not drained:", err)
+	}
+	return nil
+}
+
+// Reloads the TLS certificates on SIGHUP, and when their files change. Returns the function stopping it.
+func reloadTLSCertificates(reloader *lsmdb.TLSReloader) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go reloader.WatchFiles(ctx, tlsWatchInterval)
+
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if err := reloader.Reload(); err != nil {
+				log.Println("The TLS certificates were not reloaded:", err)
+				continue
+			}
+			log.Println("Reloaded the TLS certificates")
+		}
+	}()
+
+	return func() {
+		signal.Stop(hangups)
+		close(hangups)
+		cancel()
+	}
+}
+
+// Stops the gRPC server once its calls in progress are over, or once the timeout is reached.
+func stopGRPCServer(srv *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		srv.Stop()
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// This is the request handler for /get, with the same API as the one of the servers.
+func getHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if len(key) == 0 {
+			http.Error(w, "Key must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		v, err := router.Get([]byte(key))
+		if err != nil {
+			if err == ErrKeyNotFound {
+				fmt.Fprintf(w, "Key not found")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		fmt.Fprint(w, string(v))
+	}
+}
+
+// This is the request handler for /set, with the same API as the one of the servers.
+func setHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		var entry KeyValue
+		if err := json.NewDecoder(r.Body).Decode(&entry); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(entry.Key) == 0 || len(entry.Value) == 0 {
+			http.Error(w, "Key and value must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if err := router.Set([]byte(entry.Key), []byte(entry.Value)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// This is the request handler for /del, with the same API as the one of the servers.
+func delHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		key := r.URL.Query().Get("key")
+		if len(key) == 0 {
+			http.Error(w, "Key must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		v, err := router.Del([]byte(key))
+		if err != nil {
+			if err == ErrKeyNotFound {
+				fmt.Fprintf(w, "Key not found")
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		fmt.Fprint(w, string(v))
+	}
+}
+
+// This is the request handler for /cluster/ring, returning the layout of the ring and the ongoing migration.
+func ringHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(router.Status())
+	}
+}
+
+// This is the request handler for /cluster/shards.
+// POST adds the shard whose URL is given in the url query parameter, and DELETE removes it. The keys are migrated in
+// the background, and the migration started is returned.
+func shardsHandler(router *Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		shard := normalizeShardURL(r.URL.Query().Get("url"))
+		if len(shard) == 0 {
+			http.Error(w, "The shard URL must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		var migration MigrationStatus
+		var err error
+
+		switch r.Method {
+		case "POST":
+			migration, err = router.AddShard(shard)
+		case "DELETE":
+			migration, err = router.RemoveShard(shard)
+		default:
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		switch err {
+		case nil:
+		case ErrShardNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(migration)
+	}
+}
+
+func handleRequests(router *Router, addr string) {
+	http.HandleFunc("/get", getHandler(router))
+	http.HandleFunc("/set", setHandler(router))
+	http.HandleFunc("/del", delHandler(router))
+	http.HandleFunc("/cluster/ring", ringHandler(router))
+	http.HandleFunc("/cluster/shards", shardsHandler(router))
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
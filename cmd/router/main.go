@@ -0,0 +1,36 @@
+// The router of a sharded deployment: it spreads the keys over several servers with a consistent-hash ring, and
+// forwards the requests of the clients to the server owning each key.
+package main
+
+import (
+	"flag"
+	"log"
+	"slices"
+	"strings"
+)
+
+func main() {
+	addr := flag.String("addr", ":8000", "address of the HTTP API listener")
+	shards := flag.String("shards", "", "comma-separated URLs of the servers of the ring (e.g. http://localhost:8080,http://localhost:8081)")
+	vnodes := flag.Int("vnodes", 128, "number of virtual nodes of each server on the ring")
+	token := flag.String("shard-token", "", "bearer token sent to the servers, if their HTTP API has access control")
+	flag.Parse()
+
+	var urls []string
+	for _, shard := range strings.Split(*shards, ",") {
+		if shard = normalizeShardURL(shard); shard != "" && !slices.Contains(urls, shard) {
+			urls = append(urls, shard)
+		}
+	}
+	if len(urls) == 0 {
+		log.Fatal("At least one server must be given with -shards")
+	}
+	if *vnodes <= 0 {
+		log.Fatal("The -vnodes flag must be positive")
+	}
+
+	router := newRouter(urls, *vnodes, *token)
+	defer router.Close()
+
+	handleRequests(router, *addr)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/crc32"
+	"slices"
+	"sort"
+)
+
+// A point of the ring: the hash of a virtual node of a shard.
+type RingPoint struct {
+	Hash  uint32 `json:"hash"`
+	Shard string `json:"shard"`
+}
+
+// A consistent-hash ring of shards. Each shard owns vnodes points of the ring, and a key is owned by the shard of the
+// first point at or after its hash (wrapping around). Adding or removing a shard only moves the keys of its points.
+// A Ring is never modified once built, so it can be shared without locking.
+type Ring struct {
+	vnodes int
+	shards []string
+	points []RingPoint
+}
+
+func hashKey(key []byte) uint32 {
+	return crc32.ChecksumIEEE(key)
+}
+
+// Returns a ring of the given shards with vnodes points per shard.
+func newRing(shards []string, vnodes int) *Ring {
+	ring := &Ring{
+		vnodes: vnodes,
+		shards: slices.Clone(shards),
+		points: make([]RingPoint, 0, len(shards)*vnodes),
+	}
+	slices.Sort(ring.shards)
+
+	for _, shard := range ring.shards {
+		for i := 0; i < vnodes; i++ {
+			ring.points = append(ring.points, RingPoint{
+				Hash:  hashKey([]byte(fmt.Sprintf("%s#%d", shard, i))),
+				Shard: shard,
+			})
+		}
+	}
+
+	// Ties (very unlikely) are broken by the name of the shard, so every router builds the same ring
+	slices.SortFunc(ring.points, func(a, b RingPoint) int {
+		return cmp.Or(cmp.Compare(a.Hash, b.Hash), cmp.Compare(a.Shard, b.Shard))
+	})
+
+	return ring
+}
+
+// Returns the shard owning the key, or "" if the ring is empty.
+func (ring *Ring) owner(key []byte) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+
+	h := hashKey(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].Hash >= h })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].Shard
+}
+
+func (ring *Ring) has(shard string) bool {
+	_, found := slices.BinarySearch(ring.shards, shard)
+	return found
+}
+
+// Returns a copy of the ring with the shard added.
+func (ring *Ring) with(shard string) *Ring {
+	return newRing(append(slices.Clone(ring.shards), shard), ring.vnodes)
+}
+
+// Returns a copy of the ring without the shard.
+func (ring *Ring) without(shard string) *Ring {
+	shards := slices.DeleteFunc(slices.Clone(ring.shards), func(s string) bool { return s == shard })
+	return newRing(shards, ring.vnodes)
+}
+
+// Returns the fraction of the hash space owned by each shard.
+func (ring *Ring) shares() map[string]float64 {
+	shares := make(map[string]float64, len(ring.shards))
+	for i, point := range ring.points {
+		// The point owns the hashes between the previous point (excluded) and itself
+		var prev uint32
+		if i == 0 {
+			prev = ring.points[len(ring.points)-1].Hash
+		} else {
+			prev = ring.points[i-1].Hash
+		}
+		shares[point.Shard] += float64(point.Hash-prev) / (1 << 32)
+	}
+	if len(ring.points) == 1 {
+		shares[ring.points[0].Shard] = 1
+	}
+	return shares
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := newRing([]string{"a", "b", "c"}, 128)
+
+	if len(ring.points) != 3*128 {
+		t.Errorf("Expected %d points, got %d", 3*128, len(ring.points))
+	}
+
+	// The keys are spread over all the shards
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ring.owner([]byte(fmt.Sprint("key", i)))]++
+	}
+	for _, shard := range []string{"a", "b", "c"} {
+		if counts[shard] < 500 {
+			t.Errorf("Expected the keys to be spread, got %v", counts)
+		}
+	}
+
+	shares := ring.shares()
+	if sum := shares["a"] + shares["b"] + shares["c"]; sum < 0.999 || sum > 1.001 {
+		t.Errorf("Expected the shares to sum to 1, got %v", shares)
+	}
+
+	// Adding a shard only moves keys to it, and removing it moves them back
+	added := ring.with("d")
+	removed := added.without("d")
+	if !added.has("d") || ring.has("d") {
+		t.Error("Expected only the new ring to have the shard")
+	}
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprint("key", i))
+		before, after := ring.owner(key), added.owner(key)
+		if before != after && after != "d" {
+			t.Errorf("Expected %s to stay on %s or move to d, got %s", key, before, after)
+		}
+		if removed.owner(key) != before {
+			t.Errorf("Expected %s to be back on %s", key, before)
+		}
+	}
+
+	if owner := newRing(nil, 128).owner([]byte("key")); owner != "" {
+		t.Errorf("Expected no owner, got %s", owner)
+	}
+	if shares := newRing([]string{"a"}, 1).shares(); shares["a"] != 1 {
+		t.Errorf("Expected a share of 1, got %v", shares)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrMigrationInProgress = errors.New("a shard migration is already in progress")
+	ErrShardExists         = errors.New("the shard is already in the ring")
+	ErrShardNotFound       = errors.New("the shard is not in the ring")
+	ErrLastShard           = errors.New("the last shard of the ring can't be removed")
+)
+
+// The number of keys read per page when the keys of a shard are migrated, and the delay before a failed migration
+// is retried.
+var (
+	migrationPageSize      = 500
+	migrationRetryInterval = time.Second
+)
+
+// The state of a shard migration, started by adding or removing a shard.
+type MigrationStatus struct {
+	Kind      string    `json:"kind"`
+	Shard     string    `json:"shard"`
+	StartedAt time.Time `json:"startedAt"`
+	Moved     int64     `json:"moved"`
+	LastError string    `json:"lastError,omitempty"`
+}
+
+// Routes the requests for a key to the shard owning it on a consistent-hash ring.
+//
+// When a shard is added or removed, the new ring is used right away and the keys whose owner changed are moved in the
+// background. Until the migration is over, the previous ring is kept: a key not found on its new owner is read from
+// its previous one, and a write of a key also removes it from its previous owner. A key is moved under the same lock
+// as the requests for it, so a request never sees a key half moved.
+type Router struct {
+	// Held for reading by the requests, and for writing to change the rings
+	mu        sync.RWMutex
+	ring      *Ring
+	previous  *Ring
+	shards    map[string]*shardClient
+	migration *MigrationStatus
+	moved     atomic.Int64
+
+	stripes [256]sync.Mutex
+	client  *http.Client
+	token   string
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// The token is sent as bearer token to the shards, if their HTTP API has access control.
+func newRouter(shards []string, vnodes int, token string) *Router {
+	ctx, cancel := context.WithCancel(context.Background())
+	router := &Router{
+		ring:   newRing(shards, vnodes),
+		shards: make(map[string]*shardClient),
+		client: &http.Client{Timeout: 30 * time.Second},
+		token:  token,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, shard := range shards {
+		router.shards[shard] = &shardClient{url: shard, token: router.token, client: router.client}
+	}
+	return router
+}
+
+// Stops the ongoing migration, if any. It is resumed by no one: the router is not usable anymore.
+func (router *Router) Close() {
+	router.cancel()
+	router.running.Wait()
+}
+
+// Returns the lock of the requests for a key.
+func (router *Router) stripe(key []byte) *sync.Mutex {
+	return &router.stripes[crc32.ChecksumIEEE(key)%uint32(len(router.stripes))]
+}
+
+// Returns the shard owning the key, and the one that owned it before the ongoing migration if it is another one.
+// It is called with router.mu held.
+func (router *Router) owners(key []byte) (*shardClient, *shardClient) {
+	owner := router.shards[router.ring.owner(key)]
+	if router.previous == nil {
+		return owner, nil
+	}
+	if previous := router.shards[router.previous.owner(key)]; previous != owner {
+		return owner, previous
+	}
+	return owner, nil
+}
+
+func (router *Router) Get(key []byte) ([]byte, error) {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	owner, previous := router.owners(key)
+	if previous == nil {
+		return owner.get(key)
+	}
+
+	stripe := router.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	v, err := owner.get(key)
+	if err == ErrKeyNotFound {
+		return previous.get(key)
+	}
+	return v, err
+}
+
+func (router *Router) Set(key, value []byte) error {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	stripe := router.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	owner, previous := router.owners(key)
+	if err := owner.put(key, value); err != nil {
+		return err
+	}
+	if previous != nil {
+		if err := previous.del(key); err != nil && err != ErrKeyNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the key and returns the value it had.
+func (router *Router) Del(key []byte) ([]byte, error) {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	stripe := router.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	owner, previous := router.owners(key)
+
+	// During a migration, the key is on one of its owners at most
+	shard := owner
+	v, err := owner.get(key)
+	if err == ErrKeyNotFound && previous != nil {
+		shard = previous
+		v, err = previous.get(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := shard.del(key); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Adds a shard to the ring, and moves the keys it now owns to it in the background.
+func (router *Router) AddShard(shard string) (MigrationStatus, error) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if router.ring.has(shard) {
+		return MigrationStatus{}, ErrShardExists
+	}
+	if router.migration != nil {
+		return MigrationStatus{}, ErrMigrationInProgress
+	}
+
+	router.shards[shard] = &shardClient{url: shard, token: router.token, client: router.client}
+	return router.startMigration("add", shard, router.ring.with(shard)), nil
+}
+
+// Removes a shard from the ring, and moves its keys to their new owners in the background. The shard keeps being
+// read until the migration is over.
+func (router *Router) RemoveShard(shard string) (MigrationStatus, error) {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	if !router.ring.has(shard) {
+		return MigrationStatus{}, ErrShardNotFound
+	}
+	if len(router.ring.shards) == 1 {
+		return MigrationStatus{}, ErrLastShard
+	}
+	if router.migration != nil {
+		return MigrationStatus{}, ErrMigrationInProgress
+	}
+
+	return router.startMigration("remove", shard, router.ring.without(shard)), nil
+}
+
+// Switches to the new ring and starts moving the keys. It is called with router.mu held.
+func (router *Router) startMigration(kind, shard string, ring *Ring) MigrationStatus {
+	router.previous, router.ring = router.ring, ring
+	router.migration = &MigrationStatus{Kind: kind, Shard: shard, StartedAt: time.Now()}
+	router.moved.Store(0)
+
+	router.running.Add(1)
+	go router.migrate()
+
+	return *router.migration
+}
+
+// Moves the keys whose owner changed, retrying until it succeeds, then drops the previous ring.
+func (router *Router) migrate() {
+	defer router.running.Done()
+
+	// Only the keys of a removed shard change of owner, while an added shard takes keys from all the others
+	router.mu.RLock()
+	shards := router.previous.shards
+	if router.migration.Kind == "remove" {
+		shards = []string{router.migration.Shard}
+	}
+	router.mu.RUnlock()
+
+	for _, shard := range shards {
+		for {
+			err := router.migrateShard(router.shards[shard])
+			if err == nil {
+				break
+			}
+			if router.ctx.Err() != nil {
+				return
+			}
+
+			log.Println("The migration of the keys of", shard, "failed, retrying:", err)
+			router.mu.Lock()
+			router.migration.LastError = err.Error()
+			router.mu.Unlock()
+
+			select {
+			case <-router.ctx.Done():
+				return
+			case <-time.After(migrationRetryInterval):
+			}
+		}
+	}
+
+	router.mu.Lock()
+	defer router.mu.Unlock()
+
+	log.Printf("The migration (%s %s) is over, %d keys were moved", router.migration.Kind, router.migration.Shard, router.moved.Load())
+	if router.migration.Kind == "remove" {
+		delete(router.shards, router.migration.Shard)
+	}
+	router.previous = nil
+	router.migration = nil
+}
+
+// Scans the keys of the shard and moves those it doesn't own anymore.
+func (router *Router) migrateShard(shard *shardClient) error {
+	var start []byte
+	for {
+		if err := router.ctx.Err(); err != nil {
+			return err
+		}
+
+		page, err := shard.scan(start, migrationPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range page.Items {
+			router.mu.RLock()
+			moved, err := router.moveKey(item.Key, shard)
+			router.mu.RUnlock()
+			if moved {
+				router.moved.Add(1)
+			}
+
+			if err != nil {
+				return err
+			}
+		}
+
+		if page.Next == nil {
+			return nil
+		}
+		start = page.Next
+	}
+}
+
+// Moves the key from the shard to its owner if it is another one, and tells if it was moved. It is called with
+// router.mu held for reading.
+func (router *Router) moveKey(key []byte, from *shardClient) (bool, error) {
+	to := router.shards[router.ring.owner(key)]
+	if to == from {
+		return false, nil
+	}
+
+	stripe := router.stripe(key)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	// The key may have been written or deleted since it was scanned
+	v, err := from.get(key)
+	if err == ErrKeyNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := to.put(key, v); err != nil {
+		return false, err
+	}
+	if err := from.del(key); err != nil && err != ErrKeyNotFound {
+		return false, err
+	}
+	return true, nil
+}
+
+// The layout of the ring, as returned by /cluster/ring.
+type RingStatus struct {
+	VirtualNodes int              `json:"virtualNodes"`
+	Shards       []ShardStatus    `json:"shards"`
+	Points       []RingPoint      `json:"points"`
+	Migration    *MigrationStatus `json:"migration,omitempty"`
+}
+
+type ShardStatus struct {
+	URL   string  `json:"url"`
+	Share float64 `json:"share"`
+}
+
+func (router *Router) Status() RingStatus {
+	router.mu.RLock()
+	defer router.mu.RUnlock()
+
+	status := RingStatus{
+		VirtualNodes: router.ring.vnodes,
+		Shards:       []ShardStatus{},
+		Points:       router.ring.points,
+	}
+	shares := router.ring.shares()
+	for _, shard := range router.ring.shards {
+		status.Shards = append(status.Shards, ShardStatus{URL: shard, Share: shares[shard]})
+	}
+	if router.migration != nil {
+		migration := *router.migration
+		migration.Moved = router.moved.Load()
+		status.Migration = &migration
+	}
+	return status
+}
+
+// Returns the URL of a shard without its trailing slash.
+func normalizeShardURL(shard string) string {
+	return strings.TrimSuffix(strings.TrimSpace(shard), "/")
+}
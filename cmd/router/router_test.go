@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A backend server keeping its keys in memory, with the v2 API of the servers used by the router.
+type testShard struct {
+	mu     sync.Mutex
+	keys   map[string]string
+	server *httptest.Server
+}
+
+func startTestShard(t *testing.T) *testShard {
+	shard := &testShard{keys: map[string]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/keys/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v2/keys/")
+
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		v, found := shard.keys[key]
+		switch {
+		case r.Method == "PUT":
+			body, _ := io.ReadAll(r.Body)
+			shard.keys[key] = string(body)
+			w.WriteHeader(http.StatusNoContent)
+		case !found:
+			http.Error(w, "Key not found", http.StatusNotFound)
+		case r.Method == "GET":
+			io.WriteString(w, v)
+		case r.Method == "DELETE":
+			delete(shard.keys, key)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/v2/keys", func(w http.ResponseWriter, r *http.Request) {
+		start, _ := base64.StdEncoding.DecodeString(r.URL.Query().Get("start"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+
+		var keys []string
+		for key := range shard.keys {
+			if key >= string(start) {
+				keys = append(keys, key)
+			}
+		}
+		slices.Sort(keys)
+
+		type item struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		}
+		response := struct {
+			Items []item `json:"items"`
+			Next  []byte `json:"next,omitempty"`
+		}{Items: []item{}}
+		for i, key := range keys {
+			if i == limit {
+				response.Next = []byte(key)
+				break
+			}
+			response.Items = append(response.Items, item{Key: []byte(key), Value: []byte(shard.keys[key])})
+		}
+		json.NewEncoder(w).Encode(response)
+	})
+
+	shard.server = httptest.NewServer(mux)
+	t.Cleanup(shard.server.Close)
+	return shard
+}
+
+func (shard *testShard) count() int {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return len(shard.keys)
+}
+
+// Waits for the ongoing migration of the router to be over.
+func waitForMigration(t *testing.T, router *Router) {
+	deadline := time.Now().Add(5 * time.Second)
+	for router.Status().Migration != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the migration to be over, got %+v", router.Status().Migration)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	pageSize := migrationPageSize
+	migrationPageSize = 7
+	defer func() { migrationPageSize = pageSize }()
+
+	shard1, shard2, shard3 := startTestShard(t), startTestShard(t), startTestShard(t)
+
+	router := newRouter([]string{shard1.server.URL, shard2.server.URL}, 64, "")
+	defer router.Close()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/get", getHandler(router))
+	mux.HandleFunc("/set", setHandler(router))
+	mux.HandleFunc("/del", delHandler(router))
+	mux.HandleFunc("/cluster/ring", ringHandler(router))
+	mux.HandleFunc("/cluster/shards", shardsHandler(router))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	do := func(method, path, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	// The keys are spread over the shards
+	for i := 0; i < 100; i++ {
+		if _, body := do("POST", "/set", fmt.Sprintf(`{"key": "key%d", "value": "value%d"}`, i, i)); body != "OK" {
+			t.Fatalf("Expected OK, got %s", body)
+		}
+	}
+	if shard1.count()+shard2.count() != 100 || shard1.count() == 0 || shard2.count() == 0 {
+		t.Errorf("Expected the keys to be spread, got %d and %d", shard1.count(), shard2.count())
+	}
+
+	if _, body := do("GET", "/get?key=key42", ""); body != "value42" {
+		t.Errorf("Expected value42, got %s", body)
+	}
+	if _, body := do("DELETE", "/del?key=key42", ""); body != "value42" {
+		t.Errorf("Expected value42, got %s", body)
+	}
+	if _, body := do("GET", "/get?key=key42", ""); body != "Key not found" {
+		t.Errorf("Expected Key not found, got %s", body)
+	}
+
+	// The keys written during the migration end up on their new owner
+	if status, body := do("POST", "/cluster/shards?url="+shard3.server.URL, ""); status != http.StatusAccepted {
+		t.Fatalf("Expected status 202, got %d (%s)", status, body)
+	}
+	for i := 100; i < 120; i++ {
+		if err := router.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForMigration(t, router)
+
+	if shard3.count() == 0 || shard1.count()+shard2.count()+shard3.count() != 119 {
+		t.Errorf("Expected some keys to move to the new shard, got %d, %d and %d", shard1.count(), shard2.count(), shard3.count())
+	}
+	for i := 0; i < 120; i++ {
+		v, err := router.Get([]byte(fmt.Sprint("key", i)))
+		if i == 42 {
+			if err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound, got %v", err)
+			}
+		} else if string(v) != fmt.Sprint("value", i) {
+			t.Errorf("Expected value%d, got %q (%v)", i, v, err)
+		}
+	}
+
+	// The ring is exposed
+	_, body := do("GET", "/cluster/ring", "")
+	var ring RingStatus
+	if err := json.Unmarshal([]byte(body), &ring); err != nil {
+		t.Fatal(err)
+	}
+	if len(ring.Shards) != 3 || len(ring.Points) != 3*64 || ring.Migration != nil {
+		t.Errorf("Unexpected ring %+v", ring)
+	}
+
+	// The keys of a removed shard are moved to the others
+	if _, err := router.RemoveShard(shard1.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := router.AddShard(shard1.server.URL); err != ErrMigrationInProgress {
+		t.Errorf("Expected ErrMigrationInProgress, got %v", err)
+	}
+	waitForMigration(t, router)
+
+	if shard1.count() != 0 || shard2.count()+shard3.count() != 119 {
+		t.Errorf("Expected the keys to leave the removed shard, got %d, %d and %d", shard1.count(), shard2.count(), shard3.count())
+	}
+	if v, _ := router.Get([]byte("key7")); string(v) != "value7" {
+		t.Errorf("Expected value7, got %q", v)
+	}
+
+	if status, _ := do("DELETE", "/cluster/shards?url="+shard1.server.URL, ""); status != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", status)
+	}
+	if _, err := router.RemoveShard(shard2.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	waitForMigration(t, router)
+	if _, err := router.RemoveShard(shard3.server.URL); err != ErrLastShard {
+		t.Errorf("Expected ErrLastShard, got %v", err)
+	}
+}
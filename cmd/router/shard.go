@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+var (
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// A page of the keys of a shard, as returned by its /v2/keys resource.
+type scanPage struct {
+	Items []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"items"`
+	Next []byte `json:"next"`
+}
+
+// The client of a backend server, using its v2 API.
+type shardClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (shard *shardClient) keyURL(key []byte) string {
+	return shard.url + "/v2/keys/" + url.PathEscape(string(key))
+}
+
+// Sends a request and returns the response if its status is one of the expected ones.
+func (shard *shardClient) do(method, target string, body io.Reader, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if shard.token != "" {
+		req.Header.Set("Authorization", "Bearer "+shard.token)
+	}
+	resp, err := shard.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			return resp, nil
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrKeyNotFound
+	}
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s %s: %s: %s", method, shard.url, resp.Status, bytes.TrimSpace(message))
+}
+
+func (shard *shardClient) get(key []byte) ([]byte, error) {
+	resp, err := shard.do("GET", shard.keyURL(key), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+func (shard *shardClient) put(key, value []byte) error {
+	resp, err := shard.do("PUT", shard.keyURL(key), bytes.NewReader(value), http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (shard *shardClient) del(key []byte) error {
+	resp, err := shard.do("DELETE", shard.keyURL(key), nil, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// Returns at most limit keys from start (included) with their values, along with the start of the next page (nil once
+// the end is reached).
+func (shard *shardClient) scan(start []byte, limit int) (*scanPage, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if start != nil {
+		query.Set("start", base64.StdEncoding.EncodeToString(start))
+	}
+
+	resp, err := shard.do("GET", shard.url+"/v2/keys?"+query.Encode(), nil, http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var page scanPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
@@ -0,0 +1,555 @@
+package lsmdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"sort"
+)
+
+var (
+	ErrColumnFamilyNotFound    = errors.New("column family not found")
+	ErrColumnFamilyExists      = errors.New("column family already exists")
+	ErrInvalidColumnFamilyName = errors.New("column family names must only contain letters, digits, '_' and '-'")
+	ErrColumnFamiliesDisabled  = errors.New("column families are not enabled (no manifest file)")
+	ErrNotDefaultColumnFamily  = errors.New("column families can only be managed from the default column family")
+)
+
+const defaultColumnFamilyName = "default"
+
+var validColumnFamilyName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// The options a column family is created with.
+type ColumnFamilyOptions struct {
+	// The maximum number of bytes the memTable of the column family can hold before it is flushed to the disk
+	MemSizeThreshold int
+
+	// The name of the registered merge operator, empty if merges are not supported
+	MergeOperator string
+}
+
+// The options are encoded this way in the manifest: [MemSizeThreshold(4 bytes)][MergeOperator]
+func (opts ColumnFamilyOptions) encode() []byte {
+	encoded := encode4BytesInt(opts.MemSizeThreshold)
+	return append(encoded, opts.MergeOperator...)
+}
+
+func decodeColumnFamilyOptions(encoded []byte) (ColumnFamilyOptions, error) {
+	if len(encoded) < 4 {
+		return ColumnFamilyOptions{}, ErrCorruptedFile
+	}
+
+	opts := ColumnFamilyOptions{
+		MemSizeThreshold: decode4BytesInt(encoded[:4]),
+		MergeOperator:    string(encoded[4:]),
+	}
+	return opts, nil
+}
+
+// Returns the database owning the column family (the default column family).
+func (lsmdb *DB) rootDB() *DB {
+	if lsmdb.root != nil {
+		return lsmdb.root
+	}
+	return lsmdb
+}
+
+// Returns the default column family followed by the other ones, sorted by name.
+func (lsmdb *DB) allFamilies() []*DB {
+	root := lsmdb.rootDB()
+
+	families := []*DB{root}
+	for _, name := range root.columnFamilyNames()[1:] {
+		families = append(families, root.families[name])
+	}
+
+	return families
+}
+
+// Returns the names of all the column families, starting with the default one.
+func (lsmdb *DB) ColumnFamilyNames() []string {
+	defer lsmdb.lock()()
+	return lsmdb.columnFamilyNames()
+}
+
+func (lsmdb *DB) columnFamilyNames() []string {
+	root := lsmdb.rootDB()
+
+	names := make([]string, 0, len(root.families))
+	for name := range root.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return append([]string{defaultColumnFamilyName}, names...)
+}
+
+// Returns the column family with the given name. The default column family is the database itself.
+func (lsmdb *DB) ColumnFamily(name string) (*DB, error) {
+	defer lsmdb.lock()()
+	return lsmdb.columnFamily(name)
+}
+
+func (lsmdb *DB) columnFamily(name string) (*DB, error) {
+	root := lsmdb.rootDB()
+
+	if name == "" || name == defaultColumnFamilyName {
+		return root, nil
+	}
+
+	family, ok := root.families[name]
+	if !ok {
+		return nil, ErrColumnFamilyNotFound
+	}
+	return family, nil
+}
+
+// Returns the size in bytes of the memTable after which it is flushed, the default of the column families created
+// without their own.
+func (lsmdb *DB) MemSizeThreshold() int {
+	return lsmdb.memSizeThreshold
+}
+
+// Returns a column family sharing the WAL of the database, with its files under the families path.
+func (lsmdb *DB) newColumnFamily(name string, opts ColumnFamilyOptions) *DB {
+	familyPath := lsmdb.familiesPath + name + "/"
+
+	valueLogPath := ""
+	if lsmdb.valueLogPath != "" {
+		valueLogPath = familyPath + "vlog/"
+	}
+
+	memTable := newMemTable()
+	return &DB{
+		memTable:         &memTable,
+		wal:              lsmdb.wal,
+		magicNumber:      lsmdb.magicNumber,
+		version:          lsmdb.version,
+		metadataFileName: familyPath + "metadata.meta",
+		memSizeThreshold: opts.MemSizeThreshold,
+		fileNumThreshold: lsmdb.fileNumThreshold,
+		sstPath:          familyPath + "sst/",
+		sstFilesNum:      0,
+		mergeOperator:    lookupMergeOperator(opts.MergeOperator),
+		familyName:       name,
+		root:             lsmdb,
+
+		valueLogPath:        valueLogPath,
+		valueThreshold:      lsmdb.valueThreshold,
+		valueLogSegmentSize: lsmdb.valueLogSegmentSize,
+	}
+}
+
+// Reads the manifest and opens the column families that were created and not dropped.
+// The manifest is a list of encoded entries: a set entry records the creation of a column family
+// (the value holds its options), and a del entry records its deletion.
+func (lsmdb *DB) loadManifest() error {
+	lsmdb.families = make(map[string]*DB)
+
+	if lsmdb.manifestFileName == "" {
+		return nil
+	}
+
+	content, err := os.ReadFile(lsmdb.manifestFileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	created := make(map[string]ColumnFamilyOptions)
+	for len(content) > 0 {
+		entry, rest, err := decodeEntryBytes(content)
+		if err != nil {
+			return err
+		}
+		content = rest
+
+		switch entry.op {
+		case SetOp:
+			opts, err := decodeColumnFamilyOptions(entry.value)
+			if err != nil {
+				return err
+			}
+			created[string(entry.key)] = opts
+		case DelOp:
+			delete(created, string(entry.key))
+		}
+	}
+
+	for name, opts := range created {
+		family := lsmdb.newColumnFamily(name, opts)
+		if err := family.openFiles(); err != nil {
+			return err
+		}
+		lsmdb.families[name] = family
+	}
+
+	return nil
+}
+
+// Writes entry to the end of the manifest.
+func (lsmdb *DB) appendManifest(entry Entry) error {
+	file, err := os.OpenFile(lsmdb.manifestFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(entry.encode()); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func (lsmdb *DB) CreateColumnFamily(name string, opts ColumnFamilyOptions) error {
+	defer lsmdb.lock()()
+
+	if lsmdb.root != nil {
+		return ErrNotDefaultColumnFamily
+	}
+
+	if lsmdb.readOnly {
+		return ErrReadOnly
+	}
+
+	return lsmdb.createColumnFamily(name, opts)
+}
+
+// Creates a column family. It must be called with the database locked, on the default column family.
+func (lsmdb *DB) createColumnFamily(name string, opts ColumnFamilyOptions) error {
+	if lsmdb.manifestFileName == "" {
+		return ErrColumnFamiliesDisabled
+	}
+
+	if name == defaultColumnFamilyName || !validColumnFamilyName.MatchString(name) {
+		return ErrInvalidColumnFamilyName
+	}
+
+	if _, ok := lsmdb.families[name]; ok {
+		return ErrColumnFamilyExists
+	}
+
+	if opts.MergeOperator != "" && lookupMergeOperator(opts.MergeOperator) == nil {
+		return ErrNoMergeOperator
+	}
+
+	family := lsmdb.newColumnFamily(name, opts)
+	if err := family.openFiles(); err != nil {
+		return err
+	}
+
+	entry := Entry{
+		op:    SetOp,
+		key:   []byte(name),
+		value: opts.encode(),
+	}
+	if err := lsmdb.appendManifest(entry); err != nil {
+		return err
+	}
+
+	lsmdb.families[name] = family
+	return nil
+}
+
+func (lsmdb *DB) DropColumnFamily(name string) error {
+	defer lsmdb.lock()()
+
+	if lsmdb.root != nil {
+		return ErrNotDefaultColumnFamily
+	}
+
+	if lsmdb.readOnly {
+		return ErrReadOnly
+	}
+
+	family, ok := lsmdb.families[name]
+	if !ok {
+		return ErrColumnFamilyNotFound
+	}
+
+	delete(lsmdb.families, name)
+
+	// Flushing the other column families clears the WAL, so the records of the dropped
+	// column family can't be replayed into a new column family with the same name
+	if err := lsmdb.flushToDisk(); err != nil {
+		return err
+	}
+
+	entry := Entry{
+		op:  DelOp,
+		key: []byte(name),
+	}
+	if err := lsmdb.appendManifest(entry); err != nil {
+		return err
+	}
+
+	if family.valueLog != nil {
+		if err := family.valueLog.Close(); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(family.familyDir())
+}
+
+// Returns the directory holding the files of a column family.
+func (lsmdb *DB) familyDir() string {
+	return lsmdb.rootDB().familiesPath + lsmdb.familyName + "/"
+}
+
+// Writes entry to the WAL. The entries of the column families other than the default one are
+// written as a batch of one entry, so they carry the name of their column family.
+func (lsmdb *DB) logEntry(entry Entry) error {
+	if lsmdb.rootDB().readOnly {
+		return ErrReadOnly
+	}
+
+	if lsmdb.root == nil {
+		return lsmdb.appendRecord(entry)
+	}
+
+	batch := WriteBatch{}
+	batch.add(lsmdb.familyName, entry)
+
+	return lsmdb.appendRecord(Entry{op: BatchOp, value: batch.Encode()})
+}
+
+// A batch of operations on one or more column families, written atomically with DB.Write.
+type WriteBatch struct {
+	families []string
+	entries  []Entry
+}
+
+func (batch *WriteBatch) add(family string, entry Entry) {
+	batch.families = append(batch.families, family)
+	batch.entries = append(batch.entries, entry)
+}
+
+func (batch *WriteBatch) Put(family string, key, value []byte) {
+	batch.add(family, Entry{op: SetOp, key: key, value: value})
+}
+
+func (batch *WriteBatch) Delete(family string, key []byte) {
+	batch.add(family, Entry{op: DelOp, key: key})
+}
+
+func (batch *WriteBatch) Merge(family string, key, operand []byte) {
+	batch.add(family, Entry{op: MergeOp, key: key, value: encodeOperands([][]byte{operand})})
+}
+
+func (batch *WriteBatch) Len() int {
+	return len(batch.entries)
+}
+
+// A batch is encoded as a list of: [family name length(4 bytes)][family name][encoded entry]
+func (batch *WriteBatch) Encode() []byte {
+	encoded := make([]byte, 0)
+	for i, entry := range batch.entries {
+		encoded = append(encoded, encode4BytesInt(len(batch.families[i]))...)
+		encoded = append(encoded, batch.families[i]...)
+		encoded = append(encoded, entry.encode()...)
+	}
+
+	return encoded
+}
+
+func decodeWriteBatch(encoded []byte) (*WriteBatch, error) {
+	batch := &WriteBatch{}
+	for len(encoded) > 0 {
+		if len(encoded) < 4 {
+			return nil, ErrCorruptedFile
+		}
+		nameLen := decode4BytesInt(encoded[:4])
+		encoded = encoded[4:]
+
+		if len(encoded) < nameLen {
+			return nil, ErrCorruptedFile
+		}
+		family := string(encoded[:nameLen])
+		encoded = encoded[nameLen:]
+
+		entry, rest, err := decodeEntryBytes(encoded)
+		if err != nil {
+			return nil, err
+		}
+		encoded = rest
+
+		batch.add(family, entry)
+	}
+
+	return batch, nil
+}
+
+// Applies all the operations of the batch, or none of them if one can't be applied.
+// The batch is written as one WAL record, so a crash can't leave half of it in the database.
+func (lsmdb *DB) Write(batch *WriteBatch) error {
+	return lsmdb.WriteContext(context.Background(), batch)
+}
+
+// Like Write, but gives up with the error of ctx if it is done before the batch is written.
+func (lsmdb *DB) WriteContext(ctx context.Context, batch *WriteBatch) error {
+	unlock, err := lsmdb.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	root := lsmdb.rootDB()
+	if root.readOnly {
+		return ErrReadOnly
+	}
+
+	families, err := root.resolveBatch(batch)
+	if err != nil {
+		return err
+	}
+
+	return root.commitBatch(batch, families)
+}
+
+// A key of a column family written by a batch
+type batchKey struct {
+	family *DB
+	key    string
+}
+
+// Returns the column families of the operations of the batch, and checks that its merges can be applied to the values
+// of their keys, as left by the previous operations of the batch.
+// It must be called with the database locked, on the default column family.
+func (lsmdb *DB) resolveBatch(batch *WriteBatch) ([]*DB, error) {
+	families := make([]*DB, batch.Len())
+
+	// The values written by the batch, by column family and key (nil for the deleted keys)
+	written := make(map[batchKey][]byte)
+
+	for i, entry := range batch.entries {
+		family, err := lsmdb.columnFamily(batch.families[i])
+		if err != nil {
+			return nil, err
+		}
+		families[i] = family
+		id := batchKey{family, string(entry.key)}
+
+		switch entry.op {
+		case SetOp:
+			written[id] = entry.value
+		case DelOp:
+			written[id] = nil
+		case MergeOp:
+			if family.mergeOperator == nil {
+				return nil, ErrNoMergeOperator
+			}
+
+			operands, err := decodeOperands(entry.value)
+			if err != nil {
+				return nil, err
+			}
+
+			base, ok := written[id]
+			if !ok {
+				if err := family.checkOperands(entry.key, operands); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			merged, err := family.mergeOperator.FullMerge(entry.key, base, operands)
+			if err != nil {
+				return nil, err
+			}
+			written[id] = merged
+		}
+	}
+
+	return families, nil
+}
+
+// Writes the batch to the WAL as one record and applies it to the memTables of the column families.
+// It must be called with the database locked, on the default column family.
+func (lsmdb *DB) commitBatch(batch *WriteBatch, families []*DB) error {
+	// The big values are written to the value logs, the batch written to the WAL holds pointers to them
+	logged := WriteBatch{}
+
+	// The values of the keys in the memTables, as the entries before are applied to them
+	states := make(map[batchKey][]byte)
+
+	for i, entry := range batch.entries {
+		id := batchKey{families[i], string(entry.key)}
+		state, ok := states[id]
+		if !ok {
+			state, _ = families[i].memTable.sortedMap.Get(id.key)
+		}
+
+		var err error
+		switch entry.op {
+		case SetOp:
+			entry, err = families[i].makeSetEntry(entry.key, entry.value)
+		case MergeOp:
+			entry, err = families[i].mergeEntry(entry.key, entry.value, state)
+		}
+		if err != nil {
+			return err
+		}
+
+		states[id] = append([]byte{byte(entry.op)}, entry.value...)
+		logged.add(batch.families[i], entry)
+	}
+
+	if err := lsmdb.appendRecord(Entry{op: BatchOp, value: logged.Encode()}); err != nil {
+		return err
+	}
+
+	for i, entry := range logged.entries {
+		if err := families[i].applyToMemTable(entry.op, entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+
+	for _, family := range families {
+		if family.memTable.sizeInBytes() >= family.memSizeThreshold {
+			return lsmdb.flushToDisk()
+		}
+	}
+
+	return nil
+}
+
+// Applies a batch record read from the WAL to the memTables of its column families. The column families whose sst
+// files already hold the changes of the record, replayed with the sequence number replayedSeq, skip it.
+func (lsmdb *DB) applyBatchRecord(encoded []byte, replayedSeq uint64) error {
+	batch, err := decodeWriteBatch(encoded)
+
+	// A batch that was not completely written when the database stopped is not applied at all
+	if err == ErrCorruptedFile {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range batch.entries {
+		family, err := lsmdb.columnFamily(batch.families[i])
+
+		// The records of dropped column families are ignored
+		if err == ErrColumnFamilyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if replayedSeq <= family.flushedSeq {
+			continue
+		}
+
+		if err := family.applyToMemTable(entry.op, entry.key, entry.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
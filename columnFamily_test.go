@@ -0,0 +1,152 @@
+package lsmdb
+
+import (
+	"os"
+	"testing"
+)
+
+// Simulates a restart: the memTables are dropped and the database is opened again from its files.
+func reopenTestLSMDB(t *testing.T, lsmdb *DB) {
+	memTable := newMemTable()
+	lsmdb.memTable = &memTable
+	lsmdb.sstFilesNum = 0
+
+	if err := lsmdb.open(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestColumnFamilies(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	if err := lsmdb.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != ErrColumnFamilyExists {
+		t.Errorf("Expected ErrColumnFamilyExists, got %v", err)
+	}
+	if err := lsmdb.CreateColumnFamily("bad/name", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != ErrInvalidColumnFamilyName {
+		t.Errorf("Expected ErrInvalidColumnFamilyName, got %v", err)
+	}
+
+	users, err := lsmdb.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key lives in both keyspaces
+	lsmdb.Put([]byte("key"), []byte("default value"))
+	users.Put([]byte("key"), []byte("users value"))
+
+	if v, err := lsmdb.Get([]byte("key")); err != nil || string(v) != "default value" {
+		t.Errorf("Expected default value, got %s (%v)", v, err)
+	}
+	if v, err := users.Get([]byte("key")); err != nil || string(v) != "users value" {
+		t.Errorf("Expected users value, got %s (%v)", v, err)
+	}
+
+	// Both column families are restored from the shared WAL
+	reopenTestLSMDB(t, lsmdb)
+
+	users, err = lsmdb.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err := users.Get([]byte("key")); err != nil || string(v) != "users value" {
+		t.Errorf("Expected users value, got %s (%v)", v, err)
+	}
+	if v, err := lsmdb.Get([]byte("key")); err != nil || string(v) != "default value" {
+		t.Errorf("Expected default value, got %s (%v)", v, err)
+	}
+
+	// And from their sst files
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	reopenTestLSMDB(t, lsmdb)
+
+	users, _ = lsmdb.ColumnFamily("users")
+	if v, err := users.Get([]byte("key")); err != nil || string(v) != "users value" {
+		t.Errorf("Expected users value, got %s (%v)", v, err)
+	}
+
+	if err := lsmdb.DropColumnFamily("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(users.familyDir()); !os.IsNotExist(err) {
+		t.Errorf("Expected the directory of the dropped column family to be removed, got %v", err)
+	}
+
+	reopenTestLSMDB(t, lsmdb)
+	if _, err := lsmdb.ColumnFamily("users"); err != ErrColumnFamilyNotFound {
+		t.Errorf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+}
+
+func TestWriteBatchAcrossColumnFamilies(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	if err := lsmdb.CreateColumnFamily("counters", ColumnFamilyOptions{MemSizeThreshold: 1000, MergeOperator: "int64add"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmdb.Put([]byte("old"), []byte("value"))
+
+	batch := WriteBatch{}
+	batch.Put("default", []byte("new"), []byte("value"))
+	batch.Delete("default", []byte("old"))
+	batch.Merge("counters", []byte("total"), []byte("5"))
+	if err := lsmdb.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// A batch with an unknown column family is rejected as a whole
+	failing := WriteBatch{}
+	failing.Put("default", []byte("other"), []byte("value"))
+	failing.Put("missing", []byte("other"), []byte("value"))
+	if err := lsmdb.Write(&failing); err != ErrColumnFamilyNotFound {
+		t.Errorf("Expected ErrColumnFamilyNotFound, got %v", err)
+	}
+
+	reopenTestLSMDB(t, lsmdb)
+
+	counters, _ := lsmdb.ColumnFamily("counters")
+	if v, err := counters.Get([]byte("total")); err != nil || string(v) != "5" {
+		t.Errorf("Expected 5, got %s (%v)", v, err)
+	}
+	if v, err := lsmdb.Get([]byte("new")); err != nil || string(v) != "value" {
+		t.Errorf("Expected value, got %s (%v)", v, err)
+	}
+	if _, err := lsmdb.Get([]byte("old")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if _, err := lsmdb.Get([]byte("other")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestTornBatchIsNotApplied(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	batch := WriteBatch{}
+	batch.Put("default", []byte("key1"), []byte("value1"))
+	batch.Put("default", []byte("key2"), []byte("value2"))
+	if err := lsmdb.Write(&batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cutting the last bytes of the batch record, like a crash in the middle of the write would
+	info, err := lsmdb.wal.logFile.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.wal.logFile.Truncate(info.Size() - 3); err != nil {
+		t.Fatal(err)
+	}
+
+	reopenTestLSMDB(t, lsmdb)
+
+	if _, err := lsmdb.Get([]byte("key1")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,544 @@
+package lsmdb
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The outcome of a compaction
+type CompactionResult struct {
+	Family string `json:"family"`
+
+	// The number of sst files compacted into one, and their size
+	InputFiles int   `json:"inputFiles"`
+	InputBytes int64 `json:"inputBytes"`
+
+	// The size of the sst file written, 0 if no entry is left
+	OutputBytes int64 `json:"outputBytes"`
+
+	// The number of entries dropped: the older entries of the keys, the tombstones and the expired entries
+	DroppedEntries int `json:"droppedEntries"`
+}
+
+// An sst file read entry by entry during a compaction
+type compactionInput struct {
+	file  *os.File
+	r     *bufio.Reader
+	entry Entry
+	done  bool
+}
+
+// Reads the next entry of the file.
+func (input *compactionInput) next() error {
+	op, key, value, err := decodeNext(input.r)
+	if err == io.EOF {
+		input.done = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	input.entry = Entry{op: OperationType(op), key: key, value: value}
+	return nil
+}
+
+// Compacts the sst files of the column family whose key range intersects the range start <= k < end (nil bounds are
+// unbounded), along with the sst files written between them, into one sst file holding the latest entry of each key.
+// The files in between are compacted too so the newer entries still hide the older ones.
+// If the oldest sst file is compacted, the tombstones and the expired entries are dropped, as there is no older entry
+// left for them to hide. The merge operands are folded into their base value when it is compacted with them.
+func (lsmdb *DB) CompactRange(start, end []byte) (*CompactionResult, error) {
+	unlock, err := lsmdb.lockContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return lsmdb.compactRange(start, end)
+}
+
+func (lsmdb *DB) compactRange(start, end []byte) (*CompactionResult, error) {
+	manifest, result, err := lsmdb.writeCompaction(start, end)
+	if err != nil || manifest == nil {
+		return result, err
+	}
+
+	if err := lsmdb.installCompaction(*manifest); err != nil {
+		return nil, err
+	}
+
+	metrics := &lsmdb.rootDB().metrics
+	metrics.compactions.Add(1)
+	metrics.compactionInputBytes.Add(result.InputBytes)
+	metrics.compactionOutputBytes.Add(result.OutputBytes)
+
+	return result, nil
+}
+
+// Writes the result of the compaction of the range to a new file, and saves the compaction to its manifest, without
+// changing the sst files yet. Returns a nil manifest if no sst file intersects the range.
+func (lsmdb *DB) writeCompaction(start, end []byte) (*compactionManifest, *CompactionResult, error) {
+	result := &CompactionResult{Family: cmp.Or(lsmdb.familyName, defaultColumnFamilyName)}
+
+	// Finding the oldest and the newest sst files intersecting the range
+	first, last := 0, 0
+	for i := 1; i <= lsmdb.sstFilesNum; i++ {
+		smallestKey, largestKey, err := lsmdb.readSSTKeyRange(i)
+		if err != nil {
+			return nil, nil, err
+		}
+		if (end != nil && bytes.Compare(smallestKey, end) >= 0) || (start != nil && bytes.Compare(largestKey, start) < 0) {
+			continue
+		}
+		if first == 0 {
+			first = i
+		}
+		last = i
+	}
+	if first == 0 {
+		return nil, result, nil
+	}
+
+	// The inputs are ordered from the newest to the oldest
+	var inputs []*compactionInput
+	defer func() {
+		for _, input := range inputs {
+			input.file.Close()
+		}
+	}()
+	for i := last; i >= first; i-- {
+		file, err := os.Open(lsmdb.sstFilePath(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		input := &compactionInput{file: file}
+		inputs = append(inputs, input)
+
+		info, err := file.Stat()
+		if err != nil {
+			return nil, nil, err
+		}
+		result.InputFiles++
+		result.InputBytes += info.Size()
+
+		// The entries follow the header
+		if _, _, _, _, _, err := readHeader(file); err != nil {
+			return nil, nil, err
+		}
+		input.r = bufio.NewReader(file)
+		if err := input.next(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The entries are written after the header, which is only known at the end
+	body, err := os.CreateTemp(lsmdb.sstPath, "compaction-*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.Remove(body.Name())
+	defer body.Close()
+
+	w := bufio.NewWriter(body)
+	var count, read int
+	var smallestKey, largestKey []byte
+	for {
+		// Taking the entries of the smallest key left, from the newest to the oldest
+		var key []byte
+		for _, input := range inputs {
+			if !input.done && (key == nil || bytes.Compare(input.entry.key, key) < 0) {
+				key = input.entry.key
+			}
+		}
+		if key == nil {
+			break
+		}
+
+		var entries []Entry
+		for _, input := range inputs {
+			if !input.done && bytes.Equal(input.entry.key, key) {
+				entries = append(entries, input.entry)
+				if err := input.next(); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		read += len(entries)
+
+		entry, keep, err := lsmdb.compactEntries(key, entries, first == 1)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !keep {
+			continue
+		}
+
+		if _, err := w.Write(entry.encode()); err != nil {
+			return nil, nil, err
+		}
+		if count == 0 {
+			smallestKey = key
+		}
+		largestKey = key
+		count++
+	}
+	if err := w.Flush(); err != nil {
+		return nil, nil, err
+	}
+	result.DroppedEntries = read - count
+
+	manifest := &compactionManifest{First: first, Last: last, FilesNum: lsmdb.sstFilesNum}
+	if count > 0 {
+		size, sha, err := lsmdb.writeCompactionOutput(body, count, smallestKey, largestKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		result.OutputBytes = size
+		manifest.OutputSHA = sha
+	}
+
+	// Nothing is removed before the compaction is saved, so it is completed if the database stops in the middle
+	if err := lsmdb.saveCompactionManifest(*manifest); err != nil {
+		return nil, nil, err
+	}
+
+	return manifest, result, nil
+}
+
+// Returns the entry kept for the key, given its entries from the newest to the oldest, and false if none is kept.
+// bottom tells if the oldest sst file is compacted, so nothing older than the entries exists.
+func (lsmdb *DB) compactEntries(key []byte, entries []Entry, bottom bool) (Entry, bool, error) {
+	// The merge operands on top of the base value, the older ones first
+	var pending []byte
+	for _, entry := range entries {
+		if entry.op == MergeOp {
+			pending = slices.Concat(entry.value, pending)
+			continue
+		}
+
+		if entry.op == ExpiringSetOp {
+			if expireAt, _ := decodeExpiringValue(entry.value); isExpired(expireAt) {
+				entry = Entry{op: DelOp, key: key}
+			}
+		}
+
+		if pending == nil {
+			return entry, entry.op != DelOp || !bottom, nil
+		}
+
+		// Folding the operands into the base value, like a read does
+		var base []byte
+		switch entry.op {
+		case SetOp:
+			base = entry.value
+		case ExpiringSetOp:
+			_, base = decodeExpiringValue(entry.value)
+		case ValuePointerOp:
+			value, err := lsmdb.readValueLog(entry.value)
+			if err != nil {
+				return Entry{}, false, err
+			}
+			base = value
+		}
+
+		value, err := lsmdb.foldOperands(key, base, pending)
+		if err != nil {
+			return Entry{}, false, err
+		}
+		return Entry{op: SetOp, key: key, value: value}, true, nil
+	}
+
+	// Only merge operands were found, the base value can be in an older sst file
+	if !bottom {
+		return Entry{op: MergeOp, key: key, value: pending}, true, nil
+	}
+
+	value, err := lsmdb.foldOperands(key, nil, pending)
+	if err != nil {
+		return Entry{}, false, err
+	}
+	return Entry{op: SetOp, key: key, value: value}, true, nil
+}
+
+// Writes the result of a compaction, its header followed by the entries written to body, to the output file of the
+// compaction. Returns its size and its checksum.
+func (lsmdb *DB) writeCompactionOutput(body *os.File, count int, smallestKey, largestKey []byte) (int64, string, error) {
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+
+	file, err := os.OpenFile(lsmdb.compactionOutputPath(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	w := io.MultiWriter(file, hash)
+
+	header := lsmdb.encodeHeader(count, smallestKey, largestKey)
+	if _, err := w.Write(header); err != nil {
+		return 0, "", err
+	}
+	n, err := io.Copy(w, body)
+	if err != nil {
+		return 0, "", err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, "", err
+	}
+
+	return int64(len(header)) + n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// A compaction replacing sst files, saved to the sst directory before any of them is removed. If the database stops
+// before the replacement is done, it is completed when the database is opened again.
+type compactionManifest struct {
+	// The compacted sst files, and the number of sst files before the compaction
+	First    int `json:"first"`
+	Last     int `json:"last"`
+	FilesNum int `json:"filesNum"`
+
+	// The checksum of the output file of the compaction, empty if no entry is left
+	OutputSHA string `json:"outputSHA,omitempty"`
+
+	// Set once the compacted files are removed and the newer ones are moved aside under their new number
+	Installing bool `json:"installing"`
+}
+
+// Returns the number the sst file sstFileNum, newer than the compacted ones, has after the compaction.
+func (manifest compactionManifest) newNumber(sstFileNum int) int {
+	removed := manifest.Last - manifest.First + 1
+	if manifest.OutputSHA != "" {
+		removed--
+	}
+	return sstFileNum - removed
+}
+
+func (lsmdb *DB) compactionManifestPath() string {
+	return lsmdb.sstPath + "compaction.json"
+}
+
+func (lsmdb *DB) compactionOutputPath() string {
+	return lsmdb.sstPath + "compaction.sst"
+}
+
+// Returns the path the sst file taking the number sstFileNum is moved to, while the sst files are renumbered.
+func (lsmdb *DB) renumberedSSTPath(sstFileNum int) string {
+	return fmt.Sprint(lsmdb.sstPath, "r", sstFileNum, ".sst")
+}
+
+func (lsmdb *DB) saveCompactionManifest(manifest compactionManifest) error {
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(lsmdb.compactionManifestPath(), encoded)
+}
+
+// Replaces the compacted sst files with the output of the compaction, and renumbers the newer ones so the numbers stay
+// contiguous. Every step is skipped if it was already done, so it can resume a replacement interrupted by a crash.
+// The newer sst files are moved aside before they take their new number, as it may be the old number of another one.
+func (lsmdb *DB) installCompaction(manifest compactionManifest) error {
+	if !manifest.Installing {
+		for i := manifest.First; i <= manifest.Last; i++ {
+			if err := os.Remove(lsmdb.sstFilePath(i)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := lsmdb.removeSSTChecksum(i); err != nil {
+				return err
+			}
+		}
+
+		for i := manifest.Last + 1; i <= manifest.FilesNum; i++ {
+			from, to := lsmdb.sstFilePath(i), lsmdb.renumberedSSTPath(manifest.newNumber(i))
+			if _, err := os.Stat(from); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.Rename(from+".sha256", to+".sha256"); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Rename(from, to); err != nil {
+				return err
+			}
+		}
+
+		manifest.Installing = true
+		if err := lsmdb.saveCompactionManifest(manifest); err != nil {
+			return err
+		}
+	}
+
+	if manifest.OutputSHA != "" {
+		if err := lsmdb.writeSSTChecksum(manifest.First, manifest.OutputSHA); err != nil {
+			return err
+		}
+		if err := os.Rename(lsmdb.compactionOutputPath(), lsmdb.sstFilePath(manifest.First)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for i := manifest.Last + 1; i <= manifest.FilesNum; i++ {
+		num := manifest.newNumber(i)
+		if err := lsmdb.restoreRenumberedSST(num); err != nil {
+			return err
+		}
+	}
+
+	lsmdb.sstFilesNum = manifest.newNumber(manifest.FilesNum)
+	if err := lsmdb.updateMetadataFile(); err != nil {
+		return err
+	}
+
+	return os.Remove(lsmdb.compactionManifestPath())
+}
+
+// Moves the sst file moved aside under its new number back among the sst files, with its checksum.
+func (lsmdb *DB) restoreRenumberedSST(sstFileNum int) error {
+	path := lsmdb.renumberedSSTPath(sstFileNum)
+
+	if _, err := os.Stat(path); err == nil {
+		sha, err := readChecksumFile(path + ".sha256")
+		if err != nil {
+			return err
+		}
+		if sha != "" {
+			if err := lsmdb.writeSSTChecksum(sstFileNum, sha); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(path, lsmdb.sstFilePath(sstFileNum)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(path + ".sha256"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Completes the compaction the database was doing when it stopped, if any.
+func (lsmdb *DB) recoverCompaction() error {
+	encoded, err := os.ReadFile(lsmdb.compactionManifestPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var manifest compactionManifest
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return ErrCorruptedFile
+	}
+	return lsmdb.installCompaction(manifest)
+}
+
+// Removes the files a crash left in the sst directory: the files of a compaction that wasn't saved yet, and the sst
+// files beyond the number in the metadata file, whose flush didn't complete (their entries are still in the WAL).
+func (lsmdb *DB) removeOrphanSSTFiles() error {
+	files, err := os.ReadDir(lsmdb.sstPath)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		name := file.Name()
+
+		orphan := strings.HasSuffix(name, ".tmp") || name == filepath.Base(lsmdb.compactionOutputPath())
+		if num, ok := strings.CutPrefix(strings.TrimSuffix(name, ".sha256"), "f"); ok {
+			if n, err := strconv.Atoi(strings.TrimSuffix(num, ".sst")); err == nil && n > lsmdb.sstFilesNum {
+				orphan = true
+			}
+		}
+		if strings.HasPrefix(name, "r") && strings.Contains(name, ".sst") {
+			orphan = true
+		}
+
+		if orphan {
+			if err := os.Remove(filepath.Join(lsmdb.sstPath, name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (lsmdb *DB) removeSSTChecksum(sstFileNum int) error {
+	if err := os.Remove(lsmdb.sstChecksumPath(sstFileNum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Returns the smallest and the largest keys of an sst file, read from its header.
+func (lsmdb *DB) readSSTKeyRange(sstFileNum int) ([]byte, []byte, error) {
+	file, err := os.Open(lsmdb.sstFilePath(sstFileNum))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	magicNumber, _, smallestKey, largestKey, version, err := readHeader(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(magicNumber, lsmdb.magicNumber[:]) {
+		return nil, nil, ErrCorruptedFile
+	}
+	if version != lsmdb.version {
+		return nil, nil, ErrOutdatedVersion
+	}
+
+	return smallestKey, largestKey, nil
+}
+
+// This is the request handler compacting the sst files of a column family (/admin/compact)
+// The range is given by the start and end parameters, all the sst files are compacted without them.
+func compactHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		family, err := lsmdb.ColumnFamily(r.URL.Query().Get("family"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		var start, end []byte
+		if r.URL.Query().Has("start") {
+			start = []byte(r.URL.Query().Get("start"))
+		}
+		if r.URL.Query().Has("end") {
+			end = []byte(r.URL.Query().Get("end"))
+		}
+
+		result, err := family.CompactRange(start, end)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,219 @@
+package lsmdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes the changes and flushes them to a new sst file.
+func flushChanges(t *testing.T, lsmdb *DB, changes func()) {
+	changes()
+	if err := lsmdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompactRange(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	flushChanges(t, lsmdb, func() {
+		lsmdb.Put([]byte("a1"), []byte("1"))
+		lsmdb.Put([]byte("a3"), []byte("10"))
+		lsmdb.Merge([]byte("a4"), []byte("5"))
+	})
+	flushChanges(t, lsmdb, func() {
+		lsmdb.Delete([]byte("a1"))
+		lsmdb.Merge([]byte("a3"), []byte("5"))
+		lsmdb.PutWithExpiry([]byte("k2"), []byte("expired"), time.Now().Add(-time.Second))
+	})
+	flushChanges(t, lsmdb, func() {
+		lsmdb.Put([]byte("k9"), []byte("9"))
+	})
+
+	expectValues := func() {
+		t.Helper()
+		for key, expected := range map[string]string{"a1": "", "k2": "", "a3": "15", "a4": "5", "k9": "9"} {
+			v, err := lsmdb.Get([]byte(key))
+			if expected == "" && err != ErrKeyNotFound {
+				t.Errorf("Expected ErrKeyNotFound for %s, got %q (%v)", key, v, err)
+			}
+			if expected != "" && string(v) != expected {
+				t.Errorf("Expected %s for %s, got %q (%v)", expected, key, v, err)
+			}
+		}
+	}
+
+	// Only the second sst file intersects the range, the tombstones are kept as the first one can hold older entries
+	result, err := lsmdb.CompactRange([]byte("k0"), []byte("k3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InputFiles != 1 || result.DroppedEntries != 0 || lsmdb.sstFilesNum != 3 {
+		t.Errorf("Unexpected compaction %+v of %d files", result, lsmdb.sstFilesNum)
+	}
+	expectValues()
+
+	// No sst file intersects the range
+	if result, err := lsmdb.CompactRange([]byte("k5"), []byte("k6")); err != nil || result.InputFiles != 0 {
+		t.Errorf("Expected no compaction, got %+v (%v)", result, err)
+	}
+
+	// All the sst files are compacted into one, without the tombstones and the expired entries
+	result, err = lsmdb.CompactRange(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InputFiles != 3 || result.DroppedEntries != 4 || result.OutputBytes == 0 || lsmdb.sstFilesNum != 1 {
+		t.Errorf("Unexpected compaction %+v of %d files", result, lsmdb.sstFilesNum)
+	}
+	expectValues()
+
+	stats, err := lsmdb.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file := stats.Families[0].SSTFiles[0]; file.Entries != 3 || file.Tombstones != 0 || string(file.SmallestKey) != "a3" {
+		t.Errorf("Unexpected sst file %+v", file)
+	}
+
+	// The sst files of the database are reopened after the compaction
+	reopened := openTestLSMDB(t, filepath.Dir(lsmdb.wal.walPath))
+	reopened.mergeOperator = Int64AddOperator{}
+	if v, _ := reopened.Get([]byte("a3")); string(v) != "15" {
+		t.Errorf("Expected 15, got %q", v)
+	}
+}
+
+func TestCompactRangeRenumbersNewerFiles(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("a"), []byte("1")) })
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("b"), []byte("1")) })
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("a"), []byte("2")) })
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("b"), []byte("2")) })
+
+	// The first three files are compacted, as the second one is between the ones holding a
+	result, err := lsmdb.CompactRange([]byte("a"), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.InputFiles != 3 || lsmdb.sstFilesNum != 2 {
+		t.Errorf("Unexpected compaction %+v of %d files", result, lsmdb.sstFilesNum)
+	}
+
+	// The newest file still hides the compacted one
+	if v, _ := lsmdb.Get([]byte("b")); string(v) != "2" {
+		t.Errorf("Expected 2, got %q", v)
+	}
+	if v, _ := lsmdb.Get([]byte("a")); string(v) != "2" {
+		t.Errorf("Expected 2, got %q", v)
+	}
+
+	report, err := lsmdb.VerifySSTFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range report.Files {
+		if !file.Checksummed {
+			t.Errorf("Expected the checksum of %s to be checked", file.Name)
+		}
+	}
+}
+
+func TestCompactRangeCompletedAfterCrash(t *testing.T) {
+	// The crash points, as the steps of installCompaction done before the database stopped
+	crashes := map[string]func(lsmdb *DB, manifest compactionManifest){
+		"before the replacement": func(lsmdb *DB, manifest compactionManifest) {
+			// Along with the files of a flush whose metadata wasn't written
+			os.WriteFile(lsmdb.sstFilePath(7), []byte("partial"), 0600)
+			os.WriteFile(lsmdb.sstPath+"compaction-1.tmp", []byte("partial"), 0600)
+		},
+		"while the newer files are moved aside": func(lsmdb *DB, manifest compactionManifest) {
+			for i := manifest.First; i <= manifest.Last; i++ {
+				os.Remove(lsmdb.sstFilePath(i))
+				lsmdb.removeSSTChecksum(i)
+			}
+			os.Rename(lsmdb.sstChecksumPath(4), lsmdb.renumberedSSTPath(2)+".sha256")
+			os.Rename(lsmdb.sstFilePath(4), lsmdb.renumberedSSTPath(2))
+			os.Rename(lsmdb.sstChecksumPath(5), lsmdb.renumberedSSTPath(3)+".sha256")
+		},
+		"while the newer files are renumbered": func(lsmdb *DB, manifest compactionManifest) {
+			for i := manifest.First; i <= manifest.Last; i++ {
+				os.Remove(lsmdb.sstFilePath(i))
+				lsmdb.removeSSTChecksum(i)
+			}
+			for i := manifest.Last + 1; i <= manifest.FilesNum; i++ {
+				os.Rename(lsmdb.sstChecksumPath(i), lsmdb.renumberedSSTPath(manifest.newNumber(i))+".sha256")
+				os.Rename(lsmdb.sstFilePath(i), lsmdb.renumberedSSTPath(manifest.newNumber(i)))
+			}
+			manifest.Installing = true
+			lsmdb.saveCompactionManifest(manifest)
+
+			lsmdb.writeSSTChecksum(manifest.First, manifest.OutputSHA)
+			os.Rename(lsmdb.compactionOutputPath(), lsmdb.sstFilePath(manifest.First))
+			lsmdb.restoreRenumberedSST(2)
+		},
+	}
+
+	for name, crash := range crashes {
+		t.Run(name, func(t *testing.T) {
+			lsmdb := newTestLSMDB(t)
+
+			flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("a"), []byte("1")) })
+			flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("b"), []byte("1")) })
+			flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("a"), []byte("2")) })
+			flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("b"), []byte("2")) })
+			flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("c"), []byte("1")) })
+			flushChanges(t, lsmdb, func() {
+				lsmdb.Put([]byte("c"), []byte("2"))
+				lsmdb.Put([]byte("d"), []byte("1"))
+			})
+
+			// The first three files are compacted, the three newer ones become the files 2 to 4
+			manifest, _, err := lsmdb.writeCompaction([]byte("a"), []byte("b"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			crash(lsmdb, *manifest)
+
+			reopened := openTestLSMDB(t, filepath.Dir(lsmdb.wal.walPath))
+			if reopened.sstFilesNum != 4 {
+				t.Errorf("Expected 4 sst files, got %d", reopened.sstFilesNum)
+			}
+			for key, expected := range map[string]string{"a": "2", "b": "2", "c": "2", "d": "1"} {
+				if v, err := reopened.Get([]byte(key)); err != nil || string(v) != expected {
+					t.Errorf("Expected %s for %s, got %q (%v)", expected, key, v, err)
+				}
+			}
+
+			report, err := reopened.VerifySSTFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(report.Files) != 4 || report.Corrupted != 0 {
+				t.Errorf("Unexpected verification %+v", report)
+			}
+			for _, file := range report.Files {
+				if !file.Checksummed {
+					t.Errorf("Expected the checksum of %s to be checked", file.Name)
+				}
+			}
+
+			// Only the sst files and their checksums are left
+			files, err := os.ReadDir(reopened.sstPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 8 {
+				var names []string
+				for _, file := range files {
+					names = append(names, file.Name())
+				}
+				t.Errorf("Expected the 4 sst files and their checksums, got %v", names)
+			}
+		})
+	}
+}
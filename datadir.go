@@ -0,0 +1,109 @@
+package lsmdb
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrDataDirLocked = errors.New("the data directory is used by another process")
+)
+
+// The files of the data directory that don't belong to the LSM tree.
+const (
+	lockFileName     = "LOCK"
+	identityFileName = "IDENTITY"
+)
+
+// Locks the data directory of the database for this process, and reads its identity (generating it for a new
+// database). It does nothing if the database has no data directory, or if it already holds the lock.
+func (lsmdb *DB) lockDataDir() error {
+	if lsmdb.dataDir == "" || lsmdb.dirLock != nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(lsmdb.dataDir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(lsmdb.dataDir, lockFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if err == errWouldBlock {
+			return fmt.Errorf("%w: %s", ErrDataDirLocked, lsmdb.dataDir)
+		}
+		return err
+	}
+
+	identity, err := readIdentity(filepath.Join(lsmdb.dataDir, identityFileName))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	lsmdb.dirLock = f
+	lsmdb.identity = identity
+	return nil
+}
+
+// Releases the lock of the data directory, if it is held.
+func (lsmdb *DB) unlockDataDir() error {
+	if lsmdb.dirLock == nil {
+		return nil
+	}
+
+	// Closing the file releases the lock
+	err := lsmdb.dirLock.Close()
+	lsmdb.dirLock = nil
+	return err
+}
+
+// Returns the UUID identifying the database, generated when its data directory was created. It is empty if the
+// database has no data directory.
+func (lsmdb *DB) Identity() string {
+	return lsmdb.rootDB().identity
+}
+
+// Returns the version of the format of the files written by the database.
+func (lsmdb *DB) Version() byte {
+	return lsmdb.version
+}
+
+// Returns the identity stored in path, writing a new one if the file doesn't exist.
+func readIdentity(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err == nil {
+		return strings.TrimSpace(string(content)), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	identity := newUUID()
+
+	// The identity is written to a temporary file renamed at the end, so a crash never leaves an empty one
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(identity+"\n"), 0600); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return identity, nil
+}
+
+// Returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,80 @@
+package lsmdb
+
+import (
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDataDirLock(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	lsmdb, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	identity := lsmdb.Identity()
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(identity) {
+		t.Errorf("Expected a UUID, got %q", identity)
+	}
+
+	// Opening the database again in place keeps its lock
+	if err := lsmdb.open(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	// The data directory can't be opened twice
+	if _, err := Open(dir, nil); !errors.Is(err, ErrDataDirLocked) {
+		t.Errorf("Expected ErrDataDirLocked, got %v", err)
+	}
+
+	// It can once the database is closed, and the database keeps its identity
+	if err := lsmdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.Identity() != identity {
+		t.Errorf("Expected identity %s, got %s", identity, reopened.Identity())
+	}
+	if v, _ := reopened.Get([]byte("key")); string(v) != "value" {
+		t.Errorf("Expected value, got %q", v)
+	}
+
+	// Another database gets another identity
+	other, err := Open(filepath.Join(t.TempDir(), "data"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if other.Identity() == identity {
+		t.Error("Expected another identity")
+	}
+}
+
+func TestOpenInvalidOptions(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MemSizeThreshold = 0
+	opts.MergeOperator = "sum"
+
+	_, err := Open(t.TempDir(), &opts)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, expected := range []string{"mem-size-threshold", "merge-operator"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected an error about %s, got %v", expected, err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
-package main
+package lsmdb
 
 import (
+	"io"
 	"os"
 )
 
@@ -44,23 +45,24 @@ func readHeader(file *os.File) ([]byte, int, []byte, []byte, byte, error) {
 	return magicNumber, entryCount, smallestKey, largestKey, version[0], nil
 }
 
-// Decodes the next entry from the sst file.
+// Decodes the next entry from an sst file, or any other reader of encoded entries.
 // Returns the operation type, the key, the value, and the error.
-func decodeNext(file *os.File) (byte, []byte, []byte, error) {
+// If the file ends in the middle of the entry, the error is io.ErrUnexpectedEOF.
+func decodeNext(r io.Reader) (byte, []byte, []byte, error) {
 	opPart := make([]byte, 1)
-	if _, err := file.Read(opPart); err != nil {
+	if _, err := io.ReadFull(r, opPart); err != nil {
 		return 0, nil, nil, err
 	}
 	op := opPart[0]
 
 	keyLenPart := make([]byte, 4)
-	if _, err := file.Read(keyLenPart); err != nil {
+	if _, err := io.ReadFull(r, keyLenPart); err != nil {
 		return 0, nil, nil, err
 	}
 	keyLen := decode4BytesInt(keyLenPart)
 
 	key := make([]byte, keyLen)
-	if _, err := file.Read(key); err != nil {
+	if _, err := io.ReadFull(r, key); err != nil {
 		return 0, nil, nil, err
 	}
 
@@ -69,17 +71,54 @@ func decodeNext(file *os.File) (byte, []byte, []byte, error) {
 		return op, key, nil, nil
 	}
 
-	// Otherwise, if it's a set operation, we read the value
+	// Otherwise, if it's a set or merge operation, we read the value
 	valueLenPart := make([]byte, 4)
-	if _, err := file.Read(valueLenPart); err != nil {
+	if _, err := io.ReadFull(r, valueLenPart); err != nil {
 		return 0, nil, nil, err
 	}
 	valueLen := decode4BytesInt(valueLenPart)
 
 	value := make([]byte, valueLen)
-	if _, err := file.Read(value); err != nil {
+	if _, err := io.ReadFull(r, value); err != nil {
 		return 0, nil, nil, err
 	}
 
 	return op, key, value, nil
 }
+
+// Decodes an entry at the beginning of encoded, and returns it with the bytes that follow it.
+func decodeEntryBytes(encoded []byte) (Entry, []byte, error) {
+	if len(encoded) < 1+4 {
+		return Entry{}, nil, ErrCorruptedFile
+	}
+
+	op := OperationType(encoded[0])
+	if op != SetOp && op != DelOp && op != MergeOp && op != ValuePointerOp && op != ExpiringSetOp {
+		return Entry{}, nil, ErrCorruptedFile
+	}
+
+	keyLen := decode4BytesInt(encoded[1:5])
+	encoded = encoded[5:]
+	if len(encoded) < keyLen {
+		return Entry{}, nil, ErrCorruptedFile
+	}
+	key := encoded[:keyLen]
+	encoded = encoded[keyLen:]
+
+	// Del entries don't have a value
+	if op == DelOp {
+		return Entry{op: op, key: key}, encoded, nil
+	}
+
+	if len(encoded) < 4 {
+		return Entry{}, nil, ErrCorruptedFile
+	}
+	valueLen := decode4BytesInt(encoded[:4])
+	encoded = encoded[4:]
+	if len(encoded) < valueLen {
+		return Entry{}, nil, ErrCorruptedFile
+	}
+	value := encoded[:valueLen]
+
+	return Entry{op: op, key: key, value: value}, encoded[valueLen:], nil
+}
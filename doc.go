@@ -0,0 +1,18 @@
+// Package lsmdb is a persistent key-value store based on a log-structured merge tree: the writes are logged to a WAL
+// and kept in a memTable, which is flushed to sorted sst files once it is full.
+//
+// A database lives in its own directory, locked while it is open:
+//
+//	db, err := lsmdb.Open("data/", nil)
+//	if err != nil {
+//		return err
+//	}
+//	defer db.Close()
+//
+//	err = db.Put([]byte("key"), []byte("value"))
+//	value, err := db.Get([]byte("key"))
+//
+// The package also provides the HTTP API of a database and its replication to followers. The Redis, memcached and gRPC
+// servers are in the respserver, memcachedserver and grpcserver packages, the Raft cluster mode in raftcluster, and
+// the server program in cmd/lsmdb.
+package lsmdb
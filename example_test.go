@@ -0,0 +1,57 @@
+package lsmdb_test
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+func Example() {
+	dir, err := os.MkdirTemp("", "example_lsmdb_")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := lsmdb.Open(dir, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	for _, key := range []string{"user:1", "user:2", "user:3"} {
+		if err := db.Put([]byte(key), []byte("name of "+key)); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if _, err := db.Delete([]byte("user:2")); err != nil {
+		log.Fatal(err)
+	}
+
+	value, err := db.Get([]byte("user:1"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(value))
+
+	if _, err := db.Get([]byte("user:2")); err == lsmdb.ErrKeyNotFound {
+		fmt.Println("user:2 not found")
+	}
+
+	it, err := db.NewIterator([]byte("user:"), []byte("user;"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		fmt.Printf("%s = %s\n", it.Key(), it.Value())
+	}
+
+	// Output:
+	// name of user:1
+	// user:2 not found
+	// user:1 = name of user:1
+	// user:3 = name of user:3
+}
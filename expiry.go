@@ -0,0 +1,142 @@
+package lsmdb
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// The values of expiring keys are prefixed with their expiration time,
+// encoded as the number of milliseconds since the Unix epoch on 8 bytes.
+func encodeExpiringValue(expireAt time.Time, value []byte) []byte {
+	encoded := binary.BigEndian.AppendUint64(nil, uint64(expireAt.UnixMilli()))
+	return append(encoded, value...)
+}
+
+func decodeExpiringValue(encoded []byte) (time.Time, []byte) {
+	if len(encoded) < 8 {
+		return time.Time{}, nil
+	}
+
+	expireAt := time.UnixMilli(int64(binary.BigEndian.Uint64(encoded[:8])))
+	return expireAt, encoded[8:]
+}
+
+// Tells if a key with this expiration time expired. The zero time means the key never expires.
+func isExpired(expireAt time.Time) bool {
+	return !expireAt.IsZero() && !time.Now().Before(expireAt)
+}
+
+// Sets the value of the key, which is considered deleted once expireAt is reached.
+// If expireAt is the zero time, the key never expires, like with Put.
+// Expiring values are always stored in the LSM tree, never in the value log.
+func (lsmdb *DB) PutWithExpiry(key, value []byte, expireAt time.Time) error {
+	defer lsmdb.lock()()
+
+	return lsmdb.setWithExpiry(key, value, expireAt)
+}
+
+func (lsmdb *DB) setWithExpiry(key, value []byte, expireAt time.Time) error {
+	if expireAt.IsZero() {
+		return lsmdb.set(key, value)
+	}
+
+	entry := Entry{
+		op:    ExpiringSetOp,
+		key:   key,
+		value: encodeExpiringValue(expireAt, value),
+	}
+
+	if err := lsmdb.logEntry(entry); err != nil {
+		return err
+	}
+
+	lsmdb.memTable.writeOperation(entry.op, key, entry.value)
+
+	return lsmdb.flushIfFull()
+}
+
+// Reads the value of the key and its expiration time, and sets the ones returned by update, all under the lock of the
+// database, so the key can't be written in between. exists tells if the key has a value.
+// Nothing is written if update returns an error, which is returned.
+func (lsmdb *DB) UpdateWithExpiry(key []byte, update func(value []byte, expireAt time.Time, exists bool) ([]byte, time.Time, error)) error {
+	defer lsmdb.lock()()
+
+	value, err := lsmdb.get(key)
+	if err != nil && err != ErrKeyNotFound {
+		return err
+	}
+
+	exists := err == nil
+	var expireAt time.Time
+	if exists {
+		expireAt, err = lsmdb.expiryOf(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	value, expireAt, err = update(value, expireAt, exists)
+	if err != nil {
+		return err
+	}
+
+	return lsmdb.setWithExpiry(key, value, expireAt)
+}
+
+// Returns the value of the key and its expiration time (the zero time if the key never expires).
+func (lsmdb *DB) GetWithExpiry(key []byte) ([]byte, time.Time, error) {
+	defer lsmdb.lock()()
+
+	value, err := lsmdb.get(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	expireAt, err := lsmdb.expiryOf(key)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	return value, expireAt, nil
+}
+
+// Returns the expiration time of the newest value of the key, looking under its merge operands.
+func (lsmdb *DB) expiryOf(key []byte) (time.Time, error) {
+	if valueWithOp, ok := lsmdb.memTable.sortedMap.Get(string(key)); ok {
+		op, v := parseInMemValue(valueWithOp)
+		switch op {
+		case ExpiringSetOp:
+			expireAt, _ := decodeExpiringValue(v)
+			return expireAt, nil
+		case MergeOp:
+		default:
+			return time.Time{}, nil
+		}
+	}
+
+	if err := lsmdb.setCurrentSSTIndex(); err != nil {
+		return time.Time{}, err
+	}
+
+	for i := lsmdb.sstFilesNum; i >= 1; i-- {
+		op, v, err := lsmdb.lookupSSTFile(i, key)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		switch op {
+		case ExpiringSetOp:
+			expireAt, _ := decodeExpiringValue(v)
+			return expireAt, nil
+		case MergeOp:
+			continue
+		default:
+			return time.Time{}, nil
+		}
+	}
+
+	return time.Time{}, nil
+}
@@ -0,0 +1,155 @@
+package lsmdb
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLSMDB_SetWithExpiry(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	if err := lsmdb.PutWithExpiry([]byte("key"), []byte("1"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.PutWithExpiry([]byte("expired"), []byte("value"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	v, gotExpireAt, err := lsmdb.GetWithExpiry([]byte("key"))
+	if err != nil || string(v) != "1" || !gotExpireAt.Equal(expireAt) {
+		t.Errorf("Expected 1 expiring at %v, got %s expiring at %v (%v)", expireAt, v, gotExpireAt, err)
+	}
+	if _, err := lsmdb.Get([]byte("expired")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// The expiration time is read from the sst files, and kept by merges
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Merge([]byte("key"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+
+	v, gotExpireAt, err = lsmdb.GetWithExpiry([]byte("key"))
+	if err != nil || string(v) != "3" || !gotExpireAt.Equal(expireAt) {
+		t.Errorf("Expected 3 expiring at %v, got %s expiring at %v (%v)", expireAt, v, gotExpireAt, err)
+	}
+	if _, err := lsmdb.Get([]byte("expired")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// A plain set removes the expiration time
+	if err := lsmdb.Put([]byte("key"), []byte("4")); err != nil {
+		t.Fatal(err)
+	}
+	if _, gotExpireAt, err := lsmdb.GetWithExpiry([]byte("key")); err != nil || !gotExpireAt.IsZero() {
+		t.Errorf("Expected no expiration time, got %v (%v)", gotExpireAt, err)
+	}
+}
+
+func TestLSMDB_UpdateWithExpiry(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Millisecond)
+	if err := lsmdb.PutWithExpiry([]byte("counter"), []byte("0"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+
+	increment := func(v []byte, expireAt time.Time, exists bool) ([]byte, time.Time, error) {
+		n, err := strconv.Atoi(string(v))
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		return []byte(strconv.Itoa(n + 1)), expireAt, nil
+	}
+
+	// The updates are not lost to the other writes of the key
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := lsmdb.UpdateWithExpiry([]byte("counter"), increment); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := lsmdb.Merge([]byte("counter"), []byte("1")); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	v, gotExpireAt, err := lsmdb.GetWithExpiry([]byte("counter"))
+	if err != nil || string(v) != "400" {
+		t.Errorf("Expected 400, got %s (%v)", v, err)
+	}
+	if !gotExpireAt.Equal(expireAt) {
+		t.Errorf("Expected the expiration time %v, got %v", expireAt, gotExpireAt)
+	}
+
+	// Nothing is written when update fails
+	err = lsmdb.UpdateWithExpiry([]byte("missing"), func([]byte, time.Time, bool) ([]byte, time.Time, error) {
+		return nil, time.Time{}, ErrKeyExists
+	})
+	if err != ErrKeyExists {
+		t.Errorf("Expected ErrKeyExists, got %v", err)
+	}
+	if _, err := lsmdb.Get([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestLSMDB_MergeIntoExpiringValueAfterRestart(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	expireAt := time.Now().Add(300 * time.Millisecond)
+	if err := lsmdb.PutWithExpiry([]byte("key"), []byte("10"), expireAt); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Merge([]byte("key"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+
+	batch := &WriteBatch{}
+	batch.Merge("", []byte("key"), []byte("1"))
+	batch.Merge("", []byte("key"), []byte("1"))
+	if err := lsmdb.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := lsmdb.Get([]byte("key")); err != nil || string(v) != "17" {
+		t.Errorf("Expected 17, got %s (%v)", v, err)
+	}
+
+	// The WAL is replayed after the value expired, the merges were done before
+	time.Sleep(time.Until(expireAt) + 50*time.Millisecond)
+	reopenTestLSMDB(t, lsmdb)
+
+	if v, err := lsmdb.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %s (%v)", v, err)
+	}
+
+	// A merge into the expired value starts from nothing, and doesn't expire
+	if err := lsmdb.Merge([]byte("key"), []byte("5")); err != nil {
+		t.Fatal(err)
+	}
+	reopenTestLSMDB(t, lsmdb)
+
+	if v, expireAt, err := lsmdb.GetWithExpiry([]byte("key")); err != nil || string(v) != "5" || !expireAt.IsZero() {
+		t.Errorf("Expected 5 without expiration time, got %s expiring at %v (%v)", v, expireAt, err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package lsmdb
+
+import (
+	"errors"
+	"os"
+)
+
+var errWouldBlock = errors.New("the file is locked")
+
+// The data directory isn't locked on the systems without flock.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package lsmdb
+
+import (
+	"os"
+	"syscall"
+)
+
+var errWouldBlock error = syscall.EWOULDBLOCK
+
+// Takes an exclusive lock on the file without waiting. It fails with errWouldBlock if another open file holds it.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,225 @@
+// Package grpcserver serves a database over gRPC, with the KVStore service of the kvpb package.
+package grpcserver
+
+import (
+	"context"
+	"errors"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+	"github.com/IlyasIsHere/Persistent-key-value-store/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The gRPC service of the database (kvpb/kvstore.proto). The deadlines of the calls are passed to the engine,
+// which doesn't start the operations whose deadline is exceeded.
+type Server struct {
+	kvpb.UnimplementedKVStoreServer
+
+	db *lsmdb.DB
+}
+
+// Returns a gRPC server serving the database.
+func NewServer(db *lsmdb.DB) *grpc.Server {
+	srv := grpc.NewServer()
+	kvpb.RegisterKVStoreServer(srv, &Server{db: db})
+	return srv
+}
+
+// Returns the status matching an error of the engine.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.Is(err, lsmdb.ErrKeyNotFound), errors.Is(err, lsmdb.ErrColumnFamilyNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, lsmdb.ErrNoMergeOperator), errors.Is(err, lsmdb.ErrReadOnly):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, lsmdb.ErrInvalidMergeValue), errors.Is(err, lsmdb.ErrValueTooLarge):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, lsmdb.ErrSubscriberTooSlow):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, lsmdb.ErrSequenceNotRetained):
+		return status.Error(codes.OutOfRange, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// Returns the column family of a request, the default one if the name is empty.
+func (srv *Server) family(name string) (*lsmdb.DB, error) {
+	family, err := srv.db.ColumnFamily(name)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return family, nil
+}
+
+func (srv *Server) Get(ctx context.Context, req *kvpb.GetRequest) (*kvpb.GetResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Key must not be empty")
+	}
+
+	family, err := srv.family(req.ColumnFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := family.GetContext(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &kvpb.GetResponse{Value: value}, nil
+}
+
+func (srv *Server) Put(ctx context.Context, req *kvpb.PutRequest) (*kvpb.PutResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Key must not be empty")
+	}
+
+	family, err := srv.family(req.ColumnFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := family.PutContext(ctx, req.Key, req.Value); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &kvpb.PutResponse{}, nil
+}
+
+func (srv *Server) Delete(ctx context.Context, req *kvpb.DeleteRequest) (*kvpb.DeleteResponse, error) {
+	if len(req.Key) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Key must not be empty")
+	}
+
+	family, err := srv.family(req.ColumnFamily)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := family.DeleteContext(ctx, req.Key)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &kvpb.DeleteResponse{Value: value}, nil
+}
+
+func (srv *Server) BatchWrite(ctx context.Context, req *kvpb.BatchWriteRequest) (*kvpb.BatchWriteResponse, error) {
+	batch := lsmdb.WriteBatch{}
+
+	for _, mutation := range req.Mutations {
+		if len(mutation.Key) == 0 {
+			return nil, status.Error(codes.InvalidArgument, "Key must not be empty")
+		}
+
+		switch mutation.Op {
+		case kvpb.Mutation_OP_PUT:
+			batch.Put(mutation.ColumnFamily, mutation.Key, mutation.Value)
+		case kvpb.Mutation_OP_DELETE:
+			batch.Delete(mutation.ColumnFamily, mutation.Key)
+		case kvpb.Mutation_OP_MERGE:
+			batch.Merge(mutation.ColumnFamily, mutation.Key, mutation.Value)
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "Invalid mutation operation %v", mutation.Op)
+		}
+	}
+
+	if err := srv.db.WriteContext(ctx, &batch); err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &kvpb.BatchWriteResponse{}, nil
+}
+
+func (srv *Server) Scan(req *kvpb.ScanRequest, stream kvpb.KVStore_ScanServer) error {
+	family, err := srv.family(req.ColumnFamily)
+	if err != nil {
+		return err
+	}
+
+	// Empty bounds mean the range is not bounded on that side
+	var start, end []byte
+	if len(req.Start) > 0 {
+		start = req.Start
+	}
+	if len(req.End) > 0 {
+		end = req.End
+	}
+
+	it, err := family.NewIteratorContext(stream.Context(), start, end)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer it.Close()
+
+	for sent := uint32(0); it.Valid() && (req.Limit == 0 || sent < req.Limit); sent++ {
+		if err := stream.Send(&kvpb.KeyValue{Key: it.Key(), Value: it.Value()}); err != nil {
+			return err
+		}
+		it.Next()
+	}
+
+	if err := it.Err(); err != nil {
+		return grpcError(err)
+	}
+
+	return nil
+}
+
+func (srv *Server) Watch(req *kvpb.WatchRequest, stream kvpb.KVStore_WatchServer) error {
+	family, err := srv.family(req.ColumnFamily)
+	if err != nil {
+		return err
+	}
+
+	var sub *lsmdb.Subscription
+	if req.AfterSequence != nil {
+		if sub, err = family.SubscribeFrom(req.Prefix, *req.AfterSequence); err != nil {
+			return grpcError(err)
+		}
+	} else {
+		sub = family.Subscribe(req.Prefix)
+	}
+	defer sub.Cancel()
+
+	// The headers tell the client that the changes are watched from now on
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return grpcError(stream.Context().Err())
+
+		case event, ok := <-sub.Events():
+			if !ok {
+				return grpcError(sub.Err())
+			}
+
+			watchEvent := &kvpb.WatchEvent{
+				Type:         kvpb.WatchEvent_TYPE_PUT,
+				Key:          event.Key,
+				Value:        event.Value,
+				ColumnFamily: event.Family,
+				Sequence:     event.Seq,
+			}
+			switch event.Type {
+			case lsmdb.ChangeDelete:
+				watchEvent.Type = kvpb.WatchEvent_TYPE_DELETE
+			case lsmdb.ChangeMerge:
+				watchEvent.Type = kvpb.WatchEvent_TYPE_MERGE
+			}
+
+			if err := stream.Send(watchEvent); err != nil {
+				return err
+			}
+		}
+	}
+}
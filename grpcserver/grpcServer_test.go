@@ -0,0 +1,173 @@
+package grpcserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+	"github.com/IlyasIsHere/Persistent-key-value-store/kvpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func startTestGRPCServer(t *testing.T, db *lsmdb.DB) kvpb.KVStoreClient {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(db)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return kvpb.NewKVStoreClient(conn)
+}
+
+// Opens a database in a temporary directory, closed at the end of the test.
+func newTestDB(t *testing.T) *lsmdb.DB {
+	db, err := lsmdb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestGRPCServer(t *testing.T) {
+	db := newTestDB(t)
+	client := startTestGRPCServer(t, db)
+	ctx := context.Background()
+
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("missing")}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+
+	if _, err := client.Put(ctx, &kvpb.PutRequest{Key: []byte("a"), Value: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a")}); err != nil || string(resp.Value) != "1" {
+		t.Errorf("Expected 1, got %v (%v)", resp, err)
+	}
+
+	// BatchWrite is atomic: a merge the operator rejects fails the whole batch
+	_, err := client.BatchWrite(ctx, &kvpb.BatchWriteRequest{Mutations: []*kvpb.Mutation{
+		{Op: kvpb.Mutation_OP_PUT, Key: []byte("b"), Value: []byte("2")},
+		{Op: kvpb.Mutation_OP_MERGE, Key: []byte("a"), Value: []byte("not a number")},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("b")}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+
+	_, err = client.BatchWrite(ctx, &kvpb.BatchWriteRequest{Mutations: []*kvpb.Mutation{
+		{Op: kvpb.Mutation_OP_PUT, Key: []byte("b"), Value: []byte("2")},
+		{Op: kvpb.Mutation_OP_PUT, Key: []byte("c"), Value: []byte("3")},
+		{Op: kvpb.Mutation_OP_MERGE, Key: []byte("a"), Value: []byte("10")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, err := client.Delete(ctx, &kvpb.DeleteRequest{Key: []byte("c")}); err != nil || string(resp.Value) != "3" {
+		t.Errorf("Expected 3, got %v (%v)", resp, err)
+	}
+
+	stream, err := client.Scan(ctx, &kvpb.ScanRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var scanned []string
+	for {
+		kv, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanned = append(scanned, string(kv.Key)+"="+string(kv.Value))
+	}
+
+	if len(scanned) != 2 || scanned[0] != "a=11" || scanned[1] != "b=2" {
+		t.Errorf("Expected [a=11 b=2], got %v", scanned)
+	}
+
+	if _, err := client.Get(ctx, &kvpb.GetRequest{Key: []byte("a"), ColumnFamily: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, got %v", err)
+	}
+}
+
+func TestGRPCDeadline(t *testing.T) {
+	db := newTestDB(t)
+	client := startTestGRPCServer(t, db)
+
+	// The write waits for the lock, held by an update, until its deadline, and is never applied
+	locked, release := make(chan struct{}), make(chan struct{})
+	go db.UpdateWithExpiry([]byte("other"), func([]byte, time.Time, bool) ([]byte, time.Time, error) {
+		close(locked)
+		<-release
+		return nil, time.Time{}, lsmdb.ErrKeyExists
+	})
+	<-locked
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, err := client.Put(ctx, &kvpb.PutRequest{Key: []byte("key"), Value: []byte("value")})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if _, err := db.Get([]byte("key")); err != lsmdb.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	db := newTestDB(t)
+	client := startTestGRPCServer(t, db)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &kvpb.WatchRequest{Prefix: []byte("user:")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes are watched once the headers are received
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Put([]byte("other"), []byte("ignored"))
+	db.Put([]byte("user:1"), []byte("alice"))
+	db.Delete([]byte("user:1"))
+
+	event, err := stream.Recv()
+	if err != nil || event.Type != kvpb.WatchEvent_TYPE_PUT || string(event.Key) != "user:1" || string(event.Value) != "alice" {
+		t.Errorf("Expected PUT user:1=alice, got %v (%v)", event, err)
+	}
+
+	event, err = stream.Recv()
+	if err != nil || event.Type != kvpb.WatchEvent_TYPE_DELETE || string(event.Key) != "user:1" {
+		t.Errorf("Expected DELETE user:1, got %v (%v)", event, err)
+	}
+}
@@ -1,15 +1,21 @@
-package main
+package lsmdb
 
 import (
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"math"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // This is the request handler for the get URL.
-func getHandler(lsmdb *lsmDB) http.HandlerFunc {
+func getHandler(lsmdb *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method != "GET" {
@@ -24,6 +30,10 @@ func getHandler(lsmdb *lsmDB) http.HandlerFunc {
 			return
 		}
 
+		if !authorize(w, r, PermissionRead, []byte(key)) {
+			return
+		}
+
 		v, err := lsmdb.Get([]byte(key))
 
 		if err != nil {
@@ -46,7 +56,7 @@ type KeyValue struct {
 	Value string
 }
 
-func setHandler(lsmdb *lsmDB) http.HandlerFunc {
+func setHandler(lsmdb *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "Invalid request type", http.StatusBadRequest)
@@ -75,7 +85,27 @@ func setHandler(lsmdb *lsmDB) http.HandlerFunc {
 			return
 		}
 
-		if err := lsmdb.Set([]byte(entry.Key), []byte(entry.Value)); err != nil {
+		if !authorize(w, r, PermissionWrite, []byte(entry.Key)) {
+			return
+		}
+
+		// In cluster mode, the write is proposed to the cluster by the leader
+		if cluster := lsmdb.clusterNode(); cluster != nil {
+			if !cluster.TakesWrite(w, r) {
+				return
+			}
+
+			batch := &WriteBatch{}
+			batch.Put(cmp.Or(lsmdb.familyName, defaultColumnFamilyName), []byte(entry.Key), []byte(entry.Value))
+			if _, err := cluster.Propose(batch); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, "OK")
+			return
+		}
+
+		if err := lsmdb.Put([]byte(entry.Key), []byte(entry.Value)); err != nil {
 			// http.Error(w, "Some error happened.", http.StatusBadRequest)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
@@ -84,7 +114,48 @@ func setHandler(lsmdb *lsmDB) http.HandlerFunc {
 	}
 }
 
-func delHandler(lsmdb *lsmDB) http.HandlerFunc {
+func mergeHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		var entry KeyValue
+		err := json.NewDecoder(r.Body).Decode(&entry)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(entry.Key) == 0 {
+			http.Error(w, "Key must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if len(entry.Key) > math.MaxUint32 {
+			http.Error(w, "Key length exceeds maximum allowed", http.StatusBadRequest)
+			return
+		}
+
+		if len(entry.Value) > math.MaxUint32 {
+			http.Error(w, "Value length exceeds maximum allowed", http.StatusBadRequest)
+			return
+		}
+
+		if !authorize(w, r, PermissionWrite, []byte(entry.Key)) {
+			return
+		}
+
+		if err := lsmdb.Merge([]byte(entry.Key), []byte(entry.Value)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+func delHandler(lsmdb *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "DELETE" {
 			w.WriteHeader(http.StatusBadRequest)
@@ -99,7 +170,25 @@ func delHandler(lsmdb *lsmDB) http.HandlerFunc {
 			return
 		}
 
-		v, err := lsmdb.Del([]byte(key))
+		if !authorize(w, r, PermissionWrite, []byte(key)) {
+			return
+		}
+
+		var v []byte
+		var err error
+
+		// In cluster mode, the deletion is proposed to the cluster by the leader
+		if cluster := lsmdb.clusterNode(); cluster != nil {
+			if !cluster.TakesWrite(w, r) {
+				return
+			}
+
+			batch := &WriteBatch{}
+			batch.Delete(cmp.Or(lsmdb.familyName, defaultColumnFamilyName), []byte(key))
+			v, err = cluster.Propose(batch)
+		} else {
+			v, err = lsmdb.Delete([]byte(key))
+		}
 
 		if err != nil {
 			if err == ErrKeyNotFound {
@@ -110,13 +199,523 @@ func delHandler(lsmdb *lsmDB) http.HandlerFunc {
 			return
 		}
 
+		// The deleted value is only returned to the principals allowed to read it
+		if !isAllowed(r, PermissionRead, []byte(key)) {
+			fmt.Fprint(w, "OK")
+			return
+		}
 		fmt.Fprint(w, string(v))
 	}
 }
 
-func handleRequests(lsmdb *lsmDB) {
-	http.HandleFunc("/get", getHandler(lsmdb))
-	http.HandleFunc("/set", setHandler(lsmdb))
-	http.HandleFunc("/del", delHandler(lsmdb))
-	log.Fatal(http.ListenAndServe(":8080", nil))
+type ColumnFamilyRequest struct {
+	MemSizeThreshold int
+	MergeOperator    string
+}
+
+// This is the request handler for the URLs of column families:
+// /cf lists them, /cf/{name}/create and /cf/{name}/drop manage them,
+// and /cf/{name}/get, /cf/{name}/set, /cf/{name}/del and /cf/{name}/merge work like /get, /set, /del and /merge.
+func columnFamilyHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cf"), "/")
+
+		if path == "" {
+			if r.Method != "GET" {
+				http.Error(w, "Invalid request type", http.StatusBadRequest)
+				return
+			}
+			if !authorizeRange(w, r, PermissionAdmin, nil, nil) {
+				return
+			}
+			json.NewEncoder(w).Encode(lsmdb.ColumnFamilyNames())
+			return
+		}
+
+		name, action, ok := strings.Cut(path, "/")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch action {
+		case "create":
+			requireAdmin(createColumnFamilyHandler(lsmdb, name))(w, r)
+			return
+		case "drop":
+			requireAdmin(dropColumnFamilyHandler(lsmdb, name))(w, r)
+			return
+		}
+
+		family, err := lsmdb.ColumnFamily(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		switch action {
+		case "get":
+			getHandler(family)(w, r)
+		case "set":
+			setHandler(family)(w, r)
+		case "del":
+			delHandler(family)(w, r)
+		case "merge":
+			mergeHandler(family)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func createColumnFamilyHandler(lsmdb *DB, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		// The options of the default column family are used when they are not given
+		opts := ColumnFamilyRequest{MemSizeThreshold: lsmdb.memSizeThreshold}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if opts.MemSizeThreshold <= 0 {
+			http.Error(w, "MemSizeThreshold must be positive", http.StatusBadRequest)
+			return
+		}
+
+		err := lsmdb.CreateColumnFamily(name, ColumnFamilyOptions{
+			MemSizeThreshold: opts.MemSizeThreshold,
+			MergeOperator:    opts.MergeOperator,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+func dropColumnFamilyHandler(lsmdb *DB, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		if err := lsmdb.DropColumnFamily(name); err != nil {
+			if err == ErrColumnFamilyNotFound {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// Runs the value log garbage collector of every column family.
+// The optional discardRatio parameter (0.5 by default) is the ratio of unused values a segment must have to be reclaimed.
+func valueLogGCHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		discardRatio := 0.5
+		if param := r.URL.Query().Get("discardRatio"); param != "" {
+			ratio, err := strconv.ParseFloat(param, 64)
+			if err != nil || ratio < 0 || ratio > 1 {
+				http.Error(w, "discardRatio must be a number between 0 and 1", http.StatusBadRequest)
+				return
+			}
+			discardRatio = ratio
+		}
+
+		reclaimed := make(map[string]int64)
+		for _, name := range lsmdb.ColumnFamilyNames() {
+			family, err := lsmdb.ColumnFamily(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			n, err := family.GarbageCollectValueLog(discardRatio)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			reclaimed[name] = n
+		}
+
+		json.NewEncoder(w).Encode(reclaimed)
+	}
+}
+
+// The directory of the data directory the checkpoints are created in
+const checkpointsDirName = "checkpoints"
+
+// This is the request handler flushing the memTables to sst files (/admin/flush)
+func flushHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		if err := lsmdb.Flush(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// This is the request handler for the checkpoint URL. It creates a checkpoint in the checkpoints/ directory of the
+// data directory, named by the name parameter (by default by the current time), and sends back its manifest.
+func checkpointHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = time.Now().UTC().Format("20060102T150405.000000000Z")
+		}
+
+		// The name can't lead out of the checkpoints directory
+		if name == "." || !filepath.IsLocal(name) || strings.ContainsAny(name, `/\`) {
+			http.Error(w, "Invalid checkpoint name", http.StatusBadRequest)
+			return
+		}
+		dir := filepath.Join(filepath.Dir(lsmdb.rootDB().wal.walPath), checkpointsDirName, name)
+
+		manifest, err := lsmdb.Checkpoint(dir)
+		if err == ErrCheckpointExists {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Name string `json:"name"`
+			Dir  string `json:"dir"`
+			*CheckpointManifest
+		}{name, dir, manifest})
+	}
+}
+
+// This is the request handler for the backup URL. GET lists the backups, and POST creates a new one.
+func backupHandler(lsmdb *DB, engine *BackupEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var result interface{}
+		var err error
+
+		switch r.Method {
+		case "GET":
+			result, err = engine.ListBackups()
+		case "POST":
+			result, err = engine.CreateBackup(lsmdb)
+		default:
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// This is the request handler for the backup verification URL, which checks the files of the backup given by the id
+// parameter.
+func verifyBackupHandler(engine *BackupEngine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "id must be a backup ID", http.StatusBadRequest)
+			return
+		}
+
+		err = engine.VerifyBackup(id)
+		switch {
+		case err == ErrBackupNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, ErrBackupCorrupted):
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, "OK")
+		}
+	}
+}
+
+// The maximum size of the values sent to the raw binary API
+const maxStreamedValueSize = 1 << 30
+
+// This is the request handler for the raw binary API: PUT /kv/{key} sets the value of the key to the request body,
+// and GET /kv/{key} sends back the value as it is read.
+func streamHandler(lsmdb *DB, maxValueSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/kv/")
+
+		if len(key) == 0 {
+			http.Error(w, "Key must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		if len(key) > math.MaxUint32 {
+			http.Error(w, "Key length exceeds maximum allowed", http.StatusBadRequest)
+			return
+		}
+
+		permission := PermissionRead
+		if r.Method == "PUT" {
+			permission = PermissionWrite
+		}
+		if !authorize(w, r, permission, []byte(key)) {
+			return
+		}
+
+		switch r.Method {
+		case "PUT":
+			if r.Header.Get("Content-Type") != "application/octet-stream" {
+				http.Error(w, "Content-Type must be application/octet-stream", http.StatusUnsupportedMediaType)
+				return
+			}
+
+			if r.ContentLength > maxValueSize {
+				http.Error(w, "Value length exceeds maximum allowed", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			// The limit is also enforced while the body is read, for bodies without a Content-Length
+			body := http.MaxBytesReader(w, r.Body, maxValueSize)
+
+			if err := lsmdb.PutStream([]byte(key), body); err != nil {
+				var maxBytesErr *http.MaxBytesError
+				if errors.As(err, &maxBytesErr) {
+					http.Error(w, "Value length exceeds maximum allowed", http.StatusRequestEntityTooLarge)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprint(w, "OK")
+
+		case "GET":
+			value, size, err := lsmdb.GetStream([]byte(key))
+			if err != nil {
+				if err == ErrKeyNotFound {
+					http.Error(w, "Key not found", http.StatusNotFound)
+					return
+				}
+				http.Error(w, "Some error happened.", http.StatusInternalServerError)
+				return
+			}
+			defer value.Close()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			io.Copy(w, value)
+
+		default:
+			http.Error(w, "Invalid request type", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// Comments are sent on idle watch streams at this interval, so the proxies don't close them
+const watchKeepAliveInterval = 15 * time.Second
+
+// The data of the events sent by the watch URL. Value is missing for deletions.
+type WatchEventResponse struct {
+	Seq    uint64  `json:"seq"`
+	Type   string  `json:"type"`
+	Family string  `json:"family,omitempty"`
+	Key    string  `json:"key"`
+	Value  *string `json:"value,omitempty"`
+}
+
+// This is the request handler for the watch URL. The changes of the keys starting with the prefix parameter (in the
+// column family of the family parameter) are sent as Server-Sent Events, whose id is their sequence number.
+// With the after parameter, or the Last-Event-ID header of a reconnecting client, the changes committed after that
+// sequence number are sent first.
+func watchHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		family, err := lsmdb.ColumnFamily(r.URL.Query().Get("family"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		prefix := []byte(r.URL.Query().Get("prefix"))
+		if !authorizeRange(w, r, PermissionRead, prefix, prefixEnd(prefix)) {
+			return
+		}
+
+		after := r.URL.Query().Get("after")
+		if after == "" {
+			after = r.Header.Get("Last-Event-ID")
+		}
+
+		var sub *Subscription
+		if after != "" {
+			afterSeq, err := strconv.ParseUint(after, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid sequence number", http.StatusBadRequest)
+				return
+			}
+
+			sub, err = family.SubscribeFrom(prefix, afterSeq)
+			if err == ErrSequenceNotRetained {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			sub = family.Subscribe(prefix)
+		}
+		defer sub.Cancel()
+
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		keepAlive := time.NewTicker(watchKeepAliveInterval)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keep-alive\n\n")
+
+			case event, ok := <-sub.Events():
+				if !ok {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", sub.Err())
+					rc.Flush()
+					return
+				}
+
+				data := WatchEventResponse{
+					Seq:    event.Seq,
+					Type:   event.Type.String(),
+					Family: event.Family,
+					Key:    string(event.Key),
+				}
+				if event.Type != ChangeDelete {
+					value := string(event.Value)
+					data.Value = &value
+				}
+
+				encoded, _ := json.Marshal(data)
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Type, encoded)
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Returns the handler of the HTTP API of the database. The backup engine, the follower and the cluster are optional,
+// and their endpoints are only served if they are given.
+// With access control, the requests are authenticated and their operations must be allowed by the ACL: the
+// endpoints of the keys need the read or the write permission on them, and the other ones the admin permission on all
+// the keys. Without it, the API is open, except the admin endpoints triggering flushes, compactions and verifications
+// which are disabled.
+func NewHTTPHandler(lsmdb *DB, backupEngine *BackupEngine, follower *Follower, cluster Cluster, access *AccessControl) *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// The requests of all the handlers are counted and timed for the metrics
+	handle := func(pattern string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, instrumentHandler(lsmdb, pattern, access.authenticate(handler)))
+	}
+
+	// The maintenance endpoints are never open to everyone
+	maintenance := func(handler http.HandlerFunc) http.HandlerFunc {
+		if access == nil {
+			return func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "The admin endpoints are disabled without access control", http.StatusForbidden)
+			}
+		}
+		return requireAdmin(handler)
+	}
+
+	handle("/get", getHandler(lsmdb))
+	handle("/set", setHandler(lsmdb))
+	handle("/del", delHandler(lsmdb))
+	handle("/merge", mergeHandler(lsmdb))
+	handle("/cf", columnFamilyHandler(lsmdb))
+	handle("/cf/", columnFamilyHandler(lsmdb))
+	handle("/admin/vlog/gc", requireAdmin(valueLogGCHandler(lsmdb)))
+	handle("/admin/checkpoint", requireAdmin(checkpointHandler(lsmdb)))
+	handle("/admin/stats", requireAdmin(statsHandler(lsmdb)))
+	handle("/admin/flush", maintenance(flushHandler(lsmdb)))
+	handle("/admin/compact", maintenance(compactHandler(lsmdb)))
+	handle("/admin/verify", maintenance(verifyHandler(lsmdb)))
+	handle("/admin/jobs/", maintenance(jobHandler(lsmdb)))
+	if backupEngine != nil {
+		handle("/admin/backup", requireAdmin(backupHandler(lsmdb, backupEngine)))
+		handle("/admin/backup/verify", requireAdmin(verifyBackupHandler(backupEngine)))
+	}
+	handle("/kv/", streamHandler(lsmdb, maxStreamedValueSize))
+	handle("/v2/keys/", keysV2Handler(lsmdb, maxStreamedValueSize))
+	handle("/v2/keys", scanV2Handler(lsmdb))
+	handle("/watch", watchHandler(lsmdb))
+	handle("/metrics", requireAdmin(metricsHandler(lsmdb)))
+	handle("/replication/stream", requireAdmin(replicationStreamHandler(lsmdb)))
+	handle("/replication/checkpoint", requireAdmin(replicationCheckpointHandler(lsmdb)))
+	handle("/replication/status", requireAdmin(replicationStatusHandler(lsmdb, follower)))
+	if follower != nil {
+		handle("/replication/promote", requireAdmin(promoteHandler(follower)))
+	}
+	if cluster != nil {
+		handle("/cluster/join", requireAdmin(clusterJoinHandler(cluster)))
+		handle("/cluster/remove", requireAdmin(clusterRemoveHandler(cluster)))
+		handle("/cluster/status", requireAdmin(clusterStatusHandler(cluster)))
+	}
+	return mux
 }
@@ -0,0 +1,111 @@
+package lsmdb
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamHandler(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	server := httptest.NewServer(streamHandler(lsmdb, 4096))
+	defer server.Close()
+
+	put := func(key string, body io.Reader, contentType string) *http.Response {
+		req, _ := http.NewRequest("PUT", server.URL+"/kv/"+key, body)
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	// The body of unknown length is sent chunked, the limit is enforced while it is read
+	body := io.MultiReader(strings.NewReader(strings.Repeat("a", 4096)), strings.NewReader("b"))
+	if resp := put("big", body, "application/octet-stream"); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status 413, got %d", resp.StatusCode)
+	}
+	if _, err := lsmdb.Get([]byte("big")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	if resp := put("key", strings.NewReader("value"), "application/json"); resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status 415, got %d", resp.StatusCode)
+	}
+	if _, err := lsmdb.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	value := bytes.Repeat([]byte("v"), 2048)
+	if resp := put("key", io.MultiReader(bytes.NewReader(value)), "application/octet-stream"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(server.URL + "/kv/key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	got, _ := io.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Length") != "2048" || resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Unexpected headers %v", resp.Header)
+	}
+	if !bytes.Equal(got, value) {
+		t.Errorf("Expected the value of %d bytes, got %d bytes", len(value), len(got))
+	}
+
+	resp, err = http.Get(server.URL + "/kv/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestCheckpointHandler(t *testing.T) {
+	dir := t.TempDir()
+	lsmdb, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmdb.Close()
+	lsmdb.Put([]byte("key"), []byte("value"))
+
+	server := httptest.NewServer(checkpointHandler(lsmdb))
+	defer server.Close()
+
+	post := func(query string) int {
+		resp, err := http.Post(server.URL+"/admin/checkpoint"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// The checkpoints are created in the checkpoints directory of the data directory, by name only
+	for _, name := range []string{"..", ".", "a/b", `a\b`, "/tmp", "../escape"} {
+		if status := post("?name=" + url.QueryEscape(name)); status != http.StatusBadRequest {
+			t.Errorf("Expected status 400 for %q, got %d", name, status)
+		}
+	}
+	if status := post("?name=first"); status != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointsDirName, "first", "wal.log")); err != nil {
+		t.Errorf("Expected the checkpoint in the data directory, got %v", err)
+	}
+	if status := post("?name=first"); status != http.StatusConflict {
+		t.Errorf("Expected status 409, got %d", status)
+	}
+}
@@ -0,0 +1,254 @@
+package lsmdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The codes of the errors returned by the v2 API.
+type ErrorCode string
+
+const (
+	ErrorCodeKeyNotFound       ErrorCode = "KEY_NOT_FOUND"
+	ErrorCodeKeyExists         ErrorCode = "KEY_EXISTS"
+	ErrorCodeInvalidRequest    ErrorCode = "INVALID_REQUEST"
+	ErrorCodeMethodNotAllowed  ErrorCode = "METHOD_NOT_ALLOWED"
+	ErrorCodeValueTooLarge     ErrorCode = "VALUE_TOO_LARGE"
+	ErrorCodeCorruptedFile     ErrorCode = "CORRUPTED_FILE"
+	ErrorCodeOutdatedVersion   ErrorCode = "OUTDATED_VERSION"
+	ErrorCodeNoMergeOperator   ErrorCode = "NO_MERGE_OPERATOR"
+	ErrorCodeInvalidMergeValue ErrorCode = "INVALID_MERGE_VALUE"
+	ErrorCodeReadOnly          ErrorCode = "READ_ONLY"
+	ErrorCodeUnauthorized      ErrorCode = "UNAUTHORIZED"
+	ErrorCodeForbidden         ErrorCode = "FORBIDDEN"
+	ErrorCodeClosed            ErrorCode = "CLOSED"
+	ErrorCodeInternal          ErrorCode = "INTERNAL"
+)
+
+// The body of the error responses of the v2 API.
+type ErrorResponse struct {
+	Error ErrorDetails `json:"error"`
+}
+
+type ErrorDetails struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Returns the error code and the HTTP status matching an error of the engine.
+func errorCodeFor(err error) (ErrorCode, int) {
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		return ErrorCodeKeyNotFound, http.StatusNotFound
+	case errors.Is(err, ErrKeyExists):
+		return ErrorCodeKeyExists, http.StatusConflict
+	case errors.Is(err, ErrValueTooLarge), errors.As(err, &maxBytesErr):
+		return ErrorCodeValueTooLarge, http.StatusRequestEntityTooLarge
+	case errors.Is(err, ErrCorruptedFile):
+		return ErrorCodeCorruptedFile, http.StatusInternalServerError
+	case errors.Is(err, ErrOutdatedVersion):
+		return ErrorCodeOutdatedVersion, http.StatusInternalServerError
+	case errors.Is(err, ErrNoMergeOperator):
+		return ErrorCodeNoMergeOperator, http.StatusConflict
+	case errors.Is(err, ErrInvalidMergeValue):
+		return ErrorCodeInvalidMergeValue, http.StatusConflict
+	case errors.Is(err, ErrReadOnly):
+		return ErrorCodeReadOnly, http.StatusForbidden
+	case errors.Is(err, ErrClosed):
+		return ErrorCodeClosed, http.StatusServiceUnavailable
+	default:
+		return ErrorCodeInternal, http.StatusInternalServerError
+	}
+}
+
+// Writes a structured JSON error.
+func writeV2Error(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDetails{Code: code, Message: message}})
+}
+
+// Writes the structured JSON error matching an error of the engine.
+func writeV2EngineError(w http.ResponseWriter, err error) {
+	code, status := errorCodeFor(err)
+	writeV2Error(w, status, code, err.Error())
+}
+
+// Tells if the request is allowed to do an operation needing the permission on the keys start <= k < end, and
+// refuses it with a structured JSON error otherwise.
+func authorizeV2(w http.ResponseWriter, r *http.Request, permission Permission, start, end []byte) bool {
+	status, message := checkAccess(r, permission, start, end)
+	switch status {
+	case 0:
+		return true
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeV2Error(w, status, ErrorCodeUnauthorized, message)
+	default:
+		writeV2Error(w, status, ErrorCodeForbidden, message)
+	}
+	return false
+}
+
+// This is the request handler for the /v2/keys/{key} resource.
+// GET and HEAD return the raw value, PUT sets it to the raw request body (with "If-None-Match: *", only if the key
+// doesn't exist yet), and DELETE removes it.
+func keysV2Handler(lsmdb *DB, maxValueSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v2/keys/")
+
+		if len(key) == 0 {
+			writeV2Error(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "Key must not be empty")
+			return
+		}
+
+		if len(key) > math.MaxUint32 {
+			writeV2Error(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "Key length exceeds maximum allowed")
+			return
+		}
+
+		permission := PermissionWrite
+		if r.Method == "GET" || r.Method == "HEAD" {
+			permission = PermissionRead
+		}
+		if !authorizeV2(w, r, permission, []byte(key), keySuccessor([]byte(key))) {
+			return
+		}
+
+		switch r.Method {
+		case "GET", "HEAD":
+			value, size, err := lsmdb.GetStream([]byte(key))
+			if err != nil {
+				writeV2EngineError(w, err)
+				return
+			}
+			defer value.Close()
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+			if r.Method == "GET" {
+				io.Copy(w, value)
+			}
+
+		case "PUT":
+			if r.ContentLength > maxValueSize {
+				writeV2Error(w, http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge, "Value length exceeds maximum allowed")
+				return
+			}
+
+			put := lsmdb.PutStream
+			if r.Header.Get("If-None-Match") == "*" {
+				put = lsmdb.PutStreamIfAbsent
+			}
+
+			body := http.MaxBytesReader(w, r.Body, maxValueSize)
+			if err := put([]byte(key), body); err != nil {
+				writeV2EngineError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case "DELETE":
+			if _, err := lsmdb.Delete([]byte(key)); err != nil {
+				writeV2EngineError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+			writeV2Error(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Invalid request type")
+		}
+	}
+}
+
+// The default and the maximum number of items of a page of /v2/keys.
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 10000
+)
+
+// A key and its value, in a page of /v2/keys.
+type ScanItem struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// The body of the responses of /v2/keys. Next is the start of the following page, and is omitted on the last one.
+type ScanResponse struct {
+	Items []ScanItem `json:"items"`
+	Next  []byte     `json:"next,omitempty"`
+}
+
+// This is the request handler for the /v2/keys resource.
+// GET returns, in increasing order, at most limit of the keys k such that start <= k < end (each bound is optional),
+// with their values. The keys and values are base64 encoded, as the bounds of the query are.
+func scanV2Handler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeV2Error(w, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed, "Invalid request type")
+			return
+		}
+
+		query := r.URL.Query()
+
+		var bounds [2][]byte
+		for i, name := range []string{"start", "end"} {
+			if !query.Has(name) {
+				continue
+			}
+			bound, err := base64.StdEncoding.DecodeString(query.Get(name))
+			if err != nil {
+				writeV2Error(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid "+name+": "+err.Error())
+				return
+			}
+			bounds[i] = bound
+		}
+
+		if !authorizeV2(w, r, PermissionRead, bounds[0], bounds[1]) {
+			return
+		}
+
+		limit := defaultScanLimit
+		if query.Has("limit") {
+			n, err := strconv.Atoi(query.Get("limit"))
+			if err != nil || n <= 0 || n > maxScanLimit {
+				writeV2Error(w, http.StatusBadRequest, ErrorCodeInvalidRequest, "Invalid limit")
+				return
+			}
+			limit = n
+		}
+
+		it, err := lsmdb.NewIteratorContext(r.Context(), bounds[0], bounds[1])
+		if err != nil {
+			writeV2EngineError(w, err)
+			return
+		}
+		defer it.Close()
+
+		response := ScanResponse{Items: []ScanItem{}}
+		for ; it.Valid(); it.Next() {
+			if len(response.Items) == limit {
+				response.Next = it.Key()
+				break
+			}
+			response.Items = append(response.Items, ScanItem{Key: it.Key(), Value: it.Value()})
+		}
+		if err := it.Err(); err != nil {
+			writeV2EngineError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
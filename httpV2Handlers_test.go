@@ -0,0 +1,135 @@
+package lsmdb
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestKeysV2Handler(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	server := httptest.NewServer(keysV2Handler(lsmdb, 100))
+	defer server.Close()
+
+	do := func(method, key, body string, header map[string]string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+"/v2/keys/"+key, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	expectError := func(resp *http.Response, status int, code ErrorCode) {
+		if resp.StatusCode != status {
+			t.Errorf("Expected status %d, got %d", status, resp.StatusCode)
+		}
+		var body ErrorResponse
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != code {
+			t.Errorf("Expected error code %s, got %s", code, body.Error.Code)
+		}
+	}
+
+	expectError(do("GET", "key", "", nil), http.StatusNotFound, ErrorCodeKeyNotFound)
+
+	if resp := do("PUT", "key", "value", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+
+	resp := do("GET", "key", "", nil)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Errorf("Expected status 200 with 5 bytes, got %d with %d bytes", resp.StatusCode, resp.ContentLength)
+	}
+
+	if resp := do("HEAD", "key", "", nil); resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Errorf("Expected status 200 with 5 bytes, got %d with %d bytes", resp.StatusCode, resp.ContentLength)
+	}
+
+	expectError(do("PUT", "key", "other", map[string]string{"If-None-Match": "*"}), http.StatusConflict, ErrorCodeKeyExists)
+	expectError(do("PUT", "key", strings.Repeat("x", 101), nil), http.StatusRequestEntityTooLarge, ErrorCodeValueTooLarge)
+
+	resp = do("POST", "key", "", nil)
+	expectError(resp, http.StatusMethodNotAllowed, ErrorCodeMethodNotAllowed)
+	if allow := resp.Header.Get("Allow"); allow == "" {
+		t.Error("Expected an Allow header")
+	}
+
+	if resp := do("DELETE", "key", "", nil); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status 204, got %d", resp.StatusCode)
+	}
+	expectError(do("DELETE", "key", "", nil), http.StatusNotFound, ErrorCodeKeyNotFound)
+}
+
+func TestScanV2Handler(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	for i := 0; i < 5; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	lsmdb.Delete([]byte("key2"))
+
+	server := httptest.NewServer(scanV2Handler(lsmdb))
+	defer server.Close()
+
+	scan := func(query url.Values) ScanResponse {
+		resp, err := http.Get(server.URL + "/v2/keys?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+
+		var page ScanResponse
+		if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	// The pages are followed until the end of the range
+	var keys []string
+	query := url.Values{"start": {base64.StdEncoding.EncodeToString([]byte("key1"))}, "limit": {"2"}}
+	for {
+		page := scan(query)
+		for _, item := range page.Items {
+			keys = append(keys, string(item.Key)+"="+string(item.Value))
+		}
+		if page.Next == nil {
+			break
+		}
+		query.Set("start", base64.StdEncoding.EncodeToString(page.Next))
+	}
+	if strings.Join(keys, ",") != "key1=value1,key3=value3,key4=value4" {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	page := scan(url.Values{"end": {base64.StdEncoding.EncodeToString([]byte("key1"))}})
+	if len(page.Items) != 1 || string(page.Items[0].Key) != "key0" || page.Next != nil {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	resp, err := http.Get(server.URL + "/v2/keys?limit=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,379 @@
+package lsmdb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Iterates over the keys of a range in increasing order.
+// The iterator sees the range as it was when it was created: it merges, in a single pass, the entries of the memTable
+// at that time with the sorted entries of the sst files, and folds the merge operands of each key into its value.
+// Deleted and expired keys are skipped. It must be closed if it is not iterated until the end.
+type Iterator struct {
+	lsmdb *DB
+	ctx   context.Context
+
+	// The streams of entries of the memTable and of the sst files, from the newest to the oldest, with their current
+	// entries (the streams are nil once they are closed, and the entries once they are exhausted)
+	streams []entryStream
+	heads   []*Entry
+
+	key   []byte
+	value []byte
+	valid bool
+	err   error
+}
+
+// Returns an iterator over the keys k such that start <= k < end. A nil start or end means the range is not bounded.
+func (lsmdb *DB) NewIterator(start, end []byte) (*Iterator, error) {
+	return lsmdb.NewIteratorContext(context.Background(), start, end)
+}
+
+// Like NewIterator, but the iteration stops with the error of ctx once it is done.
+func (lsmdb *DB) NewIteratorContext(ctx context.Context, start, end []byte) (*Iterator, error) {
+	unlock, err := lsmdb.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	streams, err := lsmdb.openEntryStreams(start, end)
+	unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	it := &Iterator{
+		lsmdb:   lsmdb,
+		ctx:     ctx,
+		streams: streams,
+		heads:   make([]*Entry, len(streams)),
+	}
+	for i := range streams {
+		if err := it.advance(i); err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	it.Next()
+
+	return it, nil
+}
+
+// Moves the iterator to the next key having a value.
+func (it *Iterator) Next() {
+	it.valid = false
+
+	for it.err == nil {
+		if err := it.ctx.Err(); err != nil {
+			it.fail(err)
+			return
+		}
+
+		// The smallest key of the streams is the next one
+		var key []byte
+		found := false
+		for _, head := range it.heads {
+			if head != nil && (!found || bytes.Compare(head.key, key) < 0) {
+				key, found = head.key, true
+			}
+		}
+		if !found {
+			it.Close()
+			return
+		}
+
+		// The entries of the key, from the newest to the oldest
+		entries := make([]Entry, 0, 1)
+		for i, head := range it.heads {
+			if head != nil && bytes.Equal(head.key, key) {
+				entries = append(entries, *head)
+				if err := it.advance(i); err != nil {
+					it.fail(err)
+					return
+				}
+			}
+		}
+
+		value, err := it.resolve(key, entries)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			it.fail(err)
+			return
+		}
+
+		it.key, it.value, it.valid = key, value, true
+		return
+	}
+}
+
+// Moves the stream i to its next entry, and closes it once it is exhausted.
+func (it *Iterator) advance(i int) error {
+	entry, err := it.streams[i].next()
+	if err == io.EOF {
+		it.heads[i] = nil
+		err = it.streams[i].Close()
+		it.streams[i] = nil
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	it.heads[i] = &entry
+	return nil
+}
+
+// Returns the value of the key given its entries, from the newest to the oldest, the way get reads it.
+func (it *Iterator) resolve(key []byte, entries []Entry) ([]byte, error) {
+	var pending []byte
+
+	for _, entry := range entries {
+		switch entry.op {
+		case DelOp:
+			return it.lsmdb.foldOperands(key, nil, pending)
+
+		// The operands of older entries are folded before the newer ones
+		case MergeOp:
+			pending = append(entry.value, pending...)
+
+		case ValuePointerOp:
+			value, err := it.readValueLog(key, entry.value)
+			if err != nil {
+				return nil, err
+			}
+			return it.lsmdb.foldOperands(key, value, pending)
+
+		case ExpiringSetOp:
+			expireAt, value := decodeExpiringValue(entry.value)
+			if isExpired(expireAt) {
+				value = nil
+			}
+			return it.lsmdb.foldOperands(key, value, pending)
+
+		default:
+			return it.lsmdb.foldOperands(key, entry.value, pending)
+		}
+	}
+
+	return it.lsmdb.foldOperands(key, nil, pending)
+}
+
+// Reads the value the encoded pointer of the key points to in the value log.
+func (it *Iterator) readValueLog(key, encodedPtr []byte) ([]byte, error) {
+	unlock, err := it.lsmdb.lockContext(it.ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, err := it.lsmdb.readValueLog(encodedPtr)
+	unlock()
+
+	// The garbage collector reclaimed the segment since the iterator was created, after moving the value if it is
+	// still used, so the current value of the key is read instead
+	if os.IsNotExist(err) {
+		return it.lsmdb.GetContext(it.ctx, key)
+	}
+	return value, err
+}
+
+// Stops the iteration with the error.
+func (it *Iterator) fail(err error) {
+	it.err = err
+	it.valid = false
+	it.Close()
+}
+
+// Tells if the iterator is on a key. It is false once the iteration is over or if an error happened.
+func (it *Iterator) Valid() bool {
+	return it.valid && it.err == nil
+}
+
+func (it *Iterator) Key() []byte {
+	return it.key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.value
+}
+
+// Returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Releases the sst files read by the iterator. It is done once the iteration is over, and can be called any time.
+func (it *Iterator) Close() error {
+	var firstErr error
+	for i, stream := range it.streams {
+		if stream == nil {
+			continue
+		}
+		it.streams[i], it.heads[i] = nil, nil
+		if err := stream.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Returns at most count keys having a value, in increasing order, from the first key after the key after (from the
+// first key if it is nil), along with the last of them to continue from (nil once the end is reached).
+// As the scan resumes from a key, the keys that exist during a whole scan are returned exactly once, whatever the
+// flushes and compactions in between.
+func (lsmdb *DB) ScanKeys(after []byte, count int) ([][]byte, []byte, error) {
+	var start []byte
+	if after != nil {
+		start = keySuccessor(after)
+	}
+
+	it, err := lsmdb.NewIterator(start, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.Close()
+
+	found := make([][]byte, 0)
+	for ; it.Valid() && len(found) < max(count, 1); it.Next() {
+		found = append(found, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if !it.Valid() {
+		return found, nil, nil
+	}
+	return found, found[len(found)-1], nil
+}
+
+// A sorted stream of the entries of the memTable or of an sst file in a range of keys.
+type entryStream interface {
+	// Returns the next entry, or io.EOF once there are no more
+	next() (Entry, error)
+	Close() error
+}
+
+// Returns the streams of the entries k such that start <= k < end of the memTable and of the sst files, from the
+// newest to the oldest. It must be called with the database locked.
+func (lsmdb *DB) openEntryStreams(start, end []byte) ([]entryStream, error) {
+	inRange := func(key []byte) bool {
+		return (start == nil || bytes.Compare(key, start) >= 0) && (end == nil || bytes.Compare(key, end) < 0)
+	}
+
+	// The entries of the memTable are copied, as it changes with the writes
+	mem := &memTableStream{}
+	for it := lsmdb.memTable.sortedMap.Iterator(); it.Valid(); it.Next() {
+		if inRange([]byte(it.Key())) {
+			op, value := parseInMemValue(it.Value())
+			mem.entries = append(mem.entries, Entry{op: op, key: []byte(it.Key()), value: bytes.Clone(value)})
+		}
+	}
+	streams := []entryStream{mem}
+
+	if err := lsmdb.setCurrentSSTIndex(); err != nil {
+		return nil, err
+	}
+
+	// The sst files stay readable once they are open, even if a compaction removes them
+	for i := lsmdb.sstFilesNum; i >= 1; i-- {
+		stream, err := lsmdb.openSSTFileStream(i, start, end)
+		if err != nil {
+			for _, stream := range streams {
+				stream.Close()
+			}
+			return nil, err
+		}
+		if stream != nil {
+			streams = append(streams, stream)
+		}
+	}
+
+	return streams, nil
+}
+
+// The entries of the memTable in a range of keys.
+type memTableStream struct {
+	entries []Entry
+}
+
+func (stream *memTableStream) next() (Entry, error) {
+	if len(stream.entries) == 0 {
+		return Entry{}, io.EOF
+	}
+
+	entry := stream.entries[0]
+	stream.entries = stream.entries[1:]
+	return entry, nil
+}
+
+func (stream *memTableStream) Close() error {
+	stream.entries = nil
+	return nil
+}
+
+// The entries of an sst file in a range of keys, read as the stream goes.
+type sstFileStream struct {
+	file       *os.File
+	r          *bufio.Reader
+	start, end []byte
+}
+
+// Opens the stream of the entries of an sst file in the range, or returns nil if the file doesn't overlap it.
+func (lsmdb *DB) openSSTFileStream(sstFileNum int, start, end []byte) (*sstFileStream, error) {
+	filePath := fmt.Sprint(lsmdb.sstPath, "f", sstFileNum, ".sst")
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	magicNumber, _, smallestKey, largestKey, version, err := readHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if !bytes.Equal(magicNumber, lsmdb.magicNumber[:]) {
+		file.Close()
+		return nil, ErrCorruptedFile
+	}
+
+	if version != lsmdb.version {
+		file.Close()
+		return nil, ErrOutdatedVersion
+	}
+
+	// Skipping the files that don't overlap the range
+	if (end != nil && bytes.Compare(smallestKey, end) >= 0) || (start != nil && bytes.Compare(largestKey, start) < 0) {
+		file.Close()
+		return nil, nil
+	}
+
+	return &sstFileStream{file: file, r: bufio.NewReader(file), start: start, end: end}, nil
+}
+
+func (stream *sstFileStream) next() (Entry, error) {
+	for {
+		op, k, v, err := decodeNext(stream.r)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		// The entries are sorted, there is nothing left in the range
+		if stream.end != nil && bytes.Compare(k, stream.end) >= 0 {
+			return Entry{}, io.EOF
+		}
+
+		if stream.start == nil || bytes.Compare(k, stream.start) >= 0 {
+			return Entry{op: OperationType(op), key: k, value: v}, nil
+		}
+	}
+}
+
+func (stream *sstFileStream) Close() error {
+	return stream.file.Close()
+}
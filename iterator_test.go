@@ -0,0 +1,130 @@
+package lsmdb
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLSMDB_NewIterator(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = StringAppendOperator{}
+
+	lsmdb.Put([]byte("a"), []byte("1"))
+	lsmdb.Put([]byte("b"), []byte("2"))
+	lsmdb.Put([]byte("c"), []byte("3"))
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+
+	lsmdb.Delete([]byte("b"))
+	lsmdb.Merge([]byte("c"), []byte("4"))
+	lsmdb.Put([]byte("d"), []byte("5"))
+	lsmdb.Put([]byte("e"), []byte("6"))
+
+	it, err := lsmdb.NewIterator([]byte("a"), []byte("e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]string)
+	var order []string
+	for ; it.Valid(); it.Next() {
+		got[string(it.Key())] = string(it.Value())
+		order = append(order, string(it.Key()))
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+
+	if !reflect.DeepEqual(order, []string{"a", "c", "d"}) {
+		t.Errorf("Expected the keys a, c and d, got %v", order)
+	}
+	if got["c"] != "34" {
+		t.Errorf("Expected the merged value 34, got %s", got["c"])
+	}
+}
+
+func TestLSMDB_ScanKeys(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		lsmdb.Put([]byte(key), []byte("value"))
+	}
+	lsmdb.Delete([]byte("b"))
+	if err := lsmdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	var cursor []byte
+	for {
+		found, next, err := lsmdb.ScanKeys(cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range found {
+			keys = append(keys, string(key))
+		}
+
+		// Deleting a key already returned and compacting away the tombstones doesn't make the scan skip any key
+		lsmdb.Delete([]byte("a"))
+		if err := lsmdb.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := lsmdb.CompactRange(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+
+	if !reflect.DeepEqual(keys, []string{"a", "c", "d", "e"}) {
+		t.Errorf("Expected the keys a, c, d and e, got %v", keys)
+	}
+}
+
+func TestLSMDB_NewIterator_ValueLogAndExpiry(t *testing.T) {
+	lsmdb, err := Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lsmdb.Close()
+
+	big := bytes.Repeat([]byte("v"), 2048)
+	lsmdb.Put([]byte("big"), big)
+	lsmdb.PutWithExpiry([]byte("expired"), []byte("old"), time.Now().Add(-time.Second))
+	lsmdb.Put([]byte("small"), []byte("value"))
+	if err := lsmdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	lsmdb.PutWithExpiry([]byte("small"), []byte("new"), time.Now().Add(time.Hour))
+
+	it, err := lsmdb.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string][]byte)
+	for ; it.Valid(); it.Next() {
+		got[string(it.Key())] = it.Value()
+	}
+	if it.Err() != nil {
+		t.Fatal(it.Err())
+	}
+	if len(got) != 2 || !bytes.Equal(got["big"], big) || string(got["small"]) != "new" {
+		t.Errorf("Expected the keys big and small, got %q", got)
+	}
+
+	// An iterator left before the end is closed
+	it, err = lsmdb.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := it.Close(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
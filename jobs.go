@@ -0,0 +1,154 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrJobNotFound = errors.New("the job was not found")
+)
+
+// The number of finished jobs whose status is kept, the oldest ones are forgotten beyond it
+const maxFinishedJobs = 100
+
+type JobStatus string
+
+const (
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// A job running in the background of the database, while it keeps serving
+type BackgroundJob struct {
+	ID         uint64     `json:"id"`
+	Kind       string     `json:"kind"`
+	Status     JobStatus  `json:"status"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+
+	// The error of a failed job
+	Error string `json:"error,omitempty"`
+
+	// The outcome of the job, if it has one (a failed job can have one too)
+	Result any `json:"result,omitempty"`
+}
+
+// The jobs of the database, running or recently finished (only used on the default one)
+type backgroundJobs struct {
+	mu     sync.Mutex
+	lastID uint64
+	jobs   map[uint64]*BackgroundJob
+}
+
+// Records the start of a job of the kind, and returns its id with the function recording its end with its result
+// and its error.
+func (lsmdb *DB) startJob(kind string) (uint64, func(result any, err error)) {
+	jobs := &lsmdb.rootDB().jobs
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if jobs.jobs == nil {
+		jobs.jobs = make(map[uint64]*BackgroundJob)
+	}
+	jobs.lastID++
+	job := &BackgroundJob{ID: jobs.lastID, Kind: kind, Status: JobRunning, StartedAt: time.Now().UTC()}
+	jobs.jobs[job.ID] = job
+
+	return job.ID, func(result any, err error) {
+		jobs.mu.Lock()
+		defer jobs.mu.Unlock()
+
+		finishedAt := time.Now().UTC()
+		job.FinishedAt = &finishedAt
+		job.Result = result
+		job.Status = JobSucceeded
+		if err != nil {
+			job.Status = JobFailed
+			job.Error = err.Error()
+		}
+
+		jobs.forgetOldJobs()
+	}
+}
+
+// Forgets the oldest finished jobs beyond maxFinishedJobs. It must be called with the jobs locked.
+func (jobs *backgroundJobs) forgetOldJobs() {
+	var finished []uint64
+	for _, id := range slices.Sorted(maps.Keys(jobs.jobs)) {
+		if jobs.jobs[id].Status != JobRunning {
+			finished = append(finished, id)
+		}
+	}
+
+	for len(finished) > maxFinishedJobs {
+		delete(jobs.jobs, finished[0])
+		finished = finished[1:]
+	}
+}
+
+// Returns the jobs running in the background, from the oldest to the newest.
+func (lsmdb *DB) RunningJobs() []BackgroundJob {
+	jobs := &lsmdb.rootDB().jobs
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	running := make([]BackgroundJob, 0)
+	for _, id := range slices.Sorted(maps.Keys(jobs.jobs)) {
+		if jobs.jobs[id].Status == JobRunning {
+			running = append(running, *jobs.jobs[id])
+		}
+	}
+
+	return running
+}
+
+// Returns the job with the id, running or recently finished, or ErrJobNotFound.
+func (lsmdb *DB) Job(id uint64) (BackgroundJob, error) {
+	jobs := &lsmdb.rootDB().jobs
+
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	job, ok := jobs.jobs[id]
+	if !ok {
+		return BackgroundJob{}, ErrJobNotFound
+	}
+
+	return *job, nil
+}
+
+// This is the request handler returning the status of a job (/admin/jobs/<id>)
+func jobHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/admin/jobs/"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid job id", http.StatusBadRequest)
+			return
+		}
+
+		job, err := lsmdb.Job(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,4 @@
+// Package kvpb holds the protobuf messages and the gRPC client and server of the key-value store.
+package kvpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative kvstore.proto
@@ -1,21 +1,28 @@
-package main
+package lsmdb
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
+	"time"
 )
 
 var (
 	ErrCorruptedFile   = errors.New("the file is corrupted")
 	ErrKeyDeleted      = errors.New("the key was deleted")
 	ErrOutdatedVersion = errors.New("the file version is not compatible with the current version")
+	ErrClosed          = errors.New("the database is closed")
+	ErrKeyExists       = errors.New("the key already exists")
 )
 
-type lsmDB struct {
+type DB struct {
 
 	// The in-memory database
 	memTable *MemTable
@@ -29,8 +36,9 @@ type lsmDB struct {
 	// The version of the software
 	version byte
 
-	// The metadata file contains the current number of sst files
-	// That number is represented as a 4 bytes integer inside the file
+	// The metadata file contains the current number of sst files and the flushed sequence number:
+	// [sstFilesNum(4 bytes)][flushedSeq(8 bytes)] (the files written before the flushed sequence number only have the
+	// number of sst files)
 	metadataFileName string
 
 	// The maximum number of bytes our memTable can hold before it is flushed to the disk
@@ -44,63 +52,228 @@ type lsmDB struct {
 
 	// Number of current sst files
 	sstFilesNum int
+
+	// The sequence number of the last WAL record whose changes are in the sst files. The older records are not
+	// applied again when the WAL is replayed, as the WAL is only cleared once all the column families are flushed.
+	flushedSeq uint64
+
+	// The operator used to fold merge operands into values, nil if merges are not supported
+	mergeOperator MergeOperator
+
+	// The name of the column family, empty for the default one
+	familyName string
+
+	// The database owning this column family, nil for the default one
+	root *DB
+
+	// The other column families by name (only set on the default one)
+	families map[string]*DB
+
+	// The manifest file records the creation and the deletion of column families
+	manifestFileName string
+
+	// Path to the directories of the column families
+	familiesPath string
+
+	// Path to the value log directory, empty if all the values are stored in the LSM tree
+	valueLogPath string
+
+	// The values of this size or bigger are written to the value log
+	valueThreshold int
+
+	// The size after which a value log segment is closed and a new one is started
+	valueLogSegmentSize int64
+
+	// The value log, nil if it is not enabled
+	valueLog *ValueLog
+
+	// The subscriptions to the changes of the keys (only set on the default one)
+	subscriptions map[*Subscription]struct{}
+
+	// The followers the WAL records are shipped to (only set on the default one)
+	replicationFeeds map[*replicationFeed]struct{}
+
+	// Tells if the database only takes the changes of its leader (only set on the default one)
+	readOnly bool
+
+	// The cluster the writes of the HTTP API are proposed to in cluster mode, nil otherwise (only set on the default
+	// one)
+	cluster Cluster
+
+	// The directory holding all the files of the database, locked while it is open. It is empty if the files are
+	// not locked (only set on the default one)
+	dataDir string
+
+	// The open LOCK file of the data directory, holding its lock
+	dirLock *os.File
+
+	// The UUID of the database, read from the IDENTITY file of the data directory
+	identity string
+
+	// Tells if the memTables are flushed to sst files when the database is closed, so it restarts without replaying
+	// the WAL (only set on the default one)
+	flushOnClose bool
+
+	// Tells if the database is closed (only set on the default one)
+	closed bool
+
+	// The counters exposed by WriteMetrics (only used on the default one)
+	metrics engineMetrics
+
+	// The jobs running in the background (only used on the default one)
+	jobs backgroundJobs
+
+	// Guards the database, it is shared by all the column families (only the one of the default column family is used)
+	mu sync.Mutex
+}
+
+// Locks the database, and returns the function unlocking it.
+func (lsmdb *DB) lock() func() {
+	root := lsmdb.rootDB()
+	root.mu.Lock()
+	return root.mu.Unlock
 }
 
-func (lsmdb *lsmDB) setCurrentSSTIndex() error {
+// Locks the database like lock, unless ctx is done before the lock is acquired.
+// The operations run with a context check it once they hold the lock, so they are never started after their deadline.
+func (lsmdb *DB) lockContext(ctx context.Context) (func(), error) {
+	root := lsmdb.rootDB()
+
+	// Contexts that can't be cancelled don't need the lock to be acquired in another goroutine
+	if ctx.Done() == nil {
+		root.mu.Lock()
+		if root.closed {
+			root.mu.Unlock()
+			return nil, ErrClosed
+		}
+		return root.mu.Unlock, nil
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		root.mu.Lock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		if err := ctx.Err(); err != nil {
+			root.mu.Unlock()
+			return nil, err
+		}
+		if root.closed {
+			root.mu.Unlock()
+			return nil, ErrClosed
+		}
+		return root.mu.Unlock, nil
+
+	case <-ctx.Done():
+		// The lock is released as soon as it is acquired
+		go func() {
+			<-locked
+			root.mu.Unlock()
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (lsmdb *DB) setCurrentSSTIndex() error {
 	content, err := os.ReadFile(lsmdb.metadataFileName)
 	if err != nil {
 		return err
 	}
 
-	if len(content) != 4 {
+	if len(content) != 4 && len(content) != 12 {
 		return ErrCorruptedFile
 	}
 
 	currIdx := binary.BigEndian.Uint32(content)
 	lsmdb.sstFilesNum = int(currIdx)
 
+	lsmdb.flushedSeq = 0
+	if len(content) == 12 {
+		lsmdb.flushedSeq = binary.BigEndian.Uint64(content[4:])
+	}
+
 	return nil
 }
 
-func (lsmdb *lsmDB) updateMetadataFile() error {
-	file, err := os.OpenFile(lsmdb.metadataFileName, os.O_RDWR|os.O_TRUNC, 0666)
-	defer file.Close()
-	if err != nil {
-		return err
-	}
-
-	if _, err := file.Write(encode4BytesInt(lsmdb.sstFilesNum)); err != nil {
-		return err
-	}
+// Writes the number of sst files and the flushed sequence number to the metadata file, atomically.
+func (lsmdb *DB) updateMetadataFile() error {
+	return writeFileAtomically(lsmdb.metadataFileName, lsmdb.encodeMetadata())
+}
 
-	return nil
+func (lsmdb *DB) encodeMetadata() []byte {
+	return binary.BigEndian.AppendUint64(encode4BytesInt(lsmdb.sstFilesNum), lsmdb.flushedSeq)
 }
 
 // Returns a new header to be written to a new sst file.
 // The sst files header is of this form: [magicNumber(4 bytes)][entryCount(4 bytes)]
 // [lenSmallestKey(4 bytes)][SmallestKey][lenLargestKey(4 bytes)][largestKey][version(1 byte)]
-func (lsmdb *lsmDB) createHeader() []byte {
-	header := make([]byte, 0)
-	header = append(header, lsmdb.magicNumber[:]...)
-	header = append(header, encode4BytesInt(lsmdb.memTable.sortedMap.Len())...)
-
+func (lsmdb *DB) createHeader() []byte {
 	smallestKey := []byte(lsmdb.memTable.sortedMap.Iterator().Key())
-	lenSmallestKey := len(smallestKey)
-
 	largestKey := []byte(lsmdb.memTable.sortedMap.Reverse().Key())
-	lenLargestKey := len(largestKey)
 
-	header = append(header, encode4BytesInt(lenSmallestKey)...)
+	return lsmdb.encodeHeader(lsmdb.memTable.sortedMap.Len(), smallestKey, largestKey)
+}
+
+// Returns the header of an sst file holding entryCount entries, from smallestKey to largestKey.
+func (lsmdb *DB) encodeHeader(entryCount int, smallestKey, largestKey []byte) []byte {
+	header := make([]byte, 0)
+	header = append(header, lsmdb.magicNumber[:]...)
+	header = append(header, encode4BytesInt(entryCount)...)
+
+	header = append(header, encode4BytesInt(len(smallestKey))...)
 	header = append(header, smallestKey...)
-	header = append(header, encode4BytesInt(lenLargestKey)...)
+	header = append(header, encode4BytesInt(len(largestKey))...)
 	header = append(header, largestKey...)
 	header = append(header, lsmdb.version)
 
 	return header
 }
 
-// Flushes the current memTable to a new sst file, and clears the WAL.
-func (lsmdb *lsmDB) flushToDisk() error {
+// Flushes the memTables of all the column families to new sst files, clears them, and clears the WAL.
+// All the column families are flushed together because they share the WAL.
+func (lsmdb *DB) flushToDisk() error {
+	root := lsmdb.rootDB()
+
+	for _, family := range root.allFamilies() {
+		if family.memTable.sortedMap.Len() == 0 {
+			continue
+		}
+
+		// The sst file holds the changes of all the records logged so far
+		flushedSeq := family.flushedSeq
+		family.flushedSeq = root.wal.lastSeq
+		if err := family.writeMemTableToSST(); err != nil {
+			family.flushedSeq = flushedSeq
+			return err
+		}
+
+		family.memTable.sortedMap.Clear()
+	}
+
+	// Clearing the wal
+	if err := root.wal.clear(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Flushes the memTables of all the column families to sst files, so the WAL is empty.
+func (lsmdb *DB) Flush() error {
+	unlock, err := lsmdb.lockContext(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lsmdb.flushToDisk()
+}
+
+// Writes the current memTable to a new sst file.
+func (lsmdb *DB) writeMemTableToSST() error {
 
 	newSSTFilesNum := lsmdb.sstFilesNum + 1
 
@@ -114,92 +287,192 @@ func (lsmdb *lsmDB) flushToDisk() error {
 
 	defer sstFile.Close()
 
+	// The checksum of the file is computed while it is written
+	hash := sha256.New()
+	w := io.MultiWriter(sstFile, hash)
+
 	// Writing the header of the file
 	header := lsmdb.createHeader()
-	if _, err := sstFile.Write(header); err != nil {
+	if _, err := w.Write(header); err != nil {
 		return err
 	}
 
+	written := int64(len(header))
+
 	// Flushing entries from memTable to the new sst file
 	for it := lsmdb.memTable.sortedMap.Iterator(); it.Valid(); it.Next() {
 		entry := lsmdb.memTable.makeEntry([]byte(it.Key()))
 		encoded := entry.encode()
 
-		if _, err := sstFile.Write(encoded); err != nil {
+		if _, err := w.Write(encoded); err != nil {
 			return err
 		}
+		written += int64(len(encoded))
 	}
 
-	lsmdb.sstFilesNum++
-	// Updating the metadata file
-	if err := lsmdb.updateMetadataFile(); err != nil {
+	if err := lsmdb.writeSSTChecksum(newSSTFilesNum, hex.EncodeToString(hash.Sum(nil))); err != nil {
 		return err
 	}
 
-	// Clearing the wal
-	if err := lsmdb.wal.clear(); err != nil {
-		return err
-	}
+	metrics := &lsmdb.rootDB().metrics
+	metrics.flushes.Add(1)
+	metrics.flushedBytes.Add(written)
 
-	return nil
+	lsmdb.sstFilesNum++
+	// Updating the metadata file
+	return lsmdb.updateMetadataFile()
 }
 
 // Loads the entries from the WAL to the MemTable
-func (lsmdb *lsmDB) loadWALtoMemTable() error {
+func (lsmdb *DB) loadWALtoMemTable() error {
 	// Seeking to the beginning of the WAL
 	if _, err := lsmdb.wal.logFile.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
 
+	// Without a sequence record at its beginning, the WAL follows the last retained segment
+	lastSeq, err := lsmdb.wal.lastRetainedSeq()
+	if err != nil {
+		return err
+	}
+	lsmdb.wal.baseSeq, lsmdb.wal.lastSeq = lastSeq, lastSeq
+
 	// Decoding every entry and loading it to the memTable
 	for {
 		op, key, value, err := decodeNext(lsmdb.wal.logFile)
 		if err != nil {
-			if err == io.EOF {
-				return nil
+			// An entry cut at the end of the WAL was not completely written when the database stopped, it is ignored
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return lsmdb.continueFlushedSequence()
 			}
 			return err
 		}
 
-		lsmdb.memTable.writeOperation(OperationType(op), key, value)
+		if OperationType(op) == SequenceOp {
+			lsmdb.wal.baseSeq = binary.BigEndian.Uint64(value)
+			lsmdb.wal.lastSeq = lsmdb.wal.baseSeq
+			continue
+		}
+		if OperationType(op) == TimestampOp {
+			continue
+		}
+		lsmdb.wal.lastSeq++
+
+		if OperationType(op) == BatchOp {
+			if err := lsmdb.applyBatchRecord(value, lsmdb.wal.lastSeq); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// The changes already in the sst files are not applied twice (the merges are not idempotent)
+		if lsmdb.wal.lastSeq <= lsmdb.flushedSeq {
+			continue
+		}
+
+		if err := lsmdb.applyToMemTable(OperationType(op), key, value); err != nil {
+			return err
+		}
+	}
+}
+
+// Makes the sequence numbers follow the flushed ones, once the WAL is replayed. They are behind only if the database
+// stopped while the WAL was cleared, before its sequence record was written: the WAL is empty, and gets the record.
+func (lsmdb *DB) continueFlushedSequence() error {
+	flushedSeq := uint64(0)
+	for _, family := range lsmdb.allFamilies() {
+		flushedSeq = max(flushedSeq, family.flushedSeq)
+	}
+	if lsmdb.wal.lastSeq >= flushedSeq {
+		return nil
+	}
+
+	lsmdb.wal.baseSeq, lsmdb.wal.lastSeq = flushedSeq, flushedSeq
+	return lsmdb.wal.appendEntry(Entry{op: SequenceOp, value: binary.BigEndian.AppendUint64(nil, flushedSeq)})
+}
+
+// Applies an operation read from the WAL to the memTable.
+func (lsmdb *DB) applyToMemTable(op OperationType, key, value []byte) error {
+	if op == MergeOp {
+		if err := lsmdb.loadPointedValue(key); err != nil {
+			return err
+		}
+
+		// A merge that could not be folded was rejected when it was written, so it is skipped here as well
+		if err := lsmdb.memTable.Merge(key, value, lsmdb.mergeOperator); err != nil && err != ErrInvalidMergeValue {
+			return err
+		}
+		return nil
 	}
+
+	lsmdb.memTable.writeOperation(op, key, value)
+	return nil
 }
 
 // Search for a key in an sst file.
 // Returns the value if the key is found, otherwise, if the key doesn't exist at all, returns nil, ErrKeyNotFound.
-// Otherwise if the key was deleted, returns nil, ErrKeyDeleted.
-func (lsmdb *lsmDB) searchSSTFile(sstFileNum int, key []byte) ([]byte, error) {
+// Otherwise if the key was deleted (or it expired), returns nil, ErrKeyDeleted.
+// If the key only holds merge operands in this file, returns the encoded operands, ErrKeyMerged.
+// If the value of the key is in the value log, returns the encoded pointer to it, ErrValueInLog.
+func (lsmdb *DB) searchSSTFile(sstFileNum int, key []byte) ([]byte, error) {
+	op, v, err := lsmdb.lookupSSTFile(sstFileNum, key)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op {
+	case DelOp:
+		return nil, ErrKeyDeleted
+	case MergeOp:
+		return v, ErrKeyMerged
+	case ValuePointerOp:
+		return v, ErrValueInLog
+	case ExpiringSetOp:
+		expireAt, value := decodeExpiringValue(v)
+		if isExpired(expireAt) {
+			return nil, ErrKeyDeleted
+		}
+		return value, nil
+	default:
+		return v, nil
+	}
+}
+
+// Returns the operation and the value of the entry of the key in an sst file, or ErrKeyNotFound if there is none.
+func (lsmdb *DB) lookupSSTFile(sstFileNum int, key []byte) (OperationType, []byte, error) {
 	filePath := fmt.Sprint(lsmdb.sstPath, "f", sstFileNum, ".sst")
 	file, err := os.OpenFile(filePath, os.O_RDONLY, 0600)
 
 	defer file.Close()
 
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	// Seeking to the beginning of the file
 	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	// Reading the header of the sst file
 	magicNumber, _, smallestKey, largestKey, version, err := readHeader(file)
 
 	if err != nil {
-		return nil, err
+		return 0, nil, err
 	}
 
 	if !bytes.Equal(magicNumber, lsmdb.magicNumber[:]) {
-		return nil, ErrCorruptedFile
+		return 0, nil, ErrCorruptedFile
 	}
 
 	if version != lsmdb.version {
-		return nil, ErrOutdatedVersion
+		return 0, nil, ErrOutdatedVersion
 	}
 
+	metrics := &lsmdb.rootDB().metrics
 	if bytes.Compare(key, smallestKey) < 0 || bytes.Compare(key, largestKey) > 0 {
-		return nil, ErrKeyNotFound
+		metrics.rangeFilterSkips.Add(1)
+		return 0, nil, ErrKeyNotFound
 	}
 
 	// If we reach here, it means that the key may be in the sst file
@@ -208,21 +481,22 @@ func (lsmdb *lsmDB) searchSSTFile(sstFileNum int, key []byte) ([]byte, error) {
 
 		if err != nil {
 			if err == io.EOF {
-				return nil, ErrKeyNotFound
+				metrics.rangeFilterFalsePositives.Add(1)
+				return 0, nil, ErrKeyNotFound
 			}
-			return nil, err
+			return 0, nil, err
 		}
 
 		if bytes.Equal(k, key) {
-			if OperationType(op) == DelOp {
-				return nil, ErrKeyDeleted
-			}
-			return v, nil
+			metrics.rangeFilterHits.Add(1)
+			return OperationType(op), v, nil
 		}
 	}
 }
 
-func (lsmdb *lsmDB) searchAllSSTFiles(key []byte) ([]byte, error) {
+// Searches the sst files from the newest to the oldest.
+// pending holds the encoded merge operands found in newer places (the memTable), they are folded into the value found.
+func (lsmdb *DB) searchAllSSTFiles(key []byte, pending []byte) ([]byte, error) {
 	if err := lsmdb.setCurrentSSTIndex(); err != nil {
 		return nil, err
 	}
@@ -234,82 +508,296 @@ func (lsmdb *lsmDB) searchAllSSTFiles(key []byte) ([]byte, error) {
 		if err != nil {
 			switch err {
 
-			// The key was deleted, directly stop the search and return nil
+			// The key was deleted, directly stop the search and fold the pending operands into nothing
 			case ErrKeyDeleted:
-				return nil, ErrKeyNotFound
+				return lsmdb.foldOperands(key, nil, pending)
 
 			// The key is not found in the current sst file, move to the next one
 			case ErrKeyNotFound:
 				continue
 
+			// The key only has operands in this file, they are older than the pending ones
+			case ErrKeyMerged:
+				pending = append(v, pending...)
+				continue
+
+			// The key was found but its value is in the value log
+			case ErrValueInLog:
+				if v, err = lsmdb.readValueLog(v); err != nil {
+					return nil, err
+				}
+
 			// Some other error happened
 			default:
 				return nil, err
 			}
 		}
-		return v, nil
+		if pending == nil {
+			return v, nil
+		}
+		return lsmdb.foldOperands(key, v, pending)
 	}
 
-	// We reach here if the key was not found in any sst file
-	return nil, ErrKeyNotFound
+	// We reach here if no base value was found in any sst file
+	return lsmdb.foldOperands(key, nil, pending)
 }
 
-func (lsmdb *lsmDB) Get(key []byte) ([]byte, error) {
+// Folds the encoded merge operands into the base value.
+// Returns ErrKeyNotFound if there is neither a base value nor operands.
+func (lsmdb *DB) foldOperands(key, base []byte, pending []byte) ([]byte, error) {
+	if pending == nil {
+		if base == nil {
+			return nil, ErrKeyNotFound
+		}
+		return base, nil
+	}
+
+	if lsmdb.mergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+
+	operands, err := decodeOperands(pending)
+	if err != nil {
+		return nil, err
+	}
+
+	return lsmdb.mergeOperator.FullMerge(key, base, operands)
+}
+
+func (lsmdb *DB) Get(key []byte) ([]byte, error) {
+	return lsmdb.GetContext(context.Background(), key)
+}
+
+// Like Get, but gives up with the error of ctx if it is done before the database can be read.
+func (lsmdb *DB) GetContext(ctx context.Context, key []byte) ([]byte, error) {
+	unlock, err := lsmdb.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return lsmdb.get(key)
+}
+
+func (lsmdb *DB) get(key []byte) ([]byte, error) {
+	metrics := &lsmdb.rootDB().metrics
+
 	value, err := lsmdb.memTable.Get(key)
 	switch err {
 	// if the key exists in the memTable
 	case nil:
+		metrics.memTableReads.Add(1)
 		return value, nil
 
 	// if the key is marked as deleted in the memTable
 	case ErrKeyDeleted:
+		metrics.missedReads.Add(1)
 		return nil, ErrKeyNotFound
 
+	// if the key only has merge operands in the memTable, the base value is searched in the sst files
+	case ErrKeyMerged:
+		value, err = lsmdb.searchAllSSTFiles(key, value)
+
+	// if the memTable holds a pointer to the value in the value log
+	case ErrValueInLog:
+		metrics.memTableReads.Add(1)
+		return lsmdb.readValueLog(value)
+
 	// if the key is not found in the memTable
 	default:
-		return lsmdb.searchAllSSTFiles(key)
+		value, err = lsmdb.searchAllSSTFiles(key, nil)
 	}
+
+	switch err {
+	case nil:
+		metrics.sstReads.Add(1)
+	case ErrKeyNotFound:
+		metrics.missedReads.Add(1)
+	}
+	return value, err
 }
 
-func (lsmdb *lsmDB) Set(key, value []byte) error {
-	entry := Entry{
-		op:    SetOp,
-		key:   key,
-		value: value,
+func (lsmdb *DB) Put(key, value []byte) error {
+	return lsmdb.PutContext(context.Background(), key, value)
+}
+
+// Like Put, but gives up with the error of ctx if it is done before the write is started.
+func (lsmdb *DB) PutContext(ctx context.Context, key, value []byte) error {
+	unlock, err := lsmdb.lockContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return lsmdb.set(key, value)
+}
+
+// Sets the value of the key if it has none, and returns ErrKeyExists otherwise.
+func (lsmdb *DB) putIfAbsent(key, value []byte) error {
+	defer lsmdb.lock()()
+
+	if err := lsmdb.checkAbsent(key); err != nil {
+		return err
+	}
+	return lsmdb.set(key, value)
+}
+
+// Returns ErrKeyExists if the key has a value. The lock must be held.
+func (lsmdb *DB) checkAbsent(key []byte) error {
+	_, err := lsmdb.get(key)
+	switch err {
+	case nil:
+		return ErrKeyExists
+	case ErrKeyNotFound:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (lsmdb *DB) set(key, value []byte) error {
+	// Checked before the value is written to the value log
+	if lsmdb.rootDB().readOnly {
+		return ErrReadOnly
+	}
+
+	entry, err := lsmdb.makeSetEntry(key, value)
+	if err != nil {
+		return err
+	}
+
+	if err := lsmdb.logEntry(entry); err != nil {
+		return err
+	}
+
+	lsmdb.memTable.writeOperation(entry.op, key, entry.value)
+
+	return lsmdb.flushIfFull()
+}
+
+// Merges the operand into the value of the key with the merge operator, without reading the current value.
+func (lsmdb *DB) Merge(key, operand []byte) error {
+	defer lsmdb.lock()()
+
+	return lsmdb.merge(key, operand)
+}
+
+func (lsmdb *DB) merge(key, operand []byte) error {
+	if lsmdb.mergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+
+	// Rejecting operands the operator can't handle before they reach the WAL
+	if err := lsmdb.checkOperands(key, [][]byte{operand}); err != nil {
+		return err
+	}
+
+	valueWithOp, _ := lsmdb.memTable.sortedMap.Get(string(key))
+	entry, err := lsmdb.mergeEntry(key, encodeOperands([][]byte{operand}), valueWithOp)
+	if err != nil {
+		return err
+	}
+
+	if err := lsmdb.logEntry(entry); err != nil {
+		return err
+	}
+
+	if err := lsmdb.applyToMemTable(entry.op, key, entry.value); err != nil {
+		return err
+	}
+
+	return lsmdb.flushIfFull()
+}
+
+// Returns the entry logged to merge the encoded operands into the value of the key, given as it is in the memTable.
+// The operands are folded into a value with an expiration time right away, and whether it expired is decided now:
+// the folded value is logged instead of the operands, so replaying the WAL later doesn't decide otherwise.
+func (lsmdb *DB) mergeEntry(key, encodedOperands, valueWithOp []byte) (Entry, error) {
+	if len(valueWithOp) == 0 || OperationType(valueWithOp[0]) != ExpiringSetOp {
+		return Entry{op: MergeOp, key: key, value: encodedOperands}, nil
+	}
+
+	operands, err := decodeOperands(encodedOperands)
+	if err != nil {
+		return Entry{}, err
 	}
 
-	if err := lsmdb.wal.appendEntry(entry); err != nil {
+	expireAt, base := decodeExpiringValue(valueWithOp[1:])
+	if isExpired(expireAt) {
+		expireAt, base = time.Time{}, nil
+	}
+
+	merged, err := lsmdb.mergeOperator.FullMerge(key, base, operands)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if expireAt.IsZero() {
+		return lsmdb.makeSetEntry(key, merged)
+	}
+	return Entry{op: ExpiringSetOp, key: key, value: encodeExpiringValue(expireAt, merged)}, nil
+}
+
+// Checks that the merge operator can apply the operands to the key, before they are written. The value of the key is
+// only looked up in the memTable, where the operands are folded into it right away: a value in the sst files that the
+// operator can't use is left to the reads of the key, which fail with the error of the operator.
+// It must be called with the database locked.
+func (lsmdb *DB) checkOperands(key []byte, operands [][]byte) error {
+	if err := lsmdb.loadPointedValue(key); err != nil {
 		return err
 	}
 
-	lsmdb.memTable.Set(key, value)
+	base, err := lsmdb.memTable.Get(key)
+	if err != nil {
+		base = nil
+	}
 
-	// If the memTable is full, flush it to the disk
+	_, err = lsmdb.mergeOperator.FullMerge(key, base, operands)
+	return err
+}
+
+// If the memTable is full, flushes it to the disk.
+func (lsmdb *DB) flushIfFull() error {
 	if lsmdb.memTable.sizeInBytes() >= lsmdb.memSizeThreshold {
-		if err := lsmdb.flushToDisk(); err != nil {
-			return err
-		}
+		// The write waits for the flush
+		defer func(start time.Time) {
+			lsmdb.rootDB().metrics.writeStalls.observe(time.Since(start))
+		}(time.Now())
 
-		// Clearing the memTable
-		lsmdb.memTable.sortedMap.Clear()
+		return lsmdb.flushToDisk()
 	}
 
 	return nil
 }
 
-func (lsmdb *lsmDB) Del(key []byte) ([]byte, error) {
+func (lsmdb *DB) Delete(key []byte) ([]byte, error) {
+	return lsmdb.DeleteContext(context.Background(), key)
+}
+
+// Like Delete, but gives up with the error of ctx if it is done before the deletion is started.
+func (lsmdb *DB) DeleteContext(ctx context.Context, key []byte) ([]byte, error) {
+	unlock, err := lsmdb.lockContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	return lsmdb.del(key)
+}
+
+func (lsmdb *DB) del(key []byte) ([]byte, error) {
 	entry := Entry{
 		op:    DelOp,
 		key:   key,
 		value: nil,
 	}
 
-	v, err := lsmdb.Get(key)
+	v, err := lsmdb.get(key)
 	if err != nil {
 		return nil, err
 	}
 
-	if err := lsmdb.wal.appendEntry(entry); err != nil {
+	if err := lsmdb.logEntry(entry); err != nil {
 		return nil, err
 	}
 
@@ -317,25 +805,114 @@ func (lsmdb *lsmDB) Del(key []byte) ([]byte, error) {
 	return v, nil
 }
 
-func (lsmdb *lsmDB) Open() error {
+// Opens the files of the database, once its data directory (if it has one) is locked.
+func (lsmdb *DB) open() error {
+
+	if err := lsmdb.lockDataDir(); err != nil {
+		return err
+	}
+
+	// A restore cut short by a crash is completed, the WAL being one of the swapped files
+	if lsmdb.dataDir != "" {
+		restored, err := finishRestore(lsmdb.dataDir)
+		if err != nil {
+			return err
+		}
+		if restored {
+			if err := lsmdb.wal.logFile.Close(); err != nil {
+				return err
+			}
+			if lsmdb.wal.logFile, err = os.OpenFile(lsmdb.wal.walPath, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := lsmdb.openFiles(); err != nil {
+		return err
+	}
+
+	// Opening the column families recorded in the manifest
+	if err := lsmdb.loadManifest(); err != nil {
+		return err
+	}
+
+	if err := lsmdb.loadWALtoMemTable(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Closes the database: it waits for the write, flush or compaction in progress, ends the subscriptions and the
+// replication feeds, syncs and closes the files and releases the data directory. The reads and writes started after
+// it fail with ErrClosed.
+func (lsmdb *DB) Close() error {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	if root.closed {
+		return ErrClosed
+	}
+	root.closed = true
+
+	for sub := range root.subscriptions {
+		root.unsubscribe(sub, ErrClosed)
+	}
+	for feed := range root.replicationFeeds {
+		root.closeFeed(feed, ErrClosed)
+	}
+
+	var errs []error
+	if root.flushOnClose {
+		errs = append(errs, root.flushToDisk())
+	}
+	for _, family := range root.allFamilies() {
+		if family.valueLog != nil {
+			errs = append(errs, family.valueLog.Close())
+			family.valueLog = nil
+		}
+	}
+	errs = append(errs, root.wal.sync(), root.wal.logFile.Close(), root.unlockDataDir())
+
+	return errors.Join(errs...)
+}
+
+// Creates the sst directory and the metadata file if they don't exist, and reads the current number of sst files.
+func (lsmdb *DB) openFiles() error {
 
 	// Creating the sst directory if it doesn't exist
 	if _, err := os.Stat(lsmdb.sstPath); os.IsNotExist(err) {
-		if err := os.Mkdir(lsmdb.sstPath, 0700); err != nil {
+		if err := os.MkdirAll(lsmdb.sstPath, 0700); err != nil {
 			return err
 		}
 	}
 
-	// Creating the metadata file if it doesn't exist
+	// Creating the metadata file with the current number of sst files if it doesn't exist
 	if _, err := os.Stat(lsmdb.metadataFileName); os.IsNotExist(err) {
-		if _, err := os.Create(lsmdb.metadataFileName); err != nil {
+		if err := lsmdb.updateMetadataFile(); err != nil {
 			return err
 		}
+	}
 
-		// Writing the current number of sst files to the metadata file
-		if err := lsmdb.updateMetadataFile(); err != nil {
+	// Completing the compaction interrupted by a crash, if any
+	if err := lsmdb.recoverCompaction(); err != nil {
+		return err
+	}
+
+	// Opening the value log if it is enabled
+	if lsmdb.valueLogPath != "" {
+		if lsmdb.valueLog != nil {
+			if err := lsmdb.valueLog.Close(); err != nil {
+				return err
+			}
+		}
+
+		valueLog, err := openValueLog(lsmdb.valueLogPath, lsmdb.valueLogSegmentSize)
+		if err != nil {
 			return err
 		}
+		lsmdb.valueLog = valueLog
 	}
 
 	// Reading the current number of sst files from the metadata file
@@ -343,9 +920,5 @@ func (lsmdb *lsmDB) Open() error {
 		return err
 	}
 
-	if err := lsmdb.loadWALtoMemTable(); err != nil {
-		return err
-	}
-
-	return nil
+	return lsmdb.removeOrphanSSTFiles()
 }
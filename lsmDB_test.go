@@ -1,8 +1,9 @@
-package main
+package lsmdb
 
 import (
 	"bytes"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -16,7 +17,7 @@ func TestFlushToDisk(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	// Create a sample lsmDB instance
+	// Create a sample DB instance
 	memTable := newMemTable()
 	logfile, ferr := os.CreateTemp("", "test_log_*.log")
 	if ferr != nil {
@@ -37,7 +38,7 @@ func TestFlushToDisk(t *testing.T) {
 	defer os.Remove(metaFile.Name())
 	defer metaFile.Close()
 
-	lsmdb := lsmDB{
+	lsmdb := DB{
 		memTable:         &memTable,
 		wal:              &wal,
 		magicNumber:      [4]byte{0x4c, 0x53, 0x4d, 0x44},
@@ -50,8 +51,8 @@ func TestFlushToDisk(t *testing.T) {
 	}
 
 	// Set up memTable entries
-	lsmdb.Set([]byte("key1"), []byte("value1"))
-	lsmdb.Set([]byte("key2"), []byte("value2"))
+	lsmdb.Put([]byte("key1"), []byte("value1"))
+	lsmdb.Put([]byte("key2"), []byte("value2"))
 
 	// Call flushToDisk
 	err = lsmdb.flushToDisk()
@@ -99,7 +100,7 @@ func TestFlushToDisk(t *testing.T) {
 }
 
 func TestLoadWALtoMemTable(t *testing.T) {
-	// Create a sample lsmDB instance
+	// Create a sample DB instance
 	memTable := newMemTable()
 	logfile, ferr := os.CreateTemp("", "test_log_*.log")
 	if ferr != nil {
@@ -113,7 +114,7 @@ func TestLoadWALtoMemTable(t *testing.T) {
 		walPath: "wal.log",
 	}
 
-	lsmdb := lsmDB{
+	lsmdb := DB{
 		memTable:         &memTable,
 		wal:              &wal,
 		magicNumber:      [4]byte{0x4c, 0x53, 0x4d, 0x44},
@@ -167,6 +168,87 @@ func TestLoadWALtoMemTable(t *testing.T) {
 	}
 }
 
+func TestLoadWALtoMemTable_FlushedRecordsAreSkipped(t *testing.T) {
+	dir := t.TempDir()
+	lsmdb, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.CreateColumnFamily("counters", ColumnFamilyOptions{MemSizeThreshold: 1000, MergeOperator: "int64add"}); err != nil {
+		t.Fatal(err)
+	}
+	counters, _ := lsmdb.ColumnFamily("counters")
+
+	lsmdb.Merge([]byte("a"), []byte("1"))
+	batch := &WriteBatch{}
+	batch.Merge("", []byte("b"), []byte("2"))
+	batch.Merge("counters", []byte("c"), []byte("3"))
+	if err := lsmdb.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	counters.Merge([]byte("c"), []byte("4"))
+
+	// The database stops once the default column family is flushed, before the others and before the WAL is cleared
+	unlock := lsmdb.lock()
+	lsmdb.flushedSeq = lsmdb.wal.lastSeq
+	err = lsmdb.writeMemTableToSST()
+	unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	reopenedCounters, _ := reopened.ColumnFamily("counters")
+
+	if v, err := reopened.Get([]byte("a")); err != nil || string(v) != "1" {
+		t.Errorf("Expected 1, got %s (%v)", v, err)
+	}
+	if v, err := reopened.Get([]byte("b")); err != nil || string(v) != "2" {
+		t.Errorf("Expected 2, got %s (%v)", v, err)
+	}
+	if v, err := reopenedCounters.Get([]byte("c")); err != nil || string(v) != "7" {
+		t.Errorf("Expected 7, got %s (%v)", v, err)
+	}
+
+	// The sequence numbers go on after a WAL cleared without its sequence record (and without a history)
+	opts := DefaultOptions()
+	opts.WALHistoryMaxSize = 0
+	seq := reopened.LastSequence()
+	if err := reopened.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopened.Close()
+	if err := os.Truncate(filepath.Join(dir, "wal.log"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.LastSequence() != seq {
+		t.Errorf("Expected sequence %d, got %d", seq, reopened.LastSequence())
+	}
+	reopened.Merge([]byte("a"), []byte("1"))
+	reopened.Close()
+
+	reopened, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if v, err := reopened.Get([]byte("a")); err != nil || string(v) != "2" {
+		t.Errorf("Expected 2, got %s (%v)", v, err)
+	}
+}
+
 func TestLSMTreeDB(t *testing.T) {
 	memTable := newMemTable()
 
@@ -197,7 +279,7 @@ func TestLSMTreeDB(t *testing.T) {
 		walPath: logfile.Name(),
 	}
 
-	lsmdb := lsmDB{
+	lsmdb := DB{
 		memTable:         &memTable,
 		wal:              &wal,
 		magicNumber:      [4]byte{0x4c, 0x53, 0x4d, 0x44},
@@ -209,14 +291,14 @@ func TestLSMTreeDB(t *testing.T) {
 		sstFilesNum:      0,
 	}
 
-	if err := lsmdb.Open(); err != nil {
+	if err := lsmdb.open(); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := lsmdb.Set([]byte("key1"), []byte("value1")); err != nil {
+	if err := lsmdb.Put([]byte("key1"), []byte("value1")); err != nil {
 		t.Fatal(err)
 	}
-	if err := lsmdb.Set([]byte("key2"), []byte("value2")); err != nil {
+	if err := lsmdb.Put([]byte("key2"), []byte("value2")); err != nil {
 		t.Fatal(err)
 	}
 
@@ -224,7 +306,7 @@ func TestLSMTreeDB(t *testing.T) {
 		t.Error("Expected value1, got error or different value")
 	}
 
-	if v, err := lsmdb.Del([]byte("key2")); err != nil || string(v) != "value2" {
+	if v, err := lsmdb.Delete([]byte("key2")); err != nil || string(v) != "value2" {
 		t.Error("Expected value2, got error or different value")
 	}
 
@@ -233,3 +315,98 @@ func TestLSMTreeDB(t *testing.T) {
 	}
 
 }
+
+func TestClose(t *testing.T) {
+	dir := t.TempDir()
+
+	opts := DefaultOptions()
+	opts.MemSizeThreshold = 1 << 20
+	opts.FlushOnClose = true
+
+	lsmdb, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	sub := lsmdb.Subscribe(nil)
+
+	if err := lsmdb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database refuses the operations once it is closed, and ends its subscriptions
+	if err := lsmdb.Put([]byte("key"), []byte("other")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if _, err := lsmdb.Get([]byte("key")); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if err := lsmdb.Close(); err != ErrClosed {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	if _, ok := <-sub.Events(); ok || sub.Err() != ErrClosed {
+		t.Errorf("Expected the subscription to end with ErrClosed, got %v", sub.Err())
+	}
+
+	// The memTable was flushed, so the WAL has nothing to replay
+	reopened, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+
+	if reopened.memTable.sortedMap.Len() != 0 || reopened.sstFilesNum != 1 {
+		t.Errorf("Expected an empty memTable and 1 sst file, got %d keys and %d files", reopened.memTable.sortedMap.Len(), reopened.sstFilesNum)
+	}
+	if v, _ := reopened.Get([]byte("key")); string(v) != "value" {
+		t.Errorf("Expected value, got %q", v)
+	}
+}
+
+// Creates an opened DB whose files live in a temporary directory removed at the end of the test.
+func newTestLSMDB(t *testing.T) *DB {
+	tempDir, err := os.MkdirTemp("", "test_lsmdb_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(tempDir) })
+
+	return openTestLSMDB(t, tempDir)
+}
+
+// Opens the DB whose files live in dir.
+func openTestLSMDB(t *testing.T, tempDir string) *DB {
+	logfile, ferr := os.OpenFile(tempDir+"/wal.log", os.O_RDWR|os.O_CREATE, 0600)
+	if ferr != nil {
+		t.Fatal(ferr)
+	}
+
+	memTable := newMemTable()
+	wal := WAL{
+		logFile: logfile,
+		walPath: logfile.Name(),
+	}
+	t.Cleanup(func() { wal.logFile.Close() })
+
+	lsmdb := &DB{
+		memTable:         &memTable,
+		wal:              &wal,
+		magicNumber:      [4]byte{0x4c, 0x53, 0x4d, 0x44},
+		version:          1,
+		metadataFileName: tempDir + "/metadata.meta",
+		memSizeThreshold: 100,
+		fileNumThreshold: 20,
+		sstPath:          tempDir + "/sst/",
+		sstFilesNum:      0,
+		manifestFileName: tempDir + "/families.manifest",
+		familiesPath:     tempDir + "/cf/",
+	}
+
+	if err := lsmdb.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	return lsmdb
+}
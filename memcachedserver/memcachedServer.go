@@ -0,0 +1,475 @@
+// Package memcachedserver serves a database over the memcached text protocol.
+package memcachedserver
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+// The column family the memcached server stores its items in
+const memcachedColumnFamilyName = "memcached"
+
+// Exptimes bigger than this number of seconds (30 days) are Unix timestamps, the smaller ones are relative to now
+const memcachedMaxRelativeExptime = 60 * 60 * 24 * 30
+
+const memcachedMaxKeyLength = 250
+
+// The size of the largest item taken by default, the one of memcached (its -I option)
+const memcachedDefaultMaxItemSize = 1 << 20
+
+var (
+	ErrMemcachedItemCorrupted = errors.New("the memcached item is corrupted")
+)
+
+// A server speaking the memcached text protocol, so memcached clients can use the database as a persistent cache.
+// Items are stored in their own column family with their flags and their CAS token alongside the value,
+// and their exptime is the expiration time of the key.
+type Server struct {
+	db *lsmdb.DB
+
+	// The size in bytes of the largest item taken, the bigger ones are refused without being read in memory
+	MaxItemSize int
+
+	// Serializes the commands, as most of them read an item before writing it
+	mu sync.Mutex
+
+	// The CAS token given to new keys. It starts from the current time so that a key deleted and created again
+	// never gets a token it had before.
+	nextCAS uint64
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+}
+
+// The items are stored this way: [flags(4 bytes)][cas(8 bytes)][data]
+type memcachedItem struct {
+	flags uint32
+	cas   uint64
+	data  []byte
+}
+
+func (item memcachedItem) encode() []byte {
+	encoded := binary.BigEndian.AppendUint32(nil, item.flags)
+	encoded = binary.BigEndian.AppendUint64(encoded, item.cas)
+	return append(encoded, item.data...)
+}
+
+func decodeMemcachedItem(encoded []byte) (memcachedItem, error) {
+	if len(encoded) < 4+8 {
+		return memcachedItem{}, ErrMemcachedItemCorrupted
+	}
+
+	item := memcachedItem{
+		flags: binary.BigEndian.Uint32(encoded[:4]),
+		cas:   binary.BigEndian.Uint64(encoded[4:12]),
+		data:  encoded[12:],
+	}
+	return item, nil
+}
+
+// Returns the server of the database, storing its items in their own column family (created if it doesn't exist).
+func NewServer(db *lsmdb.DB) (*Server, error) {
+	family, err := db.ColumnFamily(memcachedColumnFamilyName)
+	if err == lsmdb.ErrColumnFamilyNotFound {
+		opts := lsmdb.ColumnFamilyOptions{MemSizeThreshold: db.MemSizeThreshold()}
+		if err = db.CreateColumnFamily(memcachedColumnFamilyName, opts); err == nil {
+			family, err = db.ColumnFamily(memcachedColumnFamilyName)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		db:          family,
+		MaxItemSize: memcachedDefaultMaxItemSize,
+		nextCAS:     uint64(time.Now().UnixNano()),
+	}, nil
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(listener)
+}
+
+// Accepts the connections of the listener, and serves each of them in its own goroutine.
+func (srv *Server) Serve(listener net.Listener) error {
+	srv.listenersMu.Lock()
+	srv.listeners = append(srv.listeners, listener)
+	srv.listenersMu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go srv.serveConn(conn)
+	}
+}
+
+// Stops accepting new connections.
+func (srv *Server) Close() error {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	for _, listener := range srv.listeners {
+		if err := listener.Close(); err != nil {
+			return err
+		}
+	}
+	srv.listeners = nil
+
+	return nil
+}
+
+func (srv *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if quit := srv.execute(r, w, fields); quit {
+			w.Flush()
+			return
+		}
+
+		// The replies of pipelined commands are sent together, once there are no more commands to read
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Reads a line ending with \r\n (or \n), and returns it without its ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// Returns the expiration time matching an exptime of the protocol.
+func memcachedExpireAt(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now().Add(-time.Second)
+	case exptime <= memcachedMaxRelativeExptime:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	default:
+		return time.Unix(exptime, 0)
+	}
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > memcachedMaxKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Executes a command and writes its reply. Returns true if the connection must be closed.
+func (srv *Server) execute(r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	command := fields[0]
+	args := fields[1:]
+
+	// The replies of the storage commands can be skipped with "noreply"
+	noreply := len(args) > 0 && args[len(args)-1] == "noreply"
+	if noreply {
+		args = args[:len(args)-1]
+	}
+
+	reply := func(format string, a ...interface{}) {
+		if !noreply {
+			fmt.Fprintf(w, format+"\r\n", a...)
+		}
+	}
+
+	// The first argument of every command taking arguments is a key
+	if len(args) > 0 && !validMemcachedKey(args[0]) {
+		reply("CLIENT_ERROR bad command line format")
+		return false
+	}
+
+	switch command {
+	case "get", "gets":
+		if len(args) == 0 {
+			w.WriteString("ERROR\r\n")
+			return false
+		}
+		srv.get(w, args, command == "gets")
+
+	case "set", "add", "replace", "cas":
+		srv.store(r, command, args, reply)
+
+	case "delete":
+		if len(args) != 1 {
+			reply("ERROR")
+			return false
+		}
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		if _, err := srv.db.Delete([]byte(args[0])); err == lsmdb.ErrKeyNotFound {
+			reply("NOT_FOUND")
+		} else if err != nil {
+			reply("SERVER_ERROR %s", err)
+		} else {
+			reply("DELETED")
+		}
+
+	case "incr", "decr":
+		srv.incr(command, args, reply)
+
+	case "touch":
+		if len(args) != 2 {
+			reply("ERROR")
+			return false
+		}
+
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			reply("CLIENT_ERROR bad command line format")
+			return false
+		}
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		v, err := srv.db.Get([]byte(args[0]))
+		if err == lsmdb.ErrKeyNotFound {
+			reply("NOT_FOUND")
+		} else if err != nil {
+			reply("SERVER_ERROR %s", err)
+		} else if err := srv.db.PutWithExpiry([]byte(args[0]), v, memcachedExpireAt(exptime)); err != nil {
+			reply("SERVER_ERROR %s", err)
+		} else {
+			reply("TOUCHED")
+		}
+
+	case "version":
+		fmt.Fprintf(w, "VERSION db-%d\r\n", srv.db.Version())
+
+	case "quit":
+		return true
+
+	default:
+		w.WriteString("ERROR\r\n")
+	}
+
+	return false
+}
+
+// Returns the item of the key, with its expiration time.
+func (srv *Server) getItem(key string) (memcachedItem, time.Time, error) {
+	v, expireAt, err := srv.db.GetWithExpiry([]byte(key))
+	if err != nil {
+		return memcachedItem{}, time.Time{}, err
+	}
+
+	item, err := decodeMemcachedItem(v)
+	return item, expireAt, err
+}
+
+// Writes the item of the key with a new CAS token.
+func (srv *Server) setItem(key string, item memcachedItem, previousCAS uint64, expireAt time.Time) (uint64, error) {
+	srv.nextCAS++
+	item.cas = max(previousCAS+1, srv.nextCAS)
+
+	return item.cas, srv.db.PutWithExpiry([]byte(key), item.encode(), expireAt)
+}
+
+// get <key>*  and  gets <key>*
+func (srv *Server) get(w *bufio.Writer, keys []string, withCAS bool) {
+	for _, key := range keys {
+		item, _, err := srv.getItem(key)
+		if err == lsmdb.ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			fmt.Fprintf(w, "SERVER_ERROR %s\r\n", err)
+			return
+		}
+
+		if withCAS {
+			fmt.Fprintf(w, "VALUE %s %d %d %d\r\n", key, item.flags, len(item.data), item.cas)
+		} else {
+			fmt.Fprintf(w, "VALUE %s %d %d\r\n", key, item.flags, len(item.data))
+		}
+		w.Write(item.data)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// <command> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]\r\n<data>\r\n
+func (srv *Server) store(r *bufio.Reader, command string, args []string, reply func(string, ...interface{})) {
+	expectedArgs := 4
+	if command == "cas" {
+		expectedArgs = 5
+	}
+	if len(args) != expectedArgs {
+		reply("ERROR")
+		return
+	}
+
+	flags, flagsErr := strconv.ParseUint(args[1], 10, 32)
+	exptime, exptimeErr := strconv.ParseInt(args[2], 10, 64)
+	size, sizeErr := strconv.Atoi(args[3])
+	if flagsErr != nil || exptimeErr != nil || sizeErr != nil || size < 0 {
+		reply("CLIENT_ERROR bad command line format")
+		return
+	}
+
+	var casUnique uint64
+	if command == "cas" {
+		var err error
+		if casUnique, err = strconv.ParseUint(args[4], 10, 64); err != nil {
+			reply("CLIENT_ERROR bad command line format")
+			return
+		}
+	}
+
+	// The data block of a too large item is skipped, along with its trailing \r\n
+	if size > srv.MaxItemSize {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return
+		}
+		if _, err := io.CopyN(io.Discard, r, 2); err != nil {
+			return
+		}
+		reply("SERVER_ERROR object too large for cache")
+		return
+	}
+
+	// Reading the data block and its trailing \r\n
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return
+	}
+	if string(data[size:]) != "\r\n" {
+		reply("CLIENT_ERROR bad data chunk")
+		return
+	}
+
+	key := args[0]
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	current, _, err := srv.getItem(key)
+	if err != nil && err != lsmdb.ErrKeyNotFound {
+		reply("SERVER_ERROR %s", err)
+		return
+	}
+	exists := err == nil
+
+	switch {
+	case command == "add" && exists, command == "replace" && !exists:
+		reply("NOT_STORED")
+		return
+	case command == "cas" && !exists:
+		reply("NOT_FOUND")
+		return
+	case command == "cas" && current.cas != casUnique:
+		reply("EXISTS")
+		return
+	}
+
+	item := memcachedItem{flags: uint32(flags), data: data[:size]}
+	if _, err := srv.setItem(key, item, current.cas, memcachedExpireAt(exptime)); err != nil {
+		reply("SERVER_ERROR %s", err)
+		return
+	}
+	reply("STORED")
+}
+
+// incr <key> <value> [noreply]  and  decr <key> <value> [noreply]
+// The values are unsigned 64-bit integers: incr wraps around, and decr stops at 0.
+func (srv *Server) incr(command string, args []string, reply func(string, ...interface{})) {
+	if len(args) != 2 {
+		reply("ERROR")
+		return
+	}
+
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		reply("CLIENT_ERROR invalid numeric delta argument")
+		return
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	item, expireAt, err := srv.getItem(args[0])
+	if err == lsmdb.ErrKeyNotFound {
+		reply("NOT_FOUND")
+		return
+	}
+	if err != nil {
+		reply("SERVER_ERROR %s", err)
+		return
+	}
+
+	n, err := strconv.ParseUint(strings.TrimSpace(string(item.data)), 10, 64)
+	if err != nil {
+		reply("CLIENT_ERROR cannot increment or decrement non-numeric value")
+		return
+	}
+
+	if command == "incr" {
+		n += delta
+	} else if delta > n {
+		n = 0
+	} else {
+		n -= delta
+	}
+
+	item.data = []byte(strconv.FormatUint(n, 10))
+	if _, err := srv.setItem(args[0], item, item.cas, expireAt); err != nil {
+		reply("SERVER_ERROR %s", err)
+		return
+	}
+	reply("%d", n)
+}
@@ -0,0 +1,126 @@
+package memcachedserver
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+func startTestMemcachedServer(t *testing.T) (net.Conn, *bufio.Reader) {
+	db, err := lsmdb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	srv, err := NewServer(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, bufio.NewReader(conn)
+}
+
+func TestMemcachedServer(t *testing.T) {
+	conn, r := startTestMemcachedServer(t)
+
+	// Sends a command and reads the number of reply lines given
+	do := func(command string, lines int) string {
+		t.Helper()
+		if _, err := conn.Write([]byte(command)); err != nil {
+			t.Fatal(err)
+		}
+
+		var reply strings.Builder
+		for i := 0; i < lines; i++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.WriteString(line)
+		}
+		return reply.String()
+	}
+
+	expect := func(command string, expected string) {
+		t.Helper()
+		if got := do(command, strings.Count(expected, "\n")); got != expected {
+			t.Errorf("%q: expected %q, got %q", command, expected, got)
+		}
+	}
+
+	expect("get key\r\n", "END\r\n")
+	expect("set key 42 0 5\r\nhello\r\n", "STORED\r\n")
+	expect("get key missing\r\n", "VALUE key 42 5\r\nhello\r\nEND\r\n")
+	expect("add key 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	expect("replace missing 0 0 1\r\nx\r\n", "NOT_STORED\r\n")
+	expect("add other 0 0 1\r\nx\r\n", "STORED\r\n")
+
+	// Compare-and-swap with the token given by gets
+	reply := do("gets key\r\n", 3)
+	cas := regexp.MustCompile(`VALUE key 42 5 (\d+)`).FindStringSubmatch(reply)
+	if cas == nil {
+		t.Fatalf("Unexpected gets reply %q", reply)
+	}
+	expect("cas key 7 0 3 "+cas[1]+"\r\nbye\r\n", "STORED\r\n")
+	expect("cas key 7 0 3 "+cas[1]+"\r\nbye\r\n", "EXISTS\r\n")
+	expect("cas missing 0 0 1 1\r\nx\r\n", "NOT_FOUND\r\n")
+	expect("get key\r\n", "VALUE key 7 3\r\nbye\r\nEND\r\n")
+
+	expect("set counter 0 0 2\r\n10\r\n", "STORED\r\n")
+	expect("incr counter 5\r\n", "15\r\n")
+	expect("decr counter 20\r\n", "0\r\n")
+	expect("incr key 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value\r\n")
+	expect("incr missing 1\r\n", "NOT_FOUND\r\n")
+
+	expect("touch other -1\r\n", "TOUCHED\r\n")
+	expect("get other\r\n", "END\r\n")
+	expect("touch other 0\r\n", "NOT_FOUND\r\n")
+
+	expect("set short 0 1 1\r\nx\r\n", "STORED\r\n")
+	time.Sleep(1100 * time.Millisecond)
+	expect("get short\r\n", "END\r\n")
+
+	expect("delete key\r\n", "DELETED\r\n")
+	expect("delete key\r\n", "NOT_FOUND\r\n")
+
+	// noreply commands don't send anything back
+	expect("set quiet 0 0 1 noreply\r\nq\r\nget quiet\r\n", "VALUE quiet 0 1\r\nq\r\nEND\r\n")
+
+	expect("bogus\r\n", "ERROR\r\n")
+
+	// The too large items are skipped without being allocated
+	expect("set big 0 0 1048577\r\n"+strings.Repeat("x", 1048577)+"\r\n", "SERVER_ERROR object too large for cache\r\n")
+	expect("get big\r\n", "END\r\n")
+}
+
+func TestMemcachedServer_HugeItemSize(t *testing.T) {
+	conn, r := startTestMemcachedServer(t)
+
+	conn.Write([]byte("set huge 0 0 9223372036854775807\r\nxx"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	// The server doesn't crash, it drops the connection once the data block is cut short
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("Expected the connection to be closed, got %q", line)
+	}
+}
@@ -1,7 +1,9 @@
-package main
+package lsmdb
 
 import (
 	"errors"
+	"time"
+
 	"github.com/igrmk/treemap/v2"
 )
 
@@ -13,12 +15,29 @@ var (
 type OperationType byte
 
 const (
-	SetOp OperationType = 1
-	DelOp OperationType = 2
+	SetOp   OperationType = 1
+	DelOp   OperationType = 2
+	MergeOp OperationType = 3
+
+	// Only used in the WAL, for records holding a batch of operations on column families
+	BatchOp OperationType = 4
+
+	// Set operation whose value is a pointer to the actual value in the value log
+	ValuePointerOp OperationType = 5
+
+	// Set operation whose value is prefixed with its expiration time
+	ExpiringSetOp OperationType = 6
+
+	// Only used in the WAL, for the record starting a WAL segment with the sequence number of the record before it
+	SequenceOp OperationType = 7
+
+	// Only used in the WAL, for the records holding the commit time of the records that follow them
+	TimestampOp OperationType = 8
 )
 
-// Entries in the MemTable are of this format: {key: [DelOp]} or {key: [SetOp] + [value]}
-// This format is chosen to distinguish between set and deleted keys.
+// Entries in the MemTable are of this format: {key: [DelOp]}, {key: [SetOp] + [value]}, {key: [MergeOp] + [operands]}
+// {key: [ValuePointerOp] + [pointer]} or {key: [ExpiringSetOp] + [expiration time] + [value]}
+// This format is chosen to distinguish between set, deleted and merged keys.
 type MemTable struct {
 	sortedMap treemap.TreeMap[string, []byte]
 }
@@ -40,6 +59,16 @@ func (mem *MemTable) Get(key []byte) ([]byte, error) {
 			return actualValue, nil
 		} else if op == DelOp {
 			return nil, ErrKeyDeleted
+		} else if op == MergeOp {
+			return actualValue, ErrKeyMerged
+		} else if op == ValuePointerOp {
+			return actualValue, ErrValueInLog
+		} else if op == ExpiringSetOp {
+			expireAt, value := decodeExpiringValue(actualValue)
+			if isExpired(expireAt) {
+				return nil, ErrKeyDeleted
+			}
+			return value, nil
 		}
 	}
 
@@ -55,8 +84,8 @@ func parseInMemValue(inMemValue []byte) (OperationType, []byte) {
 
 func (mem *MemTable) writeOperation(op OperationType, key []byte, value []byte) {
 	switch op {
-	case SetOp:
-		valueWithOp := append([]byte{byte(SetOp)}, value...)
+	case SetOp, ValuePointerOp, ExpiringSetOp:
+		valueWithOp := append([]byte{byte(op)}, value...)
 		mem.sortedMap.Set(string(key), valueWithOp)
 
 	case DelOp:
@@ -70,6 +99,55 @@ func (mem *MemTable) Del(key []byte) {
 
 }
 
+// Adds merge operands to a key.
+// The value of the key must not be a pointer to the value log.
+// If the key has a base value (or a tombstone) in the memTable, the operands are folded into it right away,
+// otherwise they are appended to the key's pending operands, to be folded when the key is read.
+func (mem *MemTable) Merge(key, encodedOperands []byte, operator MergeOperator) error {
+	valueWithOp, ok := mem.sortedMap.Get(string(key))
+	if ok && OperationType(valueWithOp[0]) == MergeOp {
+		pending := append([]byte{byte(MergeOp)}, valueWithOp[1:]...)
+		mem.sortedMap.Set(string(key), append(pending, encodedOperands...))
+		return nil
+	}
+
+	if !ok {
+		mem.sortedMap.Set(string(key), append([]byte{byte(MergeOp)}, encodedOperands...))
+		return nil
+	}
+
+	if operator == nil {
+		return ErrNoMergeOperator
+	}
+
+	operands, err := decodeOperands(encodedOperands)
+	if err != nil {
+		return err
+	}
+
+	op, base := parseInMemValue(valueWithOp)
+
+	// The expiration time of the value is kept, unless the value already expired
+	var expireAt time.Time
+	if op == ExpiringSetOp {
+		expireAt, base = decodeExpiringValue(base)
+		if isExpired(expireAt) {
+			expireAt, base = time.Time{}, nil
+		}
+	}
+
+	merged, err := operator.FullMerge(key, base, operands)
+	if err != nil {
+		return err
+	}
+
+	if !expireAt.IsZero() {
+		mem.writeOperation(ExpiringSetOp, key, encodeExpiringValue(expireAt, merged))
+		return nil
+	}
+	return mem.Set(key, merged)
+}
+
 func (mem *MemTable) makeEntry(key []byte) Entry {
 	valueWithOp, _ := mem.sortedMap.Get(string(key))
 	op, actualValue := parseInMemValue(valueWithOp)
@@ -0,0 +1,171 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var (
+	ErrKeyMerged         = errors.New("the key holds merge operands that are not folded yet")
+	ErrNoMergeOperator   = errors.New("no merge operator is configured")
+	ErrInvalidMergeValue = errors.New("the value or operand is not valid for the merge operator")
+)
+
+// A MergeOperator folds a list of operands into a base value.
+// existing is nil if the key has no base value (it was never set, or it was deleted).
+// Operands are given from the oldest to the newest.
+type MergeOperator interface {
+	Name() string
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// The merge operators that can be selected by name.
+var mergeOperators = map[string]MergeOperator{}
+
+// Makes a merge operator available by its name.
+func RegisterMergeOperator(op MergeOperator) {
+	mergeOperators[op.Name()] = op
+}
+
+// Returns the merge operator registered under the given name, or nil if there is none.
+func lookupMergeOperator(name string) MergeOperator {
+	return mergeOperators[name]
+}
+
+func init() {
+	RegisterMergeOperator(Int64AddOperator{})
+	RegisterMergeOperator(StringAppendOperator{})
+	RegisterMergeOperator(JSONMergePatchOperator{})
+}
+
+// Treats the value and the operands as decimal int64 numbers and adds them up.
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Name() string {
+	return "int64add"
+}
+
+func (Int64AddOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+
+	if existing != nil {
+		n, err := strconv.ParseInt(string(existing), 10, 64)
+		if err != nil {
+			return nil, ErrInvalidMergeValue
+		}
+		sum = n
+	}
+
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(string(operand), 10, 64)
+		if err != nil {
+			return nil, ErrInvalidMergeValue
+		}
+		sum += n
+	}
+
+	return []byte(strconv.FormatInt(sum, 10)), nil
+}
+
+// Appends the operands to the value, separated by Delimiter.
+type StringAppendOperator struct {
+	Delimiter string
+}
+
+func (StringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+func (op StringAppendOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	result := make([]byte, 0, len(existing))
+	result = append(result, existing...)
+
+	for i, operand := range operands {
+		if existing != nil || i > 0 {
+			result = append(result, op.Delimiter...)
+		}
+		result = append(result, operand...)
+	}
+
+	return result, nil
+}
+
+// Applies the operands to the value as JSON merge patches (RFC 7396).
+type JSONMergePatchOperator struct{}
+
+func (JSONMergePatchOperator) Name() string {
+	return "jsonmergepatch"
+}
+
+func (JSONMergePatchOperator) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var doc interface{}
+
+	if existing != nil {
+		if err := json.Unmarshal(existing, &doc); err != nil {
+			return nil, ErrInvalidMergeValue
+		}
+	}
+
+	for _, operand := range operands {
+		var patch interface{}
+		if err := json.Unmarshal(operand, &patch); err != nil {
+			return nil, ErrInvalidMergeValue
+		}
+		doc = mergePatch(doc, patch)
+	}
+
+	return json.Marshal(doc)
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = map[string]interface{}{}
+	}
+
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+		} else {
+			targetObj[name] = mergePatch(targetObj[name], value)
+		}
+	}
+
+	return targetObj
+}
+
+// Merge operands are stored as a list of this form: [operand1 length(4 bytes)][operand1][operand2 length(4 bytes)][operand2]...
+func encodeOperands(operands [][]byte) []byte {
+	encoded := make([]byte, 0)
+	for _, operand := range operands {
+		encoded = append(encoded, encode4BytesInt(len(operand))...)
+		encoded = append(encoded, operand...)
+	}
+
+	return encoded
+}
+
+func decodeOperands(encoded []byte) ([][]byte, error) {
+	operands := make([][]byte, 0)
+	for len(encoded) > 0 {
+		if len(encoded) < 4 {
+			return nil, ErrCorruptedFile
+		}
+		n := decode4BytesInt(encoded[:4])
+		encoded = encoded[4:]
+
+		if len(encoded) < n {
+			return nil, ErrCorruptedFile
+		}
+		operands = append(operands, encoded[:n])
+		encoded = encoded[n:]
+	}
+
+	return operands, nil
+}
@@ -0,0 +1,167 @@
+package lsmdb
+
+import (
+	"testing"
+)
+
+func TestInt64AddOperator(t *testing.T) {
+	op := Int64AddOperator{}
+
+	v, err := op.FullMerge([]byte("k"), []byte("10"), [][]byte{[]byte("5"), []byte("-3")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "12" {
+		t.Errorf("Expected 12, got %s", v)
+	}
+
+	if _, err := op.FullMerge([]byte("k"), nil, [][]byte{[]byte("abc")}); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+}
+
+func TestStringAppendOperator(t *testing.T) {
+	op := StringAppendOperator{Delimiter: ","}
+
+	v, err := op.FullMerge([]byte("k"), nil, [][]byte{[]byte("a"), []byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a,b" {
+		t.Errorf("Expected a,b, got %s", v)
+	}
+
+	v, err = op.FullMerge([]byte("k"), []byte("a"), [][]byte{[]byte("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != "a,b" {
+		t.Errorf("Expected a,b, got %s", v)
+	}
+}
+
+func TestJSONMergePatchOperator(t *testing.T) {
+	op := JSONMergePatchOperator{}
+
+	existing := []byte(`{"a":1,"b":{"c":2,"d":3}}`)
+	operands := [][]byte{[]byte(`{"b":{"c":null,"e":4}}`), []byte(`{"a":"x"}`)}
+
+	v, err := op.FullMerge([]byte("k"), existing, operands)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(v) != `{"a":"x","b":{"d":3,"e":4}}` {
+		t.Errorf("Unexpected merge result %s", v)
+	}
+}
+
+func TestLSMDB_Merge(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	// Operands without any base value
+	if err := lsmdb.Merge([]byte("counter"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lsmdb.Get([]byte("counter")); err != nil || string(v) != "2" {
+		t.Errorf("Expected 2, got %s (%v)", v, err)
+	}
+
+	// The base value is flushed to an sst file, the operands stay in the memTable
+	if err := lsmdb.Put([]byte("counter"), []byte("40")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	lsmdb.memTable.sortedMap.Clear()
+
+	if err := lsmdb.Merge([]byte("counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Merge([]byte("counter"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lsmdb.Get([]byte("counter")); err != nil || string(v) != "42" {
+		t.Errorf("Expected 42, got %s (%v)", v, err)
+	}
+
+	// The operands are flushed to a newer sst file
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	lsmdb.memTable.sortedMap.Clear()
+
+	if err := lsmdb.Merge([]byte("counter"), []byte("-2")); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lsmdb.Get([]byte("counter")); err != nil || string(v) != "40" {
+		t.Errorf("Expected 40, got %s (%v)", v, err)
+	}
+
+	if err := lsmdb.Merge([]byte("counter"), []byte("x")); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+}
+
+func TestLSMDB_MergeReplayedFromWAL(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	lsmdb.Put([]byte("counter"), []byte("1"))
+	lsmdb.Merge([]byte("counter"), []byte("2"))
+
+	memTable := newMemTable()
+	lsmdb.memTable = &memTable
+	if err := lsmdb.loadWALtoMemTable(); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, err := lsmdb.Get([]byte("counter")); err != nil || string(v) != "3" {
+		t.Errorf("Expected 3, got %s (%v)", v, err)
+	}
+}
+
+func TestLSMDB_MergeCheckedAgainstCurrentValue(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = Int64AddOperator{}
+
+	// An operand the operator can't handle is refused
+	if err := lsmdb.Merge([]byte("k"), []byte("one")); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+
+	// The merge is refused when the base value is in the memTable, where it would be folded
+	lsmdb.Put([]byte("k"), []byte("abc"))
+	if err := lsmdb.Merge([]byte("k"), []byte("1")); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+
+	// The base value in an sst file isn't read by the merge, the reads of the key fail instead
+	if err := lsmdb.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Merge([]byte("k"), []byte("1")); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if _, err := lsmdb.Get([]byte("k")); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+
+	// A batch is checked against the values it writes before its merges
+	batch := &WriteBatch{}
+	batch.Put(defaultColumnFamilyName, []byte("k"), []byte("10"))
+	batch.Merge(defaultColumnFamilyName, []byte("k"), []byte("5"))
+	if err := lsmdb.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+	batch = &WriteBatch{}
+	batch.Put(defaultColumnFamilyName, []byte("k"), []byte("xyz"))
+	batch.Merge(defaultColumnFamilyName, []byte("k"), []byte("5"))
+	if err := lsmdb.Write(batch); err != ErrInvalidMergeValue {
+		t.Errorf("Expected ErrInvalidMergeValue, got %v", err)
+	}
+	if v, err := lsmdb.Get([]byte("k")); string(v) != "15" || err != nil {
+		t.Errorf("Expected 15, got %q (%v)", v, err)
+	}
+}
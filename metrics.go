@@ -0,0 +1,335 @@
+package lsmdb
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The upper bounds in seconds of the buckets of the latency histograms
+var latencyBuckets = [...]float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A histogram of durations, with the buckets of latencyBuckets. The zero value is ready to use.
+type histogram struct {
+	mu sync.Mutex
+
+	// The number of durations in each bucket (not cumulated), the ones above the last bound are only in count
+	counts [len(latencyBuckets)]uint64
+	count  uint64
+
+	// The sum of the durations in seconds
+	sum float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if i := sort.SearchFloat64s(latencyBuckets[:], seconds); i < len(latencyBuckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Writes the samples of the histogram, labelled with the label name and value pairs.
+func (h *histogram) write(buf *bytes.Buffer, name string, labels ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var cumulated uint64
+	for i, bound := range latencyBuckets {
+		cumulated += h.counts[i]
+		writeSample(buf, name+"_bucket", slices.Concat(labels, []string{"le", formatMetricValue(bound)}), float64(cumulated))
+	}
+	writeSample(buf, name+"_bucket", slices.Concat(labels, []string{"le", "+Inf"}), float64(h.count))
+	writeSample(buf, name+"_sum", labels, h.sum)
+	writeSample(buf, name+"_count", labels, float64(h.count))
+}
+
+// The counters of the engine and of the HTTP API, exposed by WriteMetrics
+type engineMetrics struct {
+	// The memTables flushed to sst files, and the bytes written to these files
+	flushes      atomic.Int64
+	flushedBytes atomic.Int64
+
+	// The compactions, the size of the sst files they read, and the size of the ones they wrote
+	compactions           atomic.Int64
+	compactionInputBytes  atomic.Int64
+	compactionOutputBytes atomic.Int64
+
+	// The time the writes filling the memTable waited for it to be flushed
+	writeStalls histogram
+
+	// The reads answered by the memTable, by an sst file, and the ones of keys that don't exist
+	memTableReads atomic.Int64
+	sstReads      atomic.Int64
+	missedReads   atomic.Int64
+
+	// The sst files skipped because the key is out of their key range, the ones holding the key, and the ones
+	// read in vain because the key is in their range but not in them
+	rangeFilterSkips          atomic.Int64
+	rangeFilterHits           atomic.Int64
+	rangeFilterFalsePositives atomic.Int64
+
+	// The metrics of the HTTP handlers by pattern
+	handlersMu sync.Mutex
+	handlers   map[string]*handlerMetrics
+}
+
+// The metrics of an HTTP handler
+type handlerMetrics struct {
+	mu sync.Mutex
+
+	// The number of responses by status code
+	codes map[int]int64
+
+	durations histogram
+}
+
+// Returns the metrics of the HTTP handler registered with pattern, creating them if they don't exist.
+func (metrics *engineMetrics) handler(pattern string) *handlerMetrics {
+	metrics.handlersMu.Lock()
+	defer metrics.handlersMu.Unlock()
+
+	if metrics.handlers == nil {
+		metrics.handlers = make(map[string]*handlerMetrics)
+	}
+	if metrics.handlers[pattern] == nil {
+		metrics.handlers[pattern] = &handlerMetrics{codes: make(map[int]int64)}
+	}
+
+	return metrics.handlers[pattern]
+}
+
+// A response writer remembering the status code of the response
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	if rec.code == 0 && code >= 200 {
+		rec.code = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.code == 0 {
+		rec.code = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Lets http.ResponseController flush the streamed responses.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Returns the handler counting the requests of handler, registered with pattern, and measuring their durations.
+func instrumentHandler(lsmdb *DB, pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	metrics := lsmdb.rootDB().metrics.handler(pattern)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		handler(rec, r)
+
+		metrics.durations.observe(time.Since(start))
+		metrics.mu.Lock()
+		metrics.codes[cmp.Or(rec.code, http.StatusOK)]++
+		metrics.mu.Unlock()
+	}
+}
+
+// Writes the metrics of the database and of its HTTP API in the Prometheus text exposition format.
+func (lsmdb *DB) WriteMetrics(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := lsmdb.writeEngineMetrics(&buf); err != nil {
+		return err
+	}
+	lsmdb.rootDB().metrics.writeHandlerMetrics(&buf)
+
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// Writes the metrics of the engine, the gauges being read while the database is locked.
+func (lsmdb *DB) writeEngineMetrics(buf *bytes.Buffer) error {
+	unlock, err := lsmdb.lockContext(context.Background())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	root := lsmdb.rootDB()
+	families := root.allFamilies()
+	metrics := &root.metrics
+
+	writeMetricHeader(buf, "lsmdb_memtable_bytes", "gauge", "The size of the memTable in bytes.")
+	for _, family := range families {
+		writeSample(buf, "lsmdb_memtable_bytes", family.metricLabels(), float64(family.memTable.sizeInBytes()))
+	}
+	writeMetricHeader(buf, "lsmdb_memtable_entries", "gauge", "The number of keys in the memTable.")
+	for _, family := range families {
+		writeSample(buf, "lsmdb_memtable_entries", family.metricLabels(), float64(family.memTable.sortedMap.Len()))
+	}
+
+	// The sst files aren't organized in levels, they are all in the level 0
+	writeMetricHeader(buf, "lsmdb_sst_files", "gauge", "The number of sst files by level.")
+	for _, family := range families {
+		writeSample(buf, "lsmdb_sst_files", family.metricLabels("level", "0"), float64(family.sstFilesNum))
+	}
+	writeMetricHeader(buf, "lsmdb_sst_bytes", "gauge", "The size of the sst files in bytes by level.")
+	for _, family := range families {
+		size, err := family.sstFilesSize()
+		if err != nil {
+			return err
+		}
+		writeSample(buf, "lsmdb_sst_bytes", family.metricLabels("level", "0"), float64(size))
+	}
+
+	writeMetricHeader(buf, "lsmdb_flushes_total", "counter", "The number of memTables flushed to sst files.")
+	writeSample(buf, "lsmdb_flushes_total", nil, float64(metrics.flushes.Load()))
+	writeMetricHeader(buf, "lsmdb_flushed_bytes_total", "counter", "The number of bytes written to sst files by the flushes.")
+	writeSample(buf, "lsmdb_flushed_bytes_total", nil, float64(metrics.flushedBytes.Load()))
+	writeMetricHeader(buf, "lsmdb_compactions_total", "counter", "The number of compactions.")
+	writeSample(buf, "lsmdb_compactions_total", nil, float64(metrics.compactions.Load()))
+	writeMetricHeader(buf, "lsmdb_compaction_read_bytes_total", "counter", "The number of bytes of the sst files read by the compactions.")
+	writeSample(buf, "lsmdb_compaction_read_bytes_total", nil, float64(metrics.compactionInputBytes.Load()))
+	writeMetricHeader(buf, "lsmdb_compaction_written_bytes_total", "counter", "The number of bytes written to sst files by the compactions.")
+	writeSample(buf, "lsmdb_compaction_written_bytes_total", nil, float64(metrics.compactionOutputBytes.Load()))
+	writeMetricHeader(buf, "lsmdb_write_stall_duration_seconds", "histogram", "The time the writes waited for the full memTable to be flushed.")
+	metrics.writeStalls.write(buf, "lsmdb_write_stall_duration_seconds")
+
+	info, err := root.wal.logFile.Stat()
+	if err != nil {
+		return err
+	}
+	writeMetricHeader(buf, "lsmdb_wal_bytes", "gauge", "The size of the current WAL segment in bytes.")
+	writeSample(buf, "lsmdb_wal_bytes", nil, float64(info.Size()))
+	writeMetricHeader(buf, "lsmdb_wal_written_bytes_total", "counter", "The number of bytes appended to the WAL.")
+	writeSample(buf, "lsmdb_wal_written_bytes_total", nil, float64(root.wal.writtenBytes))
+	writeMetricHeader(buf, "lsmdb_wal_fsync_duration_seconds", "histogram", "The time taken by the fsyncs of the WAL.")
+	root.wal.syncDurations.write(buf, "lsmdb_wal_fsync_duration_seconds")
+
+	// The memTable plays the role of a cache in front of the sst files
+	writeMetricHeader(buf, "lsmdb_reads_total", "counter", "The number of reads by the place the key was found in, none if it doesn't exist.")
+	writeSample(buf, "lsmdb_reads_total", []string{"source", "memtable"}, float64(metrics.memTableReads.Load()))
+	writeSample(buf, "lsmdb_reads_total", []string{"source", "sst"}, float64(metrics.sstReads.Load()))
+	writeSample(buf, "lsmdb_reads_total", []string{"source", "none"}, float64(metrics.missedReads.Load()))
+
+	// The key range in the header of the sst files plays the role of a bloom filter
+	writeMetricHeader(buf, "lsmdb_sst_range_filter_total", "counter", "The number of sst file lookups by the result of the check of their key range.")
+	writeSample(buf, "lsmdb_sst_range_filter_total", []string{"result", "skipped"}, float64(metrics.rangeFilterSkips.Load()))
+	writeSample(buf, "lsmdb_sst_range_filter_total", []string{"result", "hit"}, float64(metrics.rangeFilterHits.Load()))
+	writeSample(buf, "lsmdb_sst_range_filter_total", []string{"result", "false_positive"}, float64(metrics.rangeFilterFalsePositives.Load()))
+
+	return nil
+}
+
+// Writes the metrics of the HTTP handlers, sorted by pattern.
+func (metrics *engineMetrics) writeHandlerMetrics(buf *bytes.Buffer) {
+	metrics.handlersMu.Lock()
+	handlers := maps.Clone(metrics.handlers)
+	metrics.handlersMu.Unlock()
+
+	patterns := slices.Sorted(maps.Keys(handlers))
+
+	writeMetricHeader(buf, "lsmdb_http_requests_total", "counter", "The number of HTTP requests by handler and status code.")
+	for _, pattern := range patterns {
+		handler := handlers[pattern]
+		handler.mu.Lock()
+		for _, code := range slices.Sorted(maps.Keys(handler.codes)) {
+			writeSample(buf, "lsmdb_http_requests_total", []string{"handler", pattern, "code", strconv.Itoa(code)}, float64(handler.codes[code]))
+		}
+		handler.mu.Unlock()
+	}
+
+	writeMetricHeader(buf, "lsmdb_http_request_duration_seconds", "histogram", "The time taken by the HTTP requests by handler.")
+	for _, pattern := range patterns {
+		handlers[pattern].durations.write(buf, "lsmdb_http_request_duration_seconds", "handler", pattern)
+	}
+}
+
+// Returns the labels of the metrics of the column family, followed by the other label name and value pairs.
+func (lsmdb *DB) metricLabels(labels ...string) []string {
+	return append([]string{"family", cmp.Or(lsmdb.familyName, defaultColumnFamilyName)}, labels...)
+}
+
+// Returns the total size of the sst files of the column family.
+func (lsmdb *DB) sstFilesSize() (int64, error) {
+	var size int64
+	for i := 1; i <= lsmdb.sstFilesNum; i++ {
+		info, err := os.Stat(fmt.Sprint(lsmdb.sstPath, "f", i, ".sst"))
+		if err != nil {
+			return 0, err
+		}
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, kind, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Writes a sample of the metric, labels holding the label name and value pairs.
+func writeSample(buf *bytes.Buffer, name string, labels []string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", labels[i], labelValueReplacer.Replace(labels[i+1]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatMetricValue(value))
+	buf.WriteByte('\n')
+}
+
+// Escapes the label values like the text exposition format requires
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// This is the request handler exposing the metrics to Prometheus (/metrics)
+func metricsHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err := lsmdb.WriteMetrics(&buf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buf.WriteTo(w)
+	}
+}
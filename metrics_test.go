@@ -0,0 +1,132 @@
+package lsmdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Reads the samples of the metrics served at url, by metric name followed by its labels.
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("Expected status 200 with the text format, got %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("Invalid sample %q", line)
+		}
+		samples[line[:i]] = value
+	}
+
+	return samples
+}
+
+func TestMetricsHandler(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	server := httptest.NewServer(NewHTTPHandler(lsmdb, nil, nil, nil, nil))
+	defer server.Close()
+
+	// The memTable is flushed after a few writes, by the write filling it
+	for i := range 10 {
+		resp, err := http.Post(server.URL+"/set", "application/json", strings.NewReader(fmt.Sprintf(`{"key": "key%d", "value": "value"}`, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	lsmdb.Put([]byte("key9"), []byte("value9"))
+
+	for _, key := range []string{"key9", "key0", "key00", "missing"} {
+		resp, err := http.Get(server.URL + "/get?key=" + key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if resp, err := http.Post(server.URL+"/get", "", nil); err == nil {
+		resp.Body.Close()
+	}
+
+	samples := scrapeMetrics(t, server.URL+"/metrics")
+	expected := map[string]float64{
+		`lsmdb_sst_files{family="default",level="0"}`:                          1,
+		`lsmdb_flushes_total`:                                                  1,
+		`lsmdb_memtable_entries{family="default"}`:                             1,
+		`lsmdb_write_stall_duration_seconds_count`:                             1,
+		`lsmdb_reads_total{source="memtable"}`:                                 1,
+		`lsmdb_reads_total{source="sst"}`:                                      1,
+		`lsmdb_reads_total{source="none"}`:                                     2,
+		`lsmdb_sst_range_filter_total{result="hit"}`:                           1,
+		`lsmdb_sst_range_filter_total{result="false_positive"}`:                1,
+		`lsmdb_sst_range_filter_total{result="skipped"}`:                       1,
+		`lsmdb_http_requests_total{handler="/set",code="200"}`:                 10,
+		`lsmdb_http_requests_total{handler="/get",code="200"}`:                 4,
+		`lsmdb_http_requests_total{handler="/get",code="400"}`:                 1,
+		`lsmdb_http_request_duration_seconds_count{handler="/get"}`:            5,
+		`lsmdb_http_request_duration_seconds_bucket{handler="/get",le="+Inf"}`: 5,
+	}
+	for name, value := range expected {
+		if samples[name] != value {
+			t.Errorf("Expected %v for %s, got %v", value, name, samples[name])
+		}
+	}
+
+	for _, name := range []string{`lsmdb_flushed_bytes_total`, `lsmdb_sst_bytes{family="default",level="0"}`, `lsmdb_memtable_bytes{family="default"}`, `lsmdb_wal_bytes`, `lsmdb_wal_written_bytes_total`} {
+		if samples[name] <= 0 {
+			t.Errorf("Expected a positive value for %s, got %v", name, samples[name])
+		}
+	}
+
+	// The histograms are exposed before anything is observed
+	if _, ok := samples[`lsmdb_wal_fsync_duration_seconds_count`]; !ok {
+		t.Error("Expected the fsync durations of the WAL")
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	h.observe(300 * time.Microsecond)
+	h.observe(20 * time.Millisecond)
+	h.observe(time.Minute)
+
+	var buf bytes.Buffer
+	h.write(&buf, "latency", "handler", `/a"b`)
+
+	for _, sample := range []string{
+		`latency_bucket{handler="/a\"b",le="0.0005"} 1`,
+		`latency_bucket{handler="/a\"b",le="0.01"} 1`,
+		`latency_bucket{handler="/a\"b",le="0.025"} 2`,
+		`latency_bucket{handler="/a\"b",le="10"} 2`,
+		`latency_bucket{handler="/a\"b",le="+Inf"} 3`,
+		`latency_sum{handler="/a\"b"} 60.0203`,
+		`latency_count{handler="/a\"b"} 3`,
+	} {
+		if !strings.Contains(buf.String(), sample+"\n") {
+			t.Errorf("Expected %s in\n%s", sample, buf.String())
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package lsmdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// The options of a database.
+type Options struct {
+	// The size in bytes of the memTable after which it is flushed to an sst file
+	MemSizeThreshold int `json:"memSizeThreshold"`
+
+	// The number of sst files after which they are compacted into one
+	FileNumThreshold int `json:"fileNumThreshold"`
+
+	// The size in bytes from which the values are written to the value log
+	ValueThreshold int `json:"valueThreshold"`
+
+	// The size in bytes after which a new value log segment is started
+	ValueLogSegmentSize int64 `json:"valueLogSegmentSize"`
+
+	// The name of the merge operator, merges are not supported if it is empty
+	MergeOperator string `json:"mergeOperator"`
+
+	// The size of the old WAL segments kept for the change feed and the followers, none is kept if it is 0
+	WALHistoryMaxSize int64 `json:"walHistoryMaxSize"`
+
+	// The directory the full WAL segments are archived to for point-in-time recovery, none is archived if it is empty
+	WALArchiveDir string `json:"walArchiveDir"`
+
+	// Flushes the memTables to sst files when the database is closed, so it restarts without replaying the WAL
+	FlushOnClose bool `json:"flushOnClose"`
+}
+
+// Returns the options used when none is given.
+func DefaultOptions() Options {
+	return Options{
+		MemSizeThreshold:    100,
+		FileNumThreshold:    20,
+		ValueThreshold:      1024,
+		ValueLogSegmentSize: 64 << 20,
+		MergeOperator:       "int64add",
+		WALHistoryMaxSize:   64 << 20,
+	}
+}
+
+// Returns an error listing the options whose values make no sense, nil if there is none.
+func (opts Options) Validate() error {
+	var errs []error
+	invalid := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if opts.MemSizeThreshold <= 0 {
+		invalid("mem-size-threshold must be positive, got %d", opts.MemSizeThreshold)
+	}
+	if opts.FileNumThreshold < 2 {
+		invalid("file-num-threshold must be at least 2, got %d", opts.FileNumThreshold)
+	}
+	if opts.ValueThreshold <= 0 {
+		invalid("value-threshold must be positive, got %d", opts.ValueThreshold)
+	}
+	if opts.ValueLogSegmentSize <= 0 {
+		invalid("value-log-segment-size must be positive, got %d", opts.ValueLogSegmentSize)
+	}
+	if opts.MergeOperator != "" && lookupMergeOperator(opts.MergeOperator) == nil {
+		invalid("unknown merge-operator %q", opts.MergeOperator)
+	}
+	if opts.WALHistoryMaxSize < 0 {
+		invalid("wal-history-max-size must not be negative, got %d", opts.WALHistoryMaxSize)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Opens the database whose files live in the directory dir, creating it if it doesn't exist. The default options
+// are used if opts is nil. The directory is locked until the database is closed.
+func Open(dir string, opts *Options) (*DB, error) {
+	if opts == nil {
+		defaults := DefaultOptions()
+		opts = &defaults
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	lsmdb, err := newDB(dir, *opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lsmdb.open(); err != nil {
+		lsmdb.wal.logFile.Close()
+		lsmdb.unlockDataDir()
+		return nil, err
+	}
+
+	return lsmdb, nil
+}
+
+// Returns the database whose data directory is dir, configured with opts and with the WAL file opened.
+// The database itself isn't opened, and the data directory is locked when it is.
+func newDB(dir string, opts Options) (*DB, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	walPath := filepath.Join(dir, "wal.log")
+	logfile, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	memTable := newMemTable()
+	wal := WAL{
+		logFile:     logfile,
+		walPath:     walPath,
+		archivePath: opts.WALArchiveDir,
+	}
+	if opts.WALHistoryMaxSize > 0 {
+		wal.historyPath = filepath.Join(dir, "wal-history") + "/"
+		wal.historyMaxSize = opts.WALHistoryMaxSize
+	}
+
+	return &DB{
+		memTable:         &memTable,
+		wal:              &wal,
+		magicNumber:      [4]byte{0x4c, 0x53, 0x4d, 0x44},
+		version:          1,
+		metadataFileName: filepath.Join(dir, "metadata.meta"),
+		memSizeThreshold: opts.MemSizeThreshold,
+		fileNumThreshold: opts.FileNumThreshold,
+		sstPath:          filepath.Join(dir, "sst") + "/",
+		sstFilesNum:      0,
+		mergeOperator:    lookupMergeOperator(opts.MergeOperator),
+		manifestFileName: filepath.Join(dir, "families.manifest"),
+		familiesPath:     filepath.Join(dir, "cf") + "/",
+		dataDir:          dir,
+		flushOnClose:     opts.FlushOnClose,
+
+		valueLogPath:        filepath.Join(dir, "vlog") + "/",
+		valueThreshold:      opts.ValueThreshold,
+		valueLogSegmentSize: opts.ValueLogSegmentSize,
+	}, nil
+}
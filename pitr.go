@@ -0,0 +1,217 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	ErrRecoveryTargetReached = errors.New("the recovery target is reached")
+	ErrCommitTimeUnknown     = errors.New("the WAL record doesn't have a commit time")
+	ErrValueNotRecoverable   = errors.New("the value of the WAL record is not in the value log of the checkpoint")
+)
+
+// The point the archived WAL is replayed up to. The records after the sequence number or committed after the time
+// are not replayed, and the zero values don't limit the replay.
+type RecoveryTarget struct {
+	Sequence uint64
+	Time     time.Time
+}
+
+// Tells if the record comes after the recovery target.
+func (target RecoveryTarget) excludes(record walRecord) (bool, error) {
+	if target.Sequence > 0 && record.seq > target.Sequence {
+		return true, nil
+	}
+
+	if !target.Time.IsZero() {
+		if record.time.IsZero() {
+			return false, ErrCommitTimeUnknown
+		}
+		if record.time.After(target.Time) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Replays the WAL segments archived in archiveDir (see WAL.archivePath) on the database, from its last sequence
+// number up to the target. The segment at walPath, the WAL of the database the segments were archived from, is
+// replayed after them if walPath isn't empty.
+// Returns the sequence number of the last replayed record, or ErrSequenceNotRetained if a record is missing.
+//
+// The values written to the value log are only in the archived records as pointers, so the records whose value
+// isn't in the value log of the database (written after its checkpoint) can't be replayed and
+// ErrValueNotRecoverable is returned for them.
+func (lsmdb *DB) ReplayArchivedWAL(archiveDir, walPath string, target RecoveryTarget) (uint64, error) {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	archive := &WAL{historyPath: archiveDir}
+
+	segments, err := archive.retainedSegments()
+	if err != nil {
+		return 0, err
+	}
+
+	replay := func(record walRecord) error {
+		if record.seq <= root.wal.lastSeq {
+			return nil
+		}
+		if record.seq != root.wal.lastSeq+1 {
+			return ErrSequenceNotRetained
+		}
+
+		if excluded, err := target.excludes(record); err != nil {
+			return err
+		} else if excluded {
+			return ErrRecoveryTargetReached
+		}
+
+		return root.replayRecord(record.entry)
+	}
+
+	lastSeq := uint64(0)
+	for _, baseSeq := range segments {
+		if baseSeq > root.wal.lastSeq {
+			return root.wal.lastSeq, ErrSequenceNotRetained
+		}
+
+		lastSeq, err = readWALSegment(archive.segmentPath(baseSeq), baseSeq, replay)
+		if err == ErrRecoveryTargetReached {
+			return root.wal.lastSeq, nil
+		}
+		if err != nil {
+			return root.wal.lastSeq, err
+		}
+	}
+
+	// The WAL starts with the sequence number of its segment if it follows a cleared one
+	if walPath != "" {
+		if _, err := readWALSegment(walPath, lastSeq, replay); err != nil && err != ErrRecoveryTargetReached {
+			return root.wal.lastSeq, err
+		}
+	}
+
+	return root.wal.lastSeq, nil
+}
+
+// Writes a record read from an archived WAL to the WAL, and applies it to the memTables.
+// It must be called with the database locked.
+func (lsmdb *DB) replayRecord(entry Entry) error {
+	batch := &WriteBatch{}
+	if entry.op == BatchOp {
+		var err error
+		if batch, err = decodeWriteBatch(entry.value); err != nil {
+			return err
+		}
+	} else {
+		batch.add(defaultColumnFamilyName, entry)
+	}
+
+	for i, entry := range batch.entries {
+		if entry.op != ValuePointerOp {
+			continue
+		}
+
+		family, err := lsmdb.columnFamily(batch.families[i])
+		if err == ErrColumnFamilyNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, err := family.readValueLog(entry.value); err != nil {
+			return fmt.Errorf("%w: %v", ErrValueNotRecoverable, err)
+		}
+	}
+
+	if err := lsmdb.appendRecord(entry); err != nil {
+		return err
+	}
+
+	if entry.op == BatchOp {
+		if err := lsmdb.applyBatchRecord(entry.value, lsmdb.wal.lastSeq); err != nil {
+			return err
+		}
+	} else if err := lsmdb.applyToMemTable(entry.op, entry.key, entry.value); err != nil {
+		return err
+	}
+
+	for _, family := range lsmdb.allFamilies() {
+		if family.memTable.sizeInBytes() >= family.memSizeThreshold {
+			return lsmdb.flushToDisk()
+		}
+	}
+
+	return nil
+}
+
+// Restores the checkpoint to the directory dir, which must not exist, and replays the archived WAL on it up to the
+// target (see ReplayArchivedWAL). Returns the sequence number of the last replayed record.
+func RestoreToPoint(checkpointDir, archiveDir, walPath, dir string, target RecoveryTarget) (uint64, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return 0, ErrTargetExists
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	encoded, err := os.ReadFile(filepath.Join(checkpointDir, checkpointManifestFileName))
+	if err != nil {
+		return 0, err
+	}
+
+	var manifest CheckpointManifest
+	if err := json.Unmarshal(encoded, &manifest); err != nil {
+		return 0, ErrCorruptedFile
+	}
+
+	// The database is restored in a temporary directory, renamed once the replay is done
+	tmp := filepath.Clean(dir) + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return 0, err
+	}
+
+	lastSeq, err := replayOnCheckpoint(&manifest, checkpointDir, archiveDir, walPath, tmp, target)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return 0, err
+	}
+
+	return lastSeq, os.Rename(tmp, dir)
+}
+
+func replayOnCheckpoint(manifest *CheckpointManifest, checkpointDir, archiveDir, walPath, dir string, target RecoveryTarget) (uint64, error) {
+	for _, file := range manifest.Files {
+		dst := filepath.Join(dir, file.Path)
+		if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+			return 0, err
+		}
+		if err := copyFilePrefix(filepath.Join(checkpointDir, file.Path), dst, file.Size); err != nil {
+			return 0, err
+		}
+	}
+
+	// The replayed database keeps no WAL history of its own
+	opts := DefaultOptions()
+	opts.WALHistoryMaxSize = 0
+
+	lsmdb, err := Open(dir, &opts)
+	if err != nil {
+		return 0, err
+	}
+
+	lastSeq, err := lsmdb.ReplayArchivedWAL(archiveDir, walPath, target)
+	if err != nil {
+		lsmdb.Close()
+		return 0, err
+	}
+
+	return lastSeq, lsmdb.Close()
+}
@@ -0,0 +1,126 @@
+package lsmdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRestoreToPoint(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	lsmdb.wal.archivePath = archiveDir
+
+	for i := 0; i < 5; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte("before"))
+	}
+
+	checkpointDir := filepath.Join(t.TempDir(), "checkpoint")
+	if _, err := lsmdb.Checkpoint(checkpointDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enough changes for the memTable to be flushed, so some of them are only in the archived segments
+	for i := 0; i < 20; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte("after"))
+	}
+	afterSeq := lsmdb.LastSequence()
+
+	time.Sleep(5 * time.Millisecond)
+	until := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	lsmdb.Delete([]byte("key0"))
+	lsmdb.Put([]byte("key1"), []byte("latest"))
+
+	if segments, _ := (&WAL{historyPath: archiveDir}).retainedSegments(); len(segments) == 0 {
+		t.Fatal("Expected some archived segments")
+	}
+
+	// Replaying up to a sequence number
+	target := filepath.Join(t.TempDir(), "seq")
+	lastSeq, err := RestoreToPoint(checkpointDir, archiveDir, lsmdb.wal.walPath, target, RecoveryTarget{Sequence: afterSeq - 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastSeq != afterSeq-1 {
+		t.Errorf("Expected sequence %d, got %d", afterSeq-1, lastSeq)
+	}
+
+	restored := openTestLSMDB(t, target)
+	if v, _ := restored.Get([]byte("key18")); string(v) != "after" {
+		t.Errorf("Expected after, got %q", v)
+	}
+	if _, err := restored.Get([]byte("key19")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	// Replaying up to a time
+	target = filepath.Join(t.TempDir(), "time")
+	lastSeq, err = RestoreToPoint(checkpointDir, archiveDir, lsmdb.wal.walPath, target, RecoveryTarget{Time: until})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastSeq != afterSeq {
+		t.Errorf("Expected sequence %d, got %d", afterSeq, lastSeq)
+	}
+
+	restored = openTestLSMDB(t, target)
+	for _, key := range []string{"key0", "key1", "key19"} {
+		if v, _ := restored.Get([]byte(key)); string(v) != "after" {
+			t.Errorf("Expected after for %s, got %q", key, v)
+		}
+	}
+
+	// Replaying everything, with the WAL of the database
+	target = filepath.Join(t.TempDir(), "all")
+	if _, err := RestoreToPoint(checkpointDir, archiveDir, lsmdb.wal.walPath, target, RecoveryTarget{}); err != nil {
+		t.Fatal(err)
+	}
+
+	restored = openTestLSMDB(t, target)
+	if _, err := restored.Get([]byte("key0")); err != ErrKeyDeleted && err != ErrKeyNotFound {
+		t.Errorf("Expected key0 to be deleted, got %v", err)
+	}
+	if v, _ := restored.Get([]byte("key1")); string(v) != "latest" {
+		t.Errorf("Expected latest, got %q", v)
+	}
+	if restored.LastSequence() != lsmdb.LastSequence() {
+		t.Errorf("Expected sequence %d, got %d", lsmdb.LastSequence(), restored.LastSequence())
+	}
+
+	if _, err := RestoreToPoint(checkpointDir, archiveDir, "", target, RecoveryTarget{}); err != ErrTargetExists {
+		t.Errorf("Expected ErrTargetExists, got %v", err)
+	}
+}
+
+func TestRestoreToPointMissingSegment(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	archiveDir := filepath.Join(t.TempDir(), "archive")
+	lsmdb.wal.archivePath = archiveDir
+
+	checkpointDir := filepath.Join(t.TempDir(), "checkpoint")
+	if _, err := lsmdb.Checkpoint(checkpointDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 40; i++ {
+		lsmdb.Put([]byte(fmt.Sprint("key", i)), []byte("value"))
+	}
+
+	segments, _ := (&WAL{historyPath: archiveDir}).retainedSegments()
+	if len(segments) < 2 {
+		t.Fatal("Expected two archived segments at least")
+	}
+	os.Remove(filepath.Join(archiveDir, fmt.Sprintf("%020d.wal", segments[0])))
+
+	target := filepath.Join(t.TempDir(), "target")
+	if _, err := RestoreToPoint(checkpointDir, archiveDir, "", target, RecoveryTarget{}); err != ErrSequenceNotRetained {
+		t.Errorf("Expected ErrSequenceNotRetained, got %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("Expected the target not to be created, got %v", err)
+	}
+}
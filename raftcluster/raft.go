@@ -0,0 +1,408 @@
+// Package raftcluster replicates a database over a cluster with Raft.
+package raftcluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+var (
+	ErrNoLeader = errors.New("the cluster has no leader")
+)
+
+// The column family holding the state of the cluster: the index of the last applied Raft log entry and the HTTP
+// addresses of the members. It is replicated like the other ones.
+const raftColumnFamilyName = "_raft"
+
+const (
+	raftAppliedIndexKey = "appliedIndex"
+	raftMemberKeyPrefix = "member/"
+)
+
+type Options struct {
+	// The ID of the node in the cluster
+	ID string
+
+	// The address the Raft traffic is served on
+	RaftAddr string
+
+	// The URL of the HTTP API of the node, the clients are redirected to the one of the leader
+	HTTPAddr string
+
+	// The directory of the Raft log and of the snapshots
+	Dir string
+
+	// Bootstraps a new cluster whose only member is the node (if it has no Raft state yet)
+	Bootstrap bool
+
+	// The bearer token sent to the cluster when joining it, if its HTTP API has access control
+	Token string
+
+	// The timeouts of the heartbeats and of the elections, the defaults of the raft package if zero
+	HeartbeatTimeout time.Duration
+	ElectionTimeout  time.Duration
+
+	// The number of log entries after which a snapshot is taken, the default of the raft package if zero
+	SnapshotThreshold uint64
+
+	// The output of the logs of the raft package, stderr if nil
+	LogOutput io.Writer
+}
+
+// A node of a cluster replicating the database with Raft: the writes are entries of the Raft log, applied to the
+// database of every node once they are committed. The reads are served by each node from its database, so they can
+// miss the last committed writes on the followers.
+type Node struct {
+	db        *lsmdb.DB
+	raft      *raft.Raft
+	store     *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+	opts      Options
+}
+
+// Starts a Raft node on the database, which only takes the writes of the cluster from then on.
+func NewNode(db *lsmdb.DB, opts Options) (*Node, error) {
+	if err := os.MkdirAll(opts.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	logOutput := opts.LogOutput
+	if logOutput == nil {
+		logOutput = os.Stderr
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(opts.ID)
+	config.LogOutput = logOutput
+	config.LogLevel = "INFO"
+	if opts.HeartbeatTimeout > 0 {
+		config.HeartbeatTimeout = opts.HeartbeatTimeout
+		config.LeaderLeaseTimeout = opts.HeartbeatTimeout
+	}
+	if opts.ElectionTimeout > 0 {
+		config.ElectionTimeout = opts.ElectionTimeout
+	}
+	if opts.SnapshotThreshold > 0 {
+		config.SnapshotThreshold = opts.SnapshotThreshold
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(opts.Dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(opts.Dir, 2, logOutput)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransport(opts.RaftAddr, nil, 3, 10*time.Second, logOutput)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	r, err := raft.NewRaft(config, &raftFSM{db: db, dir: opts.Dir}, store, store, snapshots, transport)
+	if err != nil {
+		transport.Close()
+		store.Close()
+		return nil, err
+	}
+
+	node := &Node{
+		db:        db,
+		raft:      r,
+		store:     store,
+		transport: transport,
+		opts:      opts,
+	}
+
+	db.SetCluster(node)
+
+	if opts.Bootstrap {
+		existing, err := raft.HasExistingState(store, store, snapshots)
+		if err != nil {
+			node.Shutdown()
+			return nil, err
+		}
+
+		if !existing {
+			configuration := raft.Configuration{Servers: []raft.Server{{ID: config.LocalID, Address: transport.LocalAddr()}}}
+			if err := r.BootstrapCluster(configuration).Error(); err != nil {
+				node.Shutdown()
+				return nil, err
+			}
+
+			// The HTTP address of the first member is recorded once it is elected
+			go node.registerSelf()
+		}
+	}
+
+	return node, nil
+}
+
+// Records the HTTP address of the node in the cluster state, once it is the leader.
+func (node *Node) registerSelf() {
+	for range 100 {
+		if node.raft.State() == raft.Leader {
+			batch := &lsmdb.WriteBatch{}
+			batch.Put(raftColumnFamilyName, []byte(raftMemberKeyPrefix+node.opts.ID), []byte(node.opts.HTTPAddr))
+			if _, err := node.Propose(batch); err == nil {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Returns the address the Raft traffic of the node is served on.
+func (node *Node) RaftAddr() string {
+	return string(node.transport.LocalAddr())
+}
+
+// Proposes the batch to the cluster, and returns the result of its application once it is committed.
+// It fails with raft.ErrNotLeader if the node is not the leader.
+func (node *Node) Propose(batch *lsmdb.WriteBatch) ([]byte, error) {
+	future := node.raft.Apply(batch.Encode(), 10*time.Second)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	result := future.Response().(raftResult)
+	return result.value, result.err
+}
+
+// Returns the URL of the HTTP API of the leader, or ErrNoLeader if there is no leader (or if its URL is not known yet).
+func (node *Node) LeaderHTTPAddr() (string, error) {
+	_, id := node.raft.LeaderWithID()
+	if id == "" {
+		return "", ErrNoLeader
+	}
+
+	addr, err := node.memberHTTPAddr(string(id))
+	if err != nil {
+		return "", ErrNoLeader
+	}
+	return addr, nil
+}
+
+func (node *Node) memberHTTPAddr(id string) (string, error) {
+	family, err := node.db.ColumnFamily(raftColumnFamilyName)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := family.Get([]byte(raftMemberKeyPrefix + id))
+	return string(addr), err
+}
+
+// Adds a node to the cluster as a voter. It must be called on the leader.
+func (node *Node) Join(id, raftAddr, httpAddr string) error {
+	if err := node.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(raftAddr), 0, 10*time.Second).Error(); err != nil {
+		return err
+	}
+
+	batch := &lsmdb.WriteBatch{}
+	batch.Put(raftColumnFamilyName, []byte(raftMemberKeyPrefix+id), []byte(httpAddr))
+	_, err := node.Propose(batch)
+	return err
+}
+
+// Removes a node from the cluster. It must be called on the leader.
+func (node *Node) Remove(id string) error {
+	if err := node.raft.RemoveServer(raft.ServerID(id), 0, 10*time.Second).Error(); err != nil {
+		return err
+	}
+
+	batch := &lsmdb.WriteBatch{}
+	batch.Delete(raftColumnFamilyName, []byte(raftMemberKeyPrefix+id))
+	_, err := node.Propose(batch)
+	return err
+}
+
+// Asks the node at joinURL (or the leader it redirects to) to add this node to the cluster.
+func (node *Node) JoinCluster(joinURL string) error {
+	request, _ := json.Marshal(lsmdb.ClusterJoinRequest{ID: node.opts.ID, RaftAddr: node.RaftAddr(), HTTPAddr: node.opts.HTTPAddr})
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(joinURL, "/")+"/cluster/join", bytes.NewReader(request))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if node.opts.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+node.opts.Token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("the cluster refused the node: %s", strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// Returns the state of the node and the members of the cluster.
+func (node *Node) Status() (lsmdb.ClusterStatus, error) {
+	future := node.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return lsmdb.ClusterStatus{}, err
+	}
+
+	_, leader := node.raft.LeaderWithID()
+	status := lsmdb.ClusterStatus{
+		ID:           node.opts.ID,
+		State:        node.raft.State().String(),
+		Leader:       string(leader),
+		AppliedIndex: node.raft.AppliedIndex(),
+	}
+
+	for _, server := range future.Configuration().Servers {
+		httpAddr, _ := node.memberHTTPAddr(string(server.ID))
+		status.Members = append(status.Members, lsmdb.ClusterMember{
+			ID:       string(server.ID),
+			RaftAddr: string(server.Address),
+			HTTPAddr: httpAddr,
+			Voter:    server.Suffrage == raft.Voter,
+		})
+	}
+
+	return status, nil
+}
+
+// Stops the node. The database stays read-only.
+func (node *Node) Shutdown() error {
+	err := node.raft.Shutdown().Error()
+	node.transport.Close()
+	if closeErr := node.store.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Tells if the node can take the write of the request. If it can't, the client is redirected to the leader (with
+// 307, so it sends the request again), or gets 503 if there is no leader.
+func (node *Node) TakesWrite(w http.ResponseWriter, r *http.Request) bool {
+	if node.raft.State() == raft.Leader {
+		return true
+	}
+
+	leader, err := node.LeaderHTTPAddr()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return false
+	}
+
+	http.Redirect(w, r, strings.TrimSuffix(leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return false
+}
+
+// The state machine of the Raft node: the log entries are encoded write batches, applied to the database.
+type raftFSM struct {
+	db *lsmdb.DB
+
+	// The directory the snapshots are staged in, next to the data of the node rather than in the temporary directory
+	dir string
+}
+
+// The result of the application of a Raft log entry: the previous value of the key for a deletion, and the error
+// the write was refused with, if any.
+type raftResult struct {
+	value []byte
+	err   error
+}
+
+func (fsm *raftFSM) Apply(log *raft.Log) interface{} {
+	if log.Type != raft.LogCommand {
+		return raftResult{}
+	}
+	value, err := fsm.db.ApplyLogEntry(log.Index, log.Data, raftColumnFamilyName, []byte(raftAppliedIndexKey))
+	return raftResult{value: value, err: err}
+}
+
+// The snapshots are checkpoints of the database, sent as tar archives preceded by their applied index (8 bytes).
+func (fsm *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	tmp, err := os.MkdirTemp(fsm.dir, "snapshot")
+	if err != nil {
+		return nil, err
+	}
+
+	// The entries are not applied while the snapshot is taken, so the applied index matches the checkpoint
+	index, err := fsm.db.AppliedLogIndex(raftColumnFamilyName, []byte(raftAppliedIndexKey))
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	dir := filepath.Join(tmp, "checkpoint")
+	if _, err := fsm.db.Checkpoint(dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+
+	return &raftSnapshot{dir: dir, index: index}, nil
+}
+
+// Replaces the database with the snapshot, unless it already holds the entries of the snapshot.
+func (fsm *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(snapshot, header); err != nil {
+		return err
+	}
+
+	applied, err := fsm.db.AppliedLogIndex(raftColumnFamilyName, []byte(raftAppliedIndexKey))
+	if err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint64(header) <= applied {
+		return nil
+	}
+
+	return fsm.db.RestoreCheckpointTar(snapshot)
+}
+
+type raftSnapshot struct {
+	dir   string
+	index uint64
+}
+
+func (snapshot *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := snapshot.write(sink)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (snapshot *raftSnapshot) write(w io.Writer) error {
+	if _, err := w.Write(binary.BigEndian.AppendUint64(nil, snapshot.index)); err != nil {
+		return err
+	}
+
+	return lsmdb.WriteCheckpointTar(w, snapshot.dir)
+}
+
+func (snapshot *raftSnapshot) Release() {
+	os.RemoveAll(filepath.Dir(snapshot.dir))
+}
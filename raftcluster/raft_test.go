@@ -0,0 +1,322 @@
+package raftcluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+	"github.com/hashicorp/raft"
+)
+
+type testClusterNode struct {
+	node   *Node
+	db     *lsmdb.DB
+	server *httptest.Server
+}
+
+// Opens the database whose files live in dir, closed at the end of the test.
+func openTestDB(t *testing.T, dir string) *lsmdb.DB {
+	db, err := lsmdb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func startTestClusterNode(t *testing.T, id string, bootstrap bool) *testClusterNode {
+	db := openTestDB(t, t.TempDir())
+	if err := db.CreateColumnFamily("users", lsmdb.ColumnFamilyOptions{MemSizeThreshold: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	var handler http.Handler
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	node, err := NewNode(db, Options{
+		ID:               id,
+		RaftAddr:         "127.0.0.1:0",
+		HTTPAddr:         server.URL,
+		Dir:              filepath.Join(t.TempDir(), "raft"),
+		Bootstrap:        bootstrap,
+		HeartbeatTimeout: 100 * time.Millisecond,
+		ElectionTimeout:  100 * time.Millisecond,
+		LogOutput:        io.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Shutdown() })
+
+	handler = lsmdb.NewHTTPHandler(db, nil, nil, node, nil)
+
+	return &testClusterNode{node: node, db: db, server: server}
+}
+
+// Waits for one of the nodes to be the leader, with its HTTP address known to all of them, and returns it.
+func waitForLeader(t *testing.T, nodes ...*testClusterNode) *testClusterNode {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, leader := range nodes {
+			if leader.node.raft.State() != raft.Leader {
+				continue
+			}
+
+			known := true
+			for _, node := range nodes {
+				if addr, err := node.node.LeaderHTTPAddr(); err != nil || addr != leader.server.URL {
+					known = false
+				}
+			}
+			if known {
+				return leader
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	t.Fatal("Expected a leader to be elected")
+	return nil
+}
+
+// Waits for the key to have the value on all the nodes.
+func waitForValue(t *testing.T, key, expected string, nodes ...*testClusterNode) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, node := range nodes {
+		for {
+			v, _ := node.db.Get([]byte(key))
+			if string(v) == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected %q for %s on %s, got %q", expected, key, node.node.opts.ID, v)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// Waits for the key of the column family to have the value on the node.
+func waitForFamilyValue(t *testing.T, node *testClusterNode, family, key, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var v []byte
+		if f, err := node.db.ColumnFamily(family); err == nil {
+			v, _ = f.Get([]byte(key))
+		}
+		if string(v) == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q for %s in %s on %s, got %q", expected, key, family, node.node.opts.ID, v)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRaftCluster(t *testing.T) {
+	node1 := startTestClusterNode(t, "node1", true)
+	waitForLeader(t, node1)
+
+	node2 := startTestClusterNode(t, "node2", false)
+	node3 := startTestClusterNode(t, "node3", false)
+
+	// The join requests sent to a follower are redirected to the leader
+	if err := node2.node.JoinCluster(node1.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	waitForLeader(t, node1, node2)
+	if err := node3.node.JoinCluster(node2.server.URL); err != nil {
+		t.Fatal(err)
+	}
+	nodes := []*testClusterNode{node1, node2, node3}
+	leader := waitForLeader(t, nodes...)
+
+	// The writes sent to a follower are redirected to the leader, and applied on all the nodes
+	var follower *testClusterNode
+	for _, node := range nodes {
+		if node != leader {
+			follower = node
+		}
+	}
+
+	resp, err := http.Post(follower.server.URL+"/set", "application/json", strings.NewReader(`{"key": "key1", "value": "value1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "OK" {
+		t.Errorf("Expected OK, got %s", body)
+	}
+	waitForValue(t, "key1", "value1", nodes...)
+
+	req, _ := http.NewRequest("DELETE", follower.server.URL+"/del?key=key1", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "value1" {
+		t.Errorf("Expected value1, got %s", body)
+	}
+	waitForValue(t, "key1", "", nodes...)
+
+	// The writes to a column family are proposed to it
+	resp, err = http.Post(follower.server.URL+"/cf/users/set", "application/json", strings.NewReader(`{"key": "alice", "value": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, node := range nodes {
+		waitForFamilyValue(t, node, "users", "alice", "1")
+		if _, err := node.db.Get([]byte("alice")); err != lsmdb.ErrKeyNotFound {
+			t.Errorf("Expected ErrKeyNotFound in the default column family, got %v", err)
+		}
+	}
+
+	req, _ = http.NewRequest("DELETE", follower.server.URL+"/cf/users/del?key=alice", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "1" {
+		t.Errorf("Expected 1, got %s", body)
+	}
+	for _, node := range nodes {
+		waitForFamilyValue(t, node, "users", "alice", "")
+	}
+
+	// The databases only take the writes of the cluster
+	if err := leader.db.Put([]byte("key2"), []byte("local")); err != lsmdb.ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+
+	resp, err = http.Get(follower.server.URL + "/cluster/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status lsmdb.ClusterStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	if status.State != "Follower" || status.Leader != leader.node.opts.ID || len(status.Members) != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+
+	// A new leader is elected when the leader stops
+	leader.node.Shutdown()
+
+	var remaining []*testClusterNode
+	for _, node := range nodes {
+		if node != leader {
+			remaining = append(remaining, node)
+		}
+	}
+	newLeader := waitForLeader(t, remaining...)
+
+	batch := &lsmdb.WriteBatch{}
+	batch.Put("", []byte("key3"), []byte("value3"))
+	if _, err := newLeader.node.Propose(batch); err != nil {
+		t.Fatal(err)
+	}
+	waitForValue(t, "key3", "value3", remaining...)
+
+	// The stopped node is removed from the cluster
+	if err := newLeader.node.Remove(leader.node.opts.ID); err != nil {
+		t.Fatal(err)
+	}
+	status, err = newLeader.node.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Members) != 2 {
+		t.Errorf("Expected 2 members, got %+v", status.Members)
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	db := openTestDB(t, t.TempDir())
+	fsm := &raftFSM{db: db, dir: t.TempDir()}
+
+	batch := &lsmdb.WriteBatch{}
+	batch.Put("", []byte("key1"), []byte("value1"))
+	if result := fsm.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: batch.Encode()}).(raftResult); result.err != nil {
+		t.Fatal(result.err)
+	}
+
+	// The entries replayed by Raft after a restart are not applied again
+	seq := db.LastSequence()
+	if result := fsm.Apply(&raft.Log{Index: 1, Type: raft.LogCommand, Data: batch.Encode()}).(raftResult); result.err != nil {
+		t.Fatal(result.err)
+	}
+	if db.LastSequence() != seq {
+		t.Errorf("Expected sequence %d, got %d", seq, db.LastSequence())
+	}
+
+	// A refused write still moves the applied index
+	batch = &lsmdb.WriteBatch{}
+	batch.Delete("", []byte("missing"))
+	if result := fsm.Apply(&raft.Log{Index: 2, Type: raft.LogCommand, Data: batch.Encode()}).(raftResult); result.err != lsmdb.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", result.err)
+	}
+
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	var encoded bytes.Buffer
+	if err := snapshot.(*raftSnapshot).write(&encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	// A node behind the snapshot is replaced by it
+	dir := t.TempDir()
+	restored, err := lsmdb.Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored.Put([]byte("stale"), []byte("value"))
+
+	if err := (&raftFSM{db: restored}).Restore(io.NopCloser(bytes.NewReader(encoded.Bytes()))); err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := restored.Get([]byte("key1")); string(v) != "value1" {
+		t.Errorf("Expected value1, got %q", v)
+	}
+	if _, err := restored.Get([]byte("stale")); err != lsmdb.ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+
+	applied, err := restored.AppliedLogIndex(raftColumnFamilyName, []byte(raftAppliedIndexKey))
+	if err != nil || applied != 2 {
+		t.Errorf("Expected applied index 2, got %d (%v)", applied, err)
+	}
+
+	// The restored node keeps working
+	if err := restored.Put([]byte("key2"), []byte("value2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.Close(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openTestDB(t, dir)
+	if v, _ := reopened.Get([]byte("key2")); string(v) != "value2" {
+		t.Errorf("Expected value2, got %q", v)
+	}
+}
@@ -0,0 +1,555 @@
+package lsmdb
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrReadOnly       = errors.New("the database is read-only (it is a follower)")
+	ErrReplicationGap = errors.New("a WAL record is missing from the replication stream")
+)
+
+// The interval at which the leader sends its last sequence number to the followers, so they know their lag when
+// there are no changes
+var replicationHeartbeatInterval = time.Second
+
+// The interval at which a follower reconnects to its leader after the stream ended
+var replicationRetryInterval = time.Second
+
+// A stream of WAL records shipped to a follower.
+// Each frame is the sequence number of a record (8 bytes) followed by the record, encoded like in the WAL. The
+// records are batches whose values are all in the record (the value pointers are replaced by the values), since the
+// value logs are not shared. A SequenceOp record is a heartbeat, and its sequence number is the last one of the leader.
+type replicationFeed struct {
+	frames chan []byte
+	err    error
+
+	// The address of the follower, and the sequence number of the last record sent to it
+	addr    string
+	sentSeq atomic.Uint64
+}
+
+// Returns the frame of a WAL record.
+func (lsmdb *DB) replicationFrame(seq uint64, entry Entry) ([]byte, error) {
+	batch := &WriteBatch{}
+	if entry.op == BatchOp {
+		var err error
+		if batch, err = decodeWriteBatch(entry.value); err != nil {
+			return nil, err
+		}
+	} else {
+		batch.add(defaultColumnFamilyName, entry)
+	}
+
+	shipped := WriteBatch{}
+	for i, entry := range batch.entries {
+		if entry.op == ValuePointerOp {
+			// A value garbage collected since it was written is empty, it was overwritten or it is rewritten by
+			// a later record
+			value := []byte{}
+			if family, err := lsmdb.columnFamily(batch.families[i]); err == nil && family.valueLog != nil {
+				if v, err := family.valueLog.read(entry.value); err == nil {
+					value = v
+				}
+			}
+			entry = Entry{op: SetOp, key: entry.key, value: value}
+		}
+		shipped.add(batch.families[i], entry)
+	}
+
+	record := Entry{op: BatchOp, value: shipped.Encode()}
+	return append(binary.BigEndian.AppendUint64(nil, seq), record.encode()...), nil
+}
+
+// Sends a WAL record to the followers. It is called with the database locked, on the default column family.
+// A follower that falls too far behind is dropped, and catches up from the WAL when it reconnects.
+func (lsmdb *DB) shipRecord(seq uint64, entry Entry) error {
+	frame, err := lsmdb.replicationFrame(seq, entry)
+	if err != nil {
+		return err
+	}
+
+	for feed := range lsmdb.replicationFeeds {
+		select {
+		case feed.frames <- frame:
+		default:
+			lsmdb.closeFeed(feed, ErrSubscriberTooSlow)
+		}
+	}
+
+	return nil
+}
+
+// Starts shipping the WAL records committed after the sequence number afterSeq to a follower. The records that are
+// already committed are read from the WAL, and ErrSequenceNotRetained is returned if some of them are not there.
+func (lsmdb *DB) openFeed(addr string, afterSeq uint64) (*replicationFeed, error) {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+
+	var frames [][]byte
+	err := root.wal.readRecordsAfter(afterSeq, func(record walRecord) error {
+		frame, err := root.replicationFrame(record.seq, record.entry)
+		frames = append(frames, frame)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	feed := &replicationFeed{
+		frames: make(chan []byte, len(frames)+subscriptionBufferSize),
+		addr:   addr,
+	}
+	feed.sentSeq.Store(afterSeq)
+	for _, frame := range frames {
+		feed.frames <- frame
+	}
+
+	if root.replicationFeeds == nil {
+		root.replicationFeeds = make(map[*replicationFeed]struct{})
+	}
+	root.replicationFeeds[feed] = struct{}{}
+
+	return feed, nil
+}
+
+func (lsmdb *DB) closeFeed(feed *replicationFeed, err error) {
+	root := lsmdb.rootDB()
+	if _, ok := root.replicationFeeds[feed]; !ok {
+		return
+	}
+
+	delete(root.replicationFeeds, feed)
+	feed.err = err
+	close(feed.frames)
+}
+
+// Tells if the database is read-only.
+func (lsmdb *DB) IsReadOnly() bool {
+	defer lsmdb.lock()()
+	return lsmdb.rootDB().readOnly
+}
+
+// Makes the database read-only (or writable again): the changes are refused with ErrReadOnly, except the ones
+// applied from the leader.
+func (lsmdb *DB) SetReadOnly(readOnly bool) {
+	defer lsmdb.lock()()
+	lsmdb.rootDB().readOnly = readOnly
+}
+
+// Applies a WAL record shipped by the leader, as the record with the same sequence number.
+// The records that are already applied are ignored, and ErrReplicationGap is returned if the record doesn't follow
+// the last one. The missing column families are created with the options of the default one.
+func (lsmdb *DB) applyReplicated(seq uint64, encodedBatch []byte) error {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	if seq <= root.wal.lastSeq {
+		return nil
+	}
+	if seq != root.wal.lastSeq+1 {
+		return ErrReplicationGap
+	}
+
+	batch, err := decodeWriteBatch(encodedBatch)
+	if err != nil {
+		return err
+	}
+
+	families := make([]*DB, batch.Len())
+	for i, name := range batch.families {
+		family, err := root.columnFamily(name)
+		if err == ErrColumnFamilyNotFound {
+			opts := ColumnFamilyOptions{MemSizeThreshold: root.memSizeThreshold}
+			if err := root.createColumnFamily(name, opts); err != nil {
+				return err
+			}
+			family, err = root.columnFamily(name)
+		}
+		if err != nil {
+			return err
+		}
+		families[i] = family
+	}
+
+	return root.commitBatch(batch, families)
+}
+
+// The replication status of a follower, as seen by the leader.
+type ReplicaStatus struct {
+	Addr         string `json:"addr"`
+	SentSequence uint64 `json:"sentSequence"`
+	Lag          uint64 `json:"lag"`
+}
+
+// The replication status of a database. The followers report their leader and their lag, the leaders their
+// followers and the lag of each of them.
+type ReplicationStatus struct {
+	Role     string          `json:"role"`
+	Sequence uint64          `json:"sequence"`
+	Replicas []ReplicaStatus `json:"replicas,omitempty"`
+
+	Leader         string     `json:"leader,omitempty"`
+	LeaderSequence uint64     `json:"leaderSequence,omitempty"`
+	Lag            uint64     `json:"lag"`
+	Connected      bool       `json:"connected,omitempty"`
+	LastContact    *time.Time `json:"lastContact,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// Returns the status of the leader and of its followers.
+func (lsmdb *DB) ReplicationStatus() ReplicationStatus {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+	status := ReplicationStatus{Role: "leader", Sequence: root.wal.lastSeq}
+	for feed := range root.replicationFeeds {
+		sent := feed.sentSeq.Load()
+		status.Replicas = append(status.Replicas, ReplicaStatus{
+			Addr:         feed.addr,
+			SentSequence: sent,
+			Lag:          root.wal.lastSeq - sent,
+		})
+		if lag := root.wal.lastSeq - sent; lag > status.Lag {
+			status.Lag = lag
+		}
+	}
+
+	return status
+}
+
+// Follows a leader: the database is made read-only, and the WAL records of the leader are applied to it as they are
+// committed. The database must hold the same records as the leader up to its last sequence number, which is the
+// case once it is bootstrapped from a checkpoint of the leader (see bootstrapFollower).
+type Follower struct {
+	lsmdb     *DB
+	leaderURL string
+	token     string
+	client    *http.Client
+
+	mu          sync.Mutex
+	leaderSeq   uint64
+	connected   bool
+	lastContact time.Time
+	err         error
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running sync.WaitGroup
+}
+
+// The token is sent as bearer token to the leader, if its HTTP API has access control.
+func NewFollower(lsmdb *DB, leaderURL, token string) *Follower {
+	lsmdb.SetReadOnly(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Follower{
+		lsmdb:     lsmdb,
+		leaderURL: leaderURL,
+		token:     token,
+		client:    &http.Client{},
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Follows the leader, reconnecting when the stream ends, until Stop is called.
+func (follower *Follower) Run() {
+	follower.running.Add(1)
+	defer follower.running.Done()
+
+	ctx := follower.ctx
+
+	for {
+		err := follower.follow(ctx)
+
+		follower.mu.Lock()
+		follower.connected = false
+		follower.err = err
+		follower.mu.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrSequenceNotRetained {
+			log.Println("The follower is too far behind its leader, it must be bootstrapped again:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// Stops following the leader, and waits for the last record to be applied. The database stays read-only.
+func (follower *Follower) Stop() {
+	follower.cancel()
+	follower.running.Wait()
+}
+
+// Stops following the leader, and makes the database writable, so it can take over from the leader.
+func (follower *Follower) Promote() {
+	follower.Stop()
+	follower.lsmdb.SetReadOnly(false)
+}
+
+// Reads the stream of the leader until it ends, and applies its records.
+func (follower *Follower) follow(ctx context.Context) error {
+	url := fmt.Sprintf("%s/replication/stream?after=%d", follower.leaderURL, follower.lsmdb.LastSequence())
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	setBearerToken(req, follower.token)
+
+	resp, err := follower.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return ErrSequenceNotRetained
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("the leader returned %s", resp.Status)
+	}
+
+	follower.mu.Lock()
+	follower.connected = true
+	follower.err = nil
+	follower.mu.Unlock()
+
+	seqBytes := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(resp.Body, seqBytes); err != nil {
+			return err
+		}
+		seq := binary.BigEndian.Uint64(seqBytes)
+
+		op, _, value, err := decodeNext(resp.Body)
+		if err != nil {
+			return err
+		}
+
+		if OperationType(op) == BatchOp {
+			if err := follower.lsmdb.applyReplicated(seq, value); err != nil {
+				return err
+			}
+		}
+
+		follower.mu.Lock()
+		follower.leaderSeq = max(follower.leaderSeq, seq)
+		follower.lastContact = time.Now()
+		follower.mu.Unlock()
+	}
+}
+
+// Returns the status of the follower.
+func (follower *Follower) Status() ReplicationStatus {
+	applied := follower.lsmdb.LastSequence()
+
+	follower.mu.Lock()
+	defer follower.mu.Unlock()
+
+	status := ReplicationStatus{
+		Role:           "follower",
+		Sequence:       applied,
+		Leader:         follower.leaderURL,
+		LeaderSequence: follower.leaderSeq,
+		Connected:      follower.connected,
+	}
+	if !follower.lastContact.IsZero() {
+		lastContact := follower.lastContact
+		status.LastContact = &lastContact
+	}
+	if follower.leaderSeq > applied {
+		status.Lag = follower.leaderSeq - applied
+	}
+	if follower.err != nil {
+		status.Error = follower.err.Error()
+	}
+
+	return status
+}
+
+// Downloads a checkpoint of the leader to dir, so the database opened from dir can follow it.
+// Returns the sequence number of the checkpoint. The token is sent like by the follower.
+func BootstrapFollower(leaderURL, token, dir string) (uint64, error) {
+	req, err := http.NewRequest("GET", leaderURL+"/replication/checkpoint", nil)
+	if err != nil {
+		return 0, err
+	}
+	setBearerToken(req, token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("the leader returned %s", resp.Status)
+	}
+
+	seq, err := strconv.ParseUint(resp.Header.Get("X-Checkpoint-Sequence"), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := extractTar(resp.Body, dir); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+// This is the request handler for the replication stream of the followers (/replication/stream?after=12)
+func replicationStreamHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		afterSeq, err := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid sequence number", http.StatusBadRequest)
+			return
+		}
+
+		feed, err := lsmdb.openFeed(r.RemoteAddr, afterSeq)
+		if err == ErrSequenceNotRetained {
+			http.Error(w, err.Error(), http.StatusGone)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			unlock := lsmdb.lock()
+			lsmdb.closeFeed(feed, nil)
+			unlock()
+		}()
+
+		rc := http.NewResponseController(w)
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.WriteHeader(http.StatusOK)
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		heartbeat := time.NewTicker(replicationHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+
+			case <-heartbeat.C:
+				record := Entry{op: SequenceOp}
+				frame := binary.BigEndian.AppendUint64(nil, lsmdb.LastSequence())
+				if _, err := w.Write(append(frame, record.encode()...)); err != nil {
+					return
+				}
+
+			case frame, ok := <-feed.frames:
+				if !ok {
+					log.Println("The replication stream of", feed.addr, "ended:", feed.err)
+					return
+				}
+				if _, err := w.Write(frame); err != nil {
+					return
+				}
+				feed.sentSeq.Store(binary.BigEndian.Uint64(frame))
+			}
+
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// This is the request handler for the checkpoints the new followers are bootstrapped from (/replication/checkpoint)
+// The checkpoint is sent as a tar archive, with its sequence number in the X-Checkpoint-Sequence header.
+func replicationCheckpointHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		tmp, err := os.MkdirTemp("", "replication-checkpoint")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer os.RemoveAll(tmp)
+
+		dir := filepath.Join(tmp, "checkpoint")
+		manifest, err := lsmdb.Checkpoint(dir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("X-Checkpoint-Sequence", strconv.FormatUint(manifest.Sequence, 10))
+
+		if err := WriteCheckpointTar(w, dir); err != nil {
+			log.Println("The checkpoint could not be sent:", err)
+		}
+	}
+}
+
+// This is the request handler for the replication status (/replication/status)
+// On a follower, POST /replication/promote stops the replication and makes the database writable.
+func replicationStatusHandler(lsmdb *DB, follower *Follower) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		status := lsmdb.ReplicationStatus()
+		if follower != nil && lsmdb.IsReadOnly() {
+			status = follower.Status()
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// This is the request handler promoting a follower (/replication/promote)
+func promoteHandler(follower *Follower) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		follower.Promote()
+		fmt.Fprint(w, "OK")
+	}
+}
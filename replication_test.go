@@ -0,0 +1,184 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestLeaderServer(t *testing.T, leader *DB) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/replication/stream", replicationStreamHandler(leader))
+	mux.HandleFunc("/replication/checkpoint", replicationCheckpointHandler(leader))
+	mux.HandleFunc("/replication/status", replicationStatusHandler(leader, nil))
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Waits for the follower to apply the records of the leader.
+func waitForSequence(t *testing.T, follower *Follower, seq uint64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.lsmdb.LastSequence() < seq {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected sequence %d, got %d (%+v)", seq, follower.lsmdb.LastSequence(), follower.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	heartbeat := replicationHeartbeatInterval
+	replicationHeartbeatInterval = 10 * time.Millisecond
+	defer func() { replicationHeartbeatInterval = heartbeat }()
+
+	leader := newTestLSMDB(t)
+	for i := 0; i < 10; i++ {
+		leader.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	server := newTestLeaderServer(t, leader)
+
+	// The new follower starts from a checkpoint of the leader
+	dir := t.TempDir()
+	seq, err := BootstrapFollower(server.URL, "", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seq != leader.LastSequence() {
+		t.Errorf("Expected sequence %d, got %d", leader.LastSequence(), seq)
+	}
+
+	followerDB := openTestLSMDB(t, dir)
+	if followerDB.LastSequence() != seq {
+		t.Errorf("Expected sequence %d, got %d", seq, followerDB.LastSequence())
+	}
+
+	follower := NewFollower(followerDB, server.URL, "")
+	go follower.Run()
+	defer follower.Stop()
+
+	// The changes made after the checkpoint are streamed
+	leader.Delete([]byte("key0"))
+	leader.Put([]byte("key1"), []byte("changed"))
+	if err := leader.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	batch := &WriteBatch{}
+	batch.Put("users", []byte("alice"), []byte("1"))
+	batch.Put(defaultColumnFamilyName, []byte("key2"), []byte("batched"))
+	if err := leader.Write(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForSequence(t, follower, leader.LastSequence())
+
+	if _, err := followerDB.Get([]byte("key0")); err != ErrKeyNotFound && err != ErrKeyDeleted {
+		t.Errorf("Expected key0 to be deleted, got %v", err)
+	}
+	for key, expected := range map[string]string{"key1": "changed", "key2": "batched", "key9": "value9"} {
+		if v, _ := followerDB.Get([]byte(key)); string(v) != expected {
+			t.Errorf("Expected %s for %s, got %q", expected, key, v)
+		}
+	}
+	users, err := followerDB.ColumnFamily("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := users.Get([]byte("alice")); string(v) != "1" {
+		t.Errorf("Expected 1, got %q", v)
+	}
+
+	// The follower only serves reads
+	if err := followerDB.Put([]byte("key1"), []byte("local")); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+	if err := followerDB.Write(&WriteBatch{}); err != ErrReadOnly {
+		t.Errorf("Expected ErrReadOnly, got %v", err)
+	}
+
+	// The lag is reported on both sides once the heartbeat is received
+	time.Sleep(50 * time.Millisecond)
+	status := follower.Status()
+	if status.Role != "follower" || !status.Connected || status.Lag != 0 || status.LeaderSequence != leader.LastSequence() {
+		t.Errorf("Unexpected follower status %+v", status)
+	}
+
+	resp, err := http.Get(server.URL + "/replication/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var leaderStatus ReplicationStatus
+	if err := json.NewDecoder(resp.Body).Decode(&leaderStatus); err != nil {
+		t.Fatal(err)
+	}
+	if leaderStatus.Role != "leader" || len(leaderStatus.Replicas) != 1 || leaderStatus.Replicas[0].Lag != 0 {
+		t.Errorf("Unexpected leader status %+v", leaderStatus)
+	}
+
+	// A promoted follower takes writes
+	follower.Promote()
+	if err := followerDB.Put([]byte("key1"), []byte("local")); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestReplicationCatchUp(t *testing.T) {
+	leader := newTestLSMDB(t)
+	leader.wal.historyPath = t.TempDir()
+	leader.wal.historyMaxSize = 1 << 20
+	server := newTestLeaderServer(t, leader)
+
+	dir := t.TempDir()
+	if _, err := BootstrapFollower(server.URL, "", dir); err != nil {
+		t.Fatal(err)
+	}
+	followerDB := openTestLSMDB(t, dir)
+
+	// The records committed while the follower is away are read from the WAL of the leader, even once it is cleared
+	for i := 0; i < 30; i++ {
+		leader.Put([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	if leader.wal.baseSeq == 0 {
+		t.Fatal("Expected the WAL of the leader to be cleared")
+	}
+
+	follower := NewFollower(followerDB, server.URL, "")
+	go follower.Run()
+	defer follower.Stop()
+
+	waitForSequence(t, follower, leader.LastSequence())
+
+	for i := 0; i < 30; i++ {
+		if v, _ := followerDB.Get([]byte(fmt.Sprint("key", i))); string(v) != fmt.Sprint("value", i) {
+			t.Errorf("Expected value%d, got %q", i, v)
+		}
+	}
+}
+
+func TestApplyReplicatedGap(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	batch := WriteBatch{}
+	batch.Put(defaultColumnFamilyName, []byte("key"), []byte("value"))
+
+	if err := lsmdb.applyReplicated(2, batch.Encode()); err != ErrReplicationGap {
+		t.Errorf("Expected ErrReplicationGap, got %v", err)
+	}
+	if err := lsmdb.applyReplicated(1, batch.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	// An already applied record is ignored
+	if err := lsmdb.applyReplicated(1, batch.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if lsmdb.LastSequence() != 1 {
+		t.Errorf("Expected sequence 1, got %d", lsmdb.LastSequence())
+	}
+}
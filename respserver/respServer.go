@@ -0,0 +1,743 @@
+// Package respserver serves a database over the Redis protocol (RESP2 and RESP3).
+package respserver
+
+import (
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRESPProtocol = errors.New("Protocol error")
+
+	// The errors of INCR, as they are sent to the client
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errOverflow   = errors.New("ERR increment or decrement would overflow")
+)
+
+// The number of arguments of the largest command taken, the one of Redis
+const respMaxArgs = 1024 * 1024
+
+// The length of the largest bulk string taken by default, the one of Redis (its proto-max-bulk-len option)
+const respDefaultMaxBulkLen = 512 << 20
+
+// The number of SCAN cursors remembered, the oldest ones are forgotten
+const respMaxScanCursors = 10000
+
+// A server speaking the Redis protocol (RESP2, and RESP3 after HELLO 3), so redis-cli and the Redis client
+// libraries can talk to the database.
+type Server struct {
+	db *lsmdb.DB
+
+	// The length in bytes of the largest bulk string taken, the commands with bigger ones are refused
+	MaxBulkLen int
+
+	// The last key returned by each SCAN cursor handed out, the scans resuming after it. The cursors are numbers, as
+	// the Redis clients expect them to be, and are kept from the oldest to the newest.
+	scanMu      sync.Mutex
+	scanCursors map[uint64][]byte
+	scanOrder   []uint64
+	lastCursor  uint64
+
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+}
+
+func NewServer(db *lsmdb.DB) *Server {
+	return &Server{db: db, MaxBulkLen: respDefaultMaxBulkLen, scanCursors: make(map[uint64][]byte)}
+}
+
+func (srv *Server) ListenAndServe(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return srv.Serve(listener)
+}
+
+// Accepts the connections of the listener, and serves each of them in its own goroutine.
+func (srv *Server) Serve(listener net.Listener) error {
+	srv.listenersMu.Lock()
+	srv.listeners = append(srv.listeners, listener)
+	srv.listenersMu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go srv.serveConn(conn)
+	}
+}
+
+// Stops accepting new connections.
+func (srv *Server) Close() error {
+	srv.listenersMu.Lock()
+	defer srv.listenersMu.Unlock()
+
+	for _, listener := range srv.listeners {
+		if err := listener.Close(); err != nil {
+			return err
+		}
+	}
+	srv.listeners = nil
+
+	return nil
+}
+
+// A client connection, with the version of the protocol it uses.
+type respConn struct {
+	r     *bufio.Reader
+	w     *bufio.Writer
+	proto int
+}
+
+func (srv *Server) serveConn(netConn net.Conn) {
+	defer netConn.Close()
+
+	conn := &respConn{
+		r:     bufio.NewReader(netConn),
+		w:     bufio.NewWriter(netConn),
+		proto: 2,
+	}
+
+	for {
+		args, err := readRESPCommand(conn.r, srv.MaxBulkLen)
+		if err != nil {
+			if err != io.EOF {
+				conn.writeError("ERR " + err.Error())
+				conn.w.Flush()
+			}
+			return
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := srv.execute(conn, args)
+
+		// The replies of pipelined commands are sent together, once there are no more commands to read
+		if conn.r.Buffered() == 0 || quit {
+			if err := conn.w.Flush(); err != nil {
+				return
+			}
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// Reads a command, either as an array of bulk strings or as an inline command (words separated by spaces).
+// The bulk strings longer than maxBulkLen are refused.
+func readRESPCommand(r *bufio.Reader, maxBulkLen int) ([][]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		args := make([][]byte, 0)
+		for _, field := range strings.Fields(line) {
+			args = append(args, []byte(field))
+		}
+		return args, nil
+	}
+
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrRESPProtocol)
+	}
+
+	// The arguments are only allocated as they arrive, whatever count the client announced
+	args := make([][]byte, 0, min(max(count, 0), 1024))
+	for i := 0; i < count; i++ {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(line) == 0 || line[0] != '$' {
+			return nil, ErrRESPProtocol
+		}
+
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 || n > maxBulkLen {
+			return nil, fmt.Errorf("%w: invalid bulk length", ErrRESPProtocol)
+		}
+
+		// Reading the bulk string and its trailing \r\n, the buffer growing with the bytes received
+		var arg bytes.Buffer
+		if _, err := io.CopyN(&arg, r, int64(n)+2); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(arg.Bytes(), []byte("\r\n")) {
+			return nil, ErrRESPProtocol
+		}
+		args = append(args, arg.Bytes()[:n])
+	}
+
+	return args, nil
+}
+
+// Reads a line ending with \r\n (or \n), and returns it without its ending.
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+func (conn *respConn) writeSimple(s string) {
+	fmt.Fprintf(conn.w, "+%s\r\n", s)
+}
+
+func (conn *respConn) writeError(s string) {
+	fmt.Fprintf(conn.w, "-%s\r\n", s)
+}
+
+func (conn *respConn) writeInt(n int64) {
+	fmt.Fprintf(conn.w, ":%d\r\n", n)
+}
+
+func (conn *respConn) writeBulk(b []byte) {
+	fmt.Fprintf(conn.w, "$%d\r\n", len(b))
+	conn.w.Write(b)
+	conn.w.WriteString("\r\n")
+}
+
+func (conn *respConn) writeNull() {
+	if conn.proto == 3 {
+		conn.w.WriteString("_\r\n")
+		return
+	}
+	conn.w.WriteString("$-1\r\n")
+}
+
+func (conn *respConn) writeArray(n int) {
+	fmt.Fprintf(conn.w, "*%d\r\n", n)
+}
+
+// Writes the header of a map of n pairs. RESP2 doesn't have maps, they are sent as flat arrays.
+func (conn *respConn) writeMap(n int) {
+	if conn.proto == 3 {
+		fmt.Fprintf(conn.w, "%%%d\r\n", n)
+		return
+	}
+	conn.writeArray(2 * n)
+}
+
+func (conn *respConn) writeEngineError(err error) {
+	conn.writeError("ERR " + err.Error())
+}
+
+func (conn *respConn) writeWrongArgs(command string) {
+	conn.writeError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+// Executes a command and writes its reply. Returns true if the connection must be closed.
+func (srv *Server) execute(conn *respConn, args [][]byte) bool {
+	command := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch command {
+	case "PING":
+		if len(args) > 1 {
+			conn.writeWrongArgs(command)
+		} else if len(args) == 1 {
+			conn.writeBulk(args[0])
+		} else {
+			conn.writeSimple("PONG")
+		}
+
+	case "QUIT":
+		conn.writeSimple("OK")
+		return true
+
+	case "HELLO":
+		srv.hello(conn, args)
+
+	case "GET":
+		if len(args) != 1 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		v, err := srv.db.Get(args[0])
+		if err == lsmdb.ErrKeyNotFound {
+			conn.writeNull()
+		} else if err != nil {
+			conn.writeEngineError(err)
+		} else {
+			conn.writeBulk(v)
+		}
+
+	case "SET":
+		srv.set(conn, args)
+
+	case "DEL":
+		if len(args) == 0 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		var deleted int64
+		for _, key := range args {
+			_, err := srv.db.Delete(key)
+			if err == lsmdb.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				conn.writeEngineError(err)
+				return false
+			}
+			deleted++
+		}
+		conn.writeInt(deleted)
+
+	case "EXISTS":
+		if len(args) == 0 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		var found int64
+		for _, key := range args {
+			_, err := srv.db.Get(key)
+			if err == lsmdb.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				conn.writeEngineError(err)
+				return false
+			}
+			found++
+		}
+		conn.writeInt(found)
+
+	case "MGET":
+		if len(args) == 0 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		values := make([][]byte, len(args))
+		for i, key := range args {
+			v, err := srv.db.Get(key)
+			if err != nil && err != lsmdb.ErrKeyNotFound {
+				conn.writeEngineError(err)
+				return false
+			}
+			values[i] = v
+		}
+		conn.writeArray(len(values))
+		for _, v := range values {
+			if v == nil {
+				conn.writeNull()
+			} else {
+				conn.writeBulk(v)
+			}
+		}
+
+	case "MSET":
+		if len(args) == 0 || len(args)%2 != 0 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		// All the keys are set atomically
+		batch := lsmdb.WriteBatch{}
+		for i := 0; i < len(args); i += 2 {
+			batch.Put("", args[i], args[i+1])
+		}
+		if err := srv.db.Write(&batch); err != nil {
+			conn.writeEngineError(err)
+			return false
+		}
+		conn.writeSimple("OK")
+
+	case "SCAN":
+		srv.scan(conn, args)
+
+	case "INCR":
+		if len(args) != 1 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		srv.incr(conn, args[0])
+
+	case "TTL":
+		if len(args) != 1 {
+			conn.writeWrongArgs(command)
+			return false
+		}
+		_, expireAt, err := srv.db.GetWithExpiry(args[0])
+		if err == lsmdb.ErrKeyNotFound {
+			conn.writeInt(-2)
+		} else if err != nil {
+			conn.writeEngineError(err)
+		} else if expireAt.IsZero() {
+			conn.writeInt(-1)
+		} else {
+			conn.writeInt(int64((time.Until(expireAt) + 500*time.Millisecond) / time.Second))
+		}
+
+	case "INFO":
+		srv.info(conn)
+
+	// Sent by redis-cli and some clients when they connect, only an empty reply is given
+	case "COMMAND":
+		conn.writeArray(0)
+
+	case "CLIENT", "SELECT":
+		conn.writeSimple("OK")
+
+	default:
+		conn.writeError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+	}
+
+	return false
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+func (srv *Server) hello(conn *respConn, args [][]byte) {
+	if len(args) > 0 {
+		proto, err := strconv.Atoi(string(args[0]))
+		if err != nil || (proto != 2 && proto != 3) {
+			conn.writeError("NOPROTO unsupported protocol version")
+			return
+		}
+		conn.proto = proto
+	}
+
+	conn.writeMap(6)
+	conn.writeBulk([]byte("server"))
+	conn.writeBulk([]byte("lsmdb"))
+	conn.writeBulk([]byte("version"))
+	conn.writeBulk([]byte("7.0.0"))
+	conn.writeBulk([]byte("proto"))
+	conn.writeInt(int64(conn.proto))
+	conn.writeBulk([]byte("mode"))
+	conn.writeBulk([]byte("standalone"))
+	conn.writeBulk([]byte("role"))
+	conn.writeBulk([]byte("master"))
+	conn.writeBulk([]byte("modules"))
+	conn.writeArray(0)
+}
+
+// SET key value [NX | XX] [EX seconds | PX milliseconds | KEEPTTL]
+func (srv *Server) set(conn *respConn, args [][]byte) {
+	if len(args) < 2 {
+		conn.writeWrongArgs("SET")
+		return
+	}
+
+	key, value := args[0], args[1]
+	var expireAt time.Time
+	var nx, xx, keepTTL bool
+
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); option {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 == len(args) || !expireAt.IsZero() {
+				conn.writeError("ERR syntax error")
+				return
+			}
+			i++
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 {
+				conn.writeError("ERR invalid expire time in 'set' command")
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			expireAt = time.Now().Add(time.Duration(n) * unit)
+		default:
+			conn.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	if (nx && xx) || (keepTTL && !expireAt.IsZero()) {
+		conn.writeError("ERR syntax error")
+		return
+	}
+
+	// The key is read and written under the lock of the database
+	err := srv.db.UpdateWithExpiry(key, func(_ []byte, currentExpireAt time.Time, exists bool) ([]byte, time.Time, error) {
+		if nx && exists {
+			return nil, time.Time{}, lsmdb.ErrKeyExists
+		}
+		if xx && !exists {
+			return nil, time.Time{}, lsmdb.ErrKeyNotFound
+		}
+
+		if keepTTL {
+			return value, currentExpireAt, nil
+		}
+		return value, expireAt, nil
+	})
+	switch err {
+	case nil:
+		conn.writeSimple("OK")
+	case lsmdb.ErrKeyExists, lsmdb.ErrKeyNotFound:
+		conn.writeNull()
+	default:
+		conn.writeEngineError(err)
+	}
+}
+
+// INCR key, the expiration time of the key is kept.
+func (srv *Server) incr(conn *respConn, key []byte) {
+	var n int64
+	err := srv.db.UpdateWithExpiry(key, func(v []byte, expireAt time.Time, exists bool) ([]byte, time.Time, error) {
+		n = 0
+		if exists {
+			var err error
+			n, err = strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return nil, time.Time{}, errNotInteger
+			}
+		}
+
+		if n == math.MaxInt64 {
+			return nil, time.Time{}, errOverflow
+		}
+		n++
+
+		return []byte(strconv.FormatInt(n, 10)), expireAt, nil
+	})
+	switch err {
+	case nil:
+		conn.writeInt(n)
+	case errNotInteger, errOverflow:
+		conn.writeError(err.Error())
+	default:
+		conn.writeEngineError(err)
+	}
+}
+
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type]
+func (srv *Server) scan(conn *respConn, args [][]byte) {
+	if len(args) == 0 {
+		conn.writeWrongArgs("SCAN")
+		return
+	}
+
+	cursor, err := strconv.ParseUint(string(args[0]), 10, 64)
+	if err != nil {
+		conn.writeError("ERR invalid cursor")
+		return
+	}
+
+	var after []byte
+	if cursor != 0 {
+		var ok bool
+		if after, ok = srv.scanPosition(cursor); !ok {
+			conn.writeError("ERR invalid cursor")
+			return
+		}
+	}
+
+	pattern := "*"
+	count := 10
+	keyType := "string"
+
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			conn.writeError("ERR syntax error")
+			return
+		}
+
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(string(args[i+1]))
+			if err != nil || count < 1 {
+				conn.writeError("ERR syntax error")
+				return
+			}
+		case "TYPE":
+			keyType = strings.ToLower(string(args[i+1]))
+		default:
+			conn.writeError("ERR syntax error")
+			return
+		}
+	}
+
+	keys, last, err := srv.db.ScanKeys(after, count)
+	if err != nil {
+		conn.writeEngineError(err)
+		return
+	}
+
+	// All the keys are strings
+	matching := make([][]byte, 0, len(keys))
+	for _, key := range keys {
+		if keyType == "string" && globMatch([]byte(pattern), key) {
+			matching = append(matching, key)
+		}
+	}
+
+	var next uint64
+	if last != nil {
+		next = srv.newScanCursor(last)
+	}
+
+	conn.writeArray(2)
+	conn.writeBulk([]byte(strconv.FormatUint(next, 10)))
+	conn.writeArray(len(matching))
+	for _, key := range matching {
+		conn.writeBulk(key)
+	}
+}
+
+// Returns the last key returned by the SCAN cursor, and false if the cursor is unknown.
+func (srv *Server) scanPosition(cursor uint64) ([]byte, bool) {
+	srv.scanMu.Lock()
+	defer srv.scanMu.Unlock()
+
+	after, ok := srv.scanCursors[cursor]
+	return after, ok
+}
+
+// Returns a new SCAN cursor resuming the scan after the key.
+func (srv *Server) newScanCursor(after []byte) uint64 {
+	srv.scanMu.Lock()
+	defer srv.scanMu.Unlock()
+
+	if len(srv.scanOrder) == respMaxScanCursors {
+		delete(srv.scanCursors, srv.scanOrder[0])
+		srv.scanOrder = srv.scanOrder[1:]
+	}
+
+	srv.lastCursor++
+	srv.scanCursors[srv.lastCursor] = after
+	srv.scanOrder = append(srv.scanOrder, srv.lastCursor)
+	return srv.lastCursor
+}
+
+func (srv *Server) info(conn *respConn) {
+	var info strings.Builder
+	info.WriteString("# Server\r\n")
+	info.WriteString("redis_version:7.0.0\r\n")
+	info.WriteString("redis_mode:standalone\r\n")
+	fmt.Fprintf(&info, "lsmdb_version:%d\r\n", srv.db.Version())
+	info.WriteString("\r\n# Keyspace\r\n")
+	fmt.Fprintf(&info, "column_families:%d\r\n", len(srv.db.ColumnFamilyNames()))
+
+	conn.writeBulk([]byte(info.String()))
+}
+
+// Tells if s matches the glob-style pattern of Redis: * matches any sequence, ? matches one byte,
+// [abc], [^abc] and [a-z] match one byte of a set, and \ escapes the next byte.
+func globMatch(pattern, s []byte) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+				}
+				if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					matched = matched || (s[0] >= lo && s[0] <= hi)
+					pattern = pattern[3:]
+				} else {
+					matched = matched || s[0] == pattern[0]
+					pattern = pattern[1:]
+				}
+			}
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			if matched == negate {
+				return false
+			}
+			s = s[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return len(s) == 0
+}
@@ -0,0 +1,257 @@
+package respserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	lsmdb "github.com/IlyasIsHere/Persistent-key-value-store"
+)
+
+// A minimal RESP client: it sends commands as arrays of bulk strings, and decodes the replies
+// into strings, int64s, nil, []interface{} and map[string]interface{} (errors are returned as "-ERR ..." strings).
+type testRESPClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *testRESPClient) send(args ...string) {
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	c.conn.Write([]byte(cmd.String()))
+}
+
+func (c *testRESPClient) read(t *testing.T) interface{} {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return line
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '_':
+		return nil
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := c.r.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = c.read(t)
+		}
+		return items
+	case '%':
+		n, _ := strconv.Atoi(line[1:])
+		items := make(map[string]interface{}, n)
+		for i := 0; i < n; i++ {
+			key := c.read(t).(string)
+			items[key] = c.read(t)
+		}
+		return items
+	}
+
+	t.Fatalf("Unexpected reply %q", line)
+	return nil
+}
+
+func (c *testRESPClient) do(t *testing.T, args ...string) interface{} {
+	c.send(args...)
+	return c.read(t)
+}
+
+func startTestRESPServer(t *testing.T) *testRESPClient {
+	db, err := lsmdb.Open(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer(db)
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &testRESPClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func TestRESPServer_Commands(t *testing.T) {
+	c := startTestRESPServer(t)
+
+	expect := func(expected interface{}, args ...string) {
+		t.Helper()
+		if got := c.do(t, args...); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%v: expected %#v, got %#v", args, expected, got)
+		}
+	}
+
+	expect("PONG", "PING")
+	expect("hello", "PING", "hello")
+	expect(nil, "GET", "key")
+	expect("OK", "SET", "key", "value")
+	expect("value", "GET", "key")
+	expect(nil, "SET", "key", "other", "NX")
+	expect(nil, "SET", "missing", "other", "XX")
+	expect("OK", "SET", "key", "other", "XX")
+	expect("other", "GET", "key")
+
+	expect("OK", "MSET", "a", "1", "b", "2")
+	expect([]interface{}{"1", nil, "2"}, "MGET", "a", "missing", "b")
+	expect(int64(2), "EXISTS", "a", "b", "missing")
+
+	expect(int64(2), "INCR", "a")
+	expect(int64(1), "INCR", "counter")
+	expect("-ERR value is not an integer or out of range", "INCR", "key")
+
+	expect(int64(-2), "TTL", "missing")
+	expect(int64(-1), "TTL", "a")
+	expect("OK", "SET", "temp", "100", "EX", "100")
+	expect(int64(100), "TTL", "temp")
+	expect(int64(101), "INCR", "temp")
+	expect(int64(100), "TTL", "temp")
+	expect("OK", "SET", "gone", "value", "PX", "1")
+	time.Sleep(10 * time.Millisecond)
+	expect(nil, "GET", "gone")
+
+	expect(int64(2), "DEL", "a", "b", "missing")
+	expect(nil, "GET", "a")
+
+	// The keys left are counter, key and temp (gone expired)
+	var keys []string
+	cursor := "0"
+	for {
+		reply := c.do(t, "SCAN", cursor, "COUNT", "2").([]interface{})
+		for _, key := range reply[1].([]interface{}) {
+			keys = append(keys, key.(string))
+		}
+		if cursor = reply[0].(string); cursor == "0" {
+			break
+		}
+	}
+	if !reflect.DeepEqual(keys, []string{"counter", "key", "temp"}) {
+		t.Errorf("Expected the keys counter, key and temp, got %v", keys)
+	}
+
+	expect([]interface{}{"0", []interface{}{"temp"}}, "SCAN", "0", "MATCH", "t*", "COUNT", "100")
+	expect("-ERR invalid cursor", "SCAN", "123456")
+
+	if info, ok := c.do(t, "INFO").(string); !ok || !strings.Contains(info, "redis_version") {
+		t.Errorf("Unexpected INFO reply %v", info)
+	}
+
+	expect("-ERR unknown command 'nope'", "NOPE")
+}
+
+func TestRESPServer_PipeliningAndRESP3(t *testing.T) {
+	c := startTestRESPServer(t)
+
+	// Sending all the commands before reading any reply
+	for i := 0; i < 100; i++ {
+		c.send("SET", fmt.Sprint("key", i), fmt.Sprint(i))
+	}
+	for i := 0; i < 100; i++ {
+		if reply := c.read(t); reply != "OK" {
+			t.Fatalf("Expected OK, got %v", reply)
+		}
+	}
+	if reply := c.do(t, "GET", "key42"); reply != "42" {
+		t.Errorf("Expected 42, got %v", reply)
+	}
+
+	hello, ok := c.do(t, "HELLO", "3").(map[string]interface{})
+	if !ok || hello["proto"] != int64(3) {
+		t.Fatalf("Expected a RESP3 map with proto 3, got %v", hello)
+	}
+
+	// RESP3 has its own null type
+	if _, err := c.conn.Write([]byte("GET missing\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := c.r.ReadString('\n'); line != "_\r\n" {
+		t.Errorf("Expected the RESP3 null, got %q", line)
+	}
+}
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "users", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"a\\*b", "a*b", true},
+		{"a\\*b", "axb", false},
+	}
+
+	for _, test := range tests {
+		if got := globMatch([]byte(test.pattern), []byte(test.s)); got != test.match {
+			t.Errorf("globMatch(%q, %q): expected %v, got %v", test.pattern, test.s, test.match, got)
+		}
+	}
+}
+
+func TestReadRESPCommand_Limits(t *testing.T) {
+	read := func(input string) ([][]byte, error) {
+		return readRESPCommand(bufio.NewReader(strings.NewReader(input)), 8)
+	}
+
+	if args, err := read("*2\r\n$3\r\nGET\r\n$8\r\n12345678\r\n"); err != nil || len(args) != 2 || string(args[1]) != "12345678" {
+		t.Errorf("Expected [GET 12345678], got %q (%v)", args, err)
+	}
+
+	// The lengths above the limits are refused before anything is allocated for them
+	for _, input := range []string{
+		"*2\r\n$3\r\nSET\r\n$9\r\n123456789\r\n",
+		"*1\r\n$536870913\r\n",
+		"*1\r\n$-5\r\n",
+		"*1048577\r\n",
+	} {
+		if _, err := read(input); !errors.Is(err, ErrRESPProtocol) {
+			t.Errorf("Expected ErrRESPProtocol for %q, got %v", input, err)
+		}
+	}
+
+	// A bulk string announced but not sent only fails once the connection ends
+	if _, err := read("*1\r\n$8\r\nabc"); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
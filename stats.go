@@ -0,0 +1,190 @@
+package lsmdb
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// A snapshot of the state of the database
+type Stats struct {
+	// The sequence number of the last write
+	Sequence uint64 `json:"sequence"`
+
+	// The size of the current WAL segment, shared by all the column families
+	WALSize int64 `json:"walSize"`
+
+	// The size of the sst files waiting to be compacted, in all the column families
+	PendingCompactionBytes int64 `json:"pendingCompactionBytes"`
+
+	Families []FamilyStats   `json:"families"`
+	Jobs     []BackgroundJob `json:"jobs"`
+}
+
+// The state of a column family
+type FamilyStats struct {
+	Name            string         `json:"name"`
+	MemTableEntries int            `json:"memTableEntries"`
+	MemTableBytes   int            `json:"memTableBytes"`
+	SSTFiles        []SSTFileStats `json:"sstFiles"`
+
+	// The size of the sst files once their number reaches the threshold after which they are compacted into one,
+	// 0 before
+	PendingCompactionBytes int64 `json:"pendingCompactionBytes"`
+}
+
+// The content of an sst file. The keys are encoded in base64 in JSON.
+type SSTFileStats struct {
+	Name        string `json:"name"`
+	Level       int    `json:"level"`
+	Size        int64  `json:"size"`
+	Entries     int    `json:"entries"`
+	SmallestKey []byte `json:"smallestKey"`
+	LargestKey  []byte `json:"largestKey"`
+
+	// The number of deletion markers, and their ratio to the entries
+	Tombstones     int     `json:"tombstones"`
+	TombstoneRatio float64 `json:"tombstoneRatio"`
+}
+
+// Returns the state of the database: its column families with their memTable and the content of their sst files,
+// the WAL and the jobs running in the background. The flushes are done by the writes filling the memTable, so they
+// are never running in the background.
+// All the sst files are read, with the database locked.
+func (lsmdb *DB) Stats() (*Stats, error) {
+	unlock, err := lsmdb.lockContext(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	root := lsmdb.rootDB()
+
+	info, err := root.wal.logFile.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		Sequence: root.wal.lastSeq,
+		WALSize:  info.Size(),
+		Families: make([]FamilyStats, 0),
+		Jobs:     root.RunningJobs(),
+	}
+
+	for _, family := range root.allFamilies() {
+		familyStats, err := family.familyStats()
+		if err != nil {
+			return nil, err
+		}
+		stats.Families = append(stats.Families, familyStats)
+		stats.PendingCompactionBytes += familyStats.PendingCompactionBytes
+	}
+
+	return stats, nil
+}
+
+// Returns the state of the column family. It must be called with the database locked.
+func (lsmdb *DB) familyStats() (FamilyStats, error) {
+	stats := FamilyStats{
+		Name:            cmp.Or(lsmdb.familyName, defaultColumnFamilyName),
+		MemTableEntries: lsmdb.memTable.sortedMap.Len(),
+		MemTableBytes:   lsmdb.memTable.sizeInBytes(),
+		SSTFiles:        make([]SSTFileStats, 0, lsmdb.sstFilesNum),
+	}
+
+	var size int64
+	for i := 1; i <= lsmdb.sstFilesNum; i++ {
+		fileStats, err := lsmdb.sstFileStats(i)
+		if err != nil {
+			return FamilyStats{}, err
+		}
+		stats.SSTFiles = append(stats.SSTFiles, fileStats)
+		size += fileStats.Size
+	}
+
+	if lsmdb.sstFilesNum >= lsmdb.fileNumThreshold {
+		stats.PendingCompactionBytes = size
+	}
+
+	return stats, nil
+}
+
+// Reads the header and the entries of an sst file. The sst files aren't organized in levels, they are all in the
+// level 0.
+func (lsmdb *DB) sstFileStats(sstFileNum int) (SSTFileStats, error) {
+	name := fmt.Sprint("f", sstFileNum, ".sst")
+	file, err := os.Open(lsmdb.sstPath + name)
+	if err != nil {
+		return SSTFileStats{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return SSTFileStats{}, err
+	}
+
+	magicNumber, entries, smallestKey, largestKey, version, err := readHeader(file)
+	if err != nil {
+		return SSTFileStats{}, err
+	}
+	if !bytes.Equal(magicNumber, lsmdb.magicNumber[:]) {
+		return SSTFileStats{}, ErrCorruptedFile
+	}
+	if version != lsmdb.version {
+		return SSTFileStats{}, ErrOutdatedVersion
+	}
+
+	stats := SSTFileStats{
+		Name:        name,
+		Size:        info.Size(),
+		Entries:     entries,
+		SmallestKey: smallestKey,
+		LargestKey:  largestKey,
+	}
+
+	r := bufio.NewReader(file)
+	for {
+		op, _, _, err := decodeNext(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return SSTFileStats{}, err
+		}
+		if OperationType(op) == DelOp {
+			stats.Tombstones++
+		}
+	}
+	if entries > 0 {
+		stats.TombstoneRatio = float64(stats.Tombstones) / float64(entries)
+	}
+
+	return stats, nil
+}
+
+// This is the request handler returning the state of the database (/admin/stats)
+func statsHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		stats, err := lsmdb.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
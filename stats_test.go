@@ -0,0 +1,83 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	if err := lsmdb.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := lsmdb.ColumnFamily("users")
+
+	// The memTables of all the column families are flushed by the write filling the default one
+	lsmdb.Put([]byte("b"), []byte("value"))
+	lsmdb.Delete([]byte("b"))
+	users.Put([]byte("alice"), []byte("1"))
+	lsmdb.Put([]byte("a"), []byte("value"))
+	lsmdb.Put([]byte("c"), make([]byte, 100))
+	lsmdb.Put([]byte("d"), []byte("value"))
+
+	stats, err := lsmdb.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(stats.Families) != 2 || stats.Families[0].Name != "default" || stats.Families[1].Name != "users" {
+		t.Fatalf("Unexpected families %+v", stats.Families)
+	}
+	if stats.Sequence != 6 || stats.WALSize == 0 {
+		t.Errorf("Expected sequence 6 with a WAL, got %d with %d bytes", stats.Sequence, stats.WALSize)
+	}
+
+	family := stats.Families[0]
+	if family.MemTableEntries != 1 || family.MemTableBytes != 7 {
+		t.Errorf("Expected 1 entry of 7 bytes in the memTable, got %d of %d bytes", family.MemTableEntries, family.MemTableBytes)
+	}
+	if len(family.SSTFiles) != 1 {
+		t.Fatalf("Expected 1 sst file, got %+v", family.SSTFiles)
+	}
+	file := family.SSTFiles[0]
+	if file.Name != "f1.sst" || file.Level != 0 || file.Size == 0 || file.Entries != 3 || file.Tombstones != 1 {
+		t.Errorf("Unexpected sst file %+v", file)
+	}
+	if string(file.SmallestKey) != "a" || string(file.LargestKey) != "c" || file.TombstoneRatio != 1.0/3 {
+		t.Errorf("Unexpected sst file %+v", file)
+	}
+
+	if users := stats.Families[1]; len(users.SSTFiles) != 1 || users.SSTFiles[0].Entries != 1 || users.MemTableEntries != 0 {
+		t.Errorf("Unexpected column family %+v", users)
+	}
+	if stats.PendingCompactionBytes != 0 {
+		t.Errorf("Expected no pending compaction, got %d bytes", stats.PendingCompactionBytes)
+	}
+
+	// The jobs are listed while they are running
+	_, done := lsmdb.startJob("checkpoint")
+	stats, _ = lsmdb.Stats()
+	if len(stats.Jobs) != 1 || stats.Jobs[0].Kind != "checkpoint" {
+		t.Errorf("Expected the checkpoint job, got %+v", stats.Jobs)
+	}
+	done(nil, nil)
+
+	server := httptest.NewServer(statsHandler(lsmdb))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var decoded Stats
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Jobs) != 0 || len(decoded.Families) != 2 || string(decoded.Families[0].SSTFiles[0].LargestKey) != "c" {
+		t.Errorf("Unexpected stats %+v", decoded)
+	}
+}
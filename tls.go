@@ -0,0 +1,172 @@
+package lsmdb
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNoClientCA = errors.New("the client CA file holds no certificate")
+)
+
+// The certificate of a TLS listener, and the certificate authorities its clients' certificates are verified with, read
+// from PEM files. They are reloaded when Reload is called or when the files change, without restarting the listener:
+// the new connections use the new ones.
+type TLSReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+
+	// The modification times and the sizes of the files, when they were last read
+	stamps []string
+}
+
+// Returns the reloader of the certificate and the key of the files. The client certificates are verified with the
+// certificate authorities of clientCAFile, they are not asked for if it is empty.
+func NewTLSReloader(certFile, keyFile, clientCAFile string) (*TLSReloader, error) {
+	reloader := &TLSReloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := reloader.Reload(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// Reads the files again. They are kept as they were if one of them is invalid.
+func (reloader *TLSReloader) Reload() error {
+	stamps := reloader.fileStamps()
+
+	cert, err := tls.LoadX509KeyPair(reloader.certFile, reloader.keyFile)
+	if err != nil {
+		return err
+	}
+
+	var clientCAs *x509.CertPool
+	if reloader.clientCAFile != "" {
+		pem, err := os.ReadFile(reloader.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: %s", ErrNoClientCA, reloader.clientCAFile)
+		}
+	}
+
+	reloader.mu.Lock()
+	defer reloader.mu.Unlock()
+
+	reloader.cert = &cert
+	reloader.clientCAs = clientCAs
+	reloader.stamps = stamps
+	return nil
+}
+
+// Returns the modification time and the size of each file, which tell if it changed.
+func (reloader *TLSReloader) fileStamps() []string {
+	var stamps []string
+	for _, path := range []string{reloader.certFile, reloader.keyFile, reloader.clientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			stamps = append(stamps, err.Error())
+			continue
+		}
+		stamps = append(stamps, fmt.Sprint(info.ModTime().UnixNano(), " ", info.Size()))
+	}
+	return stamps
+}
+
+// Reloads the files whenever they change, checking them at each interval, until the context is cancelled. The failed
+// reloads are logged, and tried again on the next change (a certificate and its key are rarely written at once).
+func (reloader *TLSReloader) WatchFiles(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stamps := reloader.fileStamps()
+
+		reloader.mu.Lock()
+		changed := !slices.Equal(stamps, reloader.stamps)
+		reloader.stamps = stamps
+		reloader.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Println("The TLS certificates were not reloaded:", err)
+			continue
+		}
+		log.Println("Reloaded the TLS certificates")
+	}
+}
+
+func (reloader *TLSReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	reloader.mu.RLock()
+	defer reloader.mu.RUnlock()
+
+	return reloader.cert, nil
+}
+
+// Returns the configuration of a TLS listener using the current certificate. With client certificate authorities, the
+// clients are asked for a certificate, which is verified if they give one, and required if requireClientCert is true.
+func (reloader *TLSReloader) Config(requireClientCert bool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if reloader.clientCAFile == "" {
+		return config
+	}
+
+	clientAuth := tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	// The certificate authorities can only change with the configuration of each connection
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		reloader.mu.RLock()
+		defer reloader.mu.RUnlock()
+
+		return &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.getCertificate,
+			ClientAuth:     clientAuth,
+			ClientCAs:      reloader.clientCAs,
+		}, nil
+	}
+	return config
+}
+
+// Authenticates the requests by the client certificate of their TLS connection, once verified: the principal is the
+// common name of its subject.
+type ClientCertificates struct{}
+
+func (ClientCertificates) Authenticate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", nil
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
@@ -0,0 +1,255 @@
+package lsmdb
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A certificate generated for the tests, with its key
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// Generates a certificate with the common name, signed by the parent (self-signed if nil). The certificate of a
+// server is valid for 127.0.0.1.
+func generateCertificate(t *testing.T, commonName string, parent *testCertificate, isCA bool) *testCertificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCertificate{cert: cert, key: key, der: der}
+}
+
+// Writes the certificate and its key in PEM files of the directory, and returns their paths.
+func (certificate *testCertificate) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(certificate.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (certificate *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{certificate.der}, PrivateKey: certificate.key}
+}
+
+// Starts a TLS server of the handler configured by the reloader, and returns its URL.
+// The listener of the server is wrapped, as StartTLS would add its own certificate to the configuration.
+func startTLSServer(t *testing.T, handler http.Handler, reloader *TLSReloader, requireClientCert bool) string {
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener = tls.NewListener(server.Listener, reloader.Config(requireClientCert))
+	server.Start()
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "https://", 1)
+}
+
+// Returns a client trusting the certificate authority, and sending the client certificate if there is one.
+func newTLSClient(ca *testCertificate, clientCert *testCertificate) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := &tls.Config{RootCAs: roots}
+	if clientCert != nil {
+		config.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+	}
+	// Each request is sent on a new connection, which sees the current certificate of the server
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+// Returns the common name of the certificate the server presents.
+func serverCommonName(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+
+	resp, err := client.Get(url + "/get?key=a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].Subject.CommonName
+}
+
+func TestTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	ca := generateCertificate(t, "test CA", nil, true)
+	certFile, keyFile := generateCertificate(t, "server 1", ca, false).write(t, dir, "server")
+
+	if _, err := NewTLSReloader(certFile, filepath.Join(dir, "missing.key"), ""); err == nil {
+		t.Error("Expected an error without the key")
+	}
+
+	reloader, err := NewTLSReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := startTLSServer(t, NewHTTPHandler(newTestLSMDB(t), nil, nil, nil, nil), reloader, false)
+	client := newTLSClient(ca, nil)
+
+	if name := serverCommonName(t, client, server); name != "server 1" {
+		t.Errorf("Expected server 1, got %s", name)
+	}
+
+	// The new certificate is used once reloaded, without restarting the server
+	generateCertificate(t, "server 2", ca, false).write(t, dir, "server")
+	if err := reloader.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := serverCommonName(t, client, server); name != "server 2" {
+		t.Errorf("Expected server 2, got %s", name)
+	}
+
+	// An invalid key is not loaded, the previous certificate is kept
+	os.WriteFile(keyFile, []byte("invalid"), 0600)
+	if err := reloader.Reload(); err == nil {
+		t.Error("Expected an error with an invalid key")
+	}
+	if name := serverCommonName(t, client, server); name != "server 2" {
+		t.Errorf("Expected server 2, got %s", name)
+	}
+
+	// The files are reloaded when they change
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go reloader.WatchFiles(ctx, 10*time.Millisecond)
+
+	generateCertificate(t, "server 3", ca, false).write(t, dir, "server")
+	deadline := time.Now().Add(5 * time.Second)
+	for serverCommonName(t, client, server) != "server 3" {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the certificate to be reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := generateCertificate(t, "test CA", nil, true)
+	certFile, keyFile := generateCertificate(t, "server", ca, false).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	reloader, err := NewTLSReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lsmdb := newTestLSMDB(t)
+	access := &AccessControl{
+		Authenticator: Authenticators{StaticTokens{"bob-token": "bob"}, ClientCertificates{}},
+		ACL: ACL{
+			"alice": {{Prefix: "user:alice:", Permissions: []Permission{PermissionRead, PermissionWrite}}},
+			"bob":   {{Prefix: "user:bob:", Permissions: []Permission{PermissionRead, PermissionWrite}}},
+		},
+	}
+	handler := NewHTTPHandler(lsmdb, nil, nil, nil, access)
+
+	alice := newTLSClient(ca, generateCertificate(t, "alice", ca, false))
+	anonymous := newTLSClient(ca, nil)
+	untrusted := newTLSClient(ca, generateCertificate(t, "alice", generateCertificate(t, "another CA", nil, true), false))
+
+	set := func(client *http.Client, url, key, token string) (int, error) {
+		req, _ := http.NewRequest("POST", url+"/set", strings.NewReader(`{"Key": "`+key+`", "Value": "v"}`))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// The client certificates are verified if they are given, the common name is the principal
+	server := startTLSServer(t, handler, reloader, false)
+	for _, test := range []struct {
+		client   *http.Client
+		key      string
+		token    string
+		expected int
+	}{
+		{alice, "user:alice:1", "", http.StatusOK},
+		{alice, "user:bob:1", "", http.StatusForbidden},
+		{alice, "user:bob:1", "bob-token", http.StatusOK},
+		{anonymous, "user:alice:1", "", http.StatusUnauthorized},
+		{anonymous, "user:bob:1", "bob-token", http.StatusOK},
+	} {
+		if status, err := set(test.client, server, test.key, test.token); status != test.expected {
+			t.Errorf("Expected status %d for %s, got %d (%v)", test.expected, test.key, status, err)
+		}
+	}
+	// The client doesn't send a certificate the server can't verify
+	if status, err := set(untrusted, server, "user:alice:1", ""); status != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d (%v)", status, err)
+	}
+
+	// The connections without a client certificate are refused if it is required
+	server = startTLSServer(t, handler, reloader, true)
+	if _, err := set(anonymous, server, "user:bob:1", "bob-token"); err == nil {
+		t.Error("Expected the connection without a client certificate to be refused")
+	}
+	if status, err := set(alice, server, "user:alice:1", ""); status != http.StatusOK {
+		t.Errorf("Expected status 200, got %d (%v)", status, err)
+	}
+}
@@ -0,0 +1,668 @@
+package lsmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrValueInLog       = errors.New("the value of the key is stored in the value log")
+	ErrValueLogDisabled = errors.New("the value log is not enabled")
+	ErrValueTooLarge    = errors.New("the value length exceeds the maximum allowed")
+)
+
+// The value log holds the values bigger than the value threshold, the LSM tree only stores pointers to them.
+// It is split into segment files named v1.vlog, v2.vlog, ... Values are appended to the segment with the
+// biggest number (the active one), and the other segments are reclaimed by the garbage collector.
+//
+// Each record of a segment is of this form: [key length(4 bytes)][key][value length(4 bytes)][value]
+type ValueLog struct {
+	path string
+
+	// The segment new values are appended to
+	active    *os.File
+	activeNum int
+
+	// The size after which the active segment is closed and a new one is started
+	maxSegmentSize int64
+
+	// Guards the active segment. Values are streamed to the value log without holding the lock of the database,
+	// so the value log has its own.
+	mu sync.Mutex
+
+	// The number of values of each segment streamed by PutStream whose pointer is not logged yet.
+	// The garbage collector doesn't see them as live, so it leaves their segment alone.
+	pending map[int]int
+}
+
+// A pointer to a value in the value log.
+// It is encoded this way: [segment number(4 bytes)][value offset(8 bytes)][value length(4 bytes)]
+type valuePointer struct {
+	segment int
+	offset  int64
+	length  int
+}
+
+func (ptr valuePointer) encode() []byte {
+	encoded := encode4BytesInt(ptr.segment)
+	encoded = binary.BigEndian.AppendUint64(encoded, uint64(ptr.offset))
+	return append(encoded, encode4BytesInt(ptr.length)...)
+}
+
+func decodeValuePointer(encoded []byte) (valuePointer, error) {
+	if len(encoded) != 4+8+4 {
+		return valuePointer{}, ErrCorruptedFile
+	}
+
+	ptr := valuePointer{
+		segment: decode4BytesInt(encoded[:4]),
+		offset:  int64(binary.BigEndian.Uint64(encoded[4:12])),
+		length:  decode4BytesInt(encoded[12:]),
+	}
+	return ptr, nil
+}
+
+func (vlog *ValueLog) segmentPath(num int) string {
+	return fmt.Sprint(vlog.path, "v", num, ".vlog")
+}
+
+// Returns the numbers of the segments of the value log, in increasing order.
+func (vlog *ValueLog) segments() ([]int, error) {
+	files, err := os.ReadDir(vlog.path)
+	if err != nil {
+		return nil, err
+	}
+
+	nums := make([]int, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "v") || filepath.Ext(name) != ".vlog" {
+			continue
+		}
+
+		num, err := strconv.Atoi(strings.TrimSuffix(name[1:], ".vlog"))
+		if err != nil {
+			continue
+		}
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+
+	return nums, nil
+}
+
+// Opens the value log in the given directory, creating it if it doesn't exist.
+func openValueLog(path string, maxSegmentSize int64) (*ValueLog, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+
+	vlog := &ValueLog{
+		path:           path,
+		maxSegmentSize: maxSegmentSize,
+		pending:        make(map[int]int),
+	}
+
+	nums, err := vlog.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	activeNum := 1
+	if len(nums) > 0 {
+		activeNum = nums[len(nums)-1]
+	}
+
+	if err := vlog.openSegment(activeNum); err != nil {
+		return nil, err
+	}
+
+	return vlog, nil
+}
+
+// Makes the segment with the given number the active one.
+func (vlog *ValueLog) openSegment(num int) error {
+	file, err := os.OpenFile(vlog.segmentPath(num), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	if vlog.active != nil {
+		if err := vlog.active.Close(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	vlog.active = file
+	vlog.activeNum = num
+	return nil
+}
+
+func (vlog *ValueLog) Close() error {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	return vlog.active.Close()
+}
+
+// Returns the number of the active segment.
+func (vlog *ValueLog) activeSegment() int {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	return vlog.activeNum
+}
+
+// Flushes the active segment to the disk.
+func (vlog *ValueLog) sync() error {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	return vlog.active.Sync()
+}
+
+// Returns the number of the active segment and its size.
+func (vlog *ValueLog) activeSegmentSize() (int, int64, error) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	info, err := vlog.active.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return vlog.activeNum, info.Size(), nil
+}
+
+// Writes the value to the end of the active segment, and returns the encoded pointer to it.
+func (vlog *ValueLog) append(key, value []byte) ([]byte, error) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	offset, err := vlog.active.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	// Starting a new segment if the active one is full
+	if offset >= vlog.maxSegmentSize {
+		if err := vlog.openSegment(vlog.activeNum + 1); err != nil {
+			return nil, err
+		}
+		offset = 0
+	}
+
+	record := encode4BytesInt(len(key))
+	record = append(record, key...)
+	record = append(record, encode4BytesInt(len(value))...)
+	record = append(record, value...)
+
+	if _, err := vlog.active.Write(record); err != nil {
+		return nil, err
+	}
+
+	ptr := valuePointer{
+		segment: vlog.activeNum,
+		offset:  offset + int64(4+len(key)+4),
+		length:  len(value),
+	}
+	return ptr.encode(), nil
+}
+
+// Reads the value the encoded pointer points to.
+func (vlog *ValueLog) read(encodedPtr []byte) ([]byte, error) {
+	ptr, err := decodeValuePointer(encodedPtr)
+	if err != nil {
+		return nil, err
+	}
+
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	file := vlog.active
+	if ptr.segment != vlog.activeNum {
+		file, err = os.Open(vlog.segmentPath(ptr.segment))
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+	}
+
+	value := make([]byte, ptr.length)
+	if _, err := file.ReadAt(value, ptr.offset); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// Calls fn with the key, the value and the encoded pointer of every record of a segment.
+func (vlog *ValueLog) forEachRecord(num int, fn func(key, value, encodedPtr []byte) error) error {
+	file, err := os.Open(vlog.segmentPath(num))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var offset int64
+	for {
+		lenPart := make([]byte, 4)
+		if _, err := io.ReadFull(file, lenPart); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		key := make([]byte, decode4BytesInt(lenPart))
+		if _, err := io.ReadFull(file, key); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(file, lenPart); err != nil {
+			return err
+		}
+		value := make([]byte, decode4BytesInt(lenPart))
+		if _, err := io.ReadFull(file, value); err != nil {
+			return err
+		}
+
+		ptr := valuePointer{
+			segment: num,
+			offset:  offset + int64(4+len(key)+4),
+			length:  len(value),
+		}
+		offset = ptr.offset + int64(len(value))
+
+		if err := fn(key, value, ptr.encode()); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the entry to write for setting the key. If the value is big enough, it is written to the value log
+// and the entry only holds a pointer to it.
+func (lsmdb *DB) makeSetEntry(key, value []byte) (Entry, error) {
+	if lsmdb.valueLog == nil || len(value) < lsmdb.valueThreshold {
+		return Entry{op: SetOp, key: key, value: value}, nil
+	}
+
+	ptr, err := lsmdb.valueLog.append(key, value)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	return Entry{op: ValuePointerOp, key: key, value: ptr}, nil
+}
+
+// Reads the value the encoded pointer points to in the value log.
+func (lsmdb *DB) readValueLog(encodedPtr []byte) ([]byte, error) {
+	if lsmdb.valueLog == nil {
+		return nil, ErrValueLogDisabled
+	}
+	return lsmdb.valueLog.read(encodedPtr)
+}
+
+// Merge operands can't be folded into a pointer, so if the memTable holds a pointer for the key,
+// the value is read back from the value log into the memTable.
+func (lsmdb *DB) loadPointedValue(key []byte) error {
+	ptr, err := lsmdb.memTable.Get(key)
+	if err != ErrValueInLog {
+		return nil
+	}
+
+	value, err := lsmdb.readValueLog(ptr)
+	if err != nil {
+		return err
+	}
+
+	return lsmdb.memTable.Set(key, value)
+}
+
+// Tells if the encoded pointer is the current value of the key, i.e. if the value it points to is still in use.
+func (lsmdb *DB) isLivePointer(key, encodedPtr []byte) (bool, error) {
+	v, err := lsmdb.memTable.Get(key)
+	switch err {
+	case ErrValueInLog:
+		return bytes.Equal(v, encodedPtr), nil
+
+	// The value of the key may still be in the sst files, under the operands
+	case ErrKeyMerged, ErrKeyNotFound:
+
+	default:
+		return false, nil
+	}
+
+	if err := lsmdb.setCurrentSSTIndex(); err != nil {
+		return false, err
+	}
+
+	for i := lsmdb.sstFilesNum; i >= 1; i-- {
+		v, err := lsmdb.searchSSTFile(i, key)
+		switch err {
+		case ErrValueInLog:
+			return bytes.Equal(v, encodedPtr), nil
+		case ErrKeyMerged, ErrKeyNotFound:
+			continue
+		case nil, ErrKeyDeleted:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// Reclaims the space of the value log segments (except the active one) whose ratio of values that are not in use
+// anymore (because they were overwritten or deleted) is at least discardRatio.
+// The values still in use are written again to the active segment. Returns the number of bytes reclaimed.
+func (lsmdb *DB) GarbageCollectValueLog(discardRatio float64) (int64, error) {
+	defer lsmdb.lock()()
+
+	// The rewritten values would be new WAL records, which a follower only gets from its leader
+	if lsmdb.rootDB().readOnly {
+		return 0, ErrReadOnly
+	}
+
+	if lsmdb.valueLog == nil {
+		return 0, ErrValueLogDisabled
+	}
+
+	nums, err := lsmdb.valueLog.segments()
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	for _, num := range nums {
+		if num == lsmdb.valueLog.activeSegment() || lsmdb.valueLog.hasPending(num) {
+			continue
+		}
+
+		// Finding the keys whose values are still in use
+		var total, live int64
+		liveKeys := make([][]byte, 0)
+		err := lsmdb.valueLog.forEachRecord(num, func(key, value, encodedPtr []byte) error {
+			total += int64(len(value))
+
+			isLive, err := lsmdb.isLivePointer(key, encodedPtr)
+			if err != nil {
+				return err
+			}
+			if isLive {
+				live += int64(len(value))
+				liveKeys = append(liveKeys, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return reclaimed, err
+		}
+
+		if total > 0 && float64(total-live)/float64(total) < discardRatio {
+			continue
+		}
+
+		// Writing the values in use again. The current value is read with Get rather than taken from the
+		// segment, so the merge operands pending on top of it are folded into it instead of being lost.
+		for _, key := range liveKeys {
+			value, err := lsmdb.get(key)
+			if err != nil {
+				return reclaimed, err
+			}
+			if err := lsmdb.set(key, value); err != nil {
+				return reclaimed, err
+			}
+		}
+
+		// The new pointers must be on the disk before the old values are removed
+		if err := lsmdb.valueLog.sync(); err != nil {
+			return reclaimed, err
+		}
+		if err := lsmdb.wal.sync(); err != nil {
+			return reclaimed, err
+		}
+
+		info, err := os.Stat(lsmdb.valueLog.segmentPath(num))
+		if err != nil {
+			return reclaimed, err
+		}
+		if err := os.Remove(lsmdb.valueLog.segmentPath(num)); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += info.Size()
+	}
+
+	return reclaimed, nil
+}
+
+// Tells if some values of the segment are waiting for their pointer to be logged.
+func (vlog *ValueLog) hasPending(num int) bool {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	return vlog.pending[num] > 0
+}
+
+// Writes the content of r to the end of the active segment without holding it in memory,
+// and returns the encoded pointer to it. Nothing is kept in the segment if r fails.
+// The value is pending until the returned function is called, once its pointer is logged or given up.
+func (vlog *ValueLog) appendFrom(key []byte, r io.Reader) ([]byte, func(), error) {
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+
+	offset, err := vlog.active.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Starting a new segment if the active one is full
+	if offset >= vlog.maxSegmentSize {
+		if err := vlog.openSegment(vlog.activeNum + 1); err != nil {
+			return nil, nil, err
+		}
+		offset = 0
+	}
+
+	// The value length is not known yet, it is written once the value is copied
+	header := encode4BytesInt(len(key))
+	header = append(header, key...)
+	header = append(header, encode4BytesInt(0)...)
+
+	if _, err := vlog.active.Write(header); err != nil {
+		return nil, nil, err
+	}
+
+	n, err := io.Copy(vlog.active, r)
+	if err == nil && n > math.MaxUint32 {
+		err = ErrValueTooLarge
+	}
+	if err != nil {
+		if truncErr := vlog.active.Truncate(offset); truncErr != nil {
+			return nil, nil, truncErr
+		}
+		return nil, nil, err
+	}
+
+	valueOffset := offset + int64(len(header))
+	if _, err := vlog.active.WriteAt(encode4BytesInt(int(n)), valueOffset-4); err != nil {
+		return nil, nil, err
+	}
+
+	pointer := valuePointer{
+		segment: vlog.activeNum,
+		offset:  valueOffset,
+		length:  int(n),
+	}
+
+	vlog.pending[pointer.segment]++
+	release := func() {
+		vlog.mu.Lock()
+		defer vlog.mu.Unlock()
+
+		if vlog.pending[pointer.segment]--; vlog.pending[pointer.segment] == 0 {
+			delete(vlog.pending, pointer.segment)
+		}
+	}
+	return pointer.encode(), release, nil
+}
+
+// Returns a reader of the value the encoded pointer points to, and the length of the value.
+func (vlog *ValueLog) openReader(encodedPtr []byte) (io.ReadCloser, int64, error) {
+	ptr, err := decodeValuePointer(encodedPtr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.Open(vlog.segmentPath(ptr.segment))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader := struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, ptr.offset, int64(ptr.length)), file}
+
+	return reader, int64(ptr.length), nil
+}
+
+// Returns the pointer to the value of the key if the value is in the value log and there are
+// no merge operands on top of it, otherwise returns nil.
+func (lsmdb *DB) findValuePointer(key []byte) ([]byte, error) {
+	v, err := lsmdb.memTable.Get(key)
+	switch err {
+	case ErrValueInLog:
+		return v, nil
+	case ErrKeyNotFound:
+	default:
+		return nil, nil
+	}
+
+	if err := lsmdb.setCurrentSSTIndex(); err != nil {
+		return nil, err
+	}
+
+	for i := lsmdb.sstFilesNum; i >= 1; i-- {
+		v, err := lsmdb.searchSSTFile(i, key)
+		switch err {
+		case ErrValueInLog:
+			return v, nil
+		case ErrKeyNotFound:
+			continue
+		case nil, ErrKeyDeleted, ErrKeyMerged:
+			return nil, nil
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// Sets the value of the key to the content of r.
+// If the value is big enough for the value log, it is copied there without being held in memory.
+func (lsmdb *DB) PutStream(key []byte, r io.Reader) error {
+	return lsmdb.putStream(key, r, false)
+}
+
+// Like PutStream, but only sets the value if the key has none, and returns ErrKeyExists otherwise.
+// The key is checked and the value is written at once, under the lock of the database.
+func (lsmdb *DB) PutStreamIfAbsent(key []byte, r io.Reader) error {
+	return lsmdb.putStream(key, r, true)
+}
+
+func (lsmdb *DB) putStream(key []byte, r io.Reader, ifAbsent bool) error {
+	if lsmdb.IsReadOnly() {
+		return ErrReadOnly
+	}
+
+	put := lsmdb.Put
+	if ifAbsent {
+		put = lsmdb.putIfAbsent
+	}
+
+	if lsmdb.valueLog == nil {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return put(key, value)
+	}
+
+	// Reading the beginning of the value to know if it is small enough to be stored in the LSM tree
+	head := make([]byte, lsmdb.valueThreshold)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return put(key, head[:n])
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only the value log is locked while the value is copied. If the key turns out to exist, the copied value is
+	// left to the garbage collector.
+	ptr, release, err := lsmdb.valueLog.appendFrom(key, io.MultiReader(bytes.NewReader(head), r))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	defer lsmdb.lock()()
+
+	if ifAbsent {
+		if err := lsmdb.checkAbsent(key); err != nil {
+			return err
+		}
+	}
+
+	entry := Entry{
+		op:    ValuePointerOp,
+		key:   key,
+		value: ptr,
+	}
+
+	if err := lsmdb.logEntry(entry); err != nil {
+		return err
+	}
+
+	lsmdb.memTable.writeOperation(entry.op, key, entry.value)
+
+	return lsmdb.flushIfFull()
+}
+
+// Returns a reader of the value of the key and the length of the value.
+// Values in the value log are read from it as the reader is consumed, the others are already in memory.
+func (lsmdb *DB) GetStream(key []byte) (io.ReadCloser, int64, error) {
+	if lsmdb.valueLog != nil {
+		unlock := lsmdb.lock()
+		ptr, err := lsmdb.findValuePointer(key)
+		unlock()
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ptr != nil {
+			return lsmdb.valueLog.openReader(ptr)
+		}
+	}
+
+	value, err := lsmdb.Get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return io.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+}
@@ -0,0 +1,307 @@
+package lsmdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+)
+
+func TestValueLog_appendAndRead(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "test_vlog_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	vlog, err := openValueLog(tempDir+"/", 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vlog.Close()
+
+	ptr1, err := vlog.append([]byte("key1"), []byte("a value of twenty bytes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first segment is full, the value goes to a new one
+	ptr2, err := vlog.append([]byte("key2"), []byte("another value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vlog.activeNum != 2 {
+		t.Errorf("Expected active segment 2, got %d", vlog.activeNum)
+	}
+
+	if v, err := vlog.read(ptr1); err != nil || string(v) != "a value of twenty bytes" {
+		t.Errorf("Expected the first value, got %s (%v)", v, err)
+	}
+	if v, err := vlog.read(ptr2); err != nil || string(v) != "another value" {
+		t.Errorf("Expected the second value, got %s (%v)", v, err)
+	}
+
+	// Iterating over the records gives back the same pointers
+	var ptrs [][]byte
+	err = vlog.forEachRecord(1, func(key, value, encodedPtr []byte) error {
+		ptrs = append(ptrs, encodedPtr)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ptrs) != 1 || !bytes.Equal(ptrs[0], ptr1) {
+		t.Errorf("Expected pointer %v, got %v", ptr1, ptrs)
+	}
+}
+
+func TestLSMDB_ValueLog(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 200
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	bigValue := bytes.Repeat([]byte("x"), 150)
+	if err := lsmdb.Put([]byte("big"), bigValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("small"), []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the pointer is accounted in the memTable
+	if size := lsmdb.memTable.sizeInBytes(); size >= 100 {
+		t.Errorf("Expected the memTable to only hold a pointer, got %d bytes", size)
+	}
+
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, bigValue) {
+		t.Errorf("Expected the big value, got %s (%v)", v, err)
+	}
+
+	// The pointer is dereferenced from the sst files as well
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, bigValue) {
+		t.Errorf("Expected the big value, got %s (%v)", v, err)
+	}
+
+	// Overwriting the value in a new segment leaves only garbage in the first one
+	overwritten := bytes.Repeat([]byte("y"), 150)
+	if err := lsmdb.Put([]byte("big"), overwritten); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("other"), bytes.Repeat([]byte("z"), 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	reclaimed, err := lsmdb.GarbageCollectValueLog(0.5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed == 0 {
+		t.Error("Expected the first segment to be reclaimed")
+	}
+	if _, err := os.Stat(lsmdb.valueLog.segmentPath(1)); !os.IsNotExist(err) {
+		t.Errorf("Expected the first segment to be removed, got %v", err)
+	}
+
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, overwritten) {
+		t.Errorf("Expected the overwritten value, got %s (%v)", v, err)
+	}
+}
+
+func TestLSMDB_ValueLogLiveValuesAreRewritten(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 100
+	lsmdb.mergeOperator = StringAppendOperator{}
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	bigValue := bytes.Repeat([]byte("x"), 150)
+	if err := lsmdb.Put([]byte("big"), bigValue); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.flushToDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Merge([]byte("big"), []byte("!")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("rotate"), bytes.Repeat([]byte("z"), 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := lsmdb.GarbageCollectValueLog(0); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := append(bigValue, '!')
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, expected) {
+		t.Errorf("Expected the merged value, got %s (%v)", v, err)
+	}
+
+	reopenTestLSMDB(t, lsmdb)
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, expected) {
+		t.Errorf("Expected the merged value after a restart, got %s (%v)", v, err)
+	}
+}
+
+func TestLSMDB_SetStreamAndGetStream(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 1 << 20
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	bigValue := bytes.Repeat([]byte("0123456789"), 100)
+	if err := lsmdb.PutStream([]byte("big"), bytes.NewReader(bigValue)); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.PutStream([]byte("small"), bytes.NewReader([]byte("value"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The big value went to the value log, the small one stayed in the memTable
+	if _, err := lsmdb.memTable.Get([]byte("big")); err != ErrValueInLog {
+		t.Errorf("Expected ErrValueInLog, got %v", err)
+	}
+	if v, err := lsmdb.memTable.Get([]byte("small")); err != nil || string(v) != "value" {
+		t.Errorf("Expected value, got %s (%v)", v, err)
+	}
+
+	for key, expected := range map[string][]byte{"big": bigValue, "small": []byte("value")} {
+		reader, size, err := lsmdb.GetStream([]byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := io.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != int64(len(expected)) || !bytes.Equal(got, expected) {
+			t.Errorf("Expected %d bytes for %s, got %d bytes (size %d)", len(expected), key, len(got), size)
+		}
+	}
+
+	// A failing reader leaves nothing behind
+	failing := io.MultiReader(bytes.NewReader(bigValue), iotest.ErrReader(io.ErrClosedPipe))
+	if err := lsmdb.PutStream([]byte("failed"), failing); err != io.ErrClosedPipe {
+		t.Errorf("Expected io.ErrClosedPipe, got %v", err)
+	}
+	if _, err := lsmdb.Get([]byte("failed")); err != ErrKeyNotFound {
+		t.Errorf("Expected ErrKeyNotFound, got %v", err)
+	}
+	if v, err := lsmdb.Get([]byte("big")); err != nil || !bytes.Equal(v, bigValue) {
+		t.Errorf("Expected the big value, got %d bytes (%v)", len(v), err)
+	}
+}
+
+func TestLSMDB_PutStreamIfAbsent(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 1 << 20
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only one of the concurrent writers of each key sets its value, small or big
+	for _, size := range []int{10, 1000} {
+		key := []byte(fmt.Sprint("key", size))
+
+		var wg sync.WaitGroup
+		var written atomic.Int32
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				value := bytes.Repeat([]byte{byte('a' + i)}, size)
+				switch err := lsmdb.PutStreamIfAbsent(key, bytes.NewReader(value)); err {
+				case nil:
+					written.Add(1)
+				case ErrKeyExists:
+				default:
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		if n := written.Load(); n != 1 {
+			t.Errorf("Expected 1 write of %s, got %d", key, n)
+		}
+		if v, err := lsmdb.Get(key); err != nil || len(v) != size {
+			t.Errorf("Expected %d bytes for %s, got %d bytes (%v)", size, key, len(v), err)
+		}
+	}
+
+	// A deleted key can be set again
+	if _, err := lsmdb.Delete([]byte("key10")); err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.PutStreamIfAbsent([]byte("key10"), bytes.NewReader([]byte("value"))); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+func TestLSMDB_ValueLogPendingSegmentIsKept(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.valueLogPath = lsmdb.sstPath + "../vlog/"
+	lsmdb.valueThreshold = 50
+	lsmdb.valueLogSegmentSize = 100
+	if err := lsmdb.openFiles(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A value streamed by PutStream, whose pointer is not logged yet
+	ptr, release, err := lsmdb.valueLog.appendFrom([]byte("big"), bytes.NewReader(bytes.Repeat([]byte("x"), 150)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lsmdb.Put([]byte("rotate"), bytes.Repeat([]byte("z"), 60)); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := lsmdb.valueLog.segmentPath(1)
+	if _, err := lsmdb.GarbageCollectValueLog(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(segment); err != nil {
+		t.Errorf("Expected the pending segment to be kept, got %v", err)
+	}
+
+	// Logging the pointer, as PutStream does
+	unlock := lsmdb.lock()
+	entry := Entry{op: ValuePointerOp, key: []byte("big"), value: ptr}
+	if err := lsmdb.logEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	lsmdb.memTable.writeOperation(entry.op, entry.key, entry.value)
+	unlock()
+	release()
+
+	if _, err := lsmdb.GarbageCollectValueLog(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(segment); !os.IsNotExist(err) {
+		t.Errorf("Expected the segment to be collected, got %v", err)
+	}
+	if v, err := lsmdb.Get([]byte("big")); err != nil || len(v) != 150 {
+		t.Errorf("Expected 150 bytes, got %d bytes (%v)", len(v), err)
+	}
+}
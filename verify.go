@@ -0,0 +1,225 @@
+package lsmdb
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Returns the path of the sst file, and the one of the file holding its checksum (in the format of sha256sum).
+func (lsmdb *DB) sstFilePath(sstFileNum int) string {
+	return fmt.Sprint(lsmdb.sstPath, "f", sstFileNum, ".sst")
+}
+
+func (lsmdb *DB) sstChecksumPath(sstFileNum int) string {
+	return lsmdb.sstFilePath(sstFileNum) + ".sha256"
+}
+
+// Writes the checksum of the sst file, computed while it was written.
+func (lsmdb *DB) writeSSTChecksum(sstFileNum int, sha string) error {
+	line := sha + "  " + fmt.Sprint("f", sstFileNum, ".sst") + "\n"
+	return os.WriteFile(lsmdb.sstChecksumPath(sstFileNum), []byte(line), 0600)
+}
+
+// Returns the checksum of the sst file, or an empty string if it has none (it was written before they were).
+func (lsmdb *DB) readSSTChecksum(sstFileNum int) (string, error) {
+	return readChecksumFile(lsmdb.sstChecksumPath(sstFileNum))
+}
+
+// Returns the checksum written to the file, or an empty string if the file doesn't exist.
+func readChecksumFile(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sha, _, _ := strings.Cut(string(content), " ")
+	return sha, nil
+}
+
+// The outcome of the verification of the sst files
+type VerificationReport struct {
+	Files     []SSTFileVerification `json:"files"`
+	Corrupted int                   `json:"corrupted"`
+}
+
+// The outcome of the verification of an sst file
+type SSTFileVerification struct {
+	Family string `json:"family"`
+	Name   string `json:"name"`
+
+	// Tells if the file was checked against its checksum, the files written before the checksums were are only
+	// decoded
+	Checksummed bool `json:"checksummed"`
+
+	// Why the file is corrupted, empty if it isn't
+	Error string `json:"error,omitempty"`
+}
+
+// Verifies all the sst files: their content must match their checksum, and their entries must be decodable, sorted,
+// and match their header. The database is only locked while each file is verified, so it keeps serving.
+// Returns the report with an error wrapping ErrCorruptedFile if a file is corrupted.
+func (lsmdb *DB) VerifySSTFiles() (*VerificationReport, error) {
+	report := &VerificationReport{Files: make([]SSTFileVerification, 0)}
+
+	unlock, err := lsmdb.lockContext(context.Background())
+	if err != nil {
+		return report, err
+	}
+	families := lsmdb.rootDB().allFamilies()
+	unlock()
+
+	for _, family := range families {
+		// The column family can be dropped or compacted meanwhile, the files are counted again before each one
+		for i := 1; ; i++ {
+			unlock, err := family.lockContext(context.Background())
+			if err != nil {
+				return report, err
+			}
+			if !family.isOpenFamily() || i > family.sstFilesNum {
+				unlock()
+				break
+			}
+
+			checksummed, err := family.verifySSTFile(i)
+			unlock()
+
+			verification := SSTFileVerification{
+				Family:      cmp.Or(family.familyName, defaultColumnFamilyName),
+				Name:        fmt.Sprint("f", i, ".sst"),
+				Checksummed: checksummed,
+			}
+			if err != nil {
+				verification.Error = err.Error()
+				report.Corrupted++
+			}
+			report.Files = append(report.Files, verification)
+		}
+	}
+
+	if report.Corrupted > 0 {
+		return report, fmt.Errorf("%w: %d of the %d sst files", ErrCorruptedFile, report.Corrupted, len(report.Files))
+	}
+	return report, nil
+}
+
+// Tells if the column family is still one of the database. It must be called with the database locked.
+func (lsmdb *DB) isOpenFamily() bool {
+	return lsmdb.root == nil || lsmdb.root.families[lsmdb.familyName] == lsmdb
+}
+
+// Verifies an sst file, and tells if it has a checksum. It must be called with the database locked.
+func (lsmdb *DB) verifySSTFile(sstFileNum int) (bool, error) {
+	sha, err := lsmdb.readSSTChecksum(sstFileNum)
+	if err != nil {
+		return false, err
+	}
+	if sha != "" {
+		actual, err := fileSHA256(lsmdb.sstFilePath(sstFileNum))
+		if err != nil {
+			return true, err
+		}
+		if actual != sha {
+			return true, fmt.Errorf("the checksum %s doesn't match %s", actual, sha)
+		}
+	}
+
+	file, err := os.Open(lsmdb.sstFilePath(sstFileNum))
+	if err != nil {
+		return sha != "", err
+	}
+	defer file.Close()
+
+	magicNumber, entryCount, smallestKey, largestKey, version, err := readHeader(file)
+	if err != nil {
+		return sha != "", fmt.Errorf("invalid header: %w", err)
+	}
+	if !bytes.Equal(magicNumber, lsmdb.magicNumber[:]) {
+		return sha != "", fmt.Errorf("invalid magic number %x", magicNumber)
+	}
+	if version != lsmdb.version {
+		return sha != "", ErrOutdatedVersion
+	}
+
+	var count int
+	var previous []byte
+	r := bufio.NewReader(file)
+	for {
+		op, key, _, err := decodeNext(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return sha != "", fmt.Errorf("entry %d can't be decoded: %w", count+1, err)
+		}
+
+		switch OperationType(op) {
+		case SetOp, DelOp, MergeOp, ValuePointerOp, ExpiringSetOp:
+		default:
+			return sha != "", fmt.Errorf("entry %d has the unknown operation %d", count+1, op)
+		}
+		if count == 0 && !bytes.Equal(key, smallestKey) {
+			return sha != "", fmt.Errorf("the first key %q is not the smallest key %q of the header", key, smallestKey)
+		}
+		if count > 0 && bytes.Compare(previous, key) >= 0 {
+			return sha != "", fmt.Errorf("the key %q follows the key %q", key, previous)
+		}
+
+		previous = key
+		count++
+	}
+
+	if count != entryCount {
+		return sha != "", fmt.Errorf("%d entries instead of the %d of the header", count, entryCount)
+	}
+	if count > 0 && !bytes.Equal(previous, largestKey) {
+		return sha != "", fmt.Errorf("the last key %q is not the largest key %q of the header", previous, largestKey)
+	}
+
+	return sha != "", nil
+}
+
+// Starts the verification of the sst files in the background, and returns the id of its job. The report is the
+// result of the job.
+func (lsmdb *DB) StartVerification() uint64 {
+	id, finish := lsmdb.startJob("verify")
+
+	go func() {
+		report, err := lsmdb.VerifySSTFiles()
+		finish(report, err)
+	}()
+
+	return id
+}
+
+// This is the request handler starting the verification of the sst files (/admin/verify)
+// It responds with the job of the verification, whose status is at /admin/jobs/<id>.
+func verifyHandler(lsmdb *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request type", http.StatusBadRequest)
+			return
+		}
+
+		job, err := lsmdb.Job(lsmdb.StartVerification())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Location", fmt.Sprint("/admin/jobs/", job.ID))
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,133 @@
+package lsmdb
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifySSTFiles(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("a"), []byte("value")) })
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("b"), []byte("value")) })
+	flushChanges(t, lsmdb, func() { lsmdb.Put([]byte("c"), []byte("value")) })
+
+	report, err := lsmdb.VerifySSTFiles()
+	if err != nil || len(report.Files) != 3 || report.Corrupted != 0 {
+		t.Fatalf("Expected 3 valid files, got %+v (%v)", report, err)
+	}
+
+	// A changed byte doesn't match the checksum anymore
+	content, _ := os.ReadFile(lsmdb.sstFilePath(2))
+	content[len(content)-1] ^= 0xff
+	os.WriteFile(lsmdb.sstFilePath(2), content, 0600)
+
+	// The files without checksum are still decoded
+	os.Remove(lsmdb.sstChecksumPath(3))
+	content, _ = os.ReadFile(lsmdb.sstFilePath(3))
+	os.WriteFile(lsmdb.sstFilePath(3), content[:len(content)-2], 0600)
+
+	report, err = lsmdb.VerifySSTFiles()
+	if !errors.Is(err, ErrCorruptedFile) || report.Corrupted != 2 {
+		t.Fatalf("Expected 2 corrupted files, got %+v (%v)", report, err)
+	}
+	if file := report.Files[1]; !file.Checksummed || !strings.Contains(file.Error, "checksum") {
+		t.Errorf("Expected a checksum mismatch, got %+v", file)
+	}
+	if file := report.Files[2]; file.Checksummed || file.Error == "" {
+		t.Errorf("Expected an entry that can't be decoded, got %+v", file)
+	}
+}
+
+func TestAdminHandlers(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	access := &AccessControl{
+		Authenticator: StaticTokens{"secret": "admin"},
+		ACL:           ACL{"admin": {{Prefix: "", Permissions: []Permission{PermissionAdmin}}}},
+	}
+	server := httptest.NewServer(NewHTTPHandler(lsmdb, nil, nil, nil, access))
+	defer server.Close()
+
+	do := func(method, path, token string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	for _, path := range []string{"/admin/flush", "/admin/compact", "/admin/verify"} {
+		if resp := do("POST", path, ""); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for %s, got %d", path, resp.StatusCode)
+		}
+		if resp := do("POST", path, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for %s, got %d", path, resp.StatusCode)
+		}
+	}
+
+	lsmdb.Put([]byte("key"), []byte("value"))
+	if resp := do("POST", "/admin/flush", "secret"); resp.StatusCode != http.StatusOK || lsmdb.sstFilesNum != 1 {
+		t.Errorf("Expected the memTable to be flushed, got status %d with %d sst files", resp.StatusCode, lsmdb.sstFilesNum)
+	}
+	lsmdb.Put([]byte("key"), []byte("value2"))
+	do("POST", "/admin/flush", "secret")
+
+	resp := do("POST", "/admin/compact?start=a&end=z", "secret")
+	var result CompactionResult
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || result.InputFiles != 2 || result.DroppedEntries != 1 {
+		t.Errorf("Unexpected compaction %+v with status %d", result, resp.StatusCode)
+	}
+	if resp := do("POST", "/admin/compact?family=missing", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+
+	// The verification runs in the background, its job is polled until it is finished
+	resp = do("POST", "/admin/verify", "secret")
+	var job BackgroundJob
+	json.NewDecoder(resp.Body).Decode(&job)
+	if resp.StatusCode != http.StatusAccepted || job.Kind != "verify" || resp.Header.Get("Location") == "" {
+		t.Fatalf("Unexpected job %+v with status %d", job, resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status == JobRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		resp := do("GET", resp.Header.Get("Location"), "secret")
+		job = BackgroundJob{}
+		json.NewDecoder(resp.Body).Decode(&job)
+	}
+	if job.Status != JobSucceeded || job.FinishedAt == nil {
+		t.Errorf("Expected the verification to succeed, got %+v", job)
+	}
+	if report, _ := job.Result.(map[string]any); report["corrupted"] != 0.0 || len(report["files"].([]any)) != 1 {
+		t.Errorf("Unexpected report %+v", job.Result)
+	}
+
+	if resp := do("GET", "/admin/jobs/1000", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", resp.StatusCode)
+	}
+
+	// The admin endpoints are disabled without access control
+	disabled := httptest.NewServer(NewHTTPHandler(lsmdb, nil, nil, nil, nil))
+	defer disabled.Close()
+	resp, err := http.Post(disabled.URL+"/admin/flush", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", resp.StatusCode)
+	}
+}
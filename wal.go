@@ -1,12 +1,23 @@
-package main
+package lsmdb
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// Set or del entry. For del entries, field "value" is nil.
+var (
+	ErrSequenceNotRetained = errors.New("the WAL records after this sequence number are not retained anymore")
+)
+
+// Set, del or merge entry. For del entries, field "value" is nil, for merge entries it holds the encoded operands.
 type Entry struct {
 	op    OperationType
 	key   []byte
@@ -17,9 +28,43 @@ type Entry struct {
 type WAL struct {
 	logFile *os.File
 	walPath string
+
+	// The directory the WAL segments are moved to when the WAL is cleared, so their records stay readable.
+	// If it is empty, the WAL is truncated instead.
+	historyPath string
+
+	// The maximum total size of the retained segments, the oldest ones are deleted beyond it
+	historyMaxSize int64
+
+	// Every record of the WAL (a batch being one record) gets a sequence number, one more than the previous record.
+	// This is the sequence number of the last record written.
+	lastSeq uint64
+
+	// The sequence number of the last record before the current segment
+	baseSeq uint64
+
+	// The directory the WAL segments are copied to when the WAL is cleared, and kept forever (for point-in-time
+	// recovery). It is disabled if empty.
+	archivePath string
+
+	// The commit time (in milliseconds since the Unix epoch) written with the last timestamp record
+	lastTimestamp int64
+
+	// The number of bytes appended to the WAL, and the durations of its fsyncs
+	writtenBytes  int64
+	syncDurations histogram
+}
+
+// A record read from the WAL, with its sequence number and its commit time (the zero time if it isn't known)
+type walRecord struct {
+	seq   uint64
+	time  time.Time
+	entry Entry
 }
 
 // Clears the WAL file (closes the current open wal file, and opens a new one in truncate mode)
+// If the archive is enabled, the full segment is copied to the archive directory first, and if the history is
+// enabled, it is moved to the history directory.
 func (wal *WAL) clear() error {
 	if err := wal.logFile.Close(); err != nil {
 		return err
@@ -27,34 +72,269 @@ func (wal *WAL) clear() error {
 
 	wal.logFile = nil
 
+	if wal.archivePath != "" && wal.lastSeq > wal.baseSeq {
+		if err := wal.archiveSegment(); err != nil {
+			return err
+		}
+	}
+
+	if wal.historyPath != "" && wal.lastSeq > wal.baseSeq {
+		if err := wal.retainSegment(); err != nil {
+			return err
+		}
+	}
+
 	newWal, err := os.OpenFile(wal.walPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 
 	wal.logFile = newWal
+	wal.baseSeq = wal.lastSeq
+	wal.lastTimestamp = 0
+
+	// The sequence numbers continue from the last record of the previous segment
+	if wal.baseSeq > 0 {
+		return wal.appendEntry(Entry{op: SequenceOp, value: binary.BigEndian.AppendUint64(nil, wal.baseSeq)})
+	}
+
 	return nil
 }
 
 // Writes entry to the end of the WAL
+// If the records are retained (in the history or in the archive), the entry is preceded by a timestamp record
+// when the time changed since the last one, so the records can be replayed up to a point in time.
 func (wal *WAL) appendEntry(entry Entry) error {
 	if _, err := wal.logFile.Seek(0, io.SeekEnd); err != nil {
 		return err
 	}
 
-	encodedEntry := entry.encode()
+	counted := entry.op != SequenceOp && entry.op != TimestampOp
+
+	var encodedEntry []byte
+	now := time.Now().UnixMilli()
+	if counted && (wal.historyPath != "" || wal.archivePath != "") && now != wal.lastTimestamp {
+		timestamp := Entry{op: TimestampOp, value: binary.BigEndian.AppendUint64(nil, uint64(now))}
+		encodedEntry = timestamp.encode()
+	}
+	encodedEntry = append(encodedEntry, entry.encode()...)
+
 	if _, err := wal.logFile.Write(encodedEntry); err != nil {
 		return err
 	}
+	wal.writtenBytes += int64(len(encodedEntry))
+
+	if len(encodedEntry) > len(entry.encode()) {
+		wal.lastTimestamp = now
+	}
+	if counted {
+		wal.lastSeq++
+	}
 
 	return nil
 }
 
+// Syncs the WAL file to the disk.
+func (wal *WAL) sync() error {
+	defer func(start time.Time) {
+		wal.syncDurations.observe(time.Since(start))
+	}(time.Now())
+
+	return wal.logFile.Sync()
+}
+
+// Returns the path of the retained segment whose records follow the record baseSeq.
+func (wal *WAL) segmentPath(baseSeq uint64) string {
+	return filepath.Join(wal.historyPath, fmt.Sprintf("%020d.wal", baseSeq))
+}
+
+// Returns the base sequence numbers of the retained segments, in increasing order.
+func (wal *WAL) retainedSegments() ([]uint64, error) {
+	if wal.historyPath == "" {
+		return nil, nil
+	}
+
+	files, err := os.ReadDir(wal.historyPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".wal")
+		if !ok {
+			continue
+		}
+		if baseSeq, err := strconv.ParseUint(name, 10, 64); err == nil {
+			segments = append(segments, baseSeq)
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// Copies the current segment to the archive directory.
+func (wal *WAL) archiveSegment() error {
+	if err := os.MkdirAll(wal.archivePath, 0700); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(wal.walPath)
+	if err != nil {
+		return err
+	}
+
+	dst := filepath.Join(wal.archivePath, fmt.Sprintf("%020d.wal", wal.baseSeq))
+	if err := copyFilePrefix(wal.walPath, dst+".tmp", info.Size()); err != nil {
+		return err
+	}
+
+	return os.Rename(dst+".tmp", dst)
+}
+
+// Moves the current segment to the history directory, and deletes the oldest segments beyond the maximum size.
+func (wal *WAL) retainSegment() error {
+	if err := os.MkdirAll(wal.historyPath, 0700); err != nil {
+		return err
+	}
+
+	if err := os.Rename(wal.walPath, wal.segmentPath(wal.baseSeq)); err != nil {
+		return err
+	}
+
+	segments, err := wal.retainedSegments()
+	if err != nil {
+		return err
+	}
+
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, baseSeq := range segments {
+		info, err := os.Stat(wal.segmentPath(baseSeq))
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+		total += sizes[i]
+	}
+
+	for i := 0; i < len(segments)-1 && total > wal.historyMaxSize; i++ {
+		if err := os.Remove(wal.segmentPath(segments[i])); err != nil {
+			return err
+		}
+		total -= sizes[i]
+	}
+
+	return nil
+}
+
+// Reads the records of a WAL segment, calling fn with each of them.
+// A record cut at the end of the segment is ignored. Returns the sequence number of the last record.
+func readWALSegment(path string, baseSeq uint64, fn func(record walRecord) error) (uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	seq := baseSeq
+	var commitTime time.Time
+	for {
+		op, key, value, err := decodeNext(file)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return seq, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		switch OperationType(op) {
+		case SequenceOp:
+			seq = binary.BigEndian.Uint64(value)
+			continue
+		case TimestampOp:
+			commitTime = time.UnixMilli(int64(binary.BigEndian.Uint64(value)))
+			continue
+		}
+
+		seq++
+		if err := fn(walRecord{seq: seq, time: commitTime, entry: Entry{op: OperationType(op), key: key, value: value}}); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Calls fn with every record after the sequence number afterSeq, from the retained segments then from the current
+// one, in order. Returns ErrSequenceNotRetained if some of these records are not retained anymore.
+func (wal *WAL) readRecordsAfter(afterSeq uint64, fn func(record walRecord) error) error {
+	segments, err := wal.retainedSegments()
+	if err != nil {
+		return err
+	}
+
+	if oldest := wal.oldestRetainedSeq(segments); afterSeq < oldest {
+		return ErrSequenceNotRetained
+	}
+
+	skipOlder := func(record walRecord) error {
+		if record.seq <= afterSeq {
+			return nil
+		}
+		return fn(record)
+	}
+
+	for i, baseSeq := range segments {
+		// Skipping the segments whose records are all older
+		if i+1 < len(segments) && segments[i+1] <= afterSeq {
+			continue
+		}
+		if baseSeq >= wal.baseSeq {
+			break
+		}
+
+		if _, err := readWALSegment(wal.segmentPath(baseSeq), baseSeq, skipOlder); err != nil {
+			return err
+		}
+	}
+
+	if afterSeq >= wal.lastSeq {
+		return nil
+	}
+
+	_, err = readWALSegment(wal.walPath, wal.baseSeq, skipOlder)
+	return err
+}
+
+// Returns the sequence number of the record before the oldest record that can be read.
+func (wal *WAL) oldestRetainedSeq(segments []uint64) uint64 {
+	if len(segments) > 0 {
+		return segments[0]
+	}
+	return wal.baseSeq
+}
+
+// Returns the sequence number of the last record of the retained segments, 0 if there are none.
+func (wal *WAL) lastRetainedSeq() (uint64, error) {
+	segments, err := wal.retainedSegments()
+	if err != nil || len(segments) == 0 {
+		return 0, err
+	}
+
+	newest := segments[len(segments)-1]
+	return readWALSegment(wal.segmentPath(newest), newest, func(walRecord) error { return nil })
+}
+
 // The format is the following: (1 byte for operation type, 4 bytes for key length, 4 bytes for value length).
 //
 // For a delete record: [DelOp][Key length][Key]
 //
 // For a set record: 		[SetOp][Key length][Key][Value length][Value]
+//
+// For a merge record: 	[MergeOp][Key length][Key][Operands length][Operands]
 func (entry *Entry) encode() []byte {
 
 	keyLen := len(entry.key)
@@ -64,7 +344,7 @@ func (entry *Entry) encode() []byte {
 	encoded = append(encoded, encodedKeyLen...)
 	encoded = append(encoded, entry.key...)
 
-	if entry.op == SetOp {
+	if entry.op != DelOp {
 		valueLen := len(entry.value)
 		encodedValueLen := encode4BytesInt(valueLen)
 		encoded = append(encoded, encodedValueLen...)
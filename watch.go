@@ -0,0 +1,264 @@
+package lsmdb
+
+import (
+	"bytes"
+	"errors"
+)
+
+var (
+	ErrSubscriberTooSlow = errors.New("the subscriber was dropped because it didn't keep up with the changes")
+)
+
+// The number of changes a subscriber can lag behind before it is dropped
+const subscriptionBufferSize = 1024
+
+type ChangeType int
+
+const (
+	ChangePut ChangeType = iota + 1
+	ChangeDelete
+	ChangeMerge
+)
+
+func (changeType ChangeType) String() string {
+	switch changeType {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	case ChangeMerge:
+		return "merge"
+	default:
+		return "unknown"
+	}
+}
+
+// A committed change of a key. Value is the new value for ChangePut events, the merge operand for ChangeMerge
+// events, and nil for ChangeDelete events.
+// Seq is the sequence number of the WAL record of the change (the changes of a batch share the same one).
+type ChangeEvent struct {
+	Seq    uint64
+	Type   ChangeType
+	Family string
+	Key    []byte
+	Value  []byte
+}
+
+// A subscription to the changes of the keys having a prefix in a column family.
+type Subscription struct {
+	lsmdb  *DB
+	prefix []byte
+	events chan ChangeEvent
+	err    error
+}
+
+// Subscribes to the changes of the keys starting with prefix (all the keys if it is empty), which are delivered
+// in commit order on the channel returned by Events.
+// A subscriber that falls too far behind is dropped: its channel is closed and Err returns ErrSubscriberTooSlow.
+// The values rewritten by the garbage collection of the value log are delivered as puts of the same value.
+func (lsmdb *DB) Subscribe(prefix []byte) *Subscription {
+	defer lsmdb.lock()()
+
+	sub := lsmdb.newSubscription(prefix, 0)
+	lsmdb.register(sub)
+
+	return sub
+}
+
+// Like Subscribe, but the changes committed after the sequence number afterSeq are delivered first, read from the
+// WAL. Returns ErrSequenceNotRetained if some of them are not in the WAL anymore.
+func (lsmdb *DB) SubscribeFrom(prefix []byte, afterSeq uint64) (*Subscription, error) {
+	defer lsmdb.lock()()
+
+	root := lsmdb.rootDB()
+
+	var replayed []ChangeEvent
+	err := root.wal.readRecordsAfter(afterSeq, func(record walRecord) error {
+		events, err := root.changesOf(record.seq, record.entry, func(family string, key []byte) bool {
+			return family == lsmdb.familyName && bytes.HasPrefix(key, prefix)
+		})
+		replayed = append(replayed, events...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The channel is big enough for the replayed changes, so the subscriber isn't dropped for them
+	sub := lsmdb.newSubscription(prefix, len(replayed))
+	for _, event := range replayed {
+		sub.events <- event
+	}
+	lsmdb.register(sub)
+
+	return sub, nil
+}
+
+// Returns the sequence number of the last committed change.
+func (lsmdb *DB) LastSequence() uint64 {
+	defer lsmdb.lock()()
+	return lsmdb.rootDB().wal.lastSeq
+}
+
+func (lsmdb *DB) newSubscription(prefix []byte, backlog int) *Subscription {
+	return &Subscription{
+		lsmdb:  lsmdb,
+		prefix: append([]byte(nil), prefix...),
+		events: make(chan ChangeEvent, backlog+subscriptionBufferSize),
+	}
+}
+
+func (lsmdb *DB) register(sub *Subscription) {
+	root := lsmdb.rootDB()
+	if root.subscriptions == nil {
+		root.subscriptions = make(map[*Subscription]struct{})
+	}
+	root.subscriptions[sub] = struct{}{}
+}
+
+// Returns the channel of the changes, which is closed when the subscription ends.
+func (sub *Subscription) Events() <-chan ChangeEvent {
+	return sub.events
+}
+
+// Returns the reason the subscription ended, nil if it was cancelled (or didn't end).
+func (sub *Subscription) Err() error {
+	return sub.err
+}
+
+// Ends the subscription and closes its channel.
+func (sub *Subscription) Cancel() {
+	defer sub.lsmdb.lock()()
+	sub.lsmdb.unsubscribe(sub, nil)
+}
+
+func (lsmdb *DB) unsubscribe(sub *Subscription, err error) {
+	root := lsmdb.rootDB()
+	if _, ok := root.subscriptions[sub]; !ok {
+		return
+	}
+
+	delete(root.subscriptions, sub)
+	sub.err = err
+	close(sub.events)
+}
+
+// Tells if the subscription watches this key of this column family.
+func (sub *Subscription) watches(family string, key []byte) bool {
+	return sub.lsmdb.familyName == family && bytes.HasPrefix(key, sub.prefix)
+}
+
+// Writes a record to the WAL and delivers its changes to the subscribers and the followers.
+// It is called with the database locked, so the subscribers see the changes in commit order.
+func (lsmdb *DB) appendRecord(entry Entry) error {
+	root := lsmdb.rootDB()
+
+	if err := root.wal.appendEntry(entry); err != nil {
+		return err
+	}
+
+	if len(root.replicationFeeds) > 0 {
+		if err := root.shipRecord(root.wal.lastSeq, entry); err != nil {
+			return err
+		}
+	}
+
+	if len(root.subscriptions) == 0 {
+		return nil
+	}
+
+	events, err := root.changesOf(root.wal.lastSeq, entry, func(family string, key []byte) bool {
+		for sub := range root.subscriptions {
+			if sub.watches(family, key) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		for sub := range root.subscriptions {
+			if !sub.watches(event.Family, event.Key) {
+				continue
+			}
+
+			select {
+			case sub.events <- event:
+			default:
+				root.unsubscribe(sub, ErrSubscriberTooSlow)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the changes of a WAL record whose key is wanted.
+func (lsmdb *DB) changesOf(seq uint64, entry Entry, wanted func(family string, key []byte) bool) ([]ChangeEvent, error) {
+	batch := &WriteBatch{}
+	if entry.op == BatchOp {
+		var err error
+		if batch, err = decodeWriteBatch(entry.value); err != nil {
+			return nil, err
+		}
+	} else {
+		batch.add(defaultColumnFamilyName, entry)
+	}
+
+	var events []ChangeEvent
+	for i, entry := range batch.entries {
+		family := batch.families[i]
+		if family == defaultColumnFamilyName {
+			family = ""
+		}
+
+		if !wanted(family, entry.key) {
+			continue
+		}
+
+		event := ChangeEvent{
+			Seq:    seq,
+			Type:   ChangePut,
+			Family: family,
+			Key:    append([]byte(nil), entry.key...),
+		}
+
+		switch entry.op {
+		case SetOp:
+			event.Value = append([]byte(nil), entry.value...)
+
+		case ExpiringSetOp:
+			_, value := decodeExpiringValue(entry.value)
+			event.Value = append([]byte(nil), value...)
+
+		case ValuePointerOp:
+			// The value is left empty if it was garbage collected from the value log since
+			if cf, err := lsmdb.columnFamily(family); err == nil && cf.valueLog != nil {
+				event.Value, _ = cf.valueLog.read(entry.value)
+			}
+
+		case DelOp:
+			event.Type = ChangeDelete
+
+		case MergeOp:
+			operands, err := decodeOperands(entry.value)
+			if err != nil {
+				return nil, err
+			}
+
+			event.Type = ChangeMerge
+			for _, operand := range operands {
+				event.Value = append([]byte(nil), operand...)
+				events = append(events, event)
+			}
+			continue
+		}
+
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,176 @@
+package lsmdb
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.mergeOperator = lookupMergeOperator("int64add")
+
+	sub := lsmdb.Subscribe([]byte("user:"))
+	defer sub.Cancel()
+
+	lsmdb.Put([]byte("user:1"), []byte("alice"))
+	lsmdb.Put([]byte("other"), []byte("ignored"))
+	lsmdb.Merge([]byte("user:count"), []byte("2"))
+	lsmdb.Delete([]byte("user:1"))
+
+	batch := WriteBatch{}
+	batch.Put("", []byte("user:2"), []byte("bob"))
+	batch.Put("", []byte("other"), []byte("ignored"))
+	batch.Put("", []byte("user:3"), []byte("carol"))
+	lsmdb.Write(&batch)
+
+	expected := []ChangeEvent{
+		{Seq: 1, Type: ChangePut, Key: []byte("user:1"), Value: []byte("alice")},
+		{Seq: 3, Type: ChangeMerge, Key: []byte("user:count"), Value: []byte("2")},
+		{Seq: 4, Type: ChangeDelete, Key: []byte("user:1")},
+		{Seq: 5, Type: ChangePut, Key: []byte("user:2"), Value: []byte("bob")},
+		{Seq: 5, Type: ChangePut, Key: []byte("user:3"), Value: []byte("carol")},
+	}
+
+	for _, e := range expected {
+		event := <-sub.Events()
+		if event.Seq != e.Seq || event.Type != e.Type || string(event.Key) != string(e.Key) || string(event.Value) != string(e.Value) {
+			t.Errorf("Expected %d %v %s=%s, got %d %v %s=%s", e.Seq, e.Type, e.Key, e.Value, event.Seq, event.Type, event.Key, event.Value)
+		}
+	}
+
+	if seq := lsmdb.LastSequence(); seq != 5 {
+		t.Errorf("Expected last sequence 5, got %d", seq)
+	}
+
+	sub.Cancel()
+	if _, ok := <-sub.Events(); ok {
+		t.Errorf("Expected the channel to be closed after Cancel")
+	}
+}
+
+func TestSubscriberTooSlow(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.memSizeThreshold = 1 << 20
+
+	sub := lsmdb.Subscribe(nil)
+
+	for i := 0; i <= subscriptionBufferSize; i++ {
+		lsmdb.Put([]byte("key"), []byte("value"))
+	}
+
+	// The buffered changes are still delivered before the channel is closed
+	n := 0
+	for range sub.Events() {
+		n++
+	}
+
+	if n != subscriptionBufferSize {
+		t.Errorf("Expected %d changes, got %d", subscriptionBufferSize, n)
+	}
+	if sub.Err() != ErrSubscriberTooSlow {
+		t.Errorf("Expected ErrSubscriberTooSlow, got %v", sub.Err())
+	}
+}
+
+func TestSubscribeFrom(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.wal.historyPath = t.TempDir()
+	lsmdb.wal.historyMaxSize = 1 << 20
+
+	if err := lsmdb.CreateColumnFamily("users", ColumnFamilyOptions{MemSizeThreshold: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	users, _ := lsmdb.ColumnFamily("users")
+
+	// The memTable threshold is small, so the records are spread over several WAL segments
+	for i := 0; i < 20; i++ {
+		lsmdb.Put([]byte(fmt.Sprintf("key%02d", i)), []byte(strings.Repeat("v", 10)))
+	}
+	users.Put([]byte("alice"), []byte("1"))
+	lsmdb.Delete([]byte("key00"))
+
+	reopenTestLSMDB(t, lsmdb)
+	users, _ = lsmdb.ColumnFamily("users")
+
+	if seq := lsmdb.LastSequence(); seq != 22 {
+		t.Fatalf("Expected last sequence 22 after a restart, got %d", seq)
+	}
+
+	lsmdb.Put([]byte("key00"), []byte("after restart"))
+
+	sub, err := lsmdb.SubscribeFrom(nil, 18)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sub.Cancel()
+
+	expected := []string{"19 put key18", "20 put key19", "22 delete key00", "23 put key00"}
+	for _, e := range expected {
+		event := <-sub.Events()
+		if got := fmt.Sprintf("%d %s %s", event.Seq, event.Type, event.Key); got != e {
+			t.Errorf("Expected %s, got %s", e, got)
+		}
+	}
+
+	usersSub, err := users.SubscribeFrom(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer usersSub.Cancel()
+
+	if event := <-usersSub.Events(); event.Seq != 21 || string(event.Key) != "alice" || string(event.Value) != "1" {
+		t.Errorf("Expected 21 alice=1, got %d %s=%s", event.Seq, event.Key, event.Value)
+	}
+
+	// Without history, only the records of the current WAL segment can be replayed
+	lsmdb.wal.historyPath = ""
+	if _, err := lsmdb.SubscribeFrom(nil, 0); err != ErrSequenceNotRetained {
+		t.Errorf("Expected ErrSequenceNotRetained, got %v", err)
+	}
+}
+
+func TestWatchHandler(t *testing.T) {
+	lsmdb := newTestLSMDB(t)
+	lsmdb.memSizeThreshold = 1 << 20
+
+	lsmdb.Put([]byte("user:1"), []byte("alice"))
+	lsmdb.Put([]byte("user:2"), []byte("bob"))
+
+	server := httptest.NewServer(watchHandler(lsmdb))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?prefix=user:", nil)
+	req.Header.Set("Last-Event-ID", "1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Errorf("Expected text/event-stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	lsmdb.Delete([]byte("user:1"))
+
+	expected := []string{
+		"id: 2", "event: put", `data: {"seq":2,"type":"put","key":"user:2","value":"bob"}`, "",
+		"id: 3", "event: delete", `data: {"seq":3,"type":"delete","key":"user:1"}`, "",
+	}
+
+	r := bufio.NewReader(resp.Body)
+	for _, e := range expected {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line = strings.TrimSuffix(line, "\n"); line != e {
+			t.Errorf("Expected %q, got %q", e, line)
+		}
+	}
+}